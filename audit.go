@@ -0,0 +1,399 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Audited actions
+const (
+	AuditActionUpload   = "upload"
+	AuditActionQuery    = "query"
+	AuditActionUnmask   = "unmask" // query returning unmasked PII, recorded before the rows are sent
+	AuditActionDelete   = "delete"
+	AuditActionDownload = "download" // original file of an upload
+	AuditActionList     = "list"
+	AuditActionAudit    = "audit" // reading the audit log itself
+)
+
+const (
+	accountHeader    = "x-account"
+	auditEventPrefix = "audit/events/"
+)
+
+// AuditEvent is one audited request
+type AuditEvent struct {
+	Time       time.Time `json:"time"`
+	RequestID  string    `json:"requestId"`
+	Actor      string    `json:"actor"` // x-account header
+	Principal  string    `json:"principal,omitempty"`
+	Action     string    `json:"action"`
+	ChannelID  string    `json:"channelId,omitempty"`
+	Key        string    `json:"key,omitempty"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Query      string    `json:"query,omitempty"` // raw query string: row range, filters, flags
+	Offset     int       `json:"offset,omitempty"`
+	Rows       int       `json:"rows,omitempty"`
+	Columns    []string  `json:"columns,omitempty"`
+	BytesIn    int64     `json:"bytesIn"`
+	BytesOut   int64     `json:"bytesOut"`
+	Status     int       `json:"status"`
+	DurationMs int64     `json:"durationMs"`
+	RemoteAddr string    `json:"remoteAddr"`
+}
+
+// AuditFilter selects events for the admin endpoint
+type AuditFilter struct {
+	ChannelID string
+	Action    string
+	Actor     string
+	From, To  time.Time // From inclusive, To exclusive
+	Limit     int
+}
+
+func (f AuditFilter) matches(event AuditEvent) bool {
+	if f.ChannelID != "" && event.ChannelID != f.ChannelID {
+		return false
+	}
+	if f.Action != "" && event.Action != f.Action {
+		return false
+	}
+	if f.Actor != "" && event.Actor != f.Actor {
+		return false
+	}
+	return !event.Time.Before(f.From) && event.Time.Before(f.To)
+}
+
+// AuditSink stores audit events and reads them back
+type AuditSink interface {
+	Write(ctx context.Context, event AuditEvent) error
+	// Query returns matching events, oldest first, at most filter.Limit of them
+	Query(ctx context.Context, filter AuditFilter) ([]AuditEvent, error)
+}
+
+func auditEventFromContext(ctx context.Context) *AuditEvent {
+	event, _ := ctx.Value(auditEventKey).(*AuditEvent)
+	return event
+}
+
+// describe marks the request as audited. It is a no-op outside withRequestLog.
+func (e *AuditEvent) describe(action, channelID, key string) {
+	if e == nil {
+		return
+	}
+	e.Action = action
+	e.ChannelID = channelID
+	e.Key = key
+}
+
+func (e *AuditEvent) setKey(key string) {
+	if e == nil {
+		return
+	}
+	e.Key = key
+}
+
+func (e *AuditEvent) setRows(offset, rows int) {
+	if e == nil {
+		return
+	}
+	e.Offset = offset
+	e.Rows = rows
+}
+
+// FileAuditSink appends events as JSON lines to a local file
+type FileAuditSink struct {
+	path string
+	mu   sync.Mutex
+}
+
+func NewFileAuditSink(path string) *FileAuditSink {
+	return &FileAuditSink{path: path}
+}
+
+// Check reports whether the directory of the audit file exists and is writable
+func (s *FileAuditSink) Check(_ context.Context) error {
+	probe, err := os.CreateTemp(filepath.Dir(s.path), ".audit-check-*")
+	if err != nil {
+		return fmt.Errorf("audit directory is not writable: %w", err)
+	}
+	probe.Close()
+	return os.Remove(probe.Name())
+}
+
+func (s *FileAuditSink) Write(_ context.Context, event AuditEvent) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	file, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func (s *FileAuditSink) Query(_ context.Context, filter AuditFilter) ([]AuditEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	file, err := os.Open(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var events []AuditEvent
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() && len(events) < filter.Limit {
+		var event AuditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			continue // a torn last line from a crash
+		}
+		if filter.matches(event) {
+			events = append(events, event)
+		}
+	}
+	return events, scanner.Err()
+}
+
+// S3AuditSink buffers events and stores them in batches, one JSON lines object
+// per channel and day under {prefix}{channelId}/{date}/{time}-{batchId}.jsonl,
+// named after the earliest event it holds. Queries only list the days and
+// channels they ask for.
+type S3AuditSink struct {
+	s3Client *S3Client
+	prefix   string
+
+	mu      sync.Mutex
+	pending []AuditEvent
+	flushMu sync.Mutex    // one flush at a time
+	full    chan struct{} // wakes the flusher before the interval
+}
+
+const (
+	auditFlushInterval = 5 * time.Second
+	auditBatchSize     = 500   // buffered events that start a flush early
+	auditMaxBuffered   = 10000 // events kept while storage is failing; the oldest are dropped beyond this
+)
+
+func NewS3AuditSink(s3Client *S3Client, prefix string) *S3AuditSink {
+	return &S3AuditSink{s3Client: s3Client, prefix: prefix, full: make(chan struct{}, 1)}
+}
+
+func (s *S3AuditSink) channelPrefix(channelID string) string {
+	if channelID == "" {
+		channelID = "_" // requests not tied to a channel
+	}
+	return s.prefix + channelID + "/"
+}
+
+// Write buffers the event for the next flush. Unmasked reads are refused
+// unless their event is stored, so those are written at once.
+func (s *S3AuditSink) Write(ctx context.Context, event AuditEvent) error {
+	if event.Action == AuditActionUnmask {
+		return s.putBatch(ctx, []AuditEvent{event})
+	}
+
+	s.mu.Lock()
+	s.pending = append(s.pending, event)
+	s.trimLocked()
+	full := len(s.pending) >= auditBatchSize
+	s.mu.Unlock()
+	if full {
+		select {
+		case s.full <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// trimLocked drops the oldest buffered events beyond auditMaxBuffered
+func (s *S3AuditSink) trimLocked() {
+	if dropped := len(s.pending) - auditMaxBuffered; dropped > 0 {
+		slog.Error("Dropped buffered audit events", "events", dropped)
+		s.pending = append([]AuditEvent(nil), s.pending[dropped:]...)
+	}
+}
+
+// StartFlusher flushes buffered events every auditFlushInterval, or sooner
+// when auditBatchSize events are waiting, until ctx is done. Events buffered
+// after that are stored by a final Flush.
+func (s *S3AuditSink) StartFlusher(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(auditFlushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-s.full:
+			case <-ctx.Done():
+				return
+			}
+			if err := s.Flush(context.WithoutCancel(ctx)); err != nil {
+				slog.Error("Failed to flush audit events", "error", err)
+			}
+		}
+	}()
+}
+
+// Flush stores every buffered event. Events of batches that fail stay
+// buffered for the next flush.
+func (s *S3AuditSink) Flush(ctx context.Context) error {
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+
+	s.mu.Lock()
+	events := s.pending
+	s.pending = nil
+	s.mu.Unlock()
+
+	batches := make(map[string][]AuditEvent)
+	var dirs []string
+	for _, event := range events {
+		dir := s.channelPrefix(event.ChannelID) + event.Time.Format("2006-01-02")
+		if _, ok := batches[dir]; !ok {
+			dirs = append(dirs, dir)
+		}
+		batches[dir] = append(batches[dir], event)
+	}
+
+	var failed []AuditEvent
+	var errs []error
+	for _, dir := range dirs {
+		if err := s.putBatch(ctx, batches[dir]); err != nil {
+			failed = append(failed, batches[dir]...)
+			errs = append(errs, err)
+		}
+	}
+	if len(failed) > 0 {
+		s.mu.Lock()
+		s.pending = append(failed, s.pending...)
+		s.trimLocked()
+		s.mu.Unlock()
+	}
+	return errors.Join(errs...)
+}
+
+// putBatch stores events of one channel and day as a single object
+func (s *S3AuditSink) putBatch(ctx context.Context, events []AuditEvent) error {
+	var data bytes.Buffer
+	encoder := json.NewEncoder(&data)
+	earliest := events[0].Time
+	for _, event := range events {
+		if err := encoder.Encode(event); err != nil {
+			return err
+		}
+		if event.Time.Before(earliest) {
+			earliest = event.Time
+		}
+	}
+	key := fmt.Sprintf("%s%s/%s-%s.jsonl", s.channelPrefix(events[0].ChannelID), earliest.Format("2006-01-02"),
+		earliest.Format("150405.000000"), newUploadID())
+	_, err := s.s3Client.putObject(ctx, key, data.Bytes())
+	return err
+}
+
+func (s *S3AuditSink) Query(ctx context.Context, filter AuditFilter) ([]AuditEvent, error) {
+	channelPrefixes := []string{s.channelPrefix(filter.ChannelID)}
+	if filter.ChannelID == "" {
+		var err error
+		if channelPrefixes, err = s.s3Client.ListPrefixes(ctx, s.prefix); err != nil {
+			return nil, err
+		}
+	}
+
+	var keys []string
+	from := filter.From.UTC().Truncate(24 * time.Hour)
+	for day := from; day.Before(filter.To); day = day.Add(24 * time.Hour) {
+		for _, channelPrefix := range channelPrefixes {
+			objects, err := s.s3Client.ListObjects(ctx, channelPrefix+day.Format("2006-01-02")+"/")
+			if err != nil {
+				return nil, err
+			}
+			for _, object := range objects {
+				keys = append(keys, object.Key)
+			}
+		}
+	}
+
+	// Object names start with the time of their earliest event, so reading in
+	// name order can stop at the first object named after a full page
+	sort.Slice(keys, func(i, j int) bool {
+		return auditObjectName(keys[i]) < auditObjectName(keys[j])
+	})
+
+	// Events not flushed yet are read too
+	var events []AuditEvent
+	s.mu.Lock()
+	for _, event := range s.pending {
+		if filter.matches(event) {
+			events = append(events, event)
+		}
+	}
+	s.mu.Unlock()
+	sortAuditEvents(events)
+
+	for _, key := range keys {
+		if len(events) >= filter.Limit {
+			if start, err := time.Parse("2006-01-02/150405.000000", auditObjectName(key)[:24]); err == nil && !start.Before(events[filter.Limit-1].Time) {
+				break
+			}
+		}
+		content, err := s.s3Client.GetCSVContent(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		// Objects hold one event (written before batching) or JSON lines
+		decoder := json.NewDecoder(content)
+		for decoder.More() {
+			var event AuditEvent
+			if err := decoder.Decode(&event); err != nil {
+				content.Close()
+				return nil, fmt.Errorf("failed to decode %s: %w", key, err)
+			}
+			if filter.matches(event) {
+				events = append(events, event)
+			}
+		}
+		content.Close()
+		sortAuditEvents(events)
+	}
+	if len(events) > filter.Limit {
+		events = events[:filter.Limit]
+	}
+	return events, nil
+}
+
+// auditObjectName returns the date and file name of an audit object key
+func auditObjectName(key string) string {
+	return key[strings.LastIndex(key, "/")-10:]
+}
+
+func sortAuditEvents(events []AuditEvent) {
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Time.Before(events[j].Time) })
+}
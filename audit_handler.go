@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	auditEventsPath   = "/admin/cht/v1/audit-events"
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+	defaultAuditRange = 24 * time.Hour
+	maxAuditRange     = 31 * 24 * time.Hour
+)
+
+// AuditHandler serves the audit log to admins
+type AuditHandler struct {
+	sink AuditSink
+}
+
+type AuditResponse struct {
+	Events []AuditEvent `json:"events"`
+}
+
+func NewAuditHandler(sink AuditSink) *AuditHandler {
+	return &AuditHandler{sink: sink}
+}
+
+// HandleAuditQuery returns audit events filtered by channel, action, actor and time range
+func (h *AuditHandler) HandleAuditQuery(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseAuditFilter(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, ErrCodeInvalidParameter, err.Error())
+		return
+	}
+	auditEventFromContext(r.Context()).describe(AuditActionAudit, filter.ChannelID, "")
+
+	events, err := h.sink.Query(r.Context(), filter)
+	if err != nil {
+		writeStorageError(w, r, "Failed to read audit events", err)
+		return
+	}
+	if events == nil {
+		events = []AuditEvent{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(AuditResponse{Events: events})
+}
+
+func parseAuditFilter(r *http.Request) (AuditFilter, error) {
+	query := r.URL.Query()
+	filter := AuditFilter{
+		ChannelID: query.Get("channelId"),
+		Action:    query.Get("action"),
+		Actor:     query.Get("actor"),
+		Limit:     defaultAuditLimit,
+	}
+
+	if limitStr := query.Get("limit"); limitStr != "" {
+		limit, err := strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 {
+			return filter, fmt.Errorf("invalid limit value")
+		}
+		if limit > maxAuditLimit {
+			return filter, fmt.Errorf("limit exceeds maximum allowed value of %d", maxAuditLimit)
+		}
+		filter.Limit = limit
+	}
+
+	var err error
+	if filter.To, err = parseListTime(query.Get("to")); err != nil {
+		return filter, fmt.Errorf("invalid to value: %v", err)
+	}
+	if filter.To.IsZero() {
+		filter.To = time.Now()
+	}
+	if filter.From, err = parseListTime(query.Get("from")); err != nil {
+		return filter, fmt.Errorf("invalid from value: %v", err)
+	}
+	if filter.From.IsZero() {
+		filter.From = filter.To.Add(-defaultAuditRange)
+	}
+
+	if !filter.From.Before(filter.To) {
+		return filter, fmt.Errorf("from must be before to")
+	}
+	if filter.To.Sub(filter.From) > maxAuditRange {
+		return filter, fmt.Errorf("time range exceeds maximum of %d days", int(maxAuditRange.Hours()/24))
+	}
+	return filter, nil
+}
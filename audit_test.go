@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func auditEventAt(at time.Time, channelID, action string) AuditEvent {
+	return AuditEvent{Time: at, RequestID: fmt.Sprintf("req-%d", at.UnixNano()), Actor: "tester", Action: action, ChannelID: channelID}
+}
+
+func auditRequestIDs(events []AuditEvent) []string {
+	var ids []string
+	for _, event := range events {
+		ids = append(ids, event.RequestID)
+	}
+	return ids
+}
+
+func TestS3AuditSinkBuffersUntilFlush(t *testing.T) {
+	ctx := context.Background()
+	client, store := newTestS3Client(t)
+	sink := NewS3AuditSink(client, auditEventPrefix)
+
+	day := time.Date(2024, 3, 21, 10, 0, 0, 0, time.UTC)
+	events := []AuditEvent{
+		auditEventAt(day.Add(2*time.Second), "a", AuditActionQuery),
+		auditEventAt(day, "a", AuditActionUpload), // finished after a later request
+		auditEventAt(day.Add(time.Second), "b", AuditActionQuery),
+		auditEventAt(day.Add(24*time.Hour), "a", AuditActionQuery),
+		auditEventAt(day.Add(3*time.Second), "", AuditActionAudit),
+	}
+	for _, event := range events {
+		if err := sink.Write(ctx, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if puts := store.count("PutObject"); puts != 0 {
+		t.Fatalf("%d objects written before the flush, want 0", puts)
+	}
+
+	// Buffered events are already visible to queries
+	filter := AuditFilter{From: day, To: day.Add(48 * time.Hour), Limit: 100}
+	got, err := sink.Query(ctx, filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{events[1].RequestID, events[2].RequestID, events[0].RequestID, events[4].RequestID, events[3].RequestID}
+	if ids := auditRequestIDs(got); !slices.Equal(ids, want) {
+		t.Errorf("buffered query = %v, want %v", ids, want)
+	}
+
+	if err := sink.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	keys := store.keys(auditEventPrefix)
+	wantPrefixes := []string{
+		"audit/events/_/2024-03-21/100003.000000-",
+		"audit/events/a/2024-03-21/100000.000000-", // named after its earliest event
+		"audit/events/a/2024-03-22/100000.000000-",
+		"audit/events/b/2024-03-21/100001.000000-",
+	}
+	if len(keys) != len(wantPrefixes) {
+		t.Fatalf("flushed objects %v, want one per channel and day", keys)
+	}
+	for i, key := range keys {
+		if !strings.HasPrefix(key, wantPrefixes[i]) || !strings.HasSuffix(key, ".jsonl") {
+			t.Errorf("object %s, want %s*.jsonl", key, wantPrefixes[i])
+		}
+	}
+
+	got, err = sink.Query(ctx, filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := auditRequestIDs(got); !slices.Equal(ids, want) {
+		t.Errorf("flushed query = %v, want %v", ids, want)
+	}
+}
+
+func TestS3AuditSinkQuery(t *testing.T) {
+	ctx := context.Background()
+	client, _ := newTestS3Client(t)
+	sink := NewS3AuditSink(client, auditEventPrefix)
+
+	day := time.Date(2024, 3, 21, 0, 0, 0, 0, time.UTC)
+	var all []AuditEvent
+	for i := 0; i < 12; i++ {
+		channelID := []string{"a", "b"}[i%2]
+		action := []string{AuditActionQuery, AuditActionUpload, AuditActionDelete}[i%3]
+		all = append(all, auditEventAt(day.Add(time.Duration(i)*3*time.Hour), channelID, action))
+	}
+	// Events stored one per object before batching are still read
+	for _, event := range all[:3] {
+		key := fmt.Sprintf("%s%s/%s-%s-%s.json", sink.channelPrefix(event.ChannelID), event.Time.Format("2006-01-02"),
+			event.Time.Format("150405.000000"), event.RequestID, event.Action)
+		if err := client.PutJSON(ctx, key, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The rest in batches flushed at different times
+	for _, batch := range [][]AuditEvent{all[3:7], all[7:]} {
+		for _, event := range batch {
+			sink.Write(ctx, event)
+		}
+		if err := sink.Flush(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ids := func(indexes ...int) []string {
+		var out []string
+		for _, i := range indexes {
+			out = append(out, all[i].RequestID)
+		}
+		return out
+	}
+	tests := []struct {
+		name   string
+		filter AuditFilter
+		want   []string
+	}{
+		{"everything", AuditFilter{From: day, To: day.Add(48 * time.Hour), Limit: 100}, ids(0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11)},
+		{"limit", AuditFilter{From: day, To: day.Add(48 * time.Hour), Limit: 5}, ids(0, 1, 2, 3, 4)},
+		{"channel", AuditFilter{ChannelID: "b", From: day, To: day.Add(48 * time.Hour), Limit: 100}, ids(1, 3, 5, 7, 9, 11)},
+		{"action", AuditFilter{Action: AuditActionDelete, From: day, To: day.Add(48 * time.Hour), Limit: 100}, ids(2, 5, 8, 11)},
+		{"time range", AuditFilter{From: day.Add(6 * time.Hour), To: day.Add(27 * time.Hour), Limit: 100}, ids(2, 3, 4, 5, 6, 7, 8)},
+		{"second day", AuditFilter{From: day.Add(24 * time.Hour), To: day.Add(48 * time.Hour), Limit: 2}, ids(8, 9)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := sink.Query(ctx, tt.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ids := auditRequestIDs(got); !slices.Equal(ids, tt.want) {
+				t.Errorf("query = %v, want %v", ids, tt.want)
+			}
+		})
+	}
+}
+
+func TestS3AuditSinkWritesUnmaskImmediately(t *testing.T) {
+	ctx := context.Background()
+	client, store := newTestS3Client(t)
+	sink := NewS3AuditSink(client, auditEventPrefix)
+
+	event := auditEventAt(time.Now().UTC(), "a", AuditActionUnmask)
+	if err := sink.Write(ctx, event); err != nil {
+		t.Fatal(err)
+	}
+	if keys := store.keys(auditEventPrefix + "a/"); len(keys) != 1 {
+		t.Errorf("stored %v, want the unmask event", keys)
+	}
+
+	// The read is refused when the event cannot be stored
+	store.setFail(func(op, key string) (int, string) {
+		if op == "PutObject" {
+			return http.StatusInternalServerError, "InternalError"
+		}
+		return 0, ""
+	})
+	if err := sink.Write(ctx, event); err == nil {
+		t.Error("unmask write succeeded while storage fails")
+	}
+}
+
+func TestS3AuditSinkKeepsEventsOfFailedFlush(t *testing.T) {
+	ctx := context.Background()
+	client, store := newTestS3Client(t)
+	sink := NewS3AuditSink(client, auditEventPrefix)
+
+	day := time.Date(2024, 3, 21, 10, 0, 0, 0, time.UTC)
+	sink.Write(ctx, auditEventAt(day, "a", AuditActionQuery))
+	sink.Write(ctx, auditEventAt(day, "b", AuditActionQuery))
+	store.setFail(func(op, key string) (int, string) {
+		if op == "PutObject" && strings.Contains(key, "/b/") {
+			return http.StatusInternalServerError, "InternalError"
+		}
+		return 0, ""
+	})
+	if err := sink.Flush(ctx); err == nil {
+		t.Fatal("flush succeeded while storage fails")
+	}
+	if keys := store.keys(auditEventPrefix); len(keys) != 1 {
+		t.Errorf("stored %v, want only channel a", keys)
+	}
+
+	store.setFail(nil)
+	if err := sink.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if keys := store.keys(auditEventPrefix + "b/"); len(keys) != 1 {
+		t.Errorf("stored %v, want the retried batch of channel b", keys)
+	}
+}
+
+func TestS3AuditSinkFlushesFullBatch(t *testing.T) {
+	client, store := newTestS3Client(t)
+	sink := NewS3AuditSink(client, auditEventPrefix)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sink.StartFlusher(ctx)
+
+	now := time.Now().UTC()
+	for i := 0; i < auditBatchSize; i++ {
+		sink.Write(ctx, auditEventAt(now, "a", AuditActionQuery))
+	}
+	// Well before auditFlushInterval
+	deadline := time.Now().Add(time.Second)
+	for len(store.keys(auditEventPrefix)) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("a full batch was not flushed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestFileAuditSinkQuery(t *testing.T) {
+	ctx := context.Background()
+	sink := NewFileAuditSink(filepath.Join(t.TempDir(), "audit.jsonl"))
+
+	day := time.Date(2024, 3, 21, 0, 0, 0, 0, time.UTC)
+	var all []AuditEvent
+	for i := 0; i < 6; i++ {
+		event := auditEventAt(day.Add(time.Duration(i)*time.Hour), []string{"a", "b"}[i%2], []string{AuditActionQuery, AuditActionUpload}[i/3])
+		event.Actor = []string{"alice", "bob", "carol"}[i%3]
+		all = append(all, event)
+		if err := sink.Write(ctx, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ids := func(indexes ...int) []string {
+		var out []string
+		for _, i := range indexes {
+			out = append(out, all[i].RequestID)
+		}
+		return out
+	}
+	tests := []struct {
+		name   string
+		filter AuditFilter
+		want   []string
+	}{
+		{"everything", AuditFilter{From: day, To: day.Add(24 * time.Hour), Limit: 100}, ids(0, 1, 2, 3, 4, 5)},
+		{"limit", AuditFilter{From: day, To: day.Add(24 * time.Hour), Limit: 2}, ids(0, 1)},
+		{"channel", AuditFilter{ChannelID: "a", From: day, To: day.Add(24 * time.Hour), Limit: 100}, ids(0, 2, 4)},
+		{"action", AuditFilter{Action: AuditActionUpload, From: day, To: day.Add(24 * time.Hour), Limit: 100}, ids(3, 4, 5)},
+		{"actor", AuditFilter{Actor: "bob", From: day, To: day.Add(24 * time.Hour), Limit: 100}, ids(1, 4)},
+		{"to is exclusive", AuditFilter{From: day.Add(time.Hour), To: day.Add(3 * time.Hour), Limit: 100}, ids(1, 2)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := sink.Query(ctx, tt.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ids := auditRequestIDs(got); !slices.Equal(ids, tt.want) {
+				t.Errorf("query = %v, want %v", ids, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Segment compression, chosen per upload and recorded in its metadata
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+)
+
+func validCompression(compression string) bool {
+	return compression == CompressionNone || compression == CompressionGzip
+}
+
+// gzipWriters recycles gzip state, which is about 1MB per writer, see gzipWriterState
+var gzipWriters = sync.Pool{
+	New: func() interface{} { return gzip.NewWriter(io.Discard) },
+}
+
+// compressSegment gzips an encoded segment into dst before it is encrypted
+func compressSegment(dst *bytes.Buffer, data []byte) error {
+	writer := gzipWriters.Get().(*gzip.Writer)
+	defer gzipWriters.Put(writer)
+	writer.Reset(dst)
+
+	if _, err := writer.Write(data); err != nil {
+		return fmt.Errorf("failed to compress segment: %w", err)
+	}
+	if err := writer.Close(); err != nil {
+		return fmt.Errorf("failed to compress segment: %w", err)
+	}
+	return nil
+}
+
+// decompressSegment wraps a stored segment in a reader that undoes compressSegment.
+// Uploads made before compression was recorded have an empty compression.
+func decompressSegment(compression string, content io.ReadCloser) (io.ReadCloser, error) {
+	if compression != CompressionGzip {
+		return content, nil
+	}
+	reader, err := gzip.NewReader(content)
+	if err != nil {
+		content.Close()
+		return nil, err
+	}
+	return &gzipSegment{Reader: reader, content: content}, nil
+}
+
+type gzipSegment struct {
+	*gzip.Reader
+	content io.ReadCloser
+}
+
+func (g *gzipSegment) Close() error {
+	g.Reader.Close()
+	return g.content.Close()
+}
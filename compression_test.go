@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"path/filepath"
+	"testing"
+)
+
+func TestCompressSegmentRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"small", []byte("id,name\n1,alice\n")},
+		{"large", bytes.Repeat([]byte("0123456789abcdef"), 64*1024)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var compressed bytes.Buffer
+			if err := compressSegment(&compressed, tt.data); err != nil {
+				t.Fatal(err)
+			}
+			content, err := decompressSegment(CompressionGzip, io.NopCloser(&compressed))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer content.Close()
+			got, err := io.ReadAll(content)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tt.data) {
+				t.Errorf("round trip of %d bytes returned %d different bytes", len(tt.data), len(got))
+			}
+		})
+	}
+}
+
+func TestDecompressSegment(t *testing.T) {
+	var gzipped bytes.Buffer
+	if err := compressSegment(&gzipped, []byte("id\n1\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		compression string
+		stored      []byte
+		want        string
+		wantErr     bool
+	}{
+		{"not recorded", "", []byte("id\n1\n"), "id\n1\n", false},
+		{"none", CompressionNone, []byte("id\n1\n"), "id\n1\n", false},
+		{"gzip", CompressionGzip, gzipped.Bytes(), "id\n1\n", false},
+		{"gzip recorded, plain stored", CompressionGzip, []byte("id\n1\n"), "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content, err := decompressSegment(tt.compression, io.NopCloser(bytes.NewReader(tt.stored)))
+			if tt.wantErr {
+				if err == nil {
+					t.Error("decompressSegment succeeded")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer content.Close()
+			if got, _ := io.ReadAll(content); string(got) != tt.want {
+				t.Errorf("read %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQueryCompressedUpload(t *testing.T) {
+	tests := []struct {
+		name      string
+		encrypted bool
+		params    string
+	}{
+		{"without verify", false, ""},
+		{"verify=false", false, "verify=false"},
+		{"verify=true", false, "verify=true"},
+		{"encrypted, without verify", true, ""},
+		{"encrypted, verify=true", true, "verify=true"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t, func(c *Config) {
+				if tt.encrypted {
+					c.Storage.EnvelopeKeyFile = filepath.Join(t.TempDir(), "master.key")
+				}
+			})
+			response := ts.upload(t, "ch", testCSV(250), "segmentSize=100&compression=gzip")
+
+			// Segments are stored compressed
+			segment, _ := ts.store.object(segmentKey(response.Key, 0))
+			if !tt.encrypted {
+				if _, err := gzip.NewReader(bytes.NewReader(segment)); err != nil {
+					t.Fatalf("segment is not gzip: %v", err)
+				}
+			}
+
+			// The page starts in one segment and ends in the next
+			got := ts.query(t, response.Key, "offset=150&limit=100&"+tt.params)
+			if len(got.Data) != 100 {
+				t.Fatalf("query returned %d rows, want 100", len(got.Data))
+			}
+			for i, row := range got.Data {
+				if want := fmt.Sprint(150 + i); row[0] != want {
+					t.Fatalf("row %d has id %s, want %s", i, row[0], want)
+				}
+			}
+		})
+	}
+}
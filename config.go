@@ -0,0 +1,556 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	configPath     = "/admin/config"
+	configFileEnv  = "CSV_CONFIG_FILE"
+	redactedSecret = "[REDACTED]"
+
+	// legacySegmentSize is the segment size of uploads stored before segment
+	// sizes were recorded in metadata
+	legacySegmentSize = 50000
+)
+
+// Config holds every setting that used to be a compile-time constant. Values
+// come from DefaultConfig, then a JSON file, then CSV_* environment variables,
+// then command line flags, each overriding the one before.
+type Config struct {
+	Server      ServerConfig                `json:"server"`
+	Storage     StorageConfig               `json:"storage"`
+	Upload      UploadSettings              `json:"upload"`
+	Query       QuerySettings               `json:"query"`
+	Idempotency IdempotencySettings         `json:"idempotency"`
+	Retention   RetentionSettings           `json:"retention"`
+	Channels    map[string]ChannelOverrides `json:"channels,omitempty"` // channelId -> overrides
+}
+
+type ServerConfig struct {
+	Addr            string   `json:"addr"`
+	AuditFile       string   `json:"auditFile,omitempty"`     // JSONL audit log; empty writes events to S3
+	TraceExporter   string   `json:"traceExporter,omitempty"` // "", "otlp" or "stdout"
+	UnmaskTokens    string   `json:"unmaskTokens,omitempty"`  // principal=token pairs; secret
+	ReadTimeout     Duration `json:"readTimeout"`             // whole request including the upload body; 0 disables
+	WriteTimeout    Duration `json:"writeTimeout"`            // from the end of the request headers to the end of the response; 0 disables
+	IdleTimeout     Duration `json:"idleTimeout"`             // keep-alive connections
+	ShutdownTimeout Duration `json:"shutdownTimeout"`         // how long running uploads and queries may take to finish on shutdown
+	ShutdownDelay   Duration `json:"shutdownDelay"`           // readiness fails this long before draining starts
+}
+
+// Duration is a time.Duration written as a Go duration string ("30s") in JSON
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return fmt.Errorf("duration must be a string such as \"30s\"")
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+type StorageConfig struct {
+	Bucket          string `json:"bucket"`
+	Region          string `json:"region"`
+	Profile         string `json:"profile"`
+	SSEKMSKeyID     string `json:"sseKmsKeyId,omitempty"`     // empty uses SSE-S3
+	EnvelopeKeyFile string `json:"envelopeKeyFile,omitempty"` // empty disables envelope encryption
+	PartSize        int64  `json:"partSize"`                  // objects above this size are stored as multipart uploads
+	PartConcurrency int    `json:"partConcurrency"`           // parts of one object uploaded at once
+
+	Retry RetryConfig `json:"retry"`
+}
+
+// RetryConfig is the RetryPolicy applied to every S3 request
+type RetryConfig struct {
+	MaxAttempts int      `json:"maxAttempts"` // total attempts including the first one
+	BaseDelay   Duration `json:"baseDelay"`   // delay before the first retry
+	MaxDelay    Duration `json:"maxDelay"`    // upper bound for a single backoff delay
+}
+
+func (r RetryConfig) policy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: r.MaxAttempts,
+		BaseDelay:   time.Duration(r.BaseDelay),
+		MaxDelay:    time.Duration(r.MaxDelay),
+	}
+}
+
+type UploadSettings struct {
+	SegmentSize       int    `json:"segmentSize"`       // most rows per segment in fine, batch and stream mode
+	CoarseSegmentSize int    `json:"coarseSegmentSize"` // most rows per segment in coarse mode
+	SegmentBytes      int64  `json:"segmentBytes"`      // encoded bytes a segment is cut at; 0 cuts at memoryBudget
+	MaxFileSize       int64  `json:"maxFileSize"`       // bytes
+	Workers           int    `json:"workers"`           // stream mode workers when the request does not ask for a number
+	MinSegmentSize    int    `json:"minSegmentSize"`    // smallest segmentSize a request may ask for
+	MaxSegmentSize    int    `json:"maxSegmentSize"`    // largest segmentSize a request may ask for
+	MinSegmentBytes   int64  `json:"minSegmentBytes"`   // smallest segmentBytes a request may ask for
+	MaxSegmentBytes   int64  `json:"maxSegmentBytes"`   // largest segmentBytes a request may ask for
+	MemoryBudget      int64  `json:"memoryBudget"`      // bytes of segment and original part buffers one upload holds at once
+	MaxWorkers        int    `json:"maxWorkers"`        // most stream workers a request may ask for
+	Compression       string `json:"compression"`       // segment compression when the request does not ask for one
+	KeepOriginal      bool   `json:"keepOriginal"`      // store the request body next to the segments when the request does not say
+	Dedup             string `json:"dedup"`             // what an upload identical to an earlier one in the channel does: off, reuse or alias
+}
+
+type RetentionSettings struct {
+	TTL           Duration `json:"ttl"`           // how long uploads are kept; 0 keeps them forever
+	SweepInterval Duration `json:"sweepInterval"` // how often expired uploads are deleted; 0 disables sweeping
+}
+
+type QuerySettings struct {
+	DefaultLimit int               `json:"defaultLimit"`         // rows returned when the request has no limit
+	MaxLimit     int               `json:"maxLimit"`             // largest limit a request may ask for
+	MaskMode     string            `json:"maskMode"`             // how PII columns are returned: off, partial or redact
+	PIIColumns   map[string]string `json:"piiColumns,omitempty"` // column name -> PII kind, for columns detection misses
+}
+
+type IdempotencySettings struct {
+	TTL           Duration `json:"ttl"`           // how long a key replays its upload
+	SweepInterval Duration `json:"sweepInterval"` // how often expired records are deleted; 0 disables sweeping
+}
+
+// ChannelOverrides replaces the global settings for one channel. Zero values
+// keep the global setting.
+type ChannelOverrides struct {
+	SegmentSize       int               `json:"segmentSize,omitempty"`
+	CoarseSegmentSize int               `json:"coarseSegmentSize,omitempty"`
+	MaxFileSize       int64             `json:"maxFileSize,omitempty"`
+	DefaultLimit      int               `json:"defaultLimit,omitempty"`
+	MaxLimit          int               `json:"maxLimit,omitempty"`
+	Dedup             string            `json:"dedup,omitempty"`
+	TTL               Duration          `json:"ttl,omitempty"`
+	MaskMode          string            `json:"maskMode,omitempty"`
+	PIIColumns        map[string]string `json:"piiColumns,omitempty"` // added to the global piiColumns
+}
+
+var DefaultConfig = Config{
+	Server: ServerConfig{
+		Addr:            ":8080",
+		ReadTimeout:     Duration(5 * time.Minute), // a 100MB body over a slow link
+		WriteTimeout:    Duration(10 * time.Minute),
+		IdleTimeout:     Duration(2 * time.Minute),
+		ShutdownTimeout: Duration(30 * time.Second),
+		ShutdownDelay:   Duration(5 * time.Second), // a couple of readiness probe periods
+	},
+	Storage: StorageConfig{
+		Bucket:  "bin.exp.channel.io",
+		Region:  "ap-northeast-2",
+		Profile: "ch-dev",
+
+		PartSize:        16 * 1024 * 1024,
+		PartConcurrency: 4,
+
+		Retry: RetryConfig{
+			MaxAttempts: DefaultRetryPolicy.MaxAttempts,
+			BaseDelay:   Duration(DefaultRetryPolicy.BaseDelay),
+			MaxDelay:    Duration(DefaultRetryPolicy.MaxDelay),
+		},
+	},
+	Upload: UploadSettings{
+		SegmentSize:       1000,
+		CoarseSegmentSize: 10000,
+		SegmentBytes:      8 * 1024 * 1024,   // 8MB
+		MaxFileSize:       100 * 1024 * 1024, // 100MB
+		Workers:           4,
+		MinSegmentSize:    100,
+		MaxSegmentSize:    200000,
+		MinSegmentBytes:   64 * 1024,
+		MaxSegmentBytes:   64 * 1024 * 1024,
+		MemoryBudget:      64 * 1024 * 1024,
+		MaxWorkers:        32,
+		Compression:       CompressionNone,
+		Dedup:             DedupPolicyOff,
+	},
+	Query: QuerySettings{
+		DefaultLimit: 100,
+		MaxLimit:     1000,
+		MaskMode:     MaskModePartial,
+	},
+	Idempotency: IdempotencySettings{
+		TTL:           Duration(24 * time.Hour),
+		SweepInterval: Duration(time.Hour),
+	},
+	Retention: RetentionSettings{
+		TTL:           Duration(30 * 24 * time.Hour),
+		SweepInterval: Duration(time.Hour),
+	},
+}
+
+// configSetting is a value that can be set from the environment and from a flag
+type configSetting struct {
+	flag  string
+	env   string
+	usage string
+	set   func(c *Config, value string) error
+}
+
+var configSettings = []configSetting{
+	{"addr", "CSV_ADDR", "listen address", stringSetting(func(c *Config) *string { return &c.Server.Addr })},
+	{"audit-file", "CSV_AUDIT_FILE", "write audit events to this JSONL file instead of S3", stringSetting(func(c *Config) *string { return &c.Server.AuditFile })},
+	{"trace-exporter", "CSV_TRACE_EXPORTER", "trace exporter: otlp or stdout", stringSetting(func(c *Config) *string { return &c.Server.TraceExporter })},
+	{"unmask-tokens", "CSV_UNMASK_TOKENS", "unmask grants as principal=token pairs, comma separated", stringSetting(func(c *Config) *string { return &c.Server.UnmaskTokens })},
+	{"read-timeout", "CSV_READ_TIMEOUT", "maximum time to read a request including its body", durationSetting(func(c *Config) *Duration { return &c.Server.ReadTimeout })},
+	{"write-timeout", "CSV_WRITE_TIMEOUT", "maximum time to handle a request and write its response", durationSetting(func(c *Config) *Duration { return &c.Server.WriteTimeout })},
+	{"idle-timeout", "CSV_IDLE_TIMEOUT", "how long idle keep-alive connections stay open", durationSetting(func(c *Config) *Duration { return &c.Server.IdleTimeout })},
+	{"shutdown-timeout", "CSV_SHUTDOWN_TIMEOUT", "how long in-flight uploads and queries may run after SIGTERM", durationSetting(func(c *Config) *Duration { return &c.Server.ShutdownTimeout })},
+	{"shutdown-delay", "CSV_SHUTDOWN_DELAY", "how long readiness fails before the server stops accepting requests", durationSetting(func(c *Config) *Duration { return &c.Server.ShutdownDelay })},
+	{"bucket", "CSV_S3_BUCKET", "S3 bucket", stringSetting(func(c *Config) *string { return &c.Storage.Bucket })},
+	{"region", "CSV_S3_REGION", "AWS region", stringSetting(func(c *Config) *string { return &c.Storage.Region })},
+	{"profile", "CSV_S3_PROFILE", "AWS shared config profile", stringSetting(func(c *Config) *string { return &c.Storage.Profile })},
+	{"sse-kms-key-id", "CSV_SSE_KMS_KEY_ID", "KMS key for SSE-KMS; empty uses SSE-S3", stringSetting(func(c *Config) *string { return &c.Storage.SSEKMSKeyID })},
+	{"part-size", "CSV_S3_PART_SIZE", "objects above this many bytes are stored as multipart uploads", int64Setting(func(c *Config) *int64 { return &c.Storage.PartSize })},
+	{"part-concurrency", "CSV_S3_PART_CONCURRENCY", "parts of one object uploaded at once", intSetting(func(c *Config) *int { return &c.Storage.PartConcurrency })},
+	{"retry-max-attempts", "CSV_S3_RETRY_MAX_ATTEMPTS", "attempts per S3 request including the first one", intSetting(func(c *Config) *int { return &c.Storage.Retry.MaxAttempts })},
+	{"retry-base-delay", "CSV_S3_RETRY_BASE_DELAY", "backoff before the first S3 retry", durationSetting(func(c *Config) *Duration { return &c.Storage.Retry.BaseDelay })},
+	{"retry-max-delay", "CSV_S3_RETRY_MAX_DELAY", "longest backoff between S3 retries", durationSetting(func(c *Config) *Duration { return &c.Storage.Retry.MaxDelay })},
+	{"envelope-key-file", "CSV_ENVELOPE_KEY_FILE", "master key file for envelope encryption of segments", stringSetting(func(c *Config) *string { return &c.Storage.EnvelopeKeyFile })},
+	{"segment-size", "CSV_SEGMENT_SIZE", "most rows per segment in fine, batch and stream mode", intSetting(func(c *Config) *int { return &c.Upload.SegmentSize })},
+	{"coarse-segment-size", "CSV_COARSE_SEGMENT_SIZE", "most rows per segment in coarse mode", intSetting(func(c *Config) *int { return &c.Upload.CoarseSegmentSize })},
+	{"segment-bytes", "CSV_SEGMENT_BYTES", "encoded bytes a segment is cut at, 0 to cut at the memory budget", int64Setting(func(c *Config) *int64 { return &c.Upload.SegmentBytes })},
+	{"max-file-size", "CSV_MAX_FILE_SIZE", "largest accepted upload in bytes", int64Setting(func(c *Config) *int64 { return &c.Upload.MaxFileSize })},
+	{"workers", "CSV_STREAM_WORKERS", "default number of stream upload workers", intSetting(func(c *Config) *int { return &c.Upload.Workers })},
+	{"min-segment-size", "CSV_MIN_SEGMENT_SIZE", "smallest segmentSize an upload may ask for", intSetting(func(c *Config) *int { return &c.Upload.MinSegmentSize })},
+	{"max-segment-size", "CSV_MAX_SEGMENT_SIZE", "largest segmentSize an upload may ask for", intSetting(func(c *Config) *int { return &c.Upload.MaxSegmentSize })},
+	{"min-segment-bytes", "CSV_MIN_SEGMENT_BYTES", "smallest segmentBytes an upload may ask for", int64Setting(func(c *Config) *int64 { return &c.Upload.MinSegmentBytes })},
+	{"max-segment-bytes", "CSV_MAX_SEGMENT_BYTES", "largest segmentBytes an upload may ask for", int64Setting(func(c *Config) *int64 { return &c.Upload.MaxSegmentBytes })},
+	{"memory-budget", "CSV_UPLOAD_MEMORY_BUDGET", "bytes of segment and original part buffers one upload holds in memory at once", int64Setting(func(c *Config) *int64 { return &c.Upload.MemoryBudget })},
+	{"max-workers", "CSV_MAX_STREAM_WORKERS", "most stream workers an upload may ask for", intSetting(func(c *Config) *int { return &c.Upload.MaxWorkers })},
+	{"compression", "CSV_COMPRESSION", "default segment compression: none or gzip", stringSetting(func(c *Config) *string { return &c.Upload.Compression })},
+	{"keep-original", "CSV_KEEP_ORIGINAL", "store uploaded files byte for byte next to their segments by default", boolSetting(func(c *Config) *bool { return &c.Upload.KeepOriginal })},
+	{"dedup", "CSV_DEDUP_POLICY", "what an upload identical to an earlier one does: off, reuse or alias", stringSetting(func(c *Config) *string { return &c.Upload.Dedup })},
+	{"default-limit", "CSV_QUERY_DEFAULT_LIMIT", "rows returned by a query without a limit", intSetting(func(c *Config) *int { return &c.Query.DefaultLimit })},
+	{"max-limit", "CSV_QUERY_MAX_LIMIT", "largest limit a query may ask for", intSetting(func(c *Config) *int { return &c.Query.MaxLimit })},
+	{"mask-mode", "CSV_MASK_MODE", "how queries return PII columns: off, partial or redact", stringSetting(func(c *Config) *string { return &c.Query.MaskMode })},
+	{"idempotency-ttl", "CSV_IDEMPOTENCY_TTL", "how long an Idempotency-Key replays its upload", durationSetting(func(c *Config) *Duration { return &c.Idempotency.TTL })},
+	{"idempotency-sweep-interval", "CSV_IDEMPOTENCY_SWEEP_INTERVAL", "how often expired idempotency records are deleted, 0 to never delete them", durationSetting(func(c *Config) *Duration { return &c.Idempotency.SweepInterval })},
+	{"retention-ttl", "CSV_RETENTION_TTL", "how long uploads are kept, 0 to keep them forever", durationSetting(func(c *Config) *Duration { return &c.Retention.TTL })},
+	{"retention-sweep-interval", "CSV_RETENTION_SWEEP_INTERVAL", "how often expired uploads are deleted, 0 to never delete them", durationSetting(func(c *Config) *Duration { return &c.Retention.SweepInterval })},
+}
+
+func stringSetting(field func(c *Config) *string) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		*field(c) = value
+		return nil
+	}
+}
+
+func intSetting(field func(c *Config) *int) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%q is not an integer", value)
+		}
+		*field(c) = n
+		return nil
+	}
+}
+
+func int64Setting(field func(c *Config) *int64) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%q is not an integer", value)
+		}
+		*field(c) = n
+		return nil
+	}
+}
+
+func boolSetting(field func(c *Config) *bool) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a boolean", value)
+		}
+		*field(c) = b
+		return nil
+	}
+}
+
+func durationSetting(field func(c *Config) *Duration) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a duration", value)
+		}
+		*field(c) = Duration(d)
+		return nil
+	}
+}
+
+// LoadConfig builds the effective configuration from the config file, the
+// environment and the command line, and validates it
+func LoadConfig(args []string, getenv func(string) string) (*Config, error) {
+	flags := flag.NewFlagSet("csv_query", flag.ContinueOnError)
+	configFile := flags.String("config", getenv(configFileEnv), "JSON config file ($"+configFileEnv+")")
+
+	// Flags are applied after the file and the environment, in command line order
+	var flagValues []func(*Config) error
+	for _, setting := range configSettings {
+		setting := setting
+		flags.Func(setting.flag, fmt.Sprintf("%s ($%s)", setting.usage, setting.env), func(value string) error {
+			flagValues = append(flagValues, func(c *Config) error {
+				if err := setting.set(c, value); err != nil {
+					return fmt.Errorf("flag -%s: %v", setting.flag, err)
+				}
+				return nil
+			})
+			return nil
+		})
+	}
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+
+	config := DefaultConfig
+	if *configFile != "" {
+		if err := config.readFile(*configFile); err != nil {
+			return nil, err
+		}
+	}
+	for _, setting := range configSettings {
+		if value := getenv(setting.env); value != "" {
+			if err := setting.set(&config, value); err != nil {
+				return nil, fmt.Errorf("%s: %v", setting.env, err)
+			}
+		}
+	}
+	for _, apply := range flagValues {
+		if err := apply(&config); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+func (c *Config) readFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(c); err != nil {
+		return fmt.Errorf("invalid config file %s: %v", path, err)
+	}
+	return nil
+}
+
+// Validate reports every invalid setting at once
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(c.Server.Addr != "", "server.addr is required")
+	check(c.Server.TraceExporter == TraceExporterNone || c.Server.TraceExporter == TraceExporterOTLP || c.Server.TraceExporter == TraceExporterStdout,
+		"server.traceExporter must be %q or %q", TraceExporterOTLP, TraceExporterStdout)
+	if c.Server.UnmaskTokens != "" {
+		_, err := parseUnmaskTokens(c.Server.UnmaskTokens)
+		check(err == nil, "server.unmaskTokens: %v", err)
+	}
+	check(c.Server.ReadTimeout >= 0 && c.Server.WriteTimeout >= 0 && c.Server.IdleTimeout >= 0, "server timeouts must not be negative")
+	check(c.Server.ShutdownTimeout > 0, "server.shutdownTimeout must be positive")
+	check(c.Server.ShutdownDelay >= 0, "server.shutdownDelay must not be negative")
+	check(c.Storage.Bucket != "", "storage.bucket is required")
+	check(c.Storage.Region != "", "storage.region is required")
+	check(c.Storage.PartSize >= minPartSize && c.Storage.PartSize <= maxPartSize,
+		"storage.partSize must be between %d and %d", minPartSize, maxPartSize)
+	check(c.Storage.PartConcurrency > 0, "storage.partConcurrency must be positive")
+	check(c.Storage.Retry.MaxAttempts > 0, "storage.retry.maxAttempts must be positive")
+	check(c.Storage.Retry.BaseDelay >= 0, "storage.retry.baseDelay must not be negative")
+	check(c.Storage.Retry.MaxDelay >= c.Storage.Retry.BaseDelay, "storage.retry.maxDelay must be at least storage.retry.baseDelay")
+
+	check(c.Upload.MinSegmentSize > 0, "upload.minSegmentSize must be positive")
+	check(c.Upload.MinSegmentSize <= c.Upload.SegmentSize && c.Upload.SegmentSize <= c.Upload.MaxSegmentSize,
+		"upload.segmentSize must be between upload.minSegmentSize and upload.maxSegmentSize")
+	check(c.Upload.MinSegmentSize <= c.Upload.CoarseSegmentSize && c.Upload.CoarseSegmentSize <= c.Upload.MaxSegmentSize,
+		"upload.coarseSegmentSize must be between upload.minSegmentSize and upload.maxSegmentSize")
+	check(c.Upload.MinSegmentBytes > 0 && c.Upload.MinSegmentBytes <= c.Upload.MaxSegmentBytes,
+		"upload.minSegmentBytes must be positive and at most upload.maxSegmentBytes")
+	check(c.Upload.SegmentBytes == 0 || (c.Upload.MinSegmentBytes <= c.Upload.SegmentBytes && c.Upload.SegmentBytes <= c.Upload.MaxSegmentBytes),
+		"upload.segmentBytes must be 0 or between upload.minSegmentBytes and upload.maxSegmentBytes")
+	check(c.Upload.MaxSegmentBytes <= c.Upload.MemoryBudget, "upload.maxSegmentBytes must be at most upload.memoryBudget")
+	check(c.Upload.MaxFileSize > 0, "upload.maxFileSize must be positive")
+	check(c.Upload.Workers > 0, "upload.workers must be positive")
+	check(c.Upload.Workers <= c.Upload.MaxWorkers, "upload.workers must be at most upload.maxWorkers")
+	check(validCompression(c.Upload.Compression), "upload.compression must be %q or %q", CompressionNone, CompressionGzip)
+	// Originals are streamed to storage as received and only get SSE
+	check(!c.Upload.KeepOriginal || c.Storage.EnvelopeKeyFile == "", "upload.keepOriginal cannot be combined with storage.envelopeKeyFile")
+	check(validDedupPolicy(c.Upload.Dedup), "upload.dedup must be %q, %q or %q", DedupPolicyOff, DedupPolicyReuse, DedupPolicyAlias)
+	check(c.Query.DefaultLimit > 0, "query.defaultLimit must be positive")
+	check(c.Query.MaxLimit >= c.Query.DefaultLimit, "query.maxLimit must be at least query.defaultLimit")
+	check(validMaskMode(c.Query.MaskMode), "query.maskMode must be %q, %q or %q", MaskModeOff, MaskModePartial, MaskModeRedact)
+	for column, kind := range c.Query.PIIColumns {
+		check(validPIIKind(kind), "query.piiColumns.%s must be %q, %q, %q or %q", column, PIIKindEmail, PIIKindPhone, PIIKindAddress, PIIKindOther)
+	}
+	check(c.Idempotency.TTL > 0, "idempotency.ttl must be positive")
+	check(c.Idempotency.SweepInterval >= 0, "idempotency.sweepInterval must not be negative")
+	check(c.Retention.TTL >= 0, "retention.ttl must not be negative")
+	check(c.Retention.SweepInterval >= 0, "retention.sweepInterval must not be negative")
+
+	for channelID, overrides := range c.Channels {
+		check(overrides.SegmentSize == 0 || (c.Upload.MinSegmentSize <= overrides.SegmentSize && overrides.SegmentSize <= c.Upload.MaxSegmentSize),
+			"channels.%s.segmentSize must be between upload.minSegmentSize and upload.maxSegmentSize", channelID)
+		check(overrides.CoarseSegmentSize == 0 || (c.Upload.MinSegmentSize <= overrides.CoarseSegmentSize && overrides.CoarseSegmentSize <= c.Upload.MaxSegmentSize),
+			"channels.%s.coarseSegmentSize must be between upload.minSegmentSize and upload.maxSegmentSize", channelID)
+		check(overrides.MaxFileSize >= 0, "channels.%s.maxFileSize must not be negative", channelID)
+		check(overrides.Dedup == "" || validDedupPolicy(overrides.Dedup), "channels.%s.dedup must be %q, %q or %q", channelID, DedupPolicyOff, DedupPolicyReuse, DedupPolicyAlias)
+		// An unset TTL reads as 0, so a channel cannot ask to keep uploads forever
+		check(overrides.TTL >= 0, "channels.%s.ttl must not be negative", channelID)
+		check(overrides.MaskMode == "" || validMaskMode(overrides.MaskMode), "channels.%s.maskMode must be %q, %q or %q", channelID, MaskModeOff, MaskModePartial, MaskModeRedact)
+		for column, kind := range overrides.PIIColumns {
+			check(validPIIKind(kind), "channels.%s.piiColumns.%s must be %q, %q, %q or %q", channelID, column, PIIKindEmail, PIIKindPhone, PIIKindAddress, PIIKindOther)
+		}
+		query := c.queryFor(channelID)
+		check(overrides.DefaultLimit >= 0 && overrides.MaxLimit >= 0, "channels.%s limits must not be negative", channelID)
+		check(query.MaxLimit >= query.DefaultLimit, "channels.%s: maxLimit must be at least defaultLimit", channelID)
+	}
+	return errors.Join(errs...)
+}
+
+// uploadFor returns the upload settings of a channel
+func (c *Config) uploadFor(channelID string) UploadSettings {
+	settings := c.Upload
+	overrides := c.Channels[channelID]
+	if overrides.SegmentSize > 0 {
+		settings.SegmentSize = overrides.SegmentSize
+	}
+	if overrides.CoarseSegmentSize > 0 {
+		settings.CoarseSegmentSize = overrides.CoarseSegmentSize
+	}
+	if overrides.MaxFileSize > 0 {
+		settings.MaxFileSize = overrides.MaxFileSize
+	}
+	if overrides.Dedup != "" {
+		settings.Dedup = overrides.Dedup
+	}
+	return settings
+}
+
+// segmentSizeFor returns the default segment size of an upload mode. Coarse
+// uploads cut fewer, larger segments.
+func (s UploadSettings) segmentSizeFor(mode string) int {
+	if mode == UploadModeCoarseGrained {
+		return s.CoarseSegmentSize
+	}
+	return s.SegmentSize
+}
+
+// queryFor returns the query settings of a channel
+func (c *Config) queryFor(channelID string) QuerySettings {
+	settings := c.Query
+	overrides := c.Channels[channelID]
+	if overrides.DefaultLimit > 0 {
+		settings.DefaultLimit = overrides.DefaultLimit
+	}
+	if overrides.MaxLimit > 0 {
+		settings.MaxLimit = overrides.MaxLimit
+	}
+	if overrides.MaskMode != "" {
+		settings.MaskMode = overrides.MaskMode
+	}
+	if len(overrides.PIIColumns) > 0 {
+		columns := make(map[string]string, len(settings.PIIColumns)+len(overrides.PIIColumns))
+		for column, kind := range settings.PIIColumns {
+			columns[column] = kind
+		}
+		for column, kind := range overrides.PIIColumns {
+			columns[column] = kind
+		}
+		settings.PIIColumns = columns
+	}
+	return settings
+}
+
+// idempotencyConfig gathers the idempotency settings
+func (c *Config) idempotencyConfig() IdempotencyConfig {
+	return IdempotencyConfig{
+		TTL:           time.Duration(c.Idempotency.TTL),
+		SweepInterval: time.Duration(c.Idempotency.SweepInterval),
+	}
+}
+
+// retentionConfig gathers the retention settings, with every channel that
+// overrides the TTL
+func (c *Config) retentionConfig() RetentionConfig {
+	config := RetentionConfig{
+		DefaultTTL:    time.Duration(c.Retention.TTL),
+		ChannelTTLs:   map[string]time.Duration{},
+		SweepInterval: time.Duration(c.Retention.SweepInterval),
+	}
+	for channelID, overrides := range c.Channels {
+		if overrides.TTL > 0 {
+			config.ChannelTTLs[channelID] = time.Duration(overrides.TTL)
+		}
+	}
+	return config
+}
+
+// maskingConfig gathers the masking policies, with one for every channel that
+// overrides the mode or adds PII columns. Unmask tokens were checked by Validate.
+func (c *Config) maskingConfig() MaskingConfig {
+	config := MaskingConfig{
+		DefaultPolicy:   MaskingPolicy{Mode: c.Query.MaskMode, Columns: c.Query.PIIColumns},
+		ChannelPolicies: map[string]MaskingPolicy{},
+	}
+	for channelID, overrides := range c.Channels {
+		if overrides.MaskMode != "" || len(overrides.PIIColumns) > 0 {
+			query := c.queryFor(channelID)
+			config.ChannelPolicies[channelID] = MaskingPolicy{Mode: query.MaskMode, Columns: query.PIIColumns}
+		}
+	}
+	if c.Server.UnmaskTokens != "" {
+		config.UnmaskTokens, _ = parseUnmaskTokens(c.Server.UnmaskTokens)
+	}
+	return config
+}
+
+// Redacted returns a copy safe to show to admins: unmask tokens are replaced,
+// keeping only the principals they belong to
+func (c *Config) Redacted() Config {
+	redacted := *c
+	if c.Server.UnmaskTokens != "" {
+		var pairs []string
+		for _, pair := range strings.Split(c.Server.UnmaskTokens, ",") {
+			principal, _, _ := strings.Cut(strings.TrimSpace(pair), "=")
+			pairs = append(pairs, principal+"="+redactedSecret)
+		}
+		redacted.Server.UnmaskTokens = strings.Join(pairs, ",")
+	}
+	return redacted
+}
+
+// HandleConfig shows the effective configuration with secrets removed
+func (c *Config) HandleConfig(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(c.Redacted())
+}
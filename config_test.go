@@ -0,0 +1,346 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(c *Config)
+		wantErr string // substring of the error, empty for a valid config
+	}{
+		{"defaults", func(c *Config) {}, ""},
+		{"dedup policy", func(c *Config) { c.Upload.Dedup = DedupPolicyAlias }, ""},
+		{"unknown dedup policy", func(c *Config) { c.Upload.Dedup = "always" }, "upload.dedup"},
+		{"channel dedup policy", func(c *Config) { c.Channels = map[string]ChannelOverrides{"1": {Dedup: DedupPolicyReuse}} }, ""},
+		{"unknown channel dedup policy", func(c *Config) { c.Channels = map[string]ChannelOverrides{"1": {Dedup: "yes"}} }, "channels.1.dedup"},
+		{"keep uploads forever", func(c *Config) { c.Retention.TTL = 0 }, ""},
+		{"negative ttl", func(c *Config) { c.Retention.TTL = Duration(-time.Hour) }, "retention.ttl"},
+		{"negative sweep interval", func(c *Config) { c.Retention.SweepInterval = Duration(-time.Hour) }, "retention.sweepInterval"},
+		{"channel ttl", func(c *Config) { c.Channels = map[string]ChannelOverrides{"1": {TTL: Duration(time.Hour)}} }, ""},
+		{"redact by default", func(c *Config) { c.Query.MaskMode = MaskModeRedact }, ""},
+		{"unknown mask mode", func(c *Config) { c.Query.MaskMode = "hash" }, "query.maskMode"},
+		{"unknown pii kind", func(c *Config) { c.Query.PIIColumns = map[string]string{"memo": "secret"} }, "query.piiColumns.memo"},
+		{"channel mask mode", func(c *Config) { c.Channels = map[string]ChannelOverrides{"1": {MaskMode: MaskModeOff}} }, ""},
+		{"unknown channel mask mode", func(c *Config) { c.Channels = map[string]ChannelOverrides{"1": {MaskMode: "none"}} }, "channels.1.maskMode"},
+		{"unknown channel pii kind", func(c *Config) {
+			c.Channels = map[string]ChannelOverrides{"1": {PIIColumns: map[string]string{"memo": "x"}}}
+		}, "channels.1.piiColumns.memo"},
+		{"coarse segment size above max", func(c *Config) { c.Upload.CoarseSegmentSize = c.Upload.MaxSegmentSize + 1 }, "upload.coarseSegmentSize"},
+		{"channel coarse segment size below min", func(c *Config) { c.Channels = map[string]ChannelOverrides{"1": {CoarseSegmentSize: 1}} }, "channels.1.coarseSegmentSize"},
+		{"negative channel ttl", func(c *Config) { c.Channels = map[string]ChannelOverrides{"1": {TTL: Duration(-time.Hour)}} }, "channels.1.ttl must not be negative"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := DefaultConfig
+			tt.change(&config)
+			err := config.Validate()
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("Validate() = %v, want nil", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("Validate() = %v, want an error about %s", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestUploadForChannelOverrides(t *testing.T) {
+	config := DefaultConfig
+	config.Upload.Dedup = DedupPolicyReuse
+	config.Channels = map[string]ChannelOverrides{
+		"1": {Dedup: DedupPolicyAlias, SegmentSize: 2000},
+		"3": {CoarseSegmentSize: 20000},
+	}
+
+	tests := []struct {
+		channelID             string
+		wantDedup             string
+		wantSegmentSize       int
+		wantCoarseSegmentSize int
+	}{
+		{"1", DedupPolicyAlias, 2000, DefaultConfig.Upload.CoarseSegmentSize},
+		{"2", DedupPolicyReuse, DefaultConfig.Upload.SegmentSize, DefaultConfig.Upload.CoarseSegmentSize},
+		{"3", DedupPolicyReuse, DefaultConfig.Upload.SegmentSize, 20000},
+	}
+	for _, tt := range tests {
+		settings := config.uploadFor(tt.channelID)
+		if settings.Dedup != tt.wantDedup || settings.SegmentSize != tt.wantSegmentSize || settings.CoarseSegmentSize != tt.wantCoarseSegmentSize {
+			t.Errorf("uploadFor(%s) = dedup %s, segmentSize %d, coarseSegmentSize %d, want %s, %d, %d", tt.channelID,
+				settings.Dedup, settings.SegmentSize, settings.CoarseSegmentSize, tt.wantDedup, tt.wantSegmentSize, tt.wantCoarseSegmentSize)
+		}
+	}
+}
+
+func TestRetentionConfigFromChannels(t *testing.T) {
+	config := DefaultConfig
+	config.Channels = map[string]ChannelOverrides{
+		"short": {TTL: Duration(time.Hour)},
+		"other": {SegmentSize: 1000},
+	}
+	retention := config.retentionConfig()
+
+	tests := []struct {
+		channelID string
+		want      time.Duration
+	}{
+		{"short", time.Hour},
+		{"other", 30 * 24 * time.Hour},
+		{"unknown", 30 * 24 * time.Hour},
+	}
+	for _, tt := range tests {
+		if got := retention.ttlFor(tt.channelID); got != tt.want {
+			t.Errorf("ttlFor(%s) = %v, want %v", tt.channelID, got, tt.want)
+		}
+	}
+	if retention.SweepInterval != time.Hour {
+		t.Errorf("SweepInterval = %v, want 1h", retention.SweepInterval)
+	}
+}
+
+func TestLoadConfigRetention(t *testing.T) {
+	env := map[string]string{"CSV_RETENTION_TTL": "72h"}
+	config, err := LoadConfig([]string{"-retention-sweep-interval", "10m"}, func(name string) string { return env[name] })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Retention.TTL != Duration(72*time.Hour) || config.Retention.SweepInterval != Duration(10*time.Minute) {
+		t.Errorf("retention = %+v, want ttl 72h and sweepInterval 10m", config.Retention)
+	}
+
+	env["CSV_RETENTION_TTL"] = "-1h"
+	if _, err := LoadConfig(nil, func(name string) string { return env[name] }); err == nil || !strings.Contains(err.Error(), "retention.ttl") {
+		t.Errorf("LoadConfig with a negative ttl = %v, want a retention.ttl error", err)
+	}
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(file, []byte(`{
+		"server": {"addr": ":9000", "readTimeout": "1m"},
+		"upload": {"segmentSize": 1000, "workers": 2},
+		"channels": {"7": {"segmentSize": 500}}
+	}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name            string
+		args            []string
+		env             map[string]string
+		wantAddr        string
+		wantSegmentSize int
+		wantWorkers     int
+		wantReadTimeout time.Duration
+	}{
+		{"defaults", nil, nil, ":8080", 1000, 4, 5 * time.Minute},
+		{"file", []string{"-config", file}, nil, ":9000", 1000, 2, time.Minute},
+		{"file from the environment", nil, map[string]string{configFileEnv: file}, ":9000", 1000, 2, time.Minute},
+		{"environment over file", []string{"-config", file}, map[string]string{"CSV_SEGMENT_SIZE": "2000", "CSV_READ_TIMEOUT": "90s"}, ":9000", 2000, 2, 90 * time.Second},
+		{"flag over environment", []string{"-config", file, "-segment-size", "3000"}, map[string]string{"CSV_SEGMENT_SIZE": "2000"}, ":9000", 3000, 2, time.Minute},
+		{"last flag wins", []string{"-workers", "6", "-addr", ":7000", "-workers", "8"}, map[string]string{"CSV_STREAM_WORKERS": "5"}, ":7000", 1000, 8, 5 * time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := LoadConfig(tt.args, func(name string) string { return tt.env[name] })
+			if err != nil {
+				t.Fatal(err)
+			}
+			if config.Server.Addr != tt.wantAddr || config.Upload.SegmentSize != tt.wantSegmentSize ||
+				config.Upload.Workers != tt.wantWorkers || time.Duration(config.Server.ReadTimeout) != tt.wantReadTimeout {
+				t.Errorf("addr %s, segmentSize %d, workers %d, readTimeout %v; want %s, %d, %d, %v",
+					config.Server.Addr, config.Upload.SegmentSize, config.Upload.Workers, time.Duration(config.Server.ReadTimeout),
+					tt.wantAddr, tt.wantSegmentSize, tt.wantWorkers, tt.wantReadTimeout)
+			}
+		})
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	dir := t.TempDir()
+	writeFile := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	tests := []struct {
+		name    string
+		args    []string
+		env     map[string]string
+		wantErr string
+	}{
+		{"missing file", []string{"-config", filepath.Join(dir, "missing.json")}, nil, "failed to read config file"},
+		{"unknown field", []string{"-config", writeFile("unknown.json", `{"upload": {"segmentSise": 10}}`)}, nil, "segmentSise"},
+		{"duration as a number", []string{"-config", writeFile("duration.json", `{"server": {"readTimeout": 30}}`)}, nil, "duration must be a string"},
+		{"bad environment integer", nil, map[string]string{"CSV_SEGMENT_SIZE": "many"}, "CSV_SEGMENT_SIZE"},
+		{"bad environment duration", nil, map[string]string{"CSV_IDLE_TIMEOUT": "soon"}, "CSV_IDLE_TIMEOUT"},
+		{"bad flag boolean", []string{"-keep-original", "maybe"}, nil, "flag -keep-original"},
+		{"unknown flag", []string{"-segment-sise", "10"}, nil, "segment-sise"},
+		{"invalid result", []string{"-addr", ""}, nil, "server.addr"},
+		{"no retry attempts", []string{"-retry-max-attempts", "0"}, nil, "storage.retry.maxAttempts"},
+		{"idempotency records that never replay", []string{"-idempotency-ttl", "0s"}, nil, "idempotency.ttl"},
+		{"negative idempotency sweep", nil, map[string]string{"CSV_IDEMPOTENCY_SWEEP_INTERVAL": "-1m"}, "idempotency.sweepInterval"},
+		{"retry delays reversed", nil, map[string]string{"CSV_S3_RETRY_BASE_DELAY": "10s", "CSV_S3_RETRY_MAX_DELAY": "1s"}, "storage.retry.maxDelay"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadConfig(tt.args, func(name string) string { return tt.env[name] })
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("LoadConfig error = %v, want one mentioning %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDurationJSON(t *testing.T) {
+	tests := []struct {
+		json    string
+		want    Duration
+		wantErr bool
+	}{
+		{`"30s"`, Duration(30 * time.Second), false},
+		{`"1h30m"`, Duration(90 * time.Minute), false},
+		{`"0s"`, 0, false},
+		{`30`, 0, true},
+		{`"soon"`, 0, true},
+	}
+	for _, tt := range tests {
+		var got Duration
+		err := json.Unmarshal([]byte(tt.json), &got)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("unmarshal %s = %v, %v; want %v, error %v", tt.json, got, err, tt.want, tt.wantErr)
+		}
+		if err != nil {
+			continue
+		}
+		data, _ := json.Marshal(got)
+		var back Duration
+		if err := json.Unmarshal(data, &back); err != nil || back != got {
+			t.Errorf("round trip of %s = %s, %v", tt.json, data, err)
+		}
+	}
+}
+
+func TestStorageRetryPolicy(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		env  map[string]string
+		want RetryPolicy
+	}{
+		{"defaults", nil, nil, DefaultRetryPolicy},
+		{"environment", nil, map[string]string{"CSV_S3_RETRY_MAX_ATTEMPTS": "2", "CSV_S3_RETRY_BASE_DELAY": "1s", "CSV_S3_RETRY_MAX_DELAY": "30s"},
+			RetryPolicy{MaxAttempts: 2, BaseDelay: time.Second, MaxDelay: 30 * time.Second}},
+		{"flag over environment", []string{"-retry-max-attempts", "1"}, map[string]string{"CSV_S3_RETRY_MAX_ATTEMPTS": "6"},
+			RetryPolicy{MaxAttempts: 1, BaseDelay: 200 * time.Millisecond, MaxDelay: 5 * time.Second}},
+		{"no backoff", []string{"-retry-base-delay", "0s", "-retry-max-delay", "0s"}, nil,
+			RetryPolicy{MaxAttempts: 4}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := LoadConfig(tt.args, func(name string) string { return tt.env[name] })
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := config.Storage.Retry.policy(); got != tt.want {
+				t.Errorf("retry policy = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIdempotencyConfig(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(file, []byte(`{"idempotency": {"ttl": "48h", "sweepInterval": "0s"}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		args []string
+		env  map[string]string
+		want IdempotencyConfig
+	}{
+		{"defaults", nil, nil, IdempotencyConfig{TTL: 24 * time.Hour, SweepInterval: time.Hour}},
+		{"file", []string{"-config", file}, nil, IdempotencyConfig{TTL: 48 * time.Hour}},
+		{"environment", nil, map[string]string{"CSV_IDEMPOTENCY_TTL": "1h", "CSV_IDEMPOTENCY_SWEEP_INTERVAL": "10m"},
+			IdempotencyConfig{TTL: time.Hour, SweepInterval: 10 * time.Minute}},
+		{"flag over environment", []string{"-idempotency-ttl", "2h"}, map[string]string{"CSV_IDEMPOTENCY_TTL": "1h"},
+			IdempotencyConfig{TTL: 2 * time.Hour, SweepInterval: time.Hour}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := LoadConfig(tt.args, func(name string) string { return tt.env[name] })
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := config.idempotencyConfig(); got != tt.want {
+				t.Errorf("idempotencyConfig() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQueryForChannelOverrides(t *testing.T) {
+	config := DefaultConfig
+	config.Query.PIIColumns = map[string]string{"memo": "email"}
+	config.Channels = map[string]ChannelOverrides{
+		"limits": {DefaultLimit: 10, MaxLimit: 20},
+		"masked": {MaskMode: MaskModeRedact, PIIColumns: map[string]string{"note": "phone"}},
+	}
+
+	tests := []struct {
+		channelID        string
+		wantDefaultLimit int
+		wantMaxLimit     int
+		wantMaskMode     string
+		wantColumns      int
+	}{
+		{"other", 100, 1000, MaskModePartial, 1},
+		{"limits", 10, 20, MaskModePartial, 1},
+		{"masked", 100, 1000, MaskModeRedact, 2},
+	}
+	for _, tt := range tests {
+		settings := config.queryFor(tt.channelID)
+		if settings.DefaultLimit != tt.wantDefaultLimit || settings.MaxLimit != tt.wantMaxLimit ||
+			settings.MaskMode != tt.wantMaskMode || len(settings.PIIColumns) != tt.wantColumns {
+			t.Errorf("queryFor(%s) = %+v", tt.channelID, settings)
+		}
+	}
+	if len(config.Query.PIIColumns) != 1 {
+		t.Errorf("queryFor changed the global piiColumns: %v", config.Query.PIIColumns)
+	}
+}
+
+func TestHandleConfigRedactsUnmaskTokens(t *testing.T) {
+	ts := newTestServer(t, func(c *Config) { c.Server.UnmaskTokens = "alice=secret-1, bob=secret-2" })
+
+	w := ts.do(http.MethodGet, configPath, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d", w.Code)
+	}
+	if strings.Contains(w.Body.String(), "secret-") {
+		t.Errorf("config response leaks unmask tokens: %s", w.Body)
+	}
+	var shown Config
+	decodeJSON(t, w, &shown)
+	if want := "alice=" + redactedSecret + ",bob=" + redactedSecret; shown.Server.UnmaskTokens != want {
+		t.Errorf("unmaskTokens = %q, want %q", shown.Server.UnmaskTokens, want)
+	}
+	if shown.Idempotency != ts.config.Idempotency {
+		t.Errorf("idempotency = %+v, want %+v", shown.Idempotency, ts.config.Idempotency)
+	}
+	if ts.config.Server.UnmaskTokens != "alice=secret-1, bob=secret-2" {
+		t.Errorf("Redacted changed the running config: %q", ts.config.Server.UnmaskTokens)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"time"
+)
+
+// Deduplication policies, chosen per channel with upload.dedup and channels.{channelId}.dedup
+const (
+	DedupPolicyOff   = "off"   // always store a new copy
+	DedupPolicyReuse = "reuse" // return the existing upload's key
+	DedupPolicyAlias = "alias" // keep the new key as a cheap alias of the existing upload
+)
+
+func validDedupPolicy(policy string) bool {
+	return policy == DedupPolicyOff || policy == DedupPolicyReuse || policy == DedupPolicyAlias
+}
+
+// ContentIndexEntry maps a content hash to the upload that first stored it
+type ContentIndexEntry struct {
+	ContentSHA256 string    `json:"contentSha256"`
+	Key           string    `json:"key"`
+	ID            string    `json:"id"`
+	CreatedAt     time.Time `json:"createdAt"`
+}
+
+func contentIndexKey(channelID, contentSHA256 string) string {
+	return fmt.Sprintf("content_index/%s/%s.json", channelID, contentSHA256)
+}
+
+// contentHasher hashes the normalized content of an upload: the header and rows
+// as csv.Writer encodes them, so quoting and line-ending differences between
+// otherwise identical exports do not change the hash
+type contentHasher struct {
+	hash   hash.Hash
+	writer *csv.Writer
+}
+
+func newContentHasher() *contentHasher {
+	h := sha256.New()
+	return &contentHasher{hash: h, writer: csv.NewWriter(h)}
+}
+
+func (c *contentHasher) Write(row []string) {
+	// Writing to a hash never fails
+	c.writer.Write(row)
+}
+
+func (c *contentHasher) Sum() string {
+	c.writer.Flush()
+	return hex.EncodeToString(c.hash.Sum(nil))
+}
+
+// deduplicate looks for an earlier upload of the same content in the channel.
+// On a hit it discards the segments just written and returns the response to
+// send instead; on a miss it returns nil.
+func (h *UploadHandler) deduplicate(req uploadRequest, metadata *UploadMetadata) (*UploadResponse, error) {
+	policy := h.config.uploadFor(req.channelID).Dedup
+	if policy == DedupPolicyOff {
+		return nil, nil
+	}
+
+	var entry ContentIndexEntry
+	err := h.s3Client.GetJSON(req.ctx, contentIndexKey(req.channelID, metadata.ContentSHA256), &entry)
+	if errors.Is(err, ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read content index: %w", err)
+	}
+
+	// The indexed upload may have been deleted or expired since; treat that as a miss
+	var existing UploadMetadata
+	err = h.s3Client.GetJSON(req.ctx, metadataKey(entry.Key), &existing)
+	if errors.Is(err, ErrNotFound) {
+		req.logger.Warn("Content index points at missing upload, storing a new copy", "content_sha256", metadata.ContentSHA256, "existing_key", entry.Key)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read deduplicated upload: %w", err)
+	}
+	if h.retention.Expired(existing.Key, &existing) {
+		req.logger.Info("Content index points at expired upload, storing a new copy", "content_sha256", metadata.ContentSHA256, "existing_key", entry.Key)
+		return nil, nil
+	}
+
+	// The existing upload now backs this one too, so it must live at least as long
+	if err := h.retention.extend(req.ctx, &existing, metadata.ExpiresAt); err != nil {
+		return nil, err
+	}
+
+	// Discard the copy we just wrote
+	keys := make([]string, 0, len(metadata.Segments)+1)
+	for _, segment := range metadata.Segments {
+		keys = append(keys, segment.Key)
+	}
+
+	switch policy {
+	case DedupPolicyAlias:
+		if err := h.s3Client.DeleteObjects(req.ctx, keys); err != nil {
+			return nil, fmt.Errorf("failed to discard duplicate segments: %w", err)
+		}
+
+		// The alias keeps its own original: identical rows can come from different bytes
+		metadata.AliasOf = existing.Key
+		metadata.Rows = existing.Rows
+		metadata.Segments = nil
+		metadata.Encryption = nil
+		if err := h.s3Client.PutJSON(req.ctx, metadataKey(metadata.Key), metadata); err != nil {
+			return nil, fmt.Errorf("failed to store alias metadata: %w", err)
+		}
+		req.logger.Info("Upload stored as alias", "alias_of", existing.Key, "content_sha256", metadata.ContentSHA256)
+
+		response := h.newUploadResponse(req, metadata, len(existing.Segments))
+		response.Deduplicated = true
+		response.AliasOf = existing.Key
+		return response, nil
+
+	default: // DedupPolicyReuse
+		keys = append(keys, reservationKey(metadata.Key))
+		if metadata.Original != nil {
+			keys = append(keys, metadata.Original.Key)
+		}
+		if err := h.s3Client.DeleteObjects(req.ctx, keys); err != nil {
+			return nil, fmt.Errorf("failed to discard duplicate segments: %w", err)
+		}
+		req.logger.Info("Upload deduplicated to existing upload", "file_name", req.fileName, "existing_key", existing.Key, "content_sha256", metadata.ContentSHA256)
+
+		response := h.newUploadResponse(req, &existing, len(existing.Segments))
+		response.Deduplicated = true
+		return response, nil
+	}
+}
+
+// indexContent records a newly stored upload under its content hash. Failures
+// only cost a future deduplication, so they are logged rather than returned.
+func (h *UploadHandler) indexContent(req uploadRequest, metadata *UploadMetadata) {
+	if h.config.uploadFor(metadata.ChannelID).Dedup == DedupPolicyOff {
+		return
+	}
+	entry := ContentIndexEntry{
+		ContentSHA256: metadata.ContentSHA256,
+		Key:           metadata.Key,
+		ID:            metadata.ID,
+		CreatedAt:     metadata.CreatedAt,
+	}
+	if err := h.s3Client.PutJSON(req.ctx, contentIndexKey(metadata.ChannelID, metadata.ContentSHA256), entry); err != nil {
+		req.logger.Warn("Failed to index content", "error", err)
+	}
+}
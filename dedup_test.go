@@ -0,0 +1,93 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDeduplicationPolicies(t *testing.T) {
+	first := "id,name\n1,a\n2,b\n"
+	// The same content with different quoting and line endings
+	same := "\"id\",\"name\"\r\n1,\"a\"\r\n2,b\r\n"
+
+	tests := []struct {
+		name       string
+		global     string
+		channel    string // override for channel 1, empty for none
+		second     string
+		wantDedup  bool
+		wantSame   bool // the second upload returns the first key
+		wantObject bool // the content index is written
+	}{
+		{"off by default", "", "", same, false, false, false},
+		{"reuse", DedupPolicyReuse, "", same, true, true, true},
+		{"alias", DedupPolicyAlias, "", same, true, false, true},
+		{"channel turns it on", DedupPolicyOff, DedupPolicyReuse, same, true, true, true},
+		{"channel turns it off", DedupPolicyReuse, DedupPolicyOff, same, false, false, false},
+		{"different content", DedupPolicyReuse, "", "id,name\n1,a\n", false, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newTestServer(t, func(c *Config) {
+				if tt.global != "" {
+					c.Upload.Dedup = tt.global
+				}
+				if tt.channel != "" {
+					c.Channels["1"] = ChannelOverrides{Dedup: tt.channel}
+				}
+			})
+			original := server.upload(t, "1", first, "")
+			second := server.upload(t, "1", tt.second, "")
+
+			if second.Deduplicated != tt.wantDedup {
+				t.Errorf("deduplicated = %t, want %t", second.Deduplicated, tt.wantDedup)
+			}
+			if (second.Key == original.Key) != tt.wantSame {
+				t.Errorf("second key %s, first key %s, want same = %t", second.Key, original.Key, tt.wantSame)
+			}
+			if indexed := len(server.store.keys("content_index/1/")) > 0; indexed != tt.wantObject {
+				t.Errorf("content index written = %t, want %t", indexed, tt.wantObject)
+			}
+			if rows := server.query(t, second.Key, "").Data; len(rows) != strings.Count(tt.second, "\n")-1 {
+				t.Errorf("second upload returned %d rows", len(rows))
+			}
+		})
+	}
+}
+
+func TestDeduplicationIsPerChannel(t *testing.T) {
+	server := newTestServer(t, func(c *Config) { c.Upload.Dedup = DedupPolicyReuse })
+	csv := testCSV(3)
+	one := server.upload(t, "1", csv, "")
+	two := server.upload(t, "2", csv, "")
+	if two.Deduplicated || two.Key == one.Key {
+		t.Errorf("channel 2 reused channel 1's upload %s", one.Key)
+	}
+}
+
+func TestContentHasherNormalizes(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b [][]string
+		same bool
+	}{
+		{"identical", [][]string{{"a", "b"}, {"1", "2"}}, [][]string{{"a", "b"}, {"1", "2"}}, true},
+		{"different value", [][]string{{"a", "b"}, {"1", "2"}}, [][]string{{"a", "b"}, {"1", "3"}}, false},
+		{"values moved across a field boundary", [][]string{{"a,b"}}, [][]string{{"a", "b"}}, false},
+		{"row order", [][]string{{"1"}, {"2"}}, [][]string{{"2"}, {"1"}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := newContentHasher(), newContentHasher()
+			for _, row := range tt.a {
+				a.Write(row)
+			}
+			for _, row := range tt.b {
+				b.Write(row)
+			}
+			if (a.Sum() == b.Sum()) != tt.same {
+				t.Errorf("same hash = %t, want %t", a.Sum() == b.Sum(), tt.same)
+			}
+		})
+	}
+}
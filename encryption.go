@@ -0,0 +1,243 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	envelopeAlgorithm = "AES-256-GCM"
+	dataKeySize       = 32
+)
+
+// ServerSideEncryption holds the SSE parameters sent with every PUT
+type ServerSideEncryption struct {
+	Algorithm string // "" (bucket default), "AES256" (SSE-S3) or "aws:kms" (SSE-KMS)
+	KMSKeyID  string // SSE-KMS only; empty uses the AWS managed key
+}
+
+var DefaultServerSideEncryption = ServerSideEncryption{
+	Algorithm: s3.ServerSideEncryptionAes256,
+}
+
+// parameters returns the x-amz-server-side-encryption and KMS key ID values of
+// a PUT, CreateMultipartUpload or upload input. Both are nil for the bucket
+// default, and the key ID is only sent with SSE-KMS.
+func (e ServerSideEncryption) parameters() (algorithm, kmsKeyID *string) {
+	if e.Algorithm == "" {
+		return nil, nil
+	}
+	if e.Algorithm == s3.ServerSideEncryptionAwsKms && e.KMSKeyID != "" {
+		kmsKeyID = aws.String(e.KMSKeyID)
+	}
+	return aws.String(e.Algorithm), kmsKeyID
+}
+
+// KeyProvider issues data keys and unwraps them again. Only the wrapped form of
+// a data key is ever stored.
+type KeyProvider interface {
+	// KeyID identifies the master key; it is recorded with every upload
+	KeyID() string
+	// GenerateDataKey returns a fresh data key and the same key wrapped by the master key
+	GenerateDataKey() (plaintext, wrapped []byte, err error)
+	// DecryptDataKey unwraps a data key returned by GenerateDataKey
+	DecryptDataKey(wrapped []byte) ([]byte, error)
+}
+
+// EncryptionMetadata lets reads recover the data key of an encrypted upload
+type EncryptionMetadata struct {
+	Algorithm  string `json:"algorithm"`
+	KeyID      string `json:"keyId"`
+	WrappedKey []byte `json:"wrappedKey"` // base64 in JSON
+}
+
+// EnvelopeEncryption encrypts segments client-side before upload
+type EnvelopeEncryption struct {
+	Provider KeyProvider // nil disables envelope encryption, including reads of encrypted uploads
+	Encrypt  bool        // encrypt new uploads; reads only need Provider
+}
+
+// enabled reports whether new uploads are envelope encrypted
+func (e *EnvelopeEncryption) enabled() bool {
+	return e != nil && e.Provider != nil && e.Encrypt
+}
+
+// newUploadCipher returns the cipher for a new upload and the metadata that
+// lets reads recover its data key. Both are nil when uploads are stored as is.
+func (e *EnvelopeEncryption) newUploadCipher() (*segmentCipher, *EncryptionMetadata, error) {
+	if !e.enabled() {
+		return nil, nil, nil
+	}
+	dataKey, wrapped, err := e.Provider.GenerateDataKey()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate data key: %w", err)
+	}
+	segCipher, err := newSegmentCipher(dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return segCipher, &EncryptionMetadata{
+		Algorithm:  envelopeAlgorithm,
+		KeyID:      e.Provider.KeyID(),
+		WrappedKey: wrapped,
+	}, nil
+}
+
+// cipherFor returns the cipher needed to read an upload, or nil if the upload
+// is not encrypted
+func (e *EnvelopeEncryption) cipherFor(metadata *UploadMetadata) (*segmentCipher, error) {
+	if metadata == nil || metadata.Encryption == nil {
+		return nil, nil
+	}
+	encryption := metadata.Encryption
+	if encryption.Algorithm != envelopeAlgorithm {
+		return nil, fmt.Errorf("unsupported encryption algorithm %q", encryption.Algorithm)
+	}
+	if e == nil || e.Provider == nil {
+		return nil, errors.New("upload is encrypted but no key provider is configured")
+	}
+	if encryption.KeyID != e.Provider.KeyID() {
+		return nil, fmt.Errorf("upload is encrypted with key %s, but the key provider holds %s", encryption.KeyID, e.Provider.KeyID())
+	}
+
+	dataKey, err := e.Provider.DecryptDataKey(encryption.WrappedKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt data key: %w", err)
+	}
+	return newSegmentCipher(dataKey)
+}
+
+// segmentCipher encrypts segments with an upload's data key. Each segment is
+// stored as nonce || ciphertext, authenticated together with its object key so
+// segments cannot be swapped between positions or uploads.
+type segmentCipher struct {
+	aead cipher.AEAD
+}
+
+func newSegmentCipher(dataKey []byte) (*segmentCipher, error) {
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &segmentCipher{aead: aead}, nil
+}
+
+// Seal encrypts a segment. A nil cipher returns the data unchanged.
+func (c *segmentCipher) Seal(key string, data []byte) ([]byte, error) {
+	if c == nil {
+		return data, nil
+	}
+	return sealGCM(c.aead, data, []byte(key))
+}
+
+// copySize is the length of the copy Seal makes of n bytes. A nil cipher makes none.
+func (c *segmentCipher) copySize(n int64) int64 {
+	if c == nil {
+		return 0
+	}
+	return n + int64(c.aead.NonceSize()+c.aead.Overhead())
+}
+
+// Open decrypts a segment written by Seal
+func (c *segmentCipher) Open(key string, sealed []byte) ([]byte, error) {
+	if c == nil {
+		return sealed, nil
+	}
+	return openGCM(c.aead, sealed, []byte(key))
+}
+
+// LocalKeyProvider wraps data keys with a master key kept in a local file. It
+// is meant for development and tests; production should use a KMS-backed provider.
+type LocalKeyProvider struct {
+	keyID string
+	aead  cipher.AEAD
+}
+
+// NewLocalKeyProvider loads the hex encoded 32-byte master key at path,
+// creating the file with a random key if it does not exist
+func NewLocalKeyProvider(path string) (*LocalKeyProvider, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		masterKey := make([]byte, dataKeySize)
+		if _, err := rand.Read(masterKey); err != nil {
+			return nil, err
+		}
+		data = []byte(hex.EncodeToString(masterKey) + "\n")
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			return nil, fmt.Errorf("failed to create master key file: %w", err)
+		}
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read master key file: %w", err)
+	}
+
+	masterKey, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(masterKey) != dataKeySize {
+		return nil, fmt.Errorf("master key file %s must hold %d hex encoded bytes", path, dataKeySize)
+	}
+	aead, err := newGCM(masterKey)
+	if err != nil {
+		return nil, err
+	}
+
+	fingerprint := sha256.Sum256(masterKey)
+	return &LocalKeyProvider{
+		keyID: "local:" + hex.EncodeToString(fingerprint[:8]),
+		aead:  aead,
+	}, nil
+}
+
+func (p *LocalKeyProvider) KeyID() string {
+	return p.keyID
+}
+
+func (p *LocalKeyProvider) GenerateDataKey() ([]byte, []byte, error) {
+	dataKey := make([]byte, dataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, nil, err
+	}
+	wrapped, err := sealGCM(p.aead, dataKey, []byte(p.keyID))
+	if err != nil {
+		return nil, nil, err
+	}
+	return dataKey, wrapped, nil
+}
+
+func (p *LocalKeyProvider) DecryptDataKey(wrapped []byte) ([]byte, error) {
+	return openGCM(p.aead, wrapped, []byte(p.keyID))
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealGCM encrypts plaintext under a fresh random nonce and prepends the nonce
+func sealGCM(aead cipher.AEAD, plaintext, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func openGCM(aead cipher.AEAD, sealed, additionalData []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, additionalData)
+}
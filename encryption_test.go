@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestSegmentCipherRoundTrip(t *testing.T) {
+	provider, err := NewLocalKeyProvider(filepath.Join(t.TempDir(), "master.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	envelope := &EnvelopeEncryption{Provider: provider, Encrypt: true}
+	sealer, encryption, err := envelope.newUploadCipher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Reads unwrap the data key from the recorded metadata
+	opener, err := envelope.cipherFor(&UploadMetadata{Encryption: encryption})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, data := range [][]byte{
+		nil,
+		[]byte("id,name\n1,alice\n"),
+		bytes.Repeat([]byte("0123456789abcdef"), 64*1024),
+	} {
+		sealed, err := sealer.Seal("csv_upload/ch/id/segment-0.csv", data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(data) > 0 && bytes.Contains(sealed, data) {
+			t.Errorf("sealed segment of %d bytes holds the plaintext", len(data))
+		}
+		opened, err := opener.Open("csv_upload/ch/id/segment-0.csv", sealed)
+		if err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		if !bytes.Equal(opened, data) {
+			t.Errorf("round trip of %d bytes returned %d different bytes", len(data), len(opened))
+		}
+	}
+}
+
+func TestSegmentCipherRejectsTampering(t *testing.T) {
+	provider, err := NewLocalKeyProvider(filepath.Join(t.TempDir(), "master.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataKey, _, err := provider.GenerateDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	segCipher, err := newSegmentCipher(dataKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const key = "csv_upload/ch/id/segment-0.csv"
+	sealed, err := segCipher.Seal(key, []byte("id,name\n1,alice\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	flipped := bytes.Clone(sealed)
+	flipped[len(flipped)-1] ^= 1
+	tests := []struct {
+		name   string
+		key    string
+		sealed []byte
+	}{
+		{"other segment key", "csv_upload/ch/id/segment-1.csv", sealed},
+		{"flipped bit", key, flipped},
+		{"truncated", key, sealed[:len(sealed)-1]},
+		{"shorter than a nonce", key, sealed[:4]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := segCipher.Open(tt.key, tt.sealed); err == nil {
+				t.Error("Open succeeded, want an error")
+			}
+		})
+	}
+}
+
+func TestNilSegmentCipherPassesDataThrough(t *testing.T) {
+	var segCipher *segmentCipher
+	data := []byte("id\n1\n")
+	if sealed, err := segCipher.Seal("key", data); err != nil || !bytes.Equal(sealed, data) {
+		t.Errorf("Seal = %q, %v", sealed, err)
+	}
+	if opened, err := segCipher.Open("key", data); err != nil || !bytes.Equal(opened, data) {
+		t.Errorf("Open = %q, %v", opened, err)
+	}
+}
+
+func TestLocalKeyProvider(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "master.key")
+	created, err := NewLocalKeyProvider(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataKey, wrapped, err := created.GenerateDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dataKey) != dataKeySize || bytes.Contains(wrapped, dataKey) {
+		t.Fatalf("data key of %d bytes, wrapped form holds it: %v", len(dataKey), bytes.Contains(wrapped, dataKey))
+	}
+
+	// A restart loads the same master key and unwraps keys issued before it
+	reloaded, err := NewLocalKeyProvider(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded.KeyID() != created.KeyID() {
+		t.Errorf("key ID changed across loads: %s, %s", created.KeyID(), reloaded.KeyID())
+	}
+	unwrapped, err := reloaded.DecryptDataKey(wrapped)
+	if err != nil || !bytes.Equal(unwrapped, dataKey) {
+		t.Errorf("DecryptDataKey = %x, %v, want %x", unwrapped, err, dataKey)
+	}
+
+	other, err := NewLocalKeyProvider(filepath.Join(t.TempDir(), "other.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.DecryptDataKey(wrapped); err == nil {
+		t.Error("another master key unwrapped the data key")
+	}
+}
+
+func TestLocalKeyProviderRejectsBadKeyFiles(t *testing.T) {
+	for name, content := range map[string]string{
+		"not hex":   "zz\n",
+		"too short": "00112233\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "master.key")
+			if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := NewLocalKeyProvider(path); err == nil {
+				t.Error("NewLocalKeyProvider succeeded, want an error")
+			}
+		})
+	}
+}
+
+func TestEnvelopeCipherFor(t *testing.T) {
+	provider, err := NewLocalKeyProvider(filepath.Join(t.TempDir(), "master.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	envelope := &EnvelopeEncryption{Provider: provider}
+	_, wrapped, err := provider.GenerateDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		envelope   *EnvelopeEncryption
+		encryption *EncryptionMetadata
+		wantCipher bool
+		wantErr    string
+	}{
+		{"plain upload", envelope, nil, false, ""},
+		{"plain upload without a provider", nil, nil, false, ""},
+		{"encrypted upload", envelope, &EncryptionMetadata{Algorithm: envelopeAlgorithm, KeyID: provider.KeyID(), WrappedKey: wrapped}, true, ""},
+		{"unknown algorithm", envelope, &EncryptionMetadata{Algorithm: "ROT13", KeyID: provider.KeyID(), WrappedKey: wrapped}, false, "unsupported"},
+		{"no provider", nil, &EncryptionMetadata{Algorithm: envelopeAlgorithm, KeyID: provider.KeyID(), WrappedKey: wrapped}, false, "no key provider"},
+		{"other master key", envelope, &EncryptionMetadata{Algorithm: envelopeAlgorithm, KeyID: "local:other", WrappedKey: wrapped}, false, "local:other"},
+		{"corrupt wrapped key", envelope, &EncryptionMetadata{Algorithm: envelopeAlgorithm, KeyID: provider.KeyID(), WrappedKey: wrapped[:8]}, false, "data key"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			segCipher, err := tt.envelope.cipherFor(&UploadMetadata{Encryption: tt.encryption})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("cipherFor = %v, want an error about %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (segCipher != nil) != tt.wantCipher {
+				t.Errorf("cipher = %v, want one: %v", segCipher, tt.wantCipher)
+			}
+		})
+	}
+}
+
+func TestServerSideEncryptionParameters(t *testing.T) {
+	tests := []struct {
+		name          string
+		encryption    ServerSideEncryption
+		wantAlgorithm string
+		wantKMSKeyID  string
+	}{
+		{"bucket default", ServerSideEncryption{}, "", ""},
+		{"SSE-S3", DefaultServerSideEncryption, s3.ServerSideEncryptionAes256, ""},
+		{"SSE-KMS managed key", ServerSideEncryption{Algorithm: s3.ServerSideEncryptionAwsKms}, s3.ServerSideEncryptionAwsKms, ""},
+		{"SSE-KMS", ServerSideEncryption{Algorithm: s3.ServerSideEncryptionAwsKms, KMSKeyID: "alias/csv"}, s3.ServerSideEncryptionAwsKms, "alias/csv"},
+		{"key ignored by SSE-S3", ServerSideEncryption{Algorithm: s3.ServerSideEncryptionAes256, KMSKeyID: "alias/csv"}, s3.ServerSideEncryptionAes256, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			algorithm, kmsKeyID := tt.encryption.parameters()
+			if value(algorithm) != tt.wantAlgorithm || value(kmsKeyID) != tt.wantKMSKeyID {
+				t.Errorf("algorithm %q, key %q, want %q, %q", value(algorithm), value(kmsKeyID), tt.wantAlgorithm, tt.wantKMSKeyID)
+			}
+		})
+	}
+}
+
+func value(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+func TestEncryptedUploadRoundTrip(t *testing.T) {
+	tests := []struct {
+		name     string
+		envelope bool
+		kmsKeyID string
+	}{
+		{"SSE-S3", false, ""},
+		{"SSE-KMS", false, "alias/csv"},
+		{"envelope", true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keyFile := ""
+			if tt.envelope {
+				keyFile = filepath.Join(t.TempDir(), "master.key")
+			}
+			ts := newTestServer(t, func(c *Config) {
+				c.Storage.EnvelopeKeyFile = keyFile
+				c.Storage.SSEKMSKeyID = tt.kmsKeyID
+			})
+			csv := testCSV(500)
+			uploaded := ts.upload(t, "ch", csv, "segmentSize=100")
+
+			wantSSE := s3.ServerSideEncryptionAes256
+			if tt.kmsKeyID != "" {
+				wantSSE = s3.ServerSideEncryptionAwsKms
+			}
+			for _, key := range ts.store.keys(uploaded.Key + "/") {
+				if got := ts.store.encryption(key); got != wantSSE {
+					t.Errorf("%s written with SSE %q, want %q", key, got, wantSSE)
+				}
+			}
+			segment, _ := ts.store.object(segmentKey(uploaded.Key, 0))
+			if stored := bytes.Contains(segment, []byte("user1@example.com")); stored == tt.envelope {
+				t.Errorf("segment holds plaintext: %v, want %v", stored, !tt.envelope)
+			}
+
+			// Only id and name: email is masked in query output
+			response := ts.query(t, uploaded.Key, "offset=250&limit=3")
+			want := strings.Split(csv, "\n")[251:254]
+			for i, row := range response.Data {
+				if got := strings.Join(row[:2], ","); !strings.HasPrefix(want[i], got+",") {
+					t.Errorf("row %d = %v, want %s", i, row, want[i])
+				}
+			}
+			if len(response.Data) != 3 {
+				t.Errorf("query returned %d rows, want 3", len(response.Data))
+			}
+		})
+	}
+}
+
+func TestEncryptedResumableChunks(t *testing.T) {
+	tests := []struct {
+		name     string
+		envelope bool
+	}{
+		{"SSE only", false},
+		{"envelope", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keyFile := ""
+			if tt.envelope {
+				keyFile = filepath.Join(t.TempDir(), "master.key")
+			}
+			ts := newTestServer(t, func(c *Config) { c.Storage.EnvelopeKeyFile = keyFile })
+			csv := testCSV(100)
+			sessionID := startSession(t, ts, "")
+
+			chunks := []string{csv[:1000], csv[1000:]}
+			for n, chunk := range chunks {
+				if code := putChunk(ts, sessionID, n, chunk); code != http.StatusOK {
+					t.Fatalf("chunk %d: status %d", n, code)
+				}
+				stored, _ := ts.store.object(chunkKey(sessionID, n))
+				if plaintext := bytes.Contains(stored, []byte(chunk)); plaintext == tt.envelope {
+					t.Errorf("chunk %d stored as plaintext: %v, want %v", n, plaintext, !tt.envelope)
+				}
+			}
+
+			w := ts.do(http.MethodPost, resumableSessionPrefix+sessionID+"/complete", nil)
+			if w.Code != http.StatusCreated {
+				t.Fatalf("complete: %d: %s", w.Code, w.Body)
+			}
+			var uploaded UploadResponse
+			decodeJSON(t, w, &uploaded)
+			if uploaded.Rows != 100 {
+				t.Errorf("rows = %d, want 100", uploaded.Rows)
+			}
+			response := ts.query(t, uploaded.Key, "offset=40&limit=1")
+			if want := strings.Split(csv, "\n")[41]; len(response.Data) != 1 || !strings.HasPrefix(want, strings.Join(response.Data[0][:2], ",")+",") {
+				t.Errorf("row 40 = %v, want %s", response.Data, want)
+			}
+		})
+	}
+}
+
+func TestEncryptedUploadUnreadableWithoutKey(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "master.key")
+	encrypted := newTestServer(t, func(c *Config) { c.Storage.EnvelopeKeyFile = keyFile })
+	uploaded := encrypted.upload(t, "ch", testCSV(10), "")
+
+	// The same bucket read by a server holding another master key
+	other := newTestServer(t, func(c *Config) { c.Storage.EnvelopeKeyFile = filepath.Join(t.TempDir(), "other.key") })
+	for _, key := range encrypted.store.keys(uploaded.Key + "/") {
+		data, _ := encrypted.store.object(key)
+		other.store.put(key, data)
+	}
+	w := other.do(http.MethodGet, "/admin/cht/v1/file/csv-upload/"+uploaded.Key, nil)
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("status %d, want 500: %s", w.Code, w.Body)
+	}
+}
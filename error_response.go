@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Error codes returned in ErrorResponse.Code. These are part of the public API
+// (see api.md) and must stay stable.
+const (
+	ErrCodeInvalidPath           = "INVALID_PATH"
+	ErrCodeInvalidParameter      = "INVALID_PARAMETER"
+	ErrCodeMissingParameter      = "MISSING_PARAMETER"
+	ErrCodeInvalidFileType       = "INVALID_FILE_TYPE"
+	ErrCodeFileTooLarge          = "FILE_TOO_LARGE"
+	ErrCodeInvalidCSV            = "INVALID_CSV"
+	ErrCodeOffsetOutOfRange      = "OFFSET_OUT_OF_RANGE"
+	ErrCodeNotFound              = "NOT_FOUND"
+	ErrCodeUploadExpired         = "UPLOAD_EXPIRED"
+	ErrCodeMethodNotAllowed      = "METHOD_NOT_ALLOWED"
+	ErrCodeSessionClosed         = "SESSION_CLOSED"
+	ErrCodeUploadIncomplete      = "UPLOAD_INCOMPLETE"
+	ErrCodeConflict              = "CONFLICT"
+	ErrCodeIdempotencyKeyReused  = "IDEMPOTENCY_KEY_REUSED"
+	ErrCodeIdempotencyInProgress = "IDEMPOTENCY_KEY_IN_PROGRESS"
+	ErrCodeUnmaskForbidden       = "UNMASK_FORBIDDEN"
+	ErrCodeInternal              = "INTERNAL_ERROR"
+	ErrCodeStorageDenied         = "STORAGE_ACCESS_DENIED"
+	ErrCodeStorageThrottled      = "STORAGE_THROTTLED"
+	ErrCodeStorageTimeout        = "STORAGE_TIMEOUT"
+	ErrCodeClientClosedRequest   = "CLIENT_CLOSED_REQUEST"
+	ErrCodeChecksumMismatch      = "CHECKSUM_MISMATCH"
+	ErrCodeStorageError          = "STORAGE_ERROR"
+	ErrCodeShuttingDown          = "SHUTTING_DOWN"
+)
+
+// ErrorResponse is the JSON body returned for every failed request
+type ErrorResponse struct {
+	Code      string                 `json:"code"`
+	Message   string                 `json:"message"`
+	RequestID string                 `json:"requestId"`
+	Details   map[string]interface{} `json:"details,omitempty"`
+}
+
+func writeError(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	writeErrorDetails(w, r, status, code, message, nil)
+}
+
+func writeErrorDetails(w http.ResponseWriter, r *http.Request, status int, code, message string, details map[string]interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ErrorResponse{
+		Code:      code,
+		Message:   message,
+		RequestID: requestIDFromContext(r.Context()),
+		Details:   details,
+	})
+}
+
+// writeStorageError maps a storage error to its HTTP status and writes it.
+// message describes what the handler was doing when the error occurred.
+func writeStorageError(w http.ResponseWriter, r *http.Request, message string, err error) {
+	status, code := storageErrorStatus(err)
+	var details map[string]interface{}
+	var storageErr *StorageError
+	if errors.As(err, &storageErr) {
+		details = map[string]interface{}{"operation": storageErr.Op}
+		if storageErr.Key != "" {
+			details["key"] = storageErr.Key
+		}
+	}
+	if errors.Is(err, ErrThrottled) {
+		w.Header().Set("Retry-After", "1")
+	}
+	writeErrorDetails(w, r, status, code, fmt.Sprintf("%s: %v", message, err), details)
+}
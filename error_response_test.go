@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestErrorEnvelope(t *testing.T) {
+	server := newTestServer(t, nil)
+	tests := []struct {
+		name       string
+		method     string
+		target     string
+		body       string
+		wantStatus int
+		wantCode   string
+	}{
+		{"unknown route", http.MethodGet, "/nope", "", http.StatusNotFound, ErrCodeNotFound},
+		{"wrong method", http.MethodDelete, "/cht/v1/file/csv/1/data.csv", "", http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed},
+		{"file type", http.MethodPost, "/cht/v1/file/csv/1/data.txt", "a\n1\n", http.StatusBadRequest, ErrCodeInvalidFileType},
+		{"bad mode", http.MethodPost, "/cht/v1/file/csv/1/data.csv?mode=bogus", "a\n1\n", http.StatusBadRequest, ErrCodeInvalidParameter},
+		{"unknown job", http.MethodGet, "/cht/v1/file/csv-jobs/job_missing", "", http.StatusNotFound, ErrCodeNotFound},
+		{"unknown upload", http.MethodGet, "/admin/cht/v1/file/csv-upload/csv_upload/1/" + newUploadID(), "", http.StatusNotFound, ErrCodeNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := server.do(tt.method, tt.target, strings.NewReader(tt.body))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if contentType := w.Header().Get("Content-Type"); contentType != "application/json" {
+				t.Errorf("Content-Type = %q, want application/json", contentType)
+			}
+			var response ErrorResponse
+			decodeJSON(t, w, &response)
+			if response.Code != tt.wantCode {
+				t.Errorf("code = %q, want %q", response.Code, tt.wantCode)
+			}
+			if response.Message == "" {
+				t.Error("message is empty")
+			}
+			if response.RequestID == "" || response.RequestID != w.Header().Get(requestIDHeader) {
+				t.Errorf("requestId = %q, want the %s header %q", response.RequestID, requestIDHeader, w.Header().Get(requestIDHeader))
+			}
+		})
+	}
+}
+
+func TestErrorEnvelopeCallerRequestID(t *testing.T) {
+	server := newTestServer(t, nil)
+	longest := strings.Repeat("a", maxRequestIDLength)
+	tests := []struct {
+		name     string
+		header   string
+		wantKept bool
+	}{
+		{"caller id", "caller-id", true},
+		{"printable punctuation and spaces", "trace 1/2: {ok}~", true},
+		{"longest allowed", longest, true},
+		{"too long", longest + "a", false},
+		{"control character", "caller\x1bid", false},
+		{"tab", "caller\tid", false},
+		{"non-ASCII", "caller-\u00e9", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := server.do(http.MethodGet, "/nope", nil, requestIDHeader, tt.header)
+
+			var response ErrorResponse
+			decodeJSON(t, w, &response)
+			if response.RequestID != w.Header().Get(requestIDHeader) {
+				t.Errorf("requestId = %q, header = %q", response.RequestID, w.Header().Get(requestIDHeader))
+			}
+			if kept := response.RequestID == tt.header; kept != tt.wantKept {
+				t.Errorf("requestId = %q, caller's id kept = %v, want %v", response.RequestID, kept, tt.wantKept)
+			}
+			if !validRequestID(response.RequestID) {
+				t.Errorf("requestId %q is not a valid request id", response.RequestID)
+			}
+		})
+	}
+}
+
+func TestMethodNotAllowedListsAllowedMethods(t *testing.T) {
+	server := newTestServer(t, nil)
+	w := server.do(http.MethodPut, "/admin/cht/v1/file/csv-upload/csv_upload/1/x", nil)
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("status = %d, want 405", w.Code)
+	}
+	var response ErrorResponse
+	decodeJSON(t, w, &response)
+	allow, _ := response.Details["allow"].([]interface{})
+	if len(allow) == 0 || !strings.Contains(w.Header().Get("Allow"), http.MethodDelete) {
+		t.Errorf("Allow = %q, details.allow = %v, want GET and DELETE", w.Header().Get("Allow"), allow)
+	}
+}
+
+func TestWriteStorageError(t *testing.T) {
+	tests := []struct {
+		name           string
+		err            error
+		wantStatus     int
+		wantCode       string
+		wantRetryAfter bool
+	}{
+		{"throttled", &StorageError{Op: "PutObject", Key: "a/b", Kind: ErrThrottled, Err: errors.New("slow down")}, http.StatusServiceUnavailable, ErrCodeStorageThrottled, true},
+		{"missing", &StorageError{Op: "GetObject", Key: "a/b", Kind: ErrNotFound, Err: errors.New("no such key")}, http.StatusNotFound, ErrCodeNotFound, false},
+		{"unclassified", errors.New("boom"), http.StatusInternalServerError, ErrCodeStorageError, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			writeStorageError(w, httptest.NewRequest(http.MethodGet, "/", nil), "Failed to read", tt.err)
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if got := w.Header().Get("Retry-After") != ""; got != tt.wantRetryAfter {
+				t.Errorf("Retry-After set = %t, want %t", got, tt.wantRetryAfter)
+			}
+			var response ErrorResponse
+			decodeJSON(t, w, &response)
+			if response.Code != tt.wantCode || !strings.HasPrefix(response.Message, "Failed to read: ") {
+				t.Errorf("response = %+v, want code %s", response, tt.wantCode)
+			}
+			var storageErr *StorageError
+			if errors.As(tt.err, &storageErr) && (response.Details["operation"] != storageErr.Op || response.Details["key"] != storageErr.Key) {
+				t.Errorf("details = %v, want operation %s and key %s", response.Details, storageErr.Op, storageErr.Key)
+			}
+		})
+	}
+}
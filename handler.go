@@ -1,23 +1,27 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"strconv"
 	"strings"
-)
-
-const (
-	MAX_LIMIT = 1000 // maximum number of rows that can be returned in a single request
+	"time"
 )
 
 // QueryHandler handles CSV segment queries
 type QueryHandler struct {
-	s3Client *S3Client
+	s3Client  *S3Client
+	retention *RetentionManager
+	envelope  *EnvelopeEncryption
+	masking   MaskingConfig
+	audit     AuditSink
+	config    *Config
 }
 
 type QueryResponse struct {
@@ -26,45 +30,118 @@ type QueryResponse struct {
 	Next   bool       `json:"next"`
 }
 
-func NewQueryHandler(s3Client *S3Client) *QueryHandler {
-	return &QueryHandler{s3Client: s3Client}
+// DeleteResponse reports what a delete request removed
+type DeleteResponse struct {
+	Key            string `json:"key"`
+	DeletedObjects int    `json:"deletedObjects"`
 }
 
-func (h *QueryHandler) HandleQuery(w http.ResponseWriter, r *http.Request) {
-	timer := NewTimeCheck()
-	defer timer.End()
+func NewQueryHandler(s3Client *S3Client, retention *RetentionManager, envelope *EnvelopeEncryption, masking MaskingConfig, audit AuditSink, config *Config) *QueryHandler {
+	return &QueryHandler{s3Client: s3Client, retention: retention, envelope: envelope, masking: masking, audit: audit, config: config}
+}
 
+func (h *QueryHandler) HandleQuery(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
 	// Get key from URL path
-	key := strings.TrimPrefix(r.URL.Path, "/")
+	key := strings.Trim(r.PathValue("key"), "/")
 	if key == "" {
-		http.Error(w, "key parameter is required", http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, ErrCodeMissingParameter, "key parameter is required")
 		return
 	}
-	log.Printf("Querying with key: %s", key)
+	logger := loggerFromContext(r.Context()).With("key", key)
+	logger.Info("Querying upload")
 
-	offset, limit, err := getOffsetAndLimit(r)
+	channelID, _, _ := parseUploadKey(key)
+	offset, limit, err := getOffsetAndLimit(r, h.config.queryFor(channelID))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, ErrCodeInvalidParameter, err.Error())
 		return
 	}
 
-	// Calculate which segment to read based on offset
-	// SEGMENT_SIZE is imported from upload_handler.go (50000 rows per segment)
-	segmentNum := offset / SEGMENT_SIZE
-	offsetInSegment := offset % SEGMENT_SIZE
-	log.Printf("Reading from segment %d at offset %d (total offset: %d)", segmentNum, offsetInSegment, offset)
+	verify := false
+	if verifyStr := r.URL.Query().Get("verify"); verifyStr != "" {
+		if verify, err = strconv.ParseBool(verifyStr); err != nil {
+			writeError(w, r, http.StatusBadRequest, ErrCodeInvalidParameter, "invalid verify value")
+			return
+		}
+	}
 
-	// Construct the segment file path
-	segmentKey := fmt.Sprintf("%s/segment-%d.csv", key, segmentNum)
-	log.Printf("Accessing segment file: %s", segmentKey)
+	// PII is masked unless the caller holds an unmask token and asks for it
+	event := auditEventFromContext(r.Context())
+	event.describe(AuditActionQuery, channelID, key)
+	unmask := false
+	if unmaskStr := r.URL.Query().Get("unmask"); unmaskStr != "" {
+		if unmask, err = strconv.ParseBool(unmaskStr); err != nil {
+			writeError(w, r, http.StatusBadRequest, ErrCodeInvalidParameter, "invalid unmask value")
+			return
+		}
+	}
+	principal := ""
+	if unmask {
+		var ok bool
+		if principal, ok = h.masking.unmaskPrincipal(r); !ok {
+			writeError(w, r, http.StatusForbidden, ErrCodeUnmaskForbidden, "A valid "+unmaskTokenHeader+" is required to read unmasked values")
+			return
+		}
+	}
 
-	content, err := h.s3Client.GetCSVContent(segmentKey)
+	// Load upload metadata; deduplicated aliases are resolved to the upload they point at
+	metadata, err := h.loadMetadata(r.Context(), key)
 	if err != nil {
-		if err.Error() == "file not found" {
-			http.Error(w, "File not found", http.StatusNotFound)
+		writeStorageError(w, r, "Failed to read upload metadata", err)
+		return
+	}
+	// Expired uploads answer 410 even before the sweeper has removed them, and
+	// keep answering 410 afterwards since the expiry is derived from the key
+	if h.retention.Expired(key, metadata) {
+		expiresAt, _ := h.retention.expiresAt(key, metadata)
+		writeErrorDetails(w, r, http.StatusGone, ErrCodeUploadExpired, fmt.Sprintf("Upload %s has expired", key), map[string]interface{}{"expiresAt": expiresAt})
+		return
+	}
+	if metadata != nil && metadata.AliasOf != "" {
+		logger.Info("Key is an alias", "alias_of", metadata.AliasOf)
+		key = metadata.AliasOf
+		if metadata, err = h.loadMetadata(r.Context(), key); err != nil {
+			writeStorageError(w, r, "Failed to read upload metadata", err)
 			return
 		}
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+
+	// Optionally verify segment checksums recorded at upload time
+	var checksums *UploadMetadata
+	if verify {
+		if metadata == nil {
+			logger.Warn("No metadata, reading without checksum verification")
+		}
+		checksums = metadata
+	}
+
+	// Envelope encrypted uploads are decrypted with their data key
+	segCipher, err := h.envelope.cipherFor(metadata)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, fmt.Sprintf("Failed to decrypt upload: %v", err))
+		return
+	}
+
+	// Locate the segment holding offset through the row ranges recorded at
+	// upload. Uploads without segment metadata were cut every segmentSize rows.
+	segmentSize := legacySegmentSize
+	if metadata != nil && metadata.SegmentSize > 0 {
+		segmentSize = metadata.SegmentSize
+	}
+	segmentNum, offsetInSegment := offset/segmentSize, offset%segmentSize
+	if metadata != nil && len(metadata.Segments) > 0 {
+		var ok bool
+		if segmentNum, offsetInSegment, ok = metadata.locateRow(offset); !ok {
+			writeErrorDetails(w, r, http.StatusBadRequest, ErrCodeOffsetOutOfRange, "Offset exceeds file size", map[string]interface{}{"offset": offset})
+			return
+		}
+	}
+	logger.Debug("Reading segment", "segment", segmentNum, "segment_offset", offsetInSegment, "offset", offset, "segment_key", segmentKey(key, segmentNum))
+
+	content, err := h.openSegment(r.Context(), key, segmentNum, metadata.segmentCompression(), checksums, segCipher)
+	if err != nil {
+		writeStorageError(w, r, fmt.Sprintf("Failed to read segment %d", segmentNum), err)
 		return
 	}
 	defer content.Close()
@@ -77,7 +154,7 @@ func (h *QueryHandler) HandleQuery(w http.ResponseWriter, r *http.Request) {
 	// Read header
 	header, err := csvReader.Read()
 	if err != nil {
-		http.Error(w, "Failed to read header", http.StatusUnprocessableEntity)
+		writeError(w, r, http.StatusUnprocessableEntity, ErrCodeInvalidCSV, "Failed to read header")
 		return
 	}
 
@@ -85,11 +162,11 @@ func (h *QueryHandler) HandleQuery(w http.ResponseWriter, r *http.Request) {
 	for i := 0; i < offsetInSegment; i++ {
 		_, err := csvReader.Read()
 		if err == io.EOF {
-			http.Error(w, "Offset exceeds file size", http.StatusBadRequest)
+			writeErrorDetails(w, r, http.StatusBadRequest, ErrCodeOffsetOutOfRange, "Offset exceeds file size", map[string]interface{}{"offset": offset})
 			return
 		}
 		if err != nil {
-			http.Error(w, "Failed to read file", http.StatusUnprocessableEntity)
+			writeError(w, r, http.StatusUnprocessableEntity, ErrCodeInvalidCSV, "Failed to read file")
 			return
 		}
 	}
@@ -106,24 +183,27 @@ func (h *QueryHandler) HandleQuery(w http.ResponseWriter, r *http.Request) {
 			currentSegment++
 			content.Close()
 
-			nextSegmentKey := fmt.Sprintf("%s/segment-%d.csv", key, currentSegment)
-			content, err = h.s3Client.GetCSVContent(nextSegmentKey)
-			if err != nil {
+			content, err = h.openSegment(r.Context(), key, currentSegment, metadata.segmentCompression(), checksums, segCipher)
+			if errors.Is(err, ErrNotFound) {
 				// No more segments available
 				break
 			}
+			if err != nil {
+				writeStorageError(w, r, fmt.Sprintf("Failed to read segment %d", currentSegment), err)
+				return
+			}
 
 			csvReader = csv.NewReader(content)
 			// Skip header of the next segment
 			_, err = csvReader.Read()
 			if err != nil {
-				http.Error(w, "Failed to read next segment", http.StatusUnprocessableEntity)
+				writeError(w, r, http.StatusUnprocessableEntity, ErrCodeInvalidCSV, "Failed to read next segment")
 				return
 			}
 			continue
 		}
 		if err != nil {
-			http.Error(w, "Failed to read file", http.StatusUnprocessableEntity)
+			writeError(w, r, http.StatusUnprocessableEntity, ErrCodeInvalidCSV, "Failed to read file")
 			return
 		}
 		data = append(data, row)
@@ -145,6 +225,23 @@ func (h *QueryHandler) HandleQuery(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	policy := h.masking.policyFor(channelID)
+	if policy.Mode != MaskModeOff {
+		columns := maskColumns(policy, header, metadata, data)
+		if !unmask {
+			maskRows(data, columns, policy.Mode)
+		} else if len(columns) > 0 {
+			if err := h.auditUnmaskedRead(r, principal, channelID, key, columns, offset, len(data)); err != nil {
+				writeStorageError(w, r, "Failed to record unmasked read", err)
+				return
+			}
+		}
+	}
+
+	event.setRows(offset, len(data))
+	queryDuration.Observe(time.Since(start).Seconds())
+	queryRows.Observe(float64(len(data)))
+
 	// Prepare response
 	response := QueryResponse{
 		Header: header,
@@ -157,7 +254,78 @@ func (h *QueryHandler) HandleQuery(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
-func getOffsetAndLimit(r *http.Request) (offset, limit int, err error) {
+// HandleDelete removes every segment of an upload together with its metadata
+func (h *QueryHandler) HandleDelete(w http.ResponseWriter, r *http.Request) {
+	key := strings.Trim(r.PathValue("key"), "/")
+	channelID, _, ok := parseUploadKey(key)
+	auditEventFromContext(r.Context()).describe(AuditActionDelete, channelID, key)
+	if !ok {
+		writeError(w, r, http.StatusBadRequest, ErrCodeInvalidPath, "Invalid key format. Expected: csv_upload/{channelId}/{uploadId}")
+		return
+	}
+
+	deleted, err := h.retention.Delete(r.Context(), key)
+	if err != nil {
+		writeStorageError(w, r, "Failed to delete upload", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(DeleteResponse{Key: key, DeletedObjects: deleted})
+}
+
+// openSegment reads a segment, verifying it against checksums if set,
+// decrypting it if the upload is envelope encrypted and undoing compression,
+// which applies whether or not the segment is verified
+func (h *QueryHandler) openSegment(ctx context.Context, key string, segmentNum int, compression string, checksums *UploadMetadata, segCipher *segmentCipher) (io.ReadCloser, error) {
+	content, err := h.readSegment(ctx, key, segmentNum, checksums, segCipher)
+	if err != nil {
+		return nil, err
+	}
+	content, err = decompressSegment(compression, content)
+	if err != nil {
+		return nil, &StorageError{Op: "Decompress", Key: segmentKey(key, segmentNum), Kind: ErrChecksumMismatch, Err: err}
+	}
+	return content, nil
+}
+
+// readSegment returns the stored bytes of a segment, decrypted if needed
+func (h *QueryHandler) readSegment(ctx context.Context, key string, segmentNum int, checksums *UploadMetadata, segCipher *segmentCipher) (io.ReadCloser, error) {
+	objectKey := segmentKey(key, segmentNum)
+	content, err := h.s3Client.GetVerifiedCSVContent(ctx, objectKey, checksums.segmentChecksum(segmentNum))
+	if err != nil || segCipher == nil {
+		return content, err
+	}
+	defer content.Close()
+
+	sealed, err := io.ReadAll(content)
+	if err != nil {
+		return nil, newStorageError("GetObject", objectKey, err)
+	}
+	data, err := segCipher.Open(objectKey, sealed)
+	if err != nil {
+		// GCM authentication failed: the stored object is not what was written
+		return nil, &StorageError{Op: "Decrypt", Key: objectKey, Kind: ErrChecksumMismatch, Err: err}
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+// loadMetadata reads the metadata of an upload. Uploads made before metadata
+// was recorded have none, which is reported as nil without an error.
+func (h *QueryHandler) loadMetadata(ctx context.Context, key string) (*UploadMetadata, error) {
+	metadata := &UploadMetadata{}
+	err := h.s3Client.GetJSON(ctx, metadataKey(key), metadata)
+	if errors.Is(err, ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return metadata, nil
+}
+
+func getOffsetAndLimit(r *http.Request, limits QuerySettings) (offset, limit int, err error) {
 	offsetStr := r.URL.Query().Get("offset")
 	limitStr := r.URL.Query().Get("limit")
 
@@ -171,7 +339,7 @@ func getOffsetAndLimit(r *http.Request) (offset, limit int, err error) {
 	}
 
 	// Handle limit
-	limit = 100 // default
+	limit = limits.DefaultLimit
 	if limitStr != "" {
 		limit, err = strconv.Atoi(limitStr)
 		if err != nil || limit <= 0 {
@@ -180,8 +348,8 @@ func getOffsetAndLimit(r *http.Request) (offset, limit int, err error) {
 	}
 
 	// Check max limit
-	if limit > MAX_LIMIT {
-		return 0, 0, fmt.Errorf("limit exceeds maximum allowed value of %d", MAX_LIMIT)
+	if limit > limits.MaxLimit {
+		return 0, 0, fmt.Errorf("limit exceeds maximum allowed value of %d", limits.MaxLimit)
 	}
 
 	return offset, limit, nil
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	healthzPath = "/healthz"
+	readyzPath  = "/readyz"
+
+	ReadinessReady    = "ready"
+	ReadinessNotReady = "not_ready"
+	DependencyOK      = "ok"
+	DependencyError   = "error"
+
+	readinessCheckTimeout = 2 * time.Second
+)
+
+// version is set at build time: go build -ldflags "-X main.version=v1.2.3"
+var version = "dev"
+
+// BuildInfo identifies the running binary
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Revision  string `json:"revision,omitempty"` // VCS commit the binary was built from
+	GoVersion string `json:"goVersion"`
+}
+
+func currentBuildInfo() BuildInfo {
+	build := BuildInfo{Version: version}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return build
+	}
+	build.GoVersion = info.GoVersion
+	for _, setting := range info.Settings {
+		if setting.Key == "vcs.revision" {
+			build.Revision = setting.Value
+		}
+	}
+	return build
+}
+
+// DependencyStatus is the result of one readiness check
+type DependencyStatus struct {
+	Name      string `json:"name"`
+	Status    string `json:"status"`
+	Error     string `json:"error,omitempty"`
+	LatencyMs int64  `json:"latencyMs"`
+}
+
+// ReadinessResponse is the body of GET /readyz
+type ReadinessResponse struct {
+	Status       string             `json:"status"`
+	Draining     bool               `json:"draining,omitempty"` // graceful shutdown has started
+	Build        BuildInfo          `json:"build"`
+	Dependencies []DependencyStatus `json:"dependencies"`
+}
+
+// ReadinessCheck probes one dependency the server cannot work without
+type ReadinessCheck struct {
+	Name  string
+	Check func(ctx context.Context) error
+}
+
+// HealthHandler serves liveness and readiness probes
+type HealthHandler struct {
+	uploads      *UploadTracker
+	checks       []ReadinessCheck
+	build        BuildInfo
+	shuttingDown atomic.Bool
+}
+
+func NewHealthHandler(uploads *UploadTracker, checks ...ReadinessCheck) *HealthHandler {
+	return &HealthHandler{uploads: uploads, checks: checks, build: currentBuildInfo()}
+}
+
+// MarkShuttingDown makes readiness fail from now on, so load balancers stop
+// sending traffic before the listener closes
+func (h *HealthHandler) MarkShuttingDown() {
+	h.shuttingDown.Store(true)
+}
+
+// HandleHealthz reports that the process is alive. It never checks dependencies,
+// so a storage outage does not get the process restarted.
+func (h *HealthHandler) HandleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": DependencyOK,
+		"build":  h.build,
+	})
+}
+
+// HandleReadyz reports whether the server should receive traffic: every
+// dependency must be reachable and shutdown must not have started
+func (h *HealthHandler) HandleReadyz(w http.ResponseWriter, r *http.Request) {
+	response := h.Readiness(r.Context())
+
+	status := http.StatusOK
+	if response.Status != ReadinessReady {
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
+
+// Readiness runs every check, each with its own timeout
+func (h *HealthHandler) Readiness(ctx context.Context) ReadinessResponse {
+	response := ReadinessResponse{
+		Status:       ReadinessReady,
+		Draining:     h.shuttingDown.Load() || h.uploads.Draining(),
+		Build:        h.build,
+		Dependencies: make([]DependencyStatus, 0, len(h.checks)),
+	}
+	if response.Draining {
+		response.Status = ReadinessNotReady
+	}
+
+	for _, check := range h.checks {
+		checkCtx, cancel := context.WithTimeout(ctx, readinessCheckTimeout)
+		start := time.Now()
+		err := check.Check(checkCtx)
+		cancel()
+
+		dependency := DependencyStatus{Name: check.Name, Status: DependencyOK, LatencyMs: time.Since(start).Milliseconds()}
+		if err != nil {
+			dependency.Status = DependencyError
+			dependency.Error = err.Error()
+			response.Status = ReadinessNotReady
+		}
+		response.Dependencies = append(response.Dependencies, dependency)
+	}
+	return response
+}
+
+// isProbePath reports whether path is polled by load balancers or scrapers, so
+// it is kept out of traces and info-level request logs
+func isProbePath(path string) bool {
+	return path == healthzPath || path == readyzPath || path == metricsPath
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHealthz(t *testing.T) {
+	ts := newTestServer(t, nil)
+	// Liveness never looks at storage
+	ts.store.setFail(func(op, key string) (int, string) { return http.StatusServiceUnavailable, "ServiceUnavailable" })
+
+	w := ts.do(http.MethodGet, healthzPath, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d, want 200", w.Code)
+	}
+	var body struct {
+		Status string    `json:"status"`
+		Build  BuildInfo `json:"build"`
+	}
+	decodeJSON(t, w, &body)
+	if body.Status != DependencyOK || body.Build.Version != version {
+		t.Errorf("healthz = %+v", body)
+	}
+	if calls := ts.store.count("HeadBucket"); calls != 0 {
+		t.Errorf("healthz made %d storage calls", calls)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	storageDown := func(op, key string) (int, string) {
+		if op == "HeadBucket" {
+			return http.StatusForbidden, "AccessDenied"
+		}
+		return 0, ""
+	}
+
+	tests := []struct {
+		name         string
+		fail         func(op, key string) (int, string)
+		prepare      func(ts *testServer)
+		wantCode     int
+		wantStorage  string
+		wantDraining bool
+	}{
+		{"ready", nil, nil, http.StatusOK, DependencyOK, false},
+		{"storage unreachable", storageDown, nil, http.StatusServiceUnavailable, DependencyError, false},
+		{"shutdown started", nil, func(ts *testServer) { ts.health.MarkShuttingDown() }, http.StatusServiceUnavailable, DependencyOK, true},
+		{"uploads draining", nil, func(ts *testServer) { ts.uploads.uploads.StopAccepting() }, http.StatusServiceUnavailable, DependencyOK, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t, nil)
+			ts.store.setFail(tt.fail)
+			if tt.prepare != nil {
+				tt.prepare(ts)
+			}
+
+			w := ts.do(http.MethodGet, readyzPath, nil)
+			if w.Code != tt.wantCode {
+				t.Errorf("status %d, want %d", w.Code, tt.wantCode)
+			}
+			if cache := w.Header().Get("Cache-Control"); cache != "no-store" {
+				t.Errorf("Cache-Control %q, want no-store", cache)
+			}
+			var response ReadinessResponse
+			decodeJSON(t, w, &response)
+			wantStatus := ReadinessReady
+			if tt.wantCode != http.StatusOK {
+				wantStatus = ReadinessNotReady
+			}
+			if response.Status != wantStatus || response.Draining != tt.wantDraining {
+				t.Errorf("status %s, draining %v; want %s, %v", response.Status, response.Draining, wantStatus, tt.wantDraining)
+			}
+			if len(response.Dependencies) != 1 || response.Dependencies[0].Name != "storage" || response.Dependencies[0].Status != tt.wantStorage {
+				t.Fatalf("dependencies %+v, want storage %s", response.Dependencies, tt.wantStorage)
+			}
+			if tt.wantStorage == DependencyError && response.Dependencies[0].Error == "" {
+				t.Error("failed dependency has no error")
+			}
+		})
+	}
+}
+
+func TestReadinessCheckTimeout(t *testing.T) {
+	hung := ReadinessCheck{Name: "hung", Check: func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}}
+	ok := ReadinessCheck{Name: "ok", Check: func(context.Context) error { return nil }}
+	health := NewHealthHandler(NewUploadTracker(), hung, ok)
+
+	start := time.Now()
+	response := health.Readiness(context.Background())
+	if elapsed := time.Since(start); elapsed > readinessCheckTimeout+time.Second {
+		t.Errorf("readiness took %v, want about %v", elapsed, readinessCheckTimeout)
+	}
+	if response.Status != ReadinessNotReady || len(response.Dependencies) != 2 {
+		t.Fatalf("readiness = %+v", response)
+	}
+	if hungStatus := response.Dependencies[0]; hungStatus.Status != DependencyError || hungStatus.Error != context.DeadlineExceeded.Error() {
+		t.Errorf("hung check = %+v, want a deadline error", hungStatus)
+	}
+	if response.Dependencies[1].Status != DependencyOK {
+		t.Errorf("ok check = %+v, want ok after the hung one", response.Dependencies[1])
+	}
+}
+
+func TestFileAuditSinkCheck(t *testing.T) {
+	dir := t.TempDir()
+	readOnly := t.TempDir()
+	if err := os.Chmod(readOnly, 0500); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		path    string
+		wantErr bool
+	}{
+		{"writable directory", filepath.Join(dir, "audit.jsonl"), false},
+		{"missing directory", filepath.Join(dir, "missing", "audit.jsonl"), true},
+		{"read-only directory", filepath.Join(readOnly, "audit.jsonl"), os.Geteuid() != 0}, // root writes anyway
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := NewFileAuditSink(tt.path).Check(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Check = %v, want error %v", err, tt.wantErr)
+			}
+			if entries, _ := os.ReadDir(filepath.Dir(tt.path)); len(entries) != 0 && !tt.wantErr {
+				t.Errorf("Check left %v behind", entries)
+			}
+		})
+	}
+}
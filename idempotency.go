@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	idempotencyKeyHeader    = "Idempotency-Key"
+	idempotencyPrefix       = "idempotency/"
+	maxIdempotencyKeyLength = 255
+)
+
+// IdempotencyConfig controls how long idempotency records are honoured
+type IdempotencyConfig struct {
+	TTL           time.Duration // records older than this are ignored and swept
+	SweepInterval time.Duration // how often expired records are deleted; 0 disables sweeping
+}
+
+// IdempotencyRecord remembers the outcome of an upload made with an Idempotency-Key
+type IdempotencyRecord struct {
+	Key        string          `json:"key"`
+	ChannelID  string          `json:"channelId"`
+	BodySHA256 string          `json:"bodySha256"`
+	Response   *UploadResponse `json:"response"`
+	CreatedAt  time.Time       `json:"createdAt"`
+	ExpiresAt  time.Time       `json:"expiresAt"`
+}
+
+// IdempotencyStore persists idempotency records in the storage backend and
+// tracks keys whose first request is still running
+type IdempotencyStore struct {
+	s3Client *S3Client
+	config   IdempotencyConfig
+
+	mu       sync.Mutex
+	inFlight map[string]bool
+}
+
+func NewIdempotencyStore(s3Client *S3Client, config IdempotencyConfig) *IdempotencyStore {
+	return &IdempotencyStore{
+		s3Client: s3Client,
+		config:   config,
+		inFlight: make(map[string]bool),
+	}
+}
+
+// idempotencyRecordKey hashes the client key so any header value maps to a safe object name
+func idempotencyRecordKey(channelID, key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return fmt.Sprintf("%s%s/%s.json", idempotencyPrefix, channelID, hex.EncodeToString(sum[:]))
+}
+
+var errIdempotencyInProgress = errors.New("a request with this Idempotency-Key is still in progress")
+
+// Begin claims key for a new request. The claim is taken before the record is
+// read, so of two requests with the same key only one gets past Begin: if a
+// request already finished with key, its record is returned and the claim is
+// released; if one is still running, Begin returns errIdempotencyInProgress.
+// A nil record and error means the caller holds the key until End.
+func (s *IdempotencyStore) Begin(ctx context.Context, channelID, key string) (*IdempotencyRecord, error) {
+	id := channelID + "/" + key
+	s.mu.Lock()
+	if s.inFlight[id] {
+		s.mu.Unlock()
+		return nil, errIdempotencyInProgress
+	}
+	s.inFlight[id] = true
+	s.mu.Unlock()
+
+	// Save runs before End, so a finished request's record is visible here
+	record, err := s.lookup(ctx, channelID, key)
+	if err != nil || record != nil {
+		s.End(channelID, key)
+		return record, err
+	}
+	return nil, nil
+}
+
+// lookup returns the unexpired record for key, or nil if there is none
+func (s *IdempotencyStore) lookup(ctx context.Context, channelID, key string) (*IdempotencyRecord, error) {
+	record := &IdempotencyRecord{}
+	err := s.s3Client.GetJSON(ctx, idempotencyRecordKey(channelID, key), record)
+	if errors.Is(err, ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if time.Now().After(record.ExpiresAt) {
+		return nil, nil
+	}
+	return record, nil
+}
+
+func (s *IdempotencyStore) End(channelID, key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.inFlight, channelID+"/"+key)
+}
+
+// Save records the response for key
+func (s *IdempotencyStore) Save(ctx context.Context, channelID, key, bodySHA256 string, response *UploadResponse) error {
+	now := time.Now()
+	record := IdempotencyRecord{
+		Key:        key,
+		ChannelID:  channelID,
+		BodySHA256: bodySHA256,
+		Response:   response,
+		CreatedAt:  now,
+		ExpiresAt:  now.Add(s.config.TTL),
+	}
+	return s.s3Client.PutJSON(ctx, idempotencyRecordKey(channelID, key), record)
+}
+
+// StartSweeper periodically deletes records older than the TTL until ctx is done
+func (s *IdempotencyStore) StartSweeper(ctx context.Context) {
+	if s.config.SweepInterval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(s.config.SweepInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.sweep(ctx)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+func (s *IdempotencyStore) sweep(ctx context.Context) {
+	ctx, span := startSpan(ctx, "idempotency sweep")
+	defer span.End()
+	logger := loggerFromContext(ctx)
+
+	objects, err := s.s3Client.ListObjects(ctx, idempotencyPrefix)
+	if err != nil {
+		logger.Error("Failed to list idempotency records", "error", err)
+		return
+	}
+
+	// Records are never rewritten, so LastModified is their creation time
+	cutoff := time.Now().Add(-s.config.TTL)
+	var expired []string
+	for _, object := range objects {
+		if strings.HasSuffix(object.Key, ".json") && object.LastModified.Before(cutoff) {
+			expired = append(expired, object.Key)
+		}
+	}
+	if len(expired) == 0 {
+		return
+	}
+
+	if err := s.s3Client.DeleteObjects(ctx, expired); err != nil {
+		logger.Error("Failed to delete expired idempotency records", "error", err)
+		return
+	}
+	logger.Info("Deleted expired idempotency records", "records", len(expired))
+}
+
+var errBodyTooLarge = errors.New("request body exceeds the maximum file size")
+
+// hashingBody tees everything read from an upload body into a SHA-256 hash
+type hashingBody struct {
+	io.ReadCloser
+	hash hash.Hash
+	n    int64 // bytes read so far
+}
+
+func newHashingBody(body io.ReadCloser) *hashingBody {
+	return &hashingBody{ReadCloser: body, hash: sha256.New()}
+}
+
+func (b *hashingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.hash.Write(p[:n])
+	b.n += int64(n)
+	return n, err
+}
+
+// Drain reads whatever the pipeline left unread so Sum covers the whole body.
+// It stops with errBodyTooLarge once more than limit bytes were read in total.
+func (b *hashingBody) Drain(limit int64) error {
+	_, err := io.Copy(io.Discard, io.LimitReader(b, limit-b.n+1))
+	if err == nil && b.n > limit {
+		return errBodyTooLarge
+	}
+	return err
+}
+
+// Sum returns the hex SHA-256 of everything read so far
+func (b *hashingBody) Sum() string {
+	return hex.EncodeToString(b.hash.Sum(nil))
+}
+
+// beginIdempotent handles a request carrying an Idempotency-Key. It answers the
+// request itself (replay, reuse conflict or error) and returns false, or claims
+// the key and returns true so the upload can proceed.
+func (h *UploadHandler) beginIdempotent(w http.ResponseWriter, r *http.Request, channelID, key string) bool {
+	if len(key) > maxIdempotencyKeyLength {
+		writeErrorDetails(w, r, http.StatusBadRequest, ErrCodeInvalidParameter, "Idempotency-Key is too long", map[string]interface{}{"maxLength": maxIdempotencyKeyLength})
+		return false
+	}
+
+	record, err := h.idempotency.Begin(r.Context(), channelID, key)
+	switch {
+	case errors.Is(err, errIdempotencyInProgress):
+		writeError(w, r, http.StatusConflict, ErrCodeIdempotencyInProgress, "A request with this Idempotency-Key is still in progress")
+		return false
+	case err != nil:
+		writeStorageError(w, r, "Failed to look up Idempotency-Key", err)
+		return false
+	case record != nil:
+		h.replayIdempotent(w, r, record)
+		return false
+	}
+	return true
+}
+
+// replayIdempotent returns the recorded response if the body matches the original one
+func (h *UploadHandler) replayIdempotent(w http.ResponseWriter, r *http.Request, record *IdempotencyRecord) {
+	// A body above the size limit cannot match the original upload
+	maxFileSize := h.config.uploadFor(record.ChannelID).MaxFileSize
+	body := newHashingBody(r.Body)
+	if err := body.Drain(maxFileSize); errors.Is(err, errBodyTooLarge) {
+		writeErrorDetails(w, r, http.StatusRequestEntityTooLarge, ErrCodeFileTooLarge, "File too large", map[string]interface{}{"maxBytes": maxFileSize})
+		return
+	} else if err != nil {
+		writeError(w, r, http.StatusBadRequest, ErrCodeInvalidParameter, fmt.Sprintf("Failed to read request body: %v", err))
+		return
+	}
+	if body.Sum() != record.BodySHA256 {
+		writeError(w, r, http.StatusConflict, ErrCodeIdempotencyKeyReused, "Idempotency-Key was already used with a different request body")
+		return
+	}
+
+	loggerFromContext(r.Context()).Info("Replaying upload for Idempotency-Key", "key", record.Response.Key, "channel", record.ChannelID)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(record.Response)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestIdempotencyStoreBegin(t *testing.T) {
+	ctx := context.Background()
+	client, _ := newTestS3Client(t)
+	store := NewIdempotencyStore(client, DefaultConfig.idempotencyConfig())
+
+	if record, err := store.Begin(ctx, "1", "key"); record != nil || err != nil {
+		t.Fatalf("first Begin = %v, %v, want the claim", record, err)
+	}
+	if _, err := store.Begin(ctx, "1", "key"); !errors.Is(err, errIdempotencyInProgress) {
+		t.Fatalf("Begin while claimed: err = %v, want errIdempotencyInProgress", err)
+	}
+	if record, err := store.Begin(ctx, "2", "key"); record != nil || err != nil {
+		t.Fatalf("Begin on another channel = %v, %v, want the claim", record, err)
+	}
+
+	if err := store.Save(ctx, "1", "key", "sum", &UploadResponse{Key: "csv_upload/1/a"}); err != nil {
+		t.Fatal(err)
+	}
+	store.End("1", "key")
+	record, err := store.Begin(ctx, "1", "key")
+	if err != nil || record == nil || record.Response.Key != "csv_upload/1/a" {
+		t.Fatalf("Begin after Save = %v, %v, want the record", record, err)
+	}
+	// Returning a record does not keep the key claimed
+	if _, err := store.Begin(ctx, "1", "key"); err != nil {
+		t.Errorf("Begin after a replay: err = %v", err)
+	}
+}
+
+func TestIdempotentUpload(t *testing.T) {
+	csv := testCSV(10)
+	tests := []struct {
+		name        string
+		retryBody   string
+		wantStatus  int
+		wantCode    string
+		wantReplay  bool
+		maxFileSize int64
+	}{
+		{"same body replays", csv, http.StatusCreated, "", true, 0},
+		{"different body", testCSV(11), http.StatusConflict, ErrCodeIdempotencyKeyReused, false, 0},
+		{"body above the limit", csv + strings.Repeat("x", 1000), http.StatusRequestEntityTooLarge, ErrCodeFileTooLarge, false, int64(len(csv)) + 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newTestServer(t, func(c *Config) {
+				if tt.maxFileSize > 0 {
+					c.Upload.MaxFileSize = tt.maxFileSize
+				}
+			})
+			first := server.upload(t, "1", csv, "", idempotencyKeyHeader, "retry-1")
+
+			// A chunked body has no Content-Length, so only the replay limits it
+			r := newChunkedRequest(http.MethodPost, "/cht/v1/file/csv/1/data.csv", tt.retryBody)
+			r.Header.Set(idempotencyKeyHeader, "retry-1")
+			w := server.serve(r)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("retry: status %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if replayed := w.Header().Get("Idempotent-Replayed") == "true"; replayed != tt.wantReplay {
+				t.Errorf("Idempotent-Replayed = %t, want %t", replayed, tt.wantReplay)
+			}
+			if tt.wantReplay {
+				var response UploadResponse
+				decodeJSON(t, w, &response)
+				if response.Key != first.Key {
+					t.Errorf("replayed key = %s, want %s", response.Key, first.Key)
+				}
+				return
+			}
+			var response ErrorResponse
+			decodeJSON(t, w, &response)
+			if response.Code != tt.wantCode {
+				t.Errorf("code = %s, want %s", response.Code, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestIdempotentUploadRunsOnce(t *testing.T) {
+	server := newTestServer(t, nil)
+	csv := testCSV(10)
+
+	var wg sync.WaitGroup
+	statuses := make(chan int, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := server.do(http.MethodPost, "/cht/v1/file/csv/1/data.csv", strings.NewReader(csv), idempotencyKeyHeader, "once")
+			statuses <- w.Code
+		}()
+	}
+	wg.Wait()
+	close(statuses)
+
+	for status := range statuses {
+		if status != http.StatusCreated && status != http.StatusConflict {
+			t.Errorf("status %d, want 201 or 409", status)
+		}
+	}
+	if uploads := server.store.keys("csv_upload/1/"); countSuffix(uploads, "/metadata.json") != 1 {
+		t.Errorf("stored uploads = %v, want exactly one", uploads)
+	}
+}
+
+func TestHashingBodyDrain(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		read    int // bytes the pipeline consumed before the drain
+		limit   int64
+		wantErr error
+	}{
+		{"under the limit", "abcdef", 2, 10, nil},
+		{"at the limit", "abcdef", 0, 6, nil},
+		{"over the limit", "abcdefgh", 3, 6, errBodyTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := newHashingBody(io.NopCloser(strings.NewReader(tt.body)))
+			io.ReadFull(body, make([]byte, tt.read))
+			err := body.Drain(tt.limit)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Drain() = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && body.Sum() != checksumSHA256([]byte(tt.body)) {
+				t.Errorf("Sum() = %s, want the SHA-256 of the whole body", body.Sum())
+			}
+		})
+	}
+}
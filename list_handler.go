@@ -0,0 +1,422 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	listPrefix       = "/admin/cht/v1/file/csv-uploads/"
+	defaultListLimit = 20
+	maxListLimit     = 100
+	maxListScan      = 1000 // uploads inspected per request when filtering by file name
+
+	UploadStatusCompleted  = "completed"
+	UploadStatusIncomplete = "incomplete" // reserved but no metadata yet: in progress or failed
+	UploadStatusLegacy     = "legacy"     // uploaded before metadata was recorded
+	UploadStatusExpired    = "expired"    // past retention, waiting for the sweeper
+)
+
+// UploadSummary is one entry of an upload listing
+type UploadSummary struct {
+	ID        string    `json:"id"`
+	Key       string    `json:"key"`
+	FileName  string    `json:"fileName,omitempty"`
+	Rows      int       `json:"rows"`
+	Size      int64     `json:"size"` // bytes stored across all segments
+	CreatedAt time.Time `json:"createdAt"`
+	Status    string    `json:"status"`
+	AliasOf   string    `json:"aliasOf,omitempty"`
+
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+type ListResponse struct {
+	Uploads   []UploadSummary `json:"uploads"`
+	NextToken string          `json:"nextToken,omitempty"`
+}
+
+// listOptions holds the validated listing query parameters
+type listOptions struct {
+	limit      int
+	descending bool
+	namePrefix string
+	from, to   time.Time // zero means unbounded
+	after      string    // key of the last upload returned by the previous page
+}
+
+// listToken is the opaque continuation token handed to clients
+type listToken struct {
+	After string `json:"after"`
+}
+
+// HandleList lists a channel's uploads, newest first by default
+func (h *QueryHandler) HandleList(w http.ResponseWriter, r *http.Request) {
+	channelID := r.PathValue("channelId")
+	if channelID == "" {
+		writeError(w, r, http.StatusBadRequest, ErrCodeMissingParameter, "Channel ID is required")
+		return
+	}
+	auditEventFromContext(r.Context()).describe(AuditActionList, channelID, "")
+
+	opts, err := parseListOptions(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, ErrCodeInvalidParameter, err.Error())
+		return
+	}
+
+	prefix := fmt.Sprintf("csv_upload/%s/", channelID)
+	if opts.after != "" && !strings.HasPrefix(opts.after, prefix) {
+		writeError(w, r, http.StatusBadRequest, ErrCodeInvalidParameter, "invalid token value")
+		return
+	}
+
+	response := ListResponse{Uploads: []UploadSummary{}}
+	scanned, last := 0, ""
+	var summaryErr error
+	err = h.scanUploads(r.Context(), prefix, opts, func(c listCandidate) bool {
+		if len(response.Uploads) == opts.limit || scanned == maxListScan {
+			// Another upload follows the page, so hand out a token
+			response.NextToken = encodeListToken(last)
+			return false
+		}
+		scanned++
+		summary, err := h.summarize(r.Context(), c.key, c.createdAt)
+		if err != nil {
+			summaryErr = err
+			return false
+		}
+		last = c.key
+		if opts.namePrefix != "" && !strings.HasPrefix(summary.FileName, opts.namePrefix) {
+			return true
+		}
+		response.Uploads = append(response.Uploads, summary)
+		return true
+	})
+	if summaryErr != nil {
+		writeStorageError(w, r, "Failed to read upload metadata", summaryErr)
+		return
+	}
+	if err != nil {
+		writeStorageError(w, r, "Failed to list uploads", err)
+		return
+	}
+	loggerFromContext(r.Context()).Info("Listed uploads", "channel", channelID, "uploads", len(response.Uploads), "scanned", scanned)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// listCandidate is an upload found by the listing. The listing only returns
+// keys, so the creation time is recovered from the upload ID.
+type listCandidate struct {
+	key       string
+	createdAt time.Time
+}
+
+// ULIDs start with "0" until the year 3084 and legacy IDs start with their year,
+// so under a channel prefix every ULID upload sorts before ulidRangeEnd and
+// every legacy upload after it. Within each range key order is creation order.
+const ulidRangeEnd = "0~"
+
+// listWindow is how far back the first step of a newest-first scan reaches;
+// every further step reaches twice as far as the one before
+const listWindow = time.Hour
+
+// scanUploads visits a channel's uploads in listing order, starting after the
+// cursor in opts, until visit returns false. Only the part of the channel the
+// page needs is listed, so a page costs the same however many uploads precede it.
+func (h *QueryHandler) scanUploads(ctx context.Context, prefix string, opts listOptions, visit func(listCandidate) bool) error {
+	// Legacy uploads are all older than ULID uploads
+	legacyAfter, ulidAfter := "", ""
+	if opts.after >= prefix+ulidRangeEnd {
+		legacyAfter = opts.after
+	} else {
+		ulidAfter = opts.after
+	}
+
+	if opts.descending {
+		if legacyAfter == "" {
+			more, err := h.scanULIDsBackward(ctx, prefix, opts, ulidAfter, visit)
+			if err != nil || !more {
+				return err
+			}
+		}
+		_, err := h.scanLegacy(ctx, prefix, opts, legacyAfter, visit)
+		return err
+	}
+
+	if ulidAfter == "" {
+		more, err := h.scanLegacy(ctx, prefix, opts, legacyAfter, visit)
+		if err != nil || !more {
+			return err
+		}
+	}
+	_, err := h.scanULIDsForward(ctx, prefix, opts, ulidAfter, visit)
+	return err
+}
+
+// scanLegacy visits the uploads made before ULIDs. No new ones are created, so
+// the range is listed in full and the cursor found with a binary search; it
+// need not exist any more.
+func (h *QueryHandler) scanLegacy(ctx context.Context, prefix string, opts listOptions, after string, visit func(listCandidate) bool) (bool, error) {
+	var keys []string
+	err := h.s3Client.ListPrefixesAfter(ctx, prefix, prefix+ulidRangeEnd, func(common string) bool {
+		keys = append(keys, strings.TrimSuffix(common, "/"))
+		return true
+	})
+	if err != nil {
+		return false, err
+	}
+
+	if after != "" {
+		i := sort.SearchStrings(keys, after)
+		if opts.descending {
+			keys = keys[:i]
+		} else {
+			if i < len(keys) && keys[i] == after {
+				i++
+			}
+			keys = keys[i:]
+		}
+	}
+	if opts.descending {
+		slices.Reverse(keys)
+	}
+	for _, key := range keys {
+		createdAt, _ := uploadIDTime(key[len(prefix):])
+		if !opts.contains(createdAt) {
+			continue
+		}
+		if !visit(listCandidate{key: key, createdAt: createdAt}) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// scanULIDsForward visits ULID uploads oldest first, letting S3 start the
+// listing after the cursor or the from bound
+func (h *QueryHandler) scanULIDsForward(ctx context.Context, prefix string, opts listOptions, after string, visit func(listCandidate) bool) (bool, error) {
+	startAfter := ""
+	if after != "" {
+		// The cursor's own objects sort between after+"/" and after+"0"
+		startAfter = after + "0"
+	}
+	if !opts.from.IsZero() {
+		if bound := prefix + uploadIDTimePrefix(opts.from); bound > startAfter {
+			startAfter = bound
+		}
+	}
+
+	more := true
+	err := h.s3Client.ListPrefixesAfter(ctx, prefix, startAfter, func(common string) bool {
+		key := strings.TrimSuffix(common, "/")
+		if key >= prefix+ulidRangeEnd {
+			return false
+		}
+		createdAt, _ := uploadIDTime(key[len(prefix):])
+		if !opts.to.IsZero() && !createdAt.Before(opts.to) {
+			return false
+		}
+		if !opts.contains(createdAt) {
+			return true
+		}
+		more = visit(listCandidate{key: key, createdAt: createdAt})
+		return more
+	})
+	return more, err
+}
+
+// scanULIDsBackward visits ULID uploads newest first. S3 only lists forwards,
+// so it steps back through time windows that double in size, listing each
+// window forwards and visiting it in reverse.
+func (h *QueryHandler) scanULIDsBackward(ctx context.Context, prefix string, opts listOptions, before string, visit func(listCandidate) bool) (bool, error) {
+	end, top := prefix+ulidRangeEnd, time.Now()
+	if before != "" {
+		end = before
+		top, _ = uploadIDTime(before[len(prefix):])
+	}
+	if !opts.to.IsZero() && opts.to.Before(top) {
+		end, top = prefix+uploadIDTimePrefix(opts.to), opts.to
+	}
+
+	// The oldest upload tells the scan where to stop
+	var oldest time.Time
+	found := false
+	err := h.s3Client.ListPrefixesAfter(ctx, prefix, "", func(common string) bool {
+		if key := strings.TrimSuffix(common, "/"); key < prefix+ulidRangeEnd {
+			oldest, found = uploadIDTime(key[len(prefix):])
+		}
+		return false
+	})
+	if err != nil || !found {
+		return true, err
+	}
+	if opts.from.After(oldest) {
+		oldest = opts.from
+	}
+
+	for window := listWindow; ; window *= 2 {
+		low, last := top.Add(-window), false
+		if !low.After(oldest) {
+			low, last = oldest, true
+		}
+		startAfter := prefix + uploadIDTimePrefix(low)
+
+		var keys []string
+		err := h.s3Client.ListPrefixesAfter(ctx, prefix, startAfter, func(common string) bool {
+			key := strings.TrimSuffix(common, "/")
+			if key >= end {
+				return false
+			}
+			keys = append(keys, key)
+			return true
+		})
+		if err != nil {
+			return false, err
+		}
+		for i := len(keys) - 1; i >= 0; i-- {
+			createdAt, _ := uploadIDTime(keys[i][len(prefix):])
+			if !opts.contains(createdAt) {
+				continue
+			}
+			if !visit(listCandidate{key: keys[i], createdAt: createdAt}) {
+				return false, nil
+			}
+		}
+		if last {
+			return true, nil
+		}
+		end, top = startAfter, low
+	}
+}
+
+// summarize builds a listing entry from an upload's metadata
+func (h *QueryHandler) summarize(ctx context.Context, key string, createdAt time.Time) (UploadSummary, error) {
+	summary := UploadSummary{
+		ID:        "csv_" + key[strings.LastIndex(key, "/")+1:],
+		Key:       key,
+		CreatedAt: createdAt,
+	}
+
+	metadata, err := h.loadMetadata(ctx, key)
+	if err != nil {
+		return UploadSummary{}, err
+	}
+	if metadata == nil {
+		summary.Status = UploadStatusIncomplete
+		if _, legacyErr := time.Parse(legacyUploadIDLayout, key[strings.LastIndex(key, "/")+1:]); legacyErr == nil {
+			summary.Status = UploadStatusLegacy
+		}
+		return summary, nil
+	}
+
+	summary.ID = metadata.ID
+	summary.FileName = metadata.FileName
+	summary.Rows = metadata.Rows
+	summary.CreatedAt = metadata.CreatedAt
+	summary.Status = UploadStatusCompleted
+	summary.AliasOf = metadata.AliasOf
+	summary.ExpiresAt = metadata.ExpiresAt
+	for _, segment := range metadata.Segments {
+		summary.Size += int64(segment.Size)
+	}
+	if h.retention.Expired(key, metadata) {
+		summary.Status = UploadStatusExpired
+	}
+	return summary, nil
+}
+
+// contains reports whether createdAt falls in the from/to range
+func (opts listOptions) contains(createdAt time.Time) bool {
+	if !opts.from.IsZero() && createdAt.Before(opts.from) {
+		return false
+	}
+	return opts.to.IsZero() || createdAt.Before(opts.to)
+}
+
+func parseListOptions(r *http.Request) (listOptions, error) {
+	query := r.URL.Query()
+	opts := listOptions{
+		limit:      defaultListLimit,
+		descending: true,
+		namePrefix: query.Get("namePrefix"),
+	}
+
+	if limitStr := query.Get("limit"); limitStr != "" {
+		limit, err := strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 {
+			return opts, fmt.Errorf("invalid limit value")
+		}
+		if limit > maxListLimit {
+			return opts, fmt.Errorf("limit exceeds maximum allowed value of %d", maxListLimit)
+		}
+		opts.limit = limit
+	}
+
+	switch query.Get("sort") {
+	case "", "desc":
+		opts.descending = true
+	case "asc":
+		opts.descending = false
+	default:
+		return opts, fmt.Errorf("invalid sort value. Must be asc or desc")
+	}
+
+	var err error
+	if opts.from, err = parseListTime(query.Get("from")); err != nil {
+		return opts, fmt.Errorf("invalid from value: %v", err)
+	}
+	if opts.to, err = parseListTime(query.Get("to")); err != nil {
+		return opts, fmt.Errorf("invalid to value: %v", err)
+	}
+
+	if token := query.Get("token"); token != "" {
+		if opts.after, err = decodeListToken(token); err != nil {
+			return opts, fmt.Errorf("invalid token value")
+		}
+	}
+	return opts, nil
+}
+
+// parseListTime accepts RFC 3339 timestamps or plain dates (YYYY-MM-DD, UTC)
+func parseListTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", value)
+}
+
+func encodeListToken(after string) string {
+	data, _ := json.Marshal(listToken{After: after})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeListToken(token string) (string, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return "", err
+	}
+	var decoded listToken
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return "", err
+	}
+	if decoded.After == "" {
+		return "", errors.New("empty token")
+	}
+	return decoded.After, nil
+}
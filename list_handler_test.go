@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"testing"
+	"time"
+)
+
+// seedUploads reserves one upload per creation time under the channel and
+// returns their keys, oldest first. ULIDs are used for every time after
+// legacyBefore and legacy timestamps for the rest.
+func seedUploads(s *testServer, channelID string, times []time.Time, legacyBefore time.Time) []string {
+	var keys []string
+	for _, at := range times {
+		id := (&uploadIDGenerator{}).next(at)
+		if at.Before(legacyBefore) {
+			id = at.Local().Format(legacyUploadIDLayout)
+		}
+		key := fmt.Sprintf("csv_upload/%s/%s", channelID, id)
+		s.store.put(reservationKey(key), nil)
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// listAll follows nextToken until the last page and returns the listed keys
+func (s *testServer) listAll(t *testing.T, channelID string, params url.Values) []string {
+	t.Helper()
+	var keys []string
+	for page := 0; ; page++ {
+		if page > 100 {
+			t.Fatal("listing does not end")
+		}
+		w := s.do(http.MethodGet, listPrefix+channelID+"?"+params.Encode(), nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("list: status %d: %s", w.Code, w.Body.String())
+		}
+		var response ListResponse
+		decodeJSON(t, w, &response)
+		for _, upload := range response.Uploads {
+			keys = append(keys, upload.Key)
+		}
+		if response.NextToken == "" {
+			return keys
+		}
+		params.Set("token", response.NextToken)
+	}
+}
+
+func TestListUploadsPagination(t *testing.T) {
+	base := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	var times []time.Time
+	for i := 0; i < 25; i++ {
+		// Spread over a year so newest-first pages cross several windows
+		times = append(times, base.Add(time.Duration(i*i)*12*time.Hour))
+	}
+	legacyBefore := base.Add(4 * 12 * time.Hour) // the first 2 uploads are legacy
+
+	from := base.Add(10 * 12 * time.Hour)
+	to := base.Add(300 * 12 * time.Hour)
+	inRange := func(keys []string) []string {
+		var out []string
+		for i, key := range keys {
+			if !times[i].Before(from) && times[i].Before(to) {
+				out = append(out, key)
+			}
+		}
+		return out
+	}
+
+	tests := []struct {
+		name   string
+		params url.Values
+		want   func(keys []string) []string
+	}{
+		{"newest first", url.Values{"limit": {"3"}}, reversedCopy},
+		{"oldest first", url.Values{"limit": {"4"}, "sort": {"asc"}}, func(keys []string) []string { return keys }},
+		{"single page", url.Values{"limit": {"100"}}, reversedCopy},
+		{"range newest first", url.Values{"limit": {"2"}, "from": {from.Format(time.RFC3339)}, "to": {to.Format(time.RFC3339)}},
+			func(keys []string) []string { return reversedCopy(inRange(keys)) }},
+		{"range oldest first", url.Values{"limit": {"2"}, "sort": {"asc"}, "from": {from.Format(time.RFC3339)}, "to": {to.Format(time.RFC3339)}},
+			inRange},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t, nil)
+			keys := seedUploads(ts, "ch", times, legacyBefore)
+			seedUploads(ts, "other", times[:3], legacyBefore)
+
+			got := ts.listAll(t, "ch", tt.params)
+			if want := tt.want(keys); !slices.Equal(got, want) {
+				t.Errorf("listed\n%v\nwant\n%v", got, want)
+			}
+		})
+	}
+}
+
+func TestListUploadsResumesAfterDeletedCursor(t *testing.T) {
+	for _, order := range []string{"desc", "asc"} {
+		t.Run(order, func(t *testing.T) {
+			ts := newTestServer(t, nil)
+			base := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+			var times []time.Time
+			for i := 0; i < 6; i++ {
+				times = append(times, base.Add(time.Duration(i)*time.Hour))
+			}
+			keys := seedUploads(ts, "ch", times, base.Add(90*time.Minute))
+			if order == "desc" {
+				slices.Reverse(keys)
+			}
+
+			for _, cut := range []int{1, 2, 3, 4} { // cursors on both sides of the legacy boundary
+				w := ts.do(http.MethodGet, fmt.Sprintf("%sch?sort=%s&limit=%d", listPrefix, order, cut), nil)
+				var first ListResponse
+				decodeJSON(t, w, &first)
+				if len(first.Uploads) != cut || first.Uploads[cut-1].Key != keys[cut-1] {
+					t.Fatalf("first page ends at %+v, want %s", first.Uploads, keys[cut-1])
+				}
+
+				// The upload the token points at goes away before the next page
+				ts.store.mu.Lock()
+				delete(ts.store.objects, reservationKey(keys[cut-1]))
+				ts.store.mu.Unlock()
+
+				w = ts.do(http.MethodGet, fmt.Sprintf("%sch?sort=%s&limit=1&token=%s", listPrefix, order, first.NextToken), nil)
+				var next ListResponse
+				decodeJSON(t, w, &next)
+				if len(next.Uploads) != 1 || next.Uploads[0].Key != keys[cut] {
+					t.Errorf("cursor %d: next page %+v, want %s", cut, next.Uploads, keys[cut])
+				}
+				ts.store.put(reservationKey(keys[cut-1]), nil)
+			}
+		})
+	}
+}
+
+func TestListUploadsListsOnlyWhatThePageNeeds(t *testing.T) {
+	ts := newTestServer(t, nil)
+	ts.store.maxKeys = 100
+
+	// Two thousand uploads a minute apart: a full listing takes 20 requests
+	base := time.Now().Add(-48 * time.Hour)
+	var times []time.Time
+	for i := 0; i < 2000; i++ {
+		times = append(times, base.Add(time.Duration(i)*time.Minute))
+	}
+	keys := seedUploads(ts, "ch", times, time.Time{})
+
+	tests := []struct {
+		name  string
+		query string
+		want  []string
+	}{
+		{"oldest first, deep page", "sort=asc&limit=5&token=" + encodeListToken(keys[1500]), keys[1501:1506]},
+		{"newest first, first page", "limit=5", reversedCopy(keys[1995:])},
+		{"newest first, deep page", "limit=5&token=" + encodeListToken(keys[500]), reversedCopy(keys[495:500])},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := ts.store.count("ListObjectsV2")
+			w := ts.do(http.MethodGet, listPrefix+"ch?"+tt.query, nil)
+			var response ListResponse
+			decodeJSON(t, w, &response)
+			var got []string
+			for _, upload := range response.Uploads {
+				got = append(got, upload.Key)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("listed %v, want %v", got, tt.want)
+			}
+			if calls := ts.store.count("ListObjectsV2") - before; calls >= 10 {
+				t.Errorf("page took %d listing requests, want fewer than 10", calls)
+			}
+		})
+	}
+}
+
+func TestListUploadsRejectsForeignToken(t *testing.T) {
+	ts := newTestServer(t, nil)
+	token := encodeListToken("csv_upload/other/" + newUploadID())
+	w := ts.do(http.MethodGet, listPrefix+"ch?token="+token, nil)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status %d, want 400", w.Code)
+	}
+}
+
+func reversedCopy(values []string) []string {
+	out := slices.Clone(values)
+	slices.Reverse(out)
+	return out
+}
@@ -2,162 +2,174 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
-	"strconv"
-	"strings"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 type contextKey string
 
 const (
-	channelIDKey contextKey = "channelId"
-	fileNameKey  contextKey = "fileName"
+	requestIDKey  contextKey = "requestId"
+	auditEventKey contextKey = "auditEvent"
+	loggerKey     contextKey = "logger"
 )
 
-// extractPathParams extracts channelId and fileName from the URL path
-func extractPathParams(prefix, path string) (channelId, fileName string, ok bool) {
-	// Remove prefix from path
-	trimmedPath := strings.TrimPrefix(path, prefix)
-	if trimmedPath == path {
-		return "", "", false
+// fatal logs err and exits
+func fatal(message string, err error) {
+	slog.Error(message, "error", err)
+	os.Exit(1)
+}
+
+func main() {
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, nil)))
+
+	// Settings come from defaults, -config/CSV_CONFIG_FILE, CSV_* variables and flags
+	cfg, err := LoadConfig(os.Args[1:], os.Getenv)
+	if err != nil {
+		fatal("Invalid configuration", err)
 	}
 
-	// Split remaining path
-	parts := strings.Split(strings.Trim(trimmedPath, "/"), "/")
-	if len(parts) != 2 {
-		return "", "", false
+	s3Client, err := NewS3Client(cfg.Storage)
+	if err != nil {
+		fatal("Failed to create S3 client", err)
 	}
 
-	return parts[0], parts[1], true
-}
+	// Every PUT uses SSE-S3 unless a KMS key is given
+	if kmsKeyID := cfg.Storage.SSEKMSKeyID; kmsKeyID != "" {
+		s3Client.Encryption = ServerSideEncryption{Algorithm: s3.ServerSideEncryptionAwsKms, KMSKeyID: kmsKeyID}
+	}
 
-func main() {
-	s3Client, err := NewS3Client()
+	// Client-side envelope encryption of segments, with a local master key file
+	var envelope *EnvelopeEncryption
+	if keyFile := cfg.Storage.EnvelopeKeyFile; keyFile != "" {
+		provider, err := NewLocalKeyProvider(keyFile)
+		if err != nil {
+			fatal("Failed to load envelope encryption key", err)
+		}
+		envelope = &EnvelopeEncryption{Provider: provider, Encrypt: true}
+		slog.Info("Envelope encryption enabled", "key_id", provider.KeyID())
+	}
+
+	// Masking policies per channel, and unmask grants as principal=token pairs
+	masking := cfg.maskingConfig()
+
+	// Tracing: server.traceExporter=otlp|stdout; incoming trace context is always propagated
+	shutdownTracing, err := initTracing(cfg.Server.TraceExporter)
 	if err != nil {
-		log.Fatalf("Failed to create S3 client: %v", err)
+		fatal("Failed to initialize tracing", err)
 	}
 
-	mux := http.NewServeMux()
+	// SIGTERM/SIGINT start a graceful shutdown; background sweepers stop at once
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	// Readiness depends on storage, and on the audit directory when auditing to a file
+	checks := []ReadinessCheck{{Name: "storage", Check: s3Client.HeadBucket}}
+
+	// Audit events go to a local JSONL file when server.auditFile is set, otherwise to S3
+	s3AuditSink := NewS3AuditSink(s3Client, auditEventPrefix)
+	var auditSink AuditSink = s3AuditSink
+	if auditFile := cfg.Server.AuditFile; auditFile != "" {
+		fileSink := NewFileAuditSink(auditFile)
+		auditSink = fileSink
+		checks = append(checks, ReadinessCheck{Name: "audit", Check: fileSink.Check})
+	} else {
+		s3AuditSink.StartFlusher(ctx)
+	}
 
 	// Upload handlers
-	uploadHandler := NewUploadHandler(s3Client)
-
-	// Default upload endpoint (fine-grained)
-	mux.HandleFunc("/cht/v1/file/csv/", func(w http.ResponseWriter, r *http.Request) {
-		channelId, fileName, ok := extractPathParams("/cht/v1/file/csv/", r.URL.Path)
-		if !ok {
-			http.Error(w, "Invalid path format. Expected: /cht/v1/file/csv/{channelId}/{fileName}", http.StatusBadRequest)
-			return
-		}
-		ctx := context.WithValue(r.Context(), channelIDKey, channelId)
-		ctx = context.WithValue(ctx, fileNameKey, fileName)
-		uploadHandler.HandleUpload(w, r.WithContext(ctx))
-	})
-
-	// Test endpoints for different upload modes
-	mux.HandleFunc("/test/fine-grained/csv/", func(w http.ResponseWriter, r *http.Request) {
-		channelId, fileName, ok := extractPathParams("/test/fine-grained/csv/", r.URL.Path)
-		if !ok {
-			http.Error(w, "Invalid path format. Expected: /test/fine-grained/csv/{channelId}/{fileName}", http.StatusBadRequest)
-			return
-		}
-		ctx := context.WithValue(r.Context(), channelIDKey, channelId)
-		ctx = context.WithValue(ctx, fileNameKey, fileName)
-		uploadHandler.HandleUploadWithConfig(w, r.WithContext(ctx), UploadConfig{
-			SegmentSize: 1000,
-			UploadMode:  UploadModeFineGrained,
-		})
-	})
-
-	mux.HandleFunc("/test/coarse-grained/csv/", func(w http.ResponseWriter, r *http.Request) {
-		channelId, fileName, ok := extractPathParams("/test/coarse-grained/csv/", r.URL.Path)
-		if !ok {
-			http.Error(w, "Invalid path format. Expected: /test/coarse-grained/csv/{channelId}/{fileName}", http.StatusBadRequest)
-			return
-		}
-		ctx := context.WithValue(r.Context(), channelIDKey, channelId)
-		ctx = context.WithValue(ctx, fileNameKey, fileName)
-		uploadHandler.HandleUploadWithConfig(w, r.WithContext(ctx), UploadConfig{
-			SegmentSize: 10000,
-			UploadMode:  UploadModeCoarseGrained,
-		})
-	})
-
-	mux.HandleFunc("/test/batch-upload/csv/", func(w http.ResponseWriter, r *http.Request) {
-		channelId, fileName, ok := extractPathParams("/test/batch-upload/csv/", r.URL.Path)
-		if !ok {
-			http.Error(w, "Invalid path format. Expected: /test/batch-upload/csv/{channelId}/{fileName}", http.StatusBadRequest)
-			return
-		}
-		ctx := context.WithValue(r.Context(), channelIDKey, channelId)
-		ctx = context.WithValue(ctx, fileNameKey, fileName)
-		uploadHandler.HandleUploadWithConfig(w, r.WithContext(ctx), UploadConfig{
-			SegmentSize: 1000,
-			UploadMode:  UploadModeBatch,
-		})
-	})
-
-	// New streaming upload endpoint with goroutines
-	mux.HandleFunc("/test/stream-upload/csv/", func(w http.ResponseWriter, r *http.Request) {
-		channelId, fileName, ok := extractPathParams("/test/stream-upload/csv/", r.URL.Path)
-		if !ok {
-			http.Error(w, "Invalid path format. Expected: /test/stream-upload/csv/{channelId}/{fileName}", http.StatusBadRequest)
-			return
+	idempotency := NewIdempotencyStore(s3Client, cfg.idempotencyConfig())
+	idempotency.StartSweeper(ctx)
+	retention := NewRetentionManager(s3Client, cfg.retentionConfig())
+	retention.StartSweeper(ctx)
+	uploads := NewUploadTracker()
+	healthHandler := NewHealthHandler(uploads, checks...)
+	sessions := NewSessionStore(s3Client)
+	sessions.StartSweeper(ctx)
+	uploadHandler := NewUploadHandler(s3Client, NewJobStore(), sessions, idempotency, retention, envelope, cfg, uploads)
+
+	queryHandler := NewQueryHandler(s3Client, retention, envelope, masking, auditSink, cfg)
+	router := newRouter(cfg, uploadHandler, queryHandler, NewAuditHandler(auditSink), healthHandler)
+
+	fmt.Printf("Server starting on %s...\n", cfg.Server.Addr)
+	fmt.Println("\nAvailable endpoints:")
+	fmt.Println("1. Upload:")
+	fmt.Println("   POST /cht/v1/file/csv/{channelId}/{fileName}?mode=&segmentSize=&segmentBytes=&workers=&compression=&keepOriginal=&async=")
+	fmt.Println("   mode: fine (default), coarse, batch or stream; workers only with mode=stream")
+	fmt.Println("   compression: none (default) or gzip")
+	fmt.Println("   keepOriginal=true also stores the file byte for byte")
+	fmt.Println("   * Add ?async=true to get 202 with a job ID")
+	fmt.Println("\n2. Upload job status:")
+	fmt.Println("   GET /cht/v1/file/csv-jobs/{jobId}")
+	fmt.Println("\n3. Resumable upload:")
+	fmt.Println("   POST /cht/v1/file/csv-resumable/{channelId}/{fileName}?mode=&segmentSize=&segmentBytes=&workers=&compression=&keepOriginal=")
+	fmt.Println("   PUT  /cht/v1/file/csv-sessions/{sessionId}/chunks/{n}")
+	fmt.Println("   GET  /cht/v1/file/csv-sessions/{sessionId}")
+	fmt.Println("   POST /cht/v1/file/csv-sessions/{sessionId}/complete")
+	fmt.Println("\n4. Query CSV segments:")
+	fmt.Println("   GET /admin/cht/v1/file/csv-upload/csv_upload/{channelId}/{uploadId}")
+	fmt.Println("   Example: /admin/cht/v1/file/csv-upload/csv_upload/1/01JQ2Z8X4M5N6P7Q8R9S0T1V2W")
+	fmt.Println("   (keys from older uploads, e.g. csv_upload/1/2025-03-19-10-45-09, remain queryable)")
+	fmt.Println("   DELETE on the same path removes the upload (uploads also expire after 30 days)")
+	fmt.Println("   GET /admin/cht/v1/file/csv-original/csv_upload/{channelId}/{uploadId} returns the original file (X-Unmask-Token required when PII is masked)")
+	fmt.Println("\n5. List uploads:")
+	fmt.Println("   GET /admin/cht/v1/file/csv-uploads/{channelId}?limit=&token=&sort=&namePrefix=&from=&to=")
+	fmt.Println("\n6. Audit events:")
+	fmt.Println("   GET /admin/cht/v1/audit-events?channelId=&action=&actor=&from=&to=&limit=")
+	fmt.Println("\n7. Metrics (Prometheus):")
+	fmt.Println("   GET /metrics")
+	fmt.Println("\n8. Effective configuration:")
+	fmt.Println("   GET /admin/config")
+	fmt.Println("\n9. Health probes:")
+	fmt.Println("   GET /healthz (liveness), GET /readyz (storage reachable, not shutting down)")
+
+	server := &http.Server{
+		Addr:              cfg.Server.Addr,
+		Handler:           withTracing(router, withRequestID(promhttp.InstrumentHandlerInFlight(inFlightRequests, withRequestLog(auditSink, router)))),
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       time.Duration(cfg.Server.ReadTimeout),
+		WriteTimeout:      time.Duration(cfg.Server.WriteTimeout),
+		IdleTimeout:       time.Duration(cfg.Server.IdleTimeout),
+	}
+	// A broken profile or bucket still lets the server start, but it stays not ready
+	startupCtx, cancelStartup := context.WithTimeout(ctx, 2*readinessCheckTimeout)
+	for _, dependency := range healthHandler.Readiness(startupCtx).Dependencies {
+		if dependency.Status != DependencyOK {
+			slog.Error("Dependency is not reachable, readiness will fail until it is", "dependency", dependency.Name, "error", dependency.Error)
 		}
+	}
+	cancelStartup()
 
-		// Get number of workers from query parameter
-		workers := 4 // default value
-		if workersStr := r.URL.Query().Get("workers"); workersStr != "" {
-			if worker, err := strconv.Atoi(workersStr); err == nil && worker > 0 {
-				workers = worker
-			} else {
-				http.Error(w, "Invalid workers parameter. Must be a positive integer", http.StatusBadRequest)
-				return
-			}
-		}
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- server.ListenAndServe() }()
 
-		ctx := context.WithValue(r.Context(), channelIDKey, channelId)
-		ctx = context.WithValue(ctx, fileNameKey, fileName)
-		uploadHandler.HandleUploadWithConfig(w, r.WithContext(ctx), UploadConfig{
-			SegmentSize: 1000,
-			UploadMode:  UploadModeStream,
-			Workers:     workers, // Pass workers to config
-		})
-	})
-
-	// Query handler
-	queryHandler := NewQueryHandler(s3Client)
-	mux.HandleFunc("/admin/cht/v1/file/csv-upload/", func(w http.ResponseWriter, r *http.Request) {
-		prefix := "/admin/cht/v1/file/csv-upload/"
-		if key := strings.TrimPrefix(r.URL.Path, prefix); key != "" {
-			r = r.WithContext(r.Context())
-			r.URL.Path = "/" + key
-			queryHandler.HandleQuery(w, r)
-			return
+	select {
+	case err := <-serveErr:
+		if !errors.Is(err, http.ErrServerClosed) {
+			fatal("Failed to start server", err)
 		}
-		http.NotFound(w, r)
-	})
+	case <-ctx.Done():
+		stop() // a second signal kills the process
+		shutdown(server, healthHandler, uploads, cfg.Server)
+	}
 
-	fmt.Println("Server starting on :8080...")
-	fmt.Println("\nAvailable endpoints:")
-	fmt.Println("1. Default Upload (fine-grained):")
-	fmt.Println("   POST /cht/v1/file/csv/{channelId}/{fileName}")
-	fmt.Println("\n2. Test Endpoints:")
-	fmt.Println("   a) Fine-grained upload (1,000 rows/segment):")
-	fmt.Println("      POST /test/fine-grained/csv/{channelId}/{fileName}")
-	fmt.Println("   b) Coarse-grained upload (10,000 rows/segment):")
-	fmt.Println("      POST /test/coarse-grained/csv/{channelId}/{fileName}")
-	fmt.Println("   c) Batch upload (1,000 rows/segment, uploaded in batch):")
-	fmt.Println("      POST /test/batch-upload/csv/{channelId}/{fileName}")
-	fmt.Println("   d) Stream upload (1,000 rows/segment, concurrent streaming):")
-	fmt.Println("      POST /test/stream-upload/csv/{channelId}/{fileName}")
-	fmt.Println("\n3. Query CSV segments:")
-	fmt.Println("   GET /admin/cht/v1/file/csv-upload/csv/{channelId}/{timestamp}")
-	fmt.Println("   Example: /admin/cht/v1/file/csv-upload/csv/1/2025-03-19-10-45-09")
-
-	if err := http.ListenAndServe(":8080", mux); err != nil {
-		log.Fatalf("Failed to start server: %v", err)
+	// Flush audit events and spans recorded during shutdown
+	flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s3AuditSink.Flush(flushCtx); err != nil {
+		slog.Error("Failed to flush audit events", "error", err)
+	}
+	if err := shutdownTracing(flushCtx); err != nil {
+		slog.Error("Failed to flush traces", "error", err)
 	}
+	slog.Info("Server stopped")
 }
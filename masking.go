@@ -0,0 +1,282 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Masking modes, chosen per channel
+const (
+	MaskModeOff     = "off"     // return values as stored
+	MaskModePartial = "partial" // keep a hint of the value, e.g. j***@example.com
+	MaskModeRedact  = "redact"  // replace the whole value
+)
+
+// PII kinds recorded for detected or configured columns
+const (
+	PIIKindEmail   = "email"
+	PIIKindPhone   = "phone"
+	PIIKindAddress = "address"
+	PIIKindOther   = "other"
+)
+
+const (
+	unmaskTokenHeader = "X-Unmask-Token"
+	redactedValue     = "[REDACTED]"
+	piiSampleRows     = 100 // rows inspected per upload when detecting PII columns
+	piiMatchRatio     = 0.8 // share of non-empty sampled values that must look like PII
+)
+
+var (
+	emailPattern = regexp.MustCompile(`^[^@\s]+@[^@\s]+\.[^@\s]+$`)
+	phonePattern = regexp.MustCompile(`^\+?[0-9][0-9 ().-]{6,}[0-9]$`)
+)
+
+// MaskingPolicy decides how PII columns of a channel are returned by queries
+type MaskingPolicy struct {
+	Mode    string
+	Columns map[string]string // column name -> PII kind, for columns auto-detection misses
+}
+
+// MaskingConfig selects the masking policy for each channel and who may unmask.
+// It is built from the query, channels and server sections of Config.
+type MaskingConfig struct {
+	DefaultPolicy   MaskingPolicy
+	ChannelPolicies map[string]MaskingPolicy // channelId -> policy, overrides DefaultPolicy
+	UnmaskTokens    map[string]string        // X-Unmask-Token value -> principal recorded in the audit log
+}
+
+func (c MaskingConfig) policyFor(channelID string) MaskingPolicy {
+	if policy, ok := c.ChannelPolicies[channelID]; ok {
+		return policy
+	}
+	if c.DefaultPolicy.Mode == "" {
+		return MaskingPolicy{Mode: MaskModeOff}
+	}
+	return c.DefaultPolicy
+}
+
+func validMaskMode(mode string) bool {
+	return mode == MaskModeOff || mode == MaskModePartial || mode == MaskModeRedact
+}
+
+func validPIIKind(kind string) bool {
+	return kind == PIIKindEmail || kind == PIIKindPhone || kind == PIIKindAddress || kind == PIIKindOther
+}
+
+// PIIColumn is a column holding personal data
+type PIIColumn struct {
+	Index int    `json:"index"`
+	Name  string `json:"name"`
+	Kind  string `json:"kind"`
+}
+
+// piiDetector classifies columns from their header name and a sample of rows
+type piiDetector struct {
+	header  []string
+	sampled int
+	filled  []int // non-empty sampled values per column
+	emails  []int
+	phones  []int
+}
+
+func newPIIDetector(header []string) *piiDetector {
+	return &piiDetector{
+		header: header,
+		filled: make([]int, len(header)),
+		emails: make([]int, len(header)),
+		phones: make([]int, len(header)),
+	}
+}
+
+func (d *piiDetector) Write(row []string) {
+	if d.sampled >= piiSampleRows {
+		return
+	}
+	d.sampled++
+	for i, value := range row {
+		if i >= len(d.header) || value == "" {
+			continue
+		}
+		d.filled[i]++
+		if emailPattern.MatchString(value) {
+			d.emails[i]++
+		} else if phonePattern.MatchString(value) {
+			d.phones[i]++
+		}
+	}
+}
+
+// Columns returns the detected PII columns. The result is never nil, so
+// metadata can tell "nothing detected" apart from "not inspected".
+func (d *piiDetector) Columns() []PIIColumn {
+	columns := []PIIColumn{}
+	for i, name := range d.header {
+		kind := piiKindFromName(name)
+		if kind == "" && d.filled[i] > 0 {
+			switch {
+			case float64(d.emails[i]) >= piiMatchRatio*float64(d.filled[i]):
+				kind = PIIKindEmail
+			case float64(d.phones[i]) >= piiMatchRatio*float64(d.filled[i]):
+				kind = PIIKindPhone
+			}
+		}
+		if kind != "" {
+			columns = append(columns, PIIColumn{Index: i, Name: name, Kind: kind})
+		}
+	}
+	return columns
+}
+
+// piiKindFromName recognizes common PII column names, e.g. email, mobileNumber, address
+func piiKindFromName(name string) string {
+	normalized := strings.ToLower(strings.NewReplacer("_", "", "-", "", " ", "").Replace(name))
+	switch {
+	case strings.Contains(normalized, "email"):
+		return PIIKindEmail
+	case strings.Contains(normalized, "phone"), strings.Contains(normalized, "mobile"), normalized == "tel":
+		return PIIKindPhone
+	case strings.Contains(normalized, "address") && !strings.Contains(normalized, "ip"):
+		return PIIKindAddress
+	}
+	return ""
+}
+
+// maskColumns returns the columns to mask for a query: the ones recorded at
+// upload (or detected now, for uploads without metadata) plus the policy's own
+func maskColumns(policy MaskingPolicy, header []string, metadata *UploadMetadata, rows [][]string) []PIIColumn {
+	var columns []PIIColumn
+	if metadata != nil && metadata.PIIColumns != nil {
+		columns = append(columns, metadata.PIIColumns...)
+	} else {
+		detector := newPIIDetector(header)
+		for _, row := range rows {
+			detector.Write(row)
+		}
+		columns = detector.Columns()
+	}
+
+	for i, name := range header {
+		kind, ok := policy.Columns[name]
+		if !ok {
+			continue
+		}
+		replaced := false
+		for j := range columns {
+			if columns[j].Index == i {
+				columns[j].Kind = kind
+				replaced = true
+			}
+		}
+		if !replaced {
+			columns = append(columns, PIIColumn{Index: i, Name: name, Kind: kind})
+		}
+	}
+	return columns
+}
+
+// maskRows masks the given columns in place
+func maskRows(rows [][]string, columns []PIIColumn, mode string) {
+	for _, row := range rows {
+		for _, column := range columns {
+			if column.Index < len(row) && row[column.Index] != "" {
+				row[column.Index] = maskValue(row[column.Index], column.Kind, mode)
+			}
+		}
+	}
+}
+
+func maskValue(value, kind, mode string) string {
+	if mode == MaskModeRedact {
+		return redactedValue
+	}
+
+	switch kind {
+	case PIIKindEmail:
+		if at := strings.LastIndex(value, "@"); at > 0 {
+			first, _ := utf8.DecodeRuneInString(value)
+			return string(first) + "***" + value[at:]
+		}
+	case PIIKindPhone:
+		// Hide the last four digits, keeping separators: +1-555-0101 -> +1-555-****
+		masked := []rune(value)
+		hidden := 0
+		for i := len(masked) - 1; i >= 0 && hidden < 4; i-- {
+			if unicode.IsDigit(masked[i]) {
+				masked[i] = '*'
+				hidden++
+			}
+		}
+		return string(masked)
+	}
+
+	first, _ := utf8.DecodeRuneInString(value)
+	return string(first) + "***"
+}
+
+// unmaskPrincipal returns who is asking to see unmasked values, or false if
+// the request carries no valid unmask token. The token is compared in constant
+// time against every grant, so neither a map lookup nor an early return tells
+// a caller how close a guess came.
+func (c MaskingConfig) unmaskPrincipal(r *http.Request) (string, bool) {
+	token := r.Header.Get(unmaskTokenHeader)
+	if token == "" {
+		return "", false
+	}
+	principal, found := "", false
+	for grant, owner := range c.UnmaskTokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(grant)) == 1 {
+			principal, found = owner, true
+		}
+	}
+	return principal, found
+}
+
+// parseUnmaskTokens reads "principal=token" pairs separated by commas
+func parseUnmaskTokens(value string) (map[string]string, error) {
+	tokens := make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		principal, token, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || principal == "" || token == "" {
+			return nil, fmt.Errorf("invalid unmask token entry %q, expected principal=token", pair)
+		}
+		tokens[token] = principal
+	}
+	return tokens, nil
+}
+
+// auditUnmaskedRead records a query returning unmasked PII. It runs before the
+// rows are sent, and the read is refused if the event cannot be written.
+func (h *QueryHandler) auditUnmaskedRead(r *http.Request, principal, channelID, key string, columns []PIIColumn, offset, rows int) error {
+	names := make([]string, 0, len(columns))
+	for _, column := range columns {
+		names = append(names, column.Name)
+	}
+	event := AuditEvent{
+		Time:       time.Now().UTC(),
+		RequestID:  requestIDFromContext(r.Context()),
+		Actor:      r.Header.Get(accountHeader),
+		Principal:  principal,
+		Action:     AuditActionUnmask,
+		ChannelID:  channelID,
+		Key:        key,
+		Method:     r.Method,
+		Path:       r.URL.Path,
+		Query:      r.URL.RawQuery,
+		Offset:     offset,
+		Rows:       rows,
+		Columns:    names,
+		RemoteAddr: r.RemoteAddr,
+	}
+	if err := h.audit.Write(r.Context(), event); err != nil {
+		return err
+	}
+	loggerFromContext(r.Context()).Info("Unmasked read", "key", key, "principal", principal, "columns", names, "rows", rows)
+	return nil
+}
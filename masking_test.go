@@ -0,0 +1,186 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"testing"
+)
+
+func TestMaskValue(t *testing.T) {
+	tests := []struct {
+		value, kind, mode string
+		want              string
+	}{
+		{"jane@example.com", PIIKindEmail, MaskModePartial, "j***@example.com"},
+		{"jane@example.com", PIIKindEmail, MaskModeRedact, redactedValue},
+		{"not an email", PIIKindEmail, MaskModePartial, "n***"},
+		{"+1-555-0101", PIIKindPhone, MaskModePartial, "+1-555-****"},
+		{"010 1234 5678", PIIKindPhone, MaskModePartial, "010 1234 ****"},
+		{"12", PIIKindPhone, MaskModePartial, "**"},
+		{"서울시 강남구", PIIKindAddress, MaskModePartial, "서***"},
+		{"secret", PIIKindOther, MaskModePartial, "s***"},
+	}
+	for _, tt := range tests {
+		if got := maskValue(tt.value, tt.kind, tt.mode); got != tt.want {
+			t.Errorf("maskValue(%q, %s, %s) = %q, want %q", tt.value, tt.kind, tt.mode, got, tt.want)
+		}
+	}
+}
+
+func TestPIIKindFromName(t *testing.T) {
+	tests := map[string]string{
+		"email":         PIIKindEmail,
+		"Contact_Email": PIIKindEmail,
+		"mobileNumber":  PIIKindPhone,
+		"phone-number":  PIIKindPhone,
+		"tel":           PIIKindPhone,
+		"hotel":         "",
+		"home address":  PIIKindAddress,
+		"ip_address":    "",
+		"name":          "",
+	}
+	for name, want := range tests {
+		if got := piiKindFromName(name); got != want {
+			t.Errorf("piiKindFromName(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestPIIDetector(t *testing.T) {
+	detector := newPIIDetector([]string{"id", "contact", "number", "notes"})
+	for i := 0; i < 10; i++ {
+		contact, number := "user@example.com", "+82 10-1234-5678"
+		if i == 0 {
+			contact = "unknown" // one miss in ten stays above the match ratio
+		}
+		if i < 5 {
+			number = "" // empty values are not counted
+		}
+		detector.Write([]string{"1", contact, number, "hello"})
+	}
+
+	want := []PIIColumn{{Index: 1, Name: "contact", Kind: PIIKindEmail}, {Index: 2, Name: "number", Kind: PIIKindPhone}}
+	if got := detector.Columns(); !slices.Equal(got, want) {
+		t.Errorf("Columns() = %v, want %v", got, want)
+	}
+	if got := newPIIDetector([]string{"id"}).Columns(); got == nil || len(got) != 0 {
+		t.Errorf("Columns() of a clean upload = %#v, want an empty slice", got)
+	}
+}
+
+func TestMaskColumnsAddsPolicyColumns(t *testing.T) {
+	header := []string{"id", "email", "memo"}
+	metadata := &UploadMetadata{PIIColumns: []PIIColumn{{Index: 1, Name: "email", Kind: PIIKindEmail}}}
+	policy := MaskingPolicy{Mode: MaskModePartial, Columns: map[string]string{"memo": PIIKindOther, "email": PIIKindOther}}
+
+	want := []PIIColumn{{Index: 1, Name: "email", Kind: PIIKindOther}, {Index: 2, Name: "memo", Kind: PIIKindOther}}
+	if got := maskColumns(policy, header, metadata, nil); !slices.Equal(got, want) {
+		t.Errorf("maskColumns = %v, want %v", got, want)
+	}
+}
+
+func TestMaskingConfigFromChannels(t *testing.T) {
+	config := DefaultConfig
+	config.Query.PIIColumns = map[string]string{"memo": PIIKindOther}
+	config.Server.UnmaskTokens = "ops=secret"
+	config.Channels = map[string]ChannelOverrides{
+		"redacted": {MaskMode: MaskModeRedact},
+		"extra":    {PIIColumns: map[string]string{"nickname": PIIKindOther}},
+		"limits":   {MaxLimit: 5000},
+	}
+	masking := config.maskingConfig()
+
+	tests := []struct {
+		channelID   string
+		wantMode    string
+		wantColumns []string
+	}{
+		{"redacted", MaskModeRedact, []string{"memo"}},
+		{"extra", MaskModePartial, []string{"memo", "nickname"}},
+		{"limits", MaskModePartial, []string{"memo"}},
+		{"unknown", MaskModePartial, []string{"memo"}},
+	}
+	for _, tt := range tests {
+		policy := masking.policyFor(tt.channelID)
+		var columns []string
+		for column := range policy.Columns {
+			columns = append(columns, column)
+		}
+		slices.Sort(columns)
+		if policy.Mode != tt.wantMode || !slices.Equal(columns, tt.wantColumns) {
+			t.Errorf("policyFor(%s) = %s %v, want %s %v", tt.channelID, policy.Mode, columns, tt.wantMode, tt.wantColumns)
+		}
+	}
+	if len(config.Query.PIIColumns) != 1 {
+		t.Errorf("channel columns leaked into the global ones: %v", config.Query.PIIColumns)
+	}
+	if masking.UnmaskTokens["secret"] != "ops" {
+		t.Errorf("UnmaskTokens = %v, want secret -> ops", masking.UnmaskTokens)
+	}
+}
+
+func TestUnmaskPrincipal(t *testing.T) {
+	config := MaskingConfig{UnmaskTokens: map[string]string{"secret-1": "alice", "secret-2": "bob"}}
+	tests := []struct {
+		name          string
+		token         string
+		wantPrincipal string
+		wantOK        bool
+	}{
+		{"first grant", "secret-1", "alice", true},
+		{"second grant", "secret-2", "bob", true},
+		{"no token", "", "", false},
+		{"unknown token", "secret-3", "", false},
+		{"prefix of a grant", "secret-", "", false},
+		{"grant with a suffix", "secret-10", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _ := http.NewRequest(http.MethodGet, "/", nil)
+			if tt.token != "" {
+				r.Header.Set(unmaskTokenHeader, tt.token)
+			}
+			principal, ok := config.unmaskPrincipal(r)
+			if principal != tt.wantPrincipal || ok != tt.wantOK {
+				t.Errorf("unmaskPrincipal(%q) = %q, %v, want %q, %v", tt.token, principal, ok, tt.wantPrincipal, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestQueryMaskingPerChannel(t *testing.T) {
+	ts := newTestServer(t, func(c *Config) {
+		c.Server.UnmaskTokens = "ops=secret"
+		c.Channels["redacted"] = ChannelOverrides{MaskMode: MaskModeRedact}
+		c.Channels["plain"] = ChannelOverrides{MaskMode: MaskModeOff}
+		c.Channels["named"] = ChannelOverrides{PIIColumns: map[string]string{"name": PIIKindOther}}
+	})
+
+	tests := []struct {
+		channelID string
+		params    string
+		header    []string
+		wantRow   []string
+	}{
+		{"default", "", nil, []string{"1", "user 1", "u***@example.com"}},
+		{"redacted", "", nil, []string{"1", "user 1", redactedValue}},
+		{"plain", "", nil, []string{"1", "user 1", "user1@example.com"}},
+		{"named", "", nil, []string{"1", "u***", "u***@example.com"}},
+		{"redacted", "unmask=true", []string{unmaskTokenHeader, "secret"}, []string{"1", "user 1", "user1@example.com"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.channelID+" "+tt.params, func(t *testing.T) {
+			uploaded := ts.upload(t, tt.channelID, testCSV(3), "")
+			response := ts.query(t, uploaded.Key, "offset=1&limit=1&"+tt.params, tt.header...)
+			if len(response.Data) != 1 || !slices.Equal(response.Data[0], tt.wantRow) {
+				t.Errorf("rows = %v, want [%v]", response.Data, tt.wantRow)
+			}
+		})
+	}
+
+	uploaded := ts.upload(t, "default", testCSV(3), "")
+	w := ts.do(http.MethodGet, "/admin/cht/v1/file/csv-upload/"+uploaded.Key+"?unmask=true", nil, unmaskTokenHeader, "wrong")
+	if w.Code != http.StatusForbidden {
+		t.Errorf("unmask with a wrong token: status %d, want 403", w.Code)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// UploadMetadata describes a stored upload and is kept next to its segments
+type UploadMetadata struct {
+	ID           string            `json:"id"`
+	ChannelID    string            `json:"channelId"`
+	FileName     string            `json:"fileName"`
+	Key          string            `json:"key"`
+	UploadMode   string            `json:"uploadMode"`
+	SegmentSize  int               `json:"segmentSize"`            // most rows per segment
+	SegmentBytes int64             `json:"segmentBytes,omitempty"` // encoded bytes segments were cut at
+	Workers      int               `json:"workers,omitempty"`      // stream mode workers
+	Compression  string            `json:"compression,omitempty"`  // segment compression; empty for uploads made before it was recorded
+	Header       []string          `json:"header"`
+	Rows         int               `json:"rows"`
+	CreatedAt    time.Time         `json:"createdAt"`
+	Segments     []SegmentMetadata `json:"segments"`
+
+	ContentSHA256 string `json:"contentSha256,omitempty"` // hash of the normalized content, used for deduplication
+	AliasOf       string `json:"aliasOf,omitempty"`       // key of the upload holding the data, for deduplicated aliases
+
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"` // when the retention sweeper deletes the upload; nil keeps it forever
+
+	Encryption *EncryptionMetadata `json:"encryption,omitempty"` // set when segments are envelope encrypted
+	PIIColumns []PIIColumn         `json:"piiColumns"`           // detected at upload; null for uploads made before detection
+
+	Original *OriginalMetadata `json:"original,omitempty"` // set when the uploaded bytes were kept
+}
+
+// OriginalMetadata records the request body of an upload, stored byte for byte
+type OriginalMetadata struct {
+	Key    string `json:"key"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"` // hex encoded checksum of the stored object
+}
+
+// SegmentMetadata records what was written for a single segment
+type SegmentMetadata struct {
+	Number   int    `json:"number"`
+	Key      string `json:"key"`
+	FirstRow int    `json:"firstRow"` // index of the segment's first data row in the upload
+	Rows     int    `json:"rows"`
+	Size     int    `json:"size"`
+	SHA256   string `json:"sha256"` // hex encoded checksum of the stored object (ciphertext, if encrypted)
+}
+
+func segmentKey(basePath string, segmentNum int) string {
+	return fmt.Sprintf("%s/segment-%d.csv", basePath, segmentNum)
+}
+
+// originalKey holds the uploaded file as received, when the upload keeps it
+func originalKey(basePath string) string {
+	return fmt.Sprintf("%s/original", basePath)
+}
+
+func metadataKey(basePath string) string {
+	return fmt.Sprintf("%s/metadata.json", basePath)
+}
+
+// parseUploadKey splits an upload key of the form csv_upload/{channelId}/{uploadId}
+func parseUploadKey(key string) (channelID, uploadID string, ok bool) {
+	parts := strings.Split(key, "/")
+	if len(parts) != 3 || parts[0] != "csv_upload" || parts[1] == "" || parts[2] == "" {
+		return "", "", false
+	}
+	return parts[1], parts[2], true
+}
+
+// reservationKey marks a storage path as taken before any segment is written
+func reservationKey(basePath string) string {
+	return fmt.Sprintf("%s/.reserved", basePath)
+}
+
+// checksumSHA256 returns the hex encoded SHA-256 of data
+func checksumSHA256(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// sortSegments orders segments by number; stream mode finishes them out of order
+func sortSegments(segments []SegmentMetadata) {
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].Number < segments[j].Number
+	})
+}
+
+// locateRow finds the segment holding data row offset, and the row's position
+// in it, from the row ranges recorded per segment. An offset equal to the row
+// count points just past the last row. ok is false when offset is beyond that.
+func (m *UploadMetadata) locateRow(offset int) (segmentNum, offsetInSegment int, ok bool) {
+	for i, segment := range m.Segments {
+		next := segment.FirstRow + segment.Rows // first row of the next segment
+		if offset < next || (offset == next && i == len(m.Segments)-1) {
+			return segment.Number, offset - segment.FirstRow, true
+		}
+	}
+	return 0, 0, false
+}
+
+// segmentCompression returns how the upload's segments are compressed
+func (m *UploadMetadata) segmentCompression() string {
+	if m == nil {
+		return ""
+	}
+	return m.Compression
+}
+
+// segmentChecksum returns the recorded checksum for a segment, if any
+func (m *UploadMetadata) segmentChecksum(segmentNum int) string {
+	if m == nil {
+		return ""
+	}
+	for _, segment := range m.Segments {
+		if segment.Number == segmentNum {
+			return segment.SHA256
+		}
+	}
+	return ""
+}
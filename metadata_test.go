@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestLocateRow(t *testing.T) {
+	// Segments of uneven size, as cut by segmentBytes
+	ranges := &UploadMetadata{Segments: []SegmentMetadata{
+		{Number: 0, FirstRow: 0, Rows: 100},
+		{Number: 1, FirstRow: 100, Rows: 37},
+		{Number: 2, FirstRow: 137, Rows: 250},
+	}}
+	empty := &UploadMetadata{Segments: []SegmentMetadata{{Number: 0, Rows: 0}}}
+
+	tests := []struct {
+		name          string
+		metadata      *UploadMetadata
+		offset        int
+		wantSegment   int
+		wantInSegment int
+		wantOK        bool
+	}{
+		{"first row", ranges, 0, 0, 0, true},
+		{"last row of a segment", ranges, 99, 0, 99, true},
+		{"first row of the next", ranges, 100, 1, 0, true},
+		{"small segment", ranges, 136, 1, 36, true},
+		{"last segment", ranges, 200, 2, 63, true},
+		{"last row", ranges, 386, 2, 249, true},
+		{"just past the last row", ranges, 387, 2, 250, true},
+		{"beyond the rows", ranges, 388, 0, 0, false},
+		{"empty upload", empty, 0, 0, 0, true},
+		{"empty upload, beyond", empty, 1, 0, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			segment, inSegment, ok := tt.metadata.locateRow(tt.offset)
+			if ok != tt.wantOK || (ok && (segment != tt.wantSegment || inSegment != tt.wantInSegment)) {
+				t.Errorf("locateRow(%d) = %d, %d, %v; want %d, %d, %v", tt.offset, segment, inSegment, ok,
+					tt.wantSegment, tt.wantInSegment, tt.wantOK)
+			}
+		})
+	}
+}
+
+// wideCSV returns a CSV whose rows vary in width, so byte cut segments hold
+// different numbers of rows
+func wideCSV(rows int) string {
+	var b strings.Builder
+	b.WriteString("id,payload\n")
+	for i := 0; i < rows; i++ {
+		fmt.Fprintf(&b, "%d,%s\n", i, strings.Repeat("x", 100+(i%7)*400))
+	}
+	return b.String()
+}
+
+func TestQueryLocatesByteCutSegments(t *testing.T) {
+	ts := newTestServer(t, nil)
+	response := ts.upload(t, "ch", wideCSV(2000), "segmentBytes=65536&segmentSize=1000")
+
+	var metadata UploadMetadata
+	data, _ := ts.store.object(metadataKey(response.Key))
+	if err := json.Unmarshal(data, &metadata); err != nil {
+		t.Fatal(err)
+	}
+	if len(metadata.Segments) < 3 {
+		t.Fatalf("%d segments, want the byte target to cut several", len(metadata.Segments))
+	}
+	sizes := make(map[int]bool)
+	for _, segment := range metadata.Segments {
+		sizes[segment.Rows] = true
+	}
+	if len(sizes) < 2 {
+		t.Errorf("segments all hold the same number of rows: %+v", metadata.Segments)
+	}
+	second := metadata.Segments[1]
+
+	tests := []struct {
+		name   string
+		offset int
+		limit  int
+	}{
+		{"first page", 0, 10},
+		{"start of a segment", second.FirstRow, 10},
+		{"end of a segment", second.FirstRow + second.Rows - 1, 1},
+		{"across segments", second.FirstRow - 5, 10},
+		{"last rows", 1995, 100},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ts.query(t, response.Key, fmt.Sprintf("offset=%d&limit=%d", tt.offset, tt.limit))
+			want := min(tt.limit, 2000-tt.offset)
+			if len(got.Data) != want {
+				t.Fatalf("query returned %d rows, want %d", len(got.Data), want)
+			}
+			for i, row := range got.Data {
+				if id := fmt.Sprint(tt.offset + i); row[0] != id {
+					t.Fatalf("row %d has id %s, want %s", i, row[0], id)
+				}
+			}
+		})
+	}
+
+	w := ts.do(http.MethodGet, "/admin/cht/v1/file/csv-upload/"+response.Key+"?offset=2001", nil)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), ErrCodeOffsetOutOfRange) {
+		t.Errorf("offset past the rows: status %d: %s", w.Code, w.Body)
+	}
+}
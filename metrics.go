@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	metricsPath      = "/metrics"
+	metricsNamespace = "csv_query"
+)
+
+// Upload outcomes recorded in csv_query_uploads_total
+const (
+	uploadOutcomeSuccess      = "success"
+	uploadOutcomeDeduplicated = "deduplicated"
+	uploadOutcomeInvalid      = "invalid_csv"
+	uploadOutcomeStorageError = "storage_error"
+	uploadOutcomeAborted      = "aborted"
+	uploadOutcomeCanceled     = "canceled" // the client disconnected
+	uploadOutcomeError        = "error"
+)
+
+var (
+	uploadsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "uploads_total",
+		Help:      "Uploads processed, by upload mode and outcome.",
+	}, []string{"mode", "outcome"})
+
+	uploadDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "upload_duration_seconds",
+		Help:      "Time to segment and store an upload, by upload mode.",
+		Buckets:   prometheus.ExponentialBuckets(0.1, 2, 12), // 100ms .. ~3.4m
+	}, []string{"mode"})
+
+	ingestedRowsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "ingested_rows_total",
+		Help:      "Data rows stored in segments, by upload mode.",
+	}, []string{"mode"})
+
+	ingestedBytesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "ingested_bytes_total",
+		Help:      "Segment bytes stored, by upload mode.",
+	}, []string{"mode"})
+
+	segmentUploadDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "segment_upload_duration_seconds",
+		Help:      "Time to encode and store one segment, by upload mode. Batch uploads report their share of the batch.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"mode"})
+
+	s3RequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "s3_request_duration_seconds",
+		Help:      "Latency of single S3 request attempts, by operation.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"operation"})
+
+	s3RequestErrorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "s3_request_errors_total",
+		Help:      "Failed S3 request attempts, by operation and storage error kind.",
+	}, []string{"operation", "kind"})
+
+	queryDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "query_duration_seconds",
+		Help:      "Latency of successful queries.",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	queryRows = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "query_rows",
+		Help:      "Rows returned per query.",
+		Buckets:   prometheus.ExponentialBuckets(1, 4, 10), // 1 .. 262144
+	})
+
+	activeStreamWorkers = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "stream_workers_active",
+		Help:      "Stream mode segment workers currently running.",
+	})
+
+	inFlightRequests = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_requests_in_flight",
+		Help:      "HTTP requests currently being served.",
+	})
+)
+
+// observeUpload records a finished upload
+func observeUpload(mode string, start time.Time, response *UploadResponse, err error) {
+	uploadsTotal.WithLabelValues(mode, uploadOutcome(response, err)).Inc()
+	uploadDuration.WithLabelValues(mode).Observe(time.Since(start).Seconds())
+}
+
+func uploadOutcome(response *UploadResponse, err error) string {
+	var storageErr *StorageError
+	switch {
+	case err == nil && response != nil && response.Deduplicated:
+		return uploadOutcomeDeduplicated
+	case err == nil:
+		return uploadOutcomeSuccess
+	case errors.Is(err, errShuttingDown):
+		return uploadOutcomeAborted
+	case errors.Is(err, ErrCanceled), errors.Is(err, context.Canceled):
+		return uploadOutcomeCanceled
+	case errors.Is(err, errMalformedCSV):
+		return uploadOutcomeInvalid
+	case errors.As(err, &storageErr):
+		return uploadOutcomeStorageError
+	}
+	return uploadOutcomeError
+}
+
+// observeSegment records a stored segment
+func observeSegment(mode string, rows, bytes int, duration time.Duration) {
+	ingestedRowsTotal.WithLabelValues(mode).Add(float64(rows))
+	ingestedBytesTotal.WithLabelValues(mode).Add(float64(bytes))
+	segmentUploadDuration.WithLabelValues(mode).Observe(duration.Seconds())
+}
+
+// observeS3Request is an SDK Complete handler. SDK retries are disabled, so
+// each request is a single attempt; retries by RetryPolicy show up as
+// separate requests.
+func observeS3Request(r *request.Request) {
+	operation := r.Operation.Name
+	s3RequestDuration.WithLabelValues(operation).Observe(time.Since(r.AttemptTime).Seconds())
+	if r.Error != nil {
+		s3RequestErrorsTotal.WithLabelValues(operation, storageErrorKind(r.Error)).Inc()
+	}
+}
+
+// storageErrorKind names the kind of a storage error for metric labels
+func storageErrorKind(err error) string {
+	kind := classifyStorageError(err)
+	if kind == nil {
+		return "other"
+	}
+	return strings.ReplaceAll(kind.Error(), " ", "_")
+}
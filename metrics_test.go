@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// sampleCount returns how many observations a histogram has recorded
+func sampleCount(t *testing.T, observer prometheus.Observer) uint64 {
+	t.Helper()
+	var metric dto.Metric
+	if err := observer.(prometheus.Metric).Write(&metric); err != nil {
+		t.Fatal(err)
+	}
+	return metric.GetHistogram().GetSampleCount()
+}
+
+func TestUploadMetrics(t *testing.T) {
+	tests := []struct {
+		name        string
+		mode        string
+		csv         string
+		wantOutcome string
+		wantRows    float64
+	}{
+		{"fine", UploadModeFineGrained, testCSV(30), uploadOutcomeSuccess, 30},
+		{"coarse", UploadModeCoarseGrained, testCSV(30), uploadOutcomeSuccess, 30},
+		{"batch", UploadModeBatch, testCSV(30), uploadOutcomeSuccess, 30},
+		{"stream", UploadModeStream, testCSV(30), uploadOutcomeSuccess, 30},
+		{"malformed csv", UploadModeStream, "id,name\n1,\"open quote\n", uploadOutcomeInvalid, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t, nil)
+			uploads := uploadsTotal.WithLabelValues(tt.mode, tt.wantOutcome)
+			before, rowsBefore := testutil.ToFloat64(uploads), testutil.ToFloat64(ingestedRowsTotal.WithLabelValues(tt.mode))
+			durationsBefore := sampleCount(t, uploadDuration.WithLabelValues(tt.mode))
+
+			ts.do(http.MethodPost, "/cht/v1/file/csv/ch/data.csv?mode="+tt.mode, strings.NewReader(tt.csv))
+
+			if got := testutil.ToFloat64(uploads) - before; got != 1 {
+				t.Errorf("uploads_total{mode=%q,outcome=%q} grew by %v, want 1", tt.mode, tt.wantOutcome, got)
+			}
+			if got := testutil.ToFloat64(ingestedRowsTotal.WithLabelValues(tt.mode)) - rowsBefore; got != tt.wantRows {
+				t.Errorf("ingested_rows_total grew by %v, want %v", got, tt.wantRows)
+			}
+			if got := sampleCount(t, uploadDuration.WithLabelValues(tt.mode)) - durationsBefore; got != 1 {
+				t.Errorf("upload_duration_seconds recorded %d uploads, want 1", got)
+			}
+		})
+	}
+}
+
+func TestQueryMetrics(t *testing.T) {
+	ts := newTestServer(t, nil)
+	response := ts.upload(t, "ch", testCSV(10), "")
+	durationsBefore, rowsBefore := sampleCount(t, queryDuration), sampleCount(t, queryRows)
+
+	ts.query(t, response.Key, "offset=0&limit=5")
+
+	if got := sampleCount(t, queryDuration) - durationsBefore; got != 1 {
+		t.Errorf("query_duration_seconds recorded %d queries, want 1", got)
+	}
+	if got := sampleCount(t, queryRows) - rowsBefore; got != 1 {
+		t.Errorf("query_rows recorded %d queries, want 1", got)
+	}
+}
+
+func TestS3RequestMetrics(t *testing.T) {
+	client, store := newTestS3Client(t)
+	ctx := context.Background()
+	store.put("present", []byte("a,b\n"))
+	store.setFail(func(op, key string) (int, string) {
+		if op == "GetObject" && key == "throttled" {
+			return http.StatusServiceUnavailable, "SlowDown"
+		}
+		return 0, ""
+	})
+	client.RetryPolicy = RetryPolicy{MaxAttempts: 1}
+
+	tests := []struct {
+		name     string
+		key      string
+		wantKind string // "" when the request succeeds
+	}{
+		{"success", "present", ""},
+		{"not found", "missing", "not_found"},
+		{"throttled", "throttled", "throttled"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requestsBefore := sampleCount(t, s3RequestDuration.WithLabelValues("GetObject"))
+			var errorsBefore float64
+			if tt.wantKind != "" {
+				errorsBefore = testutil.ToFloat64(s3RequestErrorsTotal.WithLabelValues("GetObject", tt.wantKind))
+			}
+
+			if content, err := client.GetCSVContent(ctx, tt.key); err == nil {
+				content.Close()
+			}
+
+			if got := sampleCount(t, s3RequestDuration.WithLabelValues("GetObject")) - requestsBefore; got != 1 {
+				t.Errorf("s3_request_duration_seconds recorded %d requests, want 1", got)
+			}
+			if tt.wantKind != "" {
+				if got := testutil.ToFloat64(s3RequestErrorsTotal.WithLabelValues("GetObject", tt.wantKind)) - errorsBefore; got != 1 {
+					t.Errorf("s3_request_errors_total{kind=%q} grew by %v, want 1", tt.wantKind, got)
+				}
+			}
+		})
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	ts := newTestServer(t, nil)
+	ts.upload(t, "ch", testCSV(5), "mode=stream")
+
+	w := ts.do(http.MethodGet, metricsPath, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d", w.Code)
+	}
+	for _, name := range []string{
+		"csv_query_uploads_total", "csv_query_upload_duration_seconds", "csv_query_ingested_rows_total",
+		"csv_query_ingested_bytes_total", "csv_query_segment_upload_duration_seconds", "csv_query_s3_request_duration_seconds",
+		"csv_query_stream_workers_active", "csv_query_http_requests_in_flight",
+	} {
+		if !strings.Contains(w.Body.String(), "\n"+name) {
+			t.Errorf("%s is not exposed", name)
+		}
+	}
+	if got := testutil.ToFloat64(activeStreamWorkers); got != 0 {
+		t.Errorf("stream_workers_active = %v after the upload finished, want 0", got)
+	}
+}
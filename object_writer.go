@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"sort"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ObjectWriter streams one object into storage. Nothing is visible until
+// Commit succeeds. After a failed Write the caller calls Abort; a failed
+// Commit cleans up on its own.
+type ObjectWriter interface {
+	Write(p []byte) (int, error)
+	// Commit stores the object and returns the hex encoded SHA-256 of everything written
+	Commit() (string, error)
+	// Abort discards what was written. It is a no-op once the writer has finished.
+	Abort() error
+}
+
+// ObjectStorage hands out writers that pick the PUT strategy themselves, so
+// callers stream into it without knowing how the object gets stored. The
+// buffers a writer holds are borrowed from budget.
+type ObjectStorage interface {
+	NewObjectWriter(ctx context.Context, key string, budget *memoryBudget) ObjectWriter
+}
+
+var _ ObjectStorage = (*S3Client)(nil)
+
+// Part sizes S3 accepts; only the last part may be smaller than minPartSize
+const (
+	minPartSize = 5 * 1024 * 1024
+	maxPartSize = 5 * 1024 * 1024 * 1024
+)
+
+var errObjectAborted = errors.New("object write aborted")
+
+// NewObjectWriter returns a writer that stores objects up to PartSize with a
+// single PutObject, and larger ones as a multipart upload whose parts are
+// uploaded PartConcurrency at a time, each retried on its own. Every part
+// buffer reserves PartSize in budget while it is held, so a writer holds at
+// most PartConcurrency+1 of them, fewer when the budget is smaller.
+func (c *S3Client) NewObjectWriter(ctx context.Context, key string, budget *memoryBudget) ObjectWriter {
+	return c.newObjectWriter(ctx, key, budget)
+}
+
+func (c *S3Client) newObjectWriter(ctx context.Context, key string, budget *memoryBudget) *s3ObjectWriter {
+	ctx, span := startSpan(ctx, "S3 ObjectWriter", attrKey.String(key))
+	ctx, cancel := context.WithCancelCause(ctx)
+	return &s3ObjectWriter{
+		client: c,
+		ctx:    ctx,
+		cancel: cancel,
+		span:   span,
+		key:    key,
+		hash:   sha256.New(),
+		budget: budget,
+		slots:  make(chan struct{}, c.PartConcurrency),
+	}
+}
+
+type s3ObjectWriter struct {
+	client *S3Client
+	ctx    context.Context
+	cancel context.CancelCauseFunc // stops the other parts once one fails
+	span   trace.Span
+	key    string
+
+	hash   hash.Hash     // of the whole object
+	size   int64         // bytes written
+	part   *bytes.Buffer // bytes not yet handed to a part upload, nil until some are buffered
+	budget *memoryBudget // part buffers are borrowed from it
+
+	uploadID string // set once the object turned out to need a multipart upload
+	parts    int64  // number of parts started
+	slots    chan struct{}
+	running  sync.WaitGroup
+
+	mu        sync.Mutex
+	completed []*s3.CompletedPart
+	err       error // first part failure
+	finished  bool
+}
+
+// Write buffers p into parts. A part is only uploaded once more data follows
+// it, so an object that fits in one part is stored with a single PutObject.
+func (w *s3ObjectWriter) Write(p []byte) (int, error) {
+	if err := w.failure(); err != nil {
+		return 0, err
+	}
+	n := len(p)
+	w.hash.Write(p)
+	w.size += int64(n)
+
+	// Parts cut straight from p must finish before Write returns, since p
+	// belongs to the caller
+	var borrowed sync.WaitGroup
+	partSize := int(w.client.PartSize)
+	for len(p) > 0 && w.failure() == nil {
+		if w.part != nil && w.part.Len() == partSize {
+			full := w.part
+			w.part = nil
+			w.startPart(full.Bytes(), full, nil)
+		}
+		if w.part == nil && len(p) > partSize {
+			w.startPart(p[:partSize], nil, &borrowed)
+			p = p[partSize:]
+			continue
+		}
+		if w.part == nil {
+			if err := w.budget.acquire(w.ctx, w.client.PartSize); err != nil {
+				w.fail(err)
+				break
+			}
+			w.part = getBoundedBuffer(w.client.PartSize)
+		}
+		chunk := min(partSize-w.part.Len(), len(p))
+		growBuffer(w.part, chunk, w.client.PartSize)
+		w.part.Write(p[:chunk])
+		p = p[chunk:]
+	}
+	borrowed.Wait()
+
+	if err := w.failure(); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// writeParts writes data as parts cut straight from it, so nothing is copied
+// into part buffers. data must stay unchanged until Commit returns.
+func (w *s3ObjectWriter) writeParts(data []byte) {
+	w.hash.Write(data)
+	w.size += int64(len(data))
+	for len(data) > 0 && w.failure() == nil {
+		n := min(int64(len(data)), w.client.PartSize)
+		w.startPart(data[:n], nil, nil)
+		data = data[n:]
+	}
+}
+
+// startPart uploads data as the next part in the background. buf, if set, is
+// returned to the pool and the budget afterwards; borrowed, if set, is done
+// when the upload is.
+func (w *s3ObjectWriter) startPart(data []byte, buf *bytes.Buffer, borrowed *sync.WaitGroup) {
+	if w.uploadID == "" {
+		uploadID, err := w.client.createMultipartUpload(w.ctx, w.key)
+		if err != nil {
+			w.releasePart(buf)
+			w.fail(err)
+			return
+		}
+		w.uploadID = uploadID
+	}
+
+	select {
+	case w.slots <- struct{}{}:
+	case <-w.ctx.Done():
+		w.releasePart(buf)
+		w.fail(context.Cause(w.ctx))
+		return
+	}
+	w.parts++
+	number := w.parts
+	w.running.Add(1)
+	if borrowed != nil {
+		borrowed.Add(1)
+	}
+	go func() {
+		defer func() {
+			<-w.slots
+			w.releasePart(buf)
+			if borrowed != nil {
+				borrowed.Done()
+			}
+			w.running.Done()
+		}()
+
+		part, err := w.client.uploadPart(w.ctx, w.key, w.uploadID, number, data)
+		if err != nil {
+			w.fail(err)
+			return
+		}
+		w.mu.Lock()
+		w.completed = append(w.completed, part)
+		w.mu.Unlock()
+	}()
+}
+
+// releasePart returns a part buffer to the pool and its reservation to the budget
+func (w *s3ObjectWriter) releasePart(buf *bytes.Buffer) {
+	if buf == nil {
+		return
+	}
+	putSegmentBuffer(buf)
+	w.budget.release(w.client.PartSize)
+}
+
+func (w *s3ObjectWriter) fail(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err == nil {
+		w.err = err
+		w.cancel(err)
+	}
+}
+
+func (w *s3ObjectWriter) failure() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+func (w *s3ObjectWriter) Commit() (_ string, err error) {
+	if w.finished {
+		return "", fmt.Errorf("object writer for %s already finished", w.key)
+	}
+	defer func() {
+		if err != nil {
+			w.fail(err)
+			w.Abort()
+			return
+		}
+		w.finish(nil)
+	}()
+
+	// Everything fit in one part: no multipart upload was started
+	if w.uploadID == "" && w.failure() == nil {
+		var data []byte
+		if w.part != nil {
+			data = w.part.Bytes()
+		}
+		return w.client.putObject(w.ctx, w.key, data)
+	}
+
+	if w.part != nil && w.part.Len() > 0 && w.failure() == nil {
+		last := w.part
+		w.part = nil
+		w.startPart(last.Bytes(), last, nil)
+	}
+	w.running.Wait()
+	if err := w.failure(); err != nil {
+		return "", err
+	}
+
+	sort.Slice(w.completed, func(i, j int) bool {
+		return aws.Int64Value(w.completed[i].PartNumber) < aws.Int64Value(w.completed[j].PartNumber)
+	})
+	if err := w.client.completeMultipartUpload(w.ctx, w.key, w.uploadID, w.completed); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(w.hash.Sum(nil)), nil
+}
+
+func (w *s3ObjectWriter) Abort() error {
+	if w.finished {
+		return nil
+	}
+	w.fail(errObjectAborted)
+	w.running.Wait()
+
+	var err error
+	if w.uploadID != "" {
+		// The writer's context is canceled by now; cleanup gets its own deadline
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(w.ctx), abortCleanupTimeout)
+		defer cancel()
+		err = w.client.abortMultipartUpload(ctx, w.key, w.uploadID)
+	}
+	w.finish(err)
+	return err
+}
+
+// finish releases the writer's buffer and ends its span
+func (w *s3ObjectWriter) finish(err error) {
+	w.finished = true
+	w.releasePart(w.part)
+	w.part = nil
+	w.span.SetAttributes(attrBytes.Int64(w.size), attrParts.Int64(w.parts))
+	if err == nil {
+		err = w.failure()
+	}
+	endSpan(w.span, &err)
+	w.cancel(nil)
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"net/http"
+	"testing"
+)
+
+func randomBytes(n int) []byte {
+	data := make([]byte, n)
+	rand.Read(data)
+	return data
+}
+
+// writeInChunks writes data to w chunk bytes at a time
+func writeInChunks(w ObjectWriter, data []byte, chunk int) error {
+	for len(data) > 0 {
+		n := min(chunk, len(data))
+		if _, err := w.Write(data[:n]); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+func TestObjectWriterStoresObjects(t *testing.T) {
+	const part = minPartSize
+	tests := []struct {
+		name          string
+		size          int
+		chunk         int
+		budgetParts   int64
+		wantMultipart bool
+	}{
+		{"empty", 0, 1, 3, false},
+		{"small", 1000, 100, 3, false},
+		{"exactly one part", part, 64 * 1024, 3, false},
+		{"one byte over a part", part + 1, 64 * 1024, 3, true},
+		{"several parts in small writes", 5 * part / 2, 64 * 1024, 3, true},
+		{"several parts in one write", 5*part/2 + 7, 5*part/2 + 7, 3, true},
+		{"budget of a single part", 7 * part / 2, 1024 * 1024, 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, store := newTestS3Client(t)
+			budget := newMemoryBudget(tt.budgetParts * part)
+			data := randomBytes(tt.size)
+
+			w := client.NewObjectWriter(context.Background(), "objects/data", budget)
+			if err := writeInChunks(w, data, tt.chunk); err != nil {
+				t.Fatal(err)
+			}
+			checksum, err := w.Commit()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if stored, _ := store.object("objects/data"); !bytes.Equal(stored, data) {
+				t.Errorf("stored %d bytes that differ from the %d written", len(stored), len(data))
+			}
+			if checksum != checksumSHA256(data) {
+				t.Errorf("checksum %s, want %s", checksum, checksumSHA256(data))
+			}
+			if multipart := store.count("CreateMultipartUpload") > 0; multipart != tt.wantMultipart {
+				t.Errorf("multipart upload = %v, want %v", multipart, tt.wantMultipart)
+			}
+			if peak := budget.maxUsed(); peak > tt.budgetParts*part {
+				t.Errorf("part buffers reserved %d bytes, budget %d", peak, tt.budgetParts*part)
+			}
+			if budget.used != 0 {
+				t.Errorf("%d bytes still reserved after Commit", budget.used)
+			}
+		})
+	}
+}
+
+// failOp makes every request of op fail with InternalError, past the retries
+func failOp(op string) func(op, key string) (int, string) {
+	return func(requested, key string) (int, string) {
+		if requested == op {
+			return http.StatusInternalServerError, "InternalError"
+		}
+		return 0, ""
+	}
+}
+
+func TestObjectWriterAbortsFailedUpload(t *testing.T) {
+	const part = minPartSize
+	tests := []struct {
+		name      string
+		size      int
+		failOp    string
+		wantAbort bool
+	}{
+		{"part upload fails", 3 * part, "UploadPart", true},
+		{"completion fails", 3 * part, "CompleteMultipartUpload", true},
+		{"multipart upload cannot start", 3 * part, "CreateMultipartUpload", false},
+		{"single put fails", part / 2, "PutObject", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, store := newTestS3Client(t)
+			store.setFail(failOp(tt.failOp))
+			budget := newMemoryBudget(3 * part)
+
+			w := client.NewObjectWriter(context.Background(), "objects/data", budget)
+			err := writeInChunks(w, randomBytes(tt.size), 1024*1024)
+			if err != nil {
+				w.Abort()
+			} else {
+				_, err = w.Commit()
+			}
+			if err == nil {
+				t.Fatal("upload succeeded while storage fails")
+			}
+
+			if aborted := store.count("AbortMultipartUpload") > 0; aborted != tt.wantAbort {
+				t.Errorf("multipart upload aborted = %v, want %v", aborted, tt.wantAbort)
+			}
+			if open := store.openUploads(); open != 0 {
+				t.Errorf("%d multipart uploads left open", open)
+			}
+			if _, ok := store.object("objects/data"); ok {
+				t.Error("failed upload stored the object")
+			}
+			if budget.used != 0 {
+				t.Errorf("%d bytes still reserved after the failure", budget.used)
+			}
+			// Abort after a failed Commit is a no-op
+			if err := w.Abort(); err != nil {
+				t.Errorf("second Abort: %v", err)
+			}
+		})
+	}
+}
+
+func TestUploadSegment(t *testing.T) {
+	const part = minPartSize
+	tests := []struct {
+		name          string
+		size          int
+		failOp        string
+		wantMultipart bool
+	}{
+		{"single put", part, "", false},
+		{"multipart", 2*part + 1, "", true},
+		{"part upload fails", 2*part + 1, "UploadPart", true},
+		{"completion fails", 2*part + 1, "CompleteMultipartUpload", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, store := newTestS3Client(t)
+			store.setFail(failOp(tt.failOp))
+			data := randomBytes(tt.size)
+
+			checksum, err := client.UploadSegment(context.Background(), "objects/segment", data)
+			if multipart := store.count("CreateMultipartUpload") > 0; multipart != tt.wantMultipart {
+				t.Errorf("multipart upload = %v, want %v", multipart, tt.wantMultipart)
+			}
+			stored, ok := store.object("objects/segment")
+			if tt.failOp != "" {
+				if err == nil {
+					t.Fatal("upload succeeded while storage fails")
+				}
+				if ok || store.openUploads() != 0 || store.count("AbortMultipartUpload") != 1 {
+					t.Errorf("failed upload left the object (%v) or %d open uploads, %d aborts",
+						ok, store.openUploads(), store.count("AbortMultipartUpload"))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(stored, data) || checksum != checksumSHA256(data) {
+				t.Errorf("stored %d bytes with checksum %s, want %d bytes with %s", len(stored), checksum, len(data), checksumSHA256(data))
+			}
+		})
+	}
+}
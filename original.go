@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// originalPrefix serves the original file of an upload, byte for byte
+const originalPrefix = "/admin/cht/v1/file/csv-original/"
+
+// originalWriter streams the request body of an upload into its original
+// object while the body is being segmented
+type originalWriter struct {
+	ObjectWriter
+	key    string
+	size   int64
+	budget *memoryBudget // the writer's part buffers
+}
+
+func newOriginalWriter(ctx context.Context, storage ObjectStorage, basePath string, budget *memoryBudget) *originalWriter {
+	key := originalKey(basePath)
+	return &originalWriter{ObjectWriter: storage.NewObjectWriter(ctx, key, budget), key: key, budget: budget}
+}
+
+// originalPartBudget is the share of an upload's memory budget set aside for
+// the original's part buffers: a part being filled and partConcurrency in
+// flight, but no more than half the budget and at least one part. The share is
+// kept apart from the segments' because the original is written by the
+// goroutine reading the file, which must never wait for segments to be stored.
+func originalPartBudget(budget, partSize int64, partConcurrency int) int64 {
+	parts := min(int64(partConcurrency+1), budget/2/partSize)
+	return max(parts, 1) * partSize
+}
+
+func (w *originalWriter) Write(p []byte) (int, error) {
+	n, err := w.ObjectWriter.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+// Commit stores the original and describes it for the upload's metadata
+func (w *originalWriter) Commit() (*OriginalMetadata, error) {
+	checksum, err := w.ObjectWriter.Commit()
+	if err != nil {
+		return nil, err
+	}
+	return &OriginalMetadata{Key: w.key, Size: w.size, SHA256: checksum}, nil
+}
+
+// HandleOriginal returns the file an upload was made from, exactly as it was
+// received. The bytes cannot be masked, so uploads with PII columns need an
+// unmask token and the read is audited as an unmasked read of every row.
+func (h *QueryHandler) HandleOriginal(w http.ResponseWriter, r *http.Request) {
+	key := strings.Trim(r.PathValue("key"), "/")
+	channelID, _, ok := parseUploadKey(key)
+	auditEventFromContext(r.Context()).describe(AuditActionDownload, channelID, key)
+	if !ok {
+		writeError(w, r, http.StatusBadRequest, ErrCodeInvalidPath, "Invalid key format. Expected: csv_upload/{channelId}/{uploadId}")
+		return
+	}
+	logger := loggerFromContext(r.Context()).With("key", key)
+
+	metadata, err := h.loadMetadata(r.Context(), key)
+	if err != nil {
+		writeStorageError(w, r, "Failed to read upload metadata", err)
+		return
+	}
+	if h.retention.Expired(key, metadata) {
+		expiresAt, _ := h.retention.expiresAt(key, metadata)
+		writeErrorDetails(w, r, http.StatusGone, ErrCodeUploadExpired, fmt.Sprintf("Upload %s has expired", key), map[string]interface{}{"expiresAt": expiresAt})
+		return
+	}
+	// Aliases keep their own original, so they are not resolved here
+	if metadata == nil || metadata.Original == nil {
+		writeError(w, r, http.StatusNotFound, ErrCodeNotFound, fmt.Sprintf("Upload %s has no stored original", key))
+		return
+	}
+
+	if policy := h.masking.policyFor(channelID); policy.Mode != MaskModeOff {
+		if columns := maskColumns(policy, metadata.Header, metadata, nil); len(columns) > 0 {
+			principal, ok := h.masking.unmaskPrincipal(r)
+			if !ok {
+				writeError(w, r, http.StatusForbidden, ErrCodeUnmaskForbidden, "A valid "+unmaskTokenHeader+" is required to download the original file")
+				return
+			}
+			if err := h.auditUnmaskedRead(r, principal, channelID, key, columns, 0, metadata.Rows); err != nil {
+				writeStorageError(w, r, "Failed to record unmasked read", err)
+				return
+			}
+		}
+	}
+
+	content, err := h.s3Client.GetCSVContent(r.Context(), metadata.Original.Key)
+	if err != nil {
+		writeStorageError(w, r, "Failed to read original file", err)
+		return
+	}
+	defer content.Close()
+
+	contentType := "text/csv"
+	if strings.HasSuffix(metadata.FileName, ".tsv") {
+		contentType = "text/tab-separated-values"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": metadata.FileName}))
+	w.Header().Set("Content-Length", strconv.FormatInt(metadata.Original.Size, 10))
+	if digest, err := base64Checksum(metadata.Original.SHA256); err == nil {
+		w.Header().Set("Repr-Digest", "sha-256=:"+digest+":")
+	}
+	w.WriteHeader(http.StatusOK)
+
+	if err := copyVerified(w, content, metadata.Original.SHA256); err != nil {
+		// Headers are already sent; the response ends short of Content-Length
+		logger.Error("Failed to send original file", "error", err)
+		return
+	}
+	logger.Info("Sent original file", "bytes", metadata.Original.Size)
+}
+
+// copyVerified copies content to w while checking it against the expected hex
+// SHA-256. The last chunk is held back until the whole content is verified, so
+// a mismatch never yields a complete looking response.
+func copyVerified(w io.Writer, content io.Reader, checksum string) error {
+	hash := sha256.New()
+	reader := io.TeeReader(content, hash)
+
+	buf, next := make([]byte, 32*1024), make([]byte, 32*1024)
+	n, err := io.ReadFull(reader, buf)
+	for err == nil {
+		var m int
+		m, err = io.ReadFull(reader, next)
+		if _, werr := w.Write(buf[:n]); werr != nil {
+			return werr
+		}
+		buf, next, n = next, buf, m
+	}
+	if err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+
+	if actual := hex.EncodeToString(hash.Sum(nil)); actual != checksum {
+		return fmt.Errorf("expected sha256 %s, got %s", checksum, actual)
+	}
+	_, err = w.Write(buf[:n])
+	return err
+}
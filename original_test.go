@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+func TestOriginalPartBudget(t *testing.T) {
+	const part = 16 * 1024 * 1024
+	tests := []struct {
+		name            string
+		budget          int64
+		partConcurrency int
+		want            int64
+	}{
+		{"room for every part", 256 * 1024 * 1024, 4, 5 * part},
+		{"half the budget", 64 * 1024 * 1024, 4, 2 * part},
+		{"budget below two parts", 24 * 1024 * 1024, 4, part},
+		{"budget below one part", 8 * 1024 * 1024, 4, part},
+		{"one part at a time", 256 * 1024 * 1024, 1, 2 * part},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := originalPartBudget(tt.budget, part, tt.partConcurrency); got != tt.want {
+				t.Errorf("originalPartBudget(%d, %d) = %d, want %d", tt.budget, tt.partConcurrency, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDownloadOriginalRoundTrip(t *testing.T) {
+	ts := newTestServer(t, func(c *Config) {
+		c.Server.UnmaskTokens = "ops=secret"
+		c.Channels["plain"] = ChannelOverrides{MaskMode: MaskModeOff}
+	})
+	// Larger than a part, so the original is stored as a multipart upload
+	large := string(wideRowsCSV(int(ts.s3.PartSize) * 2))
+
+	tests := []struct {
+		name       string
+		channelID  string
+		csv        string
+		query      string
+		token      bool
+		wantStatus int
+	}{
+		{"masked channel with a token", "ch", testCSV(10), "", true, http.StatusOK},
+		{"masked channel without a token", "ch", testCSV(10), "", false, http.StatusForbidden},
+		{"masked channel, no PII columns", "ch", "id,count\n1,2\n", "", false, http.StatusOK},
+		{"channel without masking", "plain", testCSV(10), "", false, http.StatusOK},
+		// csv.Writer would rewrite both the line endings and the quoting
+		{"CRLF and redundant quotes", "ch", "id,name,email\r\n1,\"alice\",a@example.com\r\n2,\"b \"\"q\"\"\",b@example.com\r\n", "", true, http.StatusOK},
+		{"no trailing newline", "plain", "id,name\n1,alice", "", false, http.StatusOK},
+		{"multipart, fine", "ch", large, "mode=fine", true, http.StatusOK},
+		{"multipart, batch", "ch", large, "mode=batch", true, http.StatusOK},
+		{"multipart, stream with gzip", "ch", large, "mode=stream&compression=gzip", true, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response := ts.upload(t, tt.channelID, tt.csv, "keepOriginal=true&"+tt.query)
+			if response.OriginalSHA256 != checksumSHA256([]byte(tt.csv)) {
+				t.Errorf("originalSha256 = %s, want the checksum of the body", response.OriginalSHA256)
+			}
+
+			var header []string
+			if tt.token {
+				header = []string{unmaskTokenHeader, "secret"}
+			}
+			w := ts.do(http.MethodGet, originalPrefix+response.Key, nil, header...)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			if !bytes.Equal(w.Body.Bytes(), []byte(tt.csv)) {
+				t.Errorf("downloaded %d bytes that differ from the %d uploaded", w.Body.Len(), len(tt.csv))
+			}
+			if length := w.Header().Get("Content-Length"); length != strconv.Itoa(len(tt.csv)) {
+				t.Errorf("Content-Length = %s, want %d", length, len(tt.csv))
+			}
+			digest, _ := base64Checksum(checksumSHA256([]byte(tt.csv)))
+			if got := w.Header().Get("Repr-Digest"); got != "sha-256=:"+digest+":" {
+				t.Errorf("Repr-Digest = %s, want the digest of the upload", got)
+			}
+		})
+	}
+	if ts.store.count("CompleteMultipartUpload") == 0 {
+		t.Error("no original was stored as a multipart upload")
+	}
+}
+
+func TestDownloadOriginalStopsOnMismatch(t *testing.T) {
+	ts := newTestServer(t, func(c *Config) {
+		c.Channels["plain"] = ChannelOverrides{MaskMode: MaskModeOff}
+	})
+	tests := []struct {
+		name string
+		csv  string
+	}{
+		{"small", testCSV(10)},
+		{"larger than a copy buffer", testCSV(20000)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response := ts.upload(t, "plain", tt.csv, "keepOriginal=true")
+			// Same length, one byte changed
+			tampered := []byte(tt.csv)
+			tampered[len(tampered)-2] ^= 1
+			ts.store.put(originalKey(response.Key), tampered)
+
+			w := ts.do(http.MethodGet, originalPrefix+response.Key, nil)
+			if w.Header().Get("Content-Length") != strconv.Itoa(len(tt.csv)) {
+				t.Fatalf("Content-Length = %s, want %d", w.Header().Get("Content-Length"), len(tt.csv))
+			}
+			if w.Body.Len() >= len(tt.csv) {
+				t.Errorf("sent all %d bytes of a tampered original", w.Body.Len())
+			}
+			if !bytes.HasPrefix(tampered, w.Body.Bytes()) {
+				t.Error("sent bytes that were not stored")
+			}
+		})
+	}
+}
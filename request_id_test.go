@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+// logLines decodes the JSON lines written to buf
+func logLines(t *testing.T, buf *bytes.Buffer) []map[string]any {
+	t.Helper()
+	var lines []map[string]any
+	decoder := json.NewDecoder(buf)
+	for decoder.More() {
+		var line map[string]any
+		if err := decoder.Decode(&line); err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func TestWithRequestID(t *testing.T) {
+	var buf bytes.Buffer
+	defaultLogger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, nil)))
+	t.Cleanup(func() { slog.SetDefault(defaultLogger) })
+
+	tests := []struct {
+		name   string
+		header string
+	}{
+		{"caller's id is kept", "caller-id"},
+		{"missing id is assigned", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf.Reset()
+			var seen string
+			handler := withRequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				seen, _ = r.Context().Value(requestIDKey).(string)
+				loggerFromContext(r.Context()).Info("handled")
+			}))
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.header != "" {
+				r.Header.Set(requestIDHeader, tt.header)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if seen == "" || (tt.header != "" && seen != tt.header) {
+				t.Errorf("request id %q, want %q", seen, tt.header)
+			}
+			if got := w.Header().Get(requestIDHeader); got != seen {
+				t.Errorf("response header %q, want %q", got, seen)
+			}
+			lines := logLines(t, &buf)
+			if len(lines) != 1 || lines[0]["request_id"] != seen {
+				t.Errorf("log lines %v, want one with request_id %q", lines, seen)
+			}
+		})
+	}
+}
+
+func TestStorageLogsCarryRequestID(t *testing.T) {
+	retryable := awserr.NewRequestFailure(awserr.New("InternalError", "boom", nil), http.StatusInternalServerError, "")
+
+	tests := []struct {
+		name string
+		run  func(ctx context.Context, client *S3Client, store *memoryS3)
+	}{
+		{"retry", func(ctx context.Context, client *S3Client, store *memoryS3) {
+			calls := 0
+			RetryPolicy{MaxAttempts: 2}.Do(ctx, "test", func() error {
+				if calls++; calls == 1 {
+					return retryable
+				}
+				return nil
+			})
+		}},
+		{"batch upload", func(ctx context.Context, client *S3Client, store *memoryS3) {
+			client.BatchUpload(ctx, []S3UploadDTO{{Key: "segment", Content: []byte("a,b\n")}})
+		}},
+		{"upload deletion", func(ctx context.Context, client *S3Client, store *memoryS3) {
+			store.put("csv_upload/ch/upload/0.csv", []byte("a,b\n"))
+			NewRetentionManager(client, RetentionConfig{}).Delete(ctx, "csv_upload/ch/upload")
+		}},
+		{"session chunk cleanup", func(ctx context.Context, client *S3Client, store *memoryS3) {
+			store.setFail(func(op, key string) (int, string) {
+				if op == "DeleteObjects" {
+					return http.StatusForbidden, "AccessDenied"
+				}
+				return 0, ""
+			})
+			NewSessionStore(client).discardChunks(ctx, "session", []string{chunkKey("session", 1)})
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, store := newTestS3Client(t)
+			var buf bytes.Buffer
+			logger := slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})).With("request_id", "req-1")
+			ctx := context.WithValue(context.Background(), loggerKey, logger)
+
+			tt.run(ctx, client, store)
+
+			lines := logLines(t, &buf)
+			if len(lines) == 0 {
+				t.Fatal("nothing was logged")
+			}
+			for _, line := range lines {
+				if line["request_id"] != "req-1" {
+					t.Errorf("%q logged without the request id", line["msg"])
+				}
+			}
+		})
+	}
+}
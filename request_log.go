@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// withRequestLog ends every request with one summary log line. Requests that a
+// handler described for auditing are also written to the audit sink; status,
+// byte counts and duration are filled in here.
+func withRequestLog(sink AuditSink, mux *Router) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		event := &AuditEvent{
+			Time:       time.Now().UTC(),
+			RequestID:  requestIDFromContext(r.Context()),
+			Actor:      r.Header.Get(accountHeader),
+			Method:     r.Method,
+			Path:       r.URL.Path,
+			Query:      r.URL.RawQuery,
+			RemoteAddr: r.RemoteAddr,
+		}
+		_, route := mux.Handler(r)
+		body := &countingBody{ReadCloser: r.Body}
+		r.Body = body
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		ctx := context.WithValue(r.Context(), auditEventKey, event)
+		mux.ServeHTTP(recorder, r.WithContext(ctx))
+
+		event.BytesIn = body.n
+		event.BytesOut = recorder.bytes
+		event.Status = recorder.status
+		event.DurationMs = time.Since(event.Time).Milliseconds()
+
+		logger := loggerFromContext(r.Context())
+		level := slog.LevelInfo
+		if isProbePath(r.URL.Path) {
+			level = slog.LevelDebug
+		}
+		logger.Log(r.Context(), level, "Request completed",
+			"route", route,
+			"method", r.Method,
+			"path", r.URL.Path,
+			"channel", event.ChannelID,
+			"status", event.Status,
+			"bytes_in", event.BytesIn,
+			"bytes_out", event.BytesOut,
+			"rows", event.Rows,
+			"latency_ms", event.DurationMs)
+
+		if event.Action == "" {
+			return
+		}
+		// The event is written even if the client already went away
+		if err := sink.Write(context.WithoutCancel(r.Context()), *event); err != nil {
+			logger.Error("Failed to write audit event", "error", err)
+		}
+	})
+}
+
+// loggerFromContext returns the request's logger, which tags every line with
+// the request ID. Outside a request it returns the default logger.
+func loggerFromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// countingBody counts the request bytes read by the handler
+type countingBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
+
+// statusRecorder captures the status code and response size
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	bytes       int64
+	wroteHeader bool
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status = status
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(p []byte) (int, error) {
+	w.wroteHeader = true
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
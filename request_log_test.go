@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWithRequestLog(t *testing.T) {
+	mux := &Router{ServeMux: http.NewServeMux()}
+	mux.HandleFunc("POST /items/{channelId}", func(w http.ResponseWriter, r *http.Request) {
+		event := auditEventFromContext(r.Context())
+		if r.URL.Query().Get("audit") != "" {
+			event.describe(AuditActionUpload, r.PathValue("channelId"), "items/"+r.PathValue("channelId"))
+		}
+		event.setRows(0, 2)
+		io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("created"))
+	})
+
+	tests := []struct {
+		name        string
+		target      string
+		wantChannel string
+		wantAudited bool
+	}{
+		{"audited request", "/items/ch?audit=1", "ch", true},
+		{"undescribed request", "/items/ch", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := NewFileAuditSink(filepath.Join(t.TempDir(), "audit.jsonl"))
+			var buf bytes.Buffer
+			logger := slog.New(slog.NewJSONHandler(&buf, nil)).With("request_id", "req-1")
+			r := httptest.NewRequest(http.MethodPost, tt.target, strings.NewReader("a,b\n1,2\n"))
+			r = r.WithContext(context.WithValue(context.WithValue(r.Context(), requestIDKey, "req-1"), loggerKey, logger))
+			withRequestLog(sink, mux).ServeHTTP(httptest.NewRecorder(), r)
+
+			lines := logLines(t, &buf)
+			if len(lines) != 1 {
+				t.Fatalf("logged %v, want one summary line", lines)
+			}
+			want := map[string]any{
+				"msg": "Request completed", "request_id": "req-1", "route": "POST /items/{channelId}",
+				"channel": tt.wantChannel, "status": 201.0, "bytes_in": 8.0, "bytes_out": 7.0, "rows": 2.0,
+			}
+			for field, value := range want {
+				if lines[0][field] != value {
+					t.Errorf("%s = %v, want %v", field, lines[0][field], value)
+				}
+			}
+
+			events, err := sink.Query(context.Background(), AuditFilter{From: time.Now().Add(-time.Minute), To: time.Now().Add(time.Minute), Limit: 10})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if audited := len(events) == 1; audited != tt.wantAudited {
+				t.Fatalf("audit events %+v, want audited %v", events, tt.wantAudited)
+			}
+			if tt.wantAudited && (events[0].RequestID != "req-1" || events[0].Status != http.StatusCreated || events[0].BytesIn != 8) {
+				t.Errorf("audit event %+v", events[0])
+			}
+		})
+	}
+}
@@ -0,0 +1,709 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	MAX_CHUNK_SIZE = 16 * 1024 * 1024 // 16MB per resumable chunk
+
+	resumableInitPrefix    = "/cht/v1/file/csv-resumable/"
+	resumableSessionPrefix = "/cht/v1/file/csv-sessions/"
+	sessionRetention       = 24 * time.Hour // idle sessions are discarded after this long
+	sessionSweepInterval   = time.Hour      // how often idle sessions and orphaned chunks are looked for
+	sessionChunkPrefix     = "csv_upload_sessions/"
+
+	SessionStateOpen       = "open"
+	SessionStateCompleting = "completing"
+	SessionStateCompleted  = "completed"
+	SessionStateExpired    = "expired" // discarded by the sweeper
+)
+
+var (
+	errSessionClosed   = errors.New("upload session no longer accepts chunks")
+	errChunkInProgress = errors.New("chunk is already being uploaded")
+	errSessionTooLarge = errors.New("file too large")
+)
+
+// ChunkInfo describes one received chunk of a resumable upload
+type ChunkInfo struct {
+	Number     int       `json:"number"`
+	Size       int64     `json:"size"`
+	SHA256     string    `json:"sha256"` // of the stored chunk (ciphertext, if encrypted)
+	ReceivedAt time.Time `json:"receivedAt"`
+}
+
+// ResumableSessionStatus is the JSON view of a resumable upload session
+type ResumableSessionStatus struct {
+	ID             string          `json:"id"`
+	State          string          `json:"state"`
+	ChannelID      string          `json:"channelId"`
+	FileName       string          `json:"fileName"`
+	Key            string          `json:"key"`
+	TotalChunks    int             `json:"totalChunks,omitempty"`
+	ReceivedChunks []ChunkInfo     `json:"receivedChunks"`
+	MissingChunks  []int           `json:"missingChunks"`
+	ReceivedBytes  int64           `json:"receivedBytes"`
+	JobID          string          `json:"jobId,omitempty"`
+	LastError      string          `json:"lastError,omitempty"`
+	Result         *UploadResponse `json:"result,omitempty"`
+	CreatedAt      time.Time       `json:"createdAt"`
+	UpdatedAt      time.Time       `json:"updatedAt"`
+}
+
+// ResumableSession collects numbered byte chunks until the client completes
+// the upload. The storage path is allocated at initiation, so resuming never
+// changes where the upload ends up.
+type ResumableSession struct {
+	ID string
+
+	cipher *segmentCipher // seals chunks at rest, nil without envelope encryption
+
+	mu          sync.Mutex
+	req         uploadRequest
+	state       string
+	totalChunks int // 0 until the client declares it
+	chunks      map[int]ChunkInfo
+	uploading   map[int]int64 // chunk number -> size, reserved while the chunk is stored
+	jobID       string
+	lastError   string
+	result      *UploadResponse
+	createdAt   time.Time
+	updatedAt   time.Time
+}
+
+func chunkKey(sessionID string, chunkNum int) string {
+	return fmt.Sprintf("%s%s/chunk-%d", sessionChunkPrefix, sessionID, chunkNum)
+}
+
+// reserve claims chunkNum for an upload of size bytes. The size counts against
+// the file size limit until the chunk is recorded or released, so concurrent
+// chunks cannot exceed it together, and a session with reserved chunks is
+// neither completed nor swept.
+func (s *ResumableSession) reserve(chunkNum int, size, maxFileSize int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.state != SessionStateOpen {
+		return errSessionClosed
+	}
+	if _, ok := s.uploading[chunkNum]; ok {
+		return errChunkInProgress
+	}
+	total := s.receivedBytesLocked() - s.chunks[chunkNum].Size + size
+	for _, reserved := range s.uploading {
+		total += reserved
+	}
+	if total > maxFileSize {
+		return errSessionTooLarge
+	}
+	s.uploading[chunkNum] = size
+	s.updatedAt = time.Now()
+	return nil
+}
+
+// record stores the chunk received for a reservation and releases it
+func (s *ResumableSession) record(chunk ChunkInfo) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.uploading, chunk.Number)
+	s.chunks[chunk.Number] = chunk
+	s.updatedAt = chunk.ReceivedAt
+}
+
+// release gives up a reservation whose chunk could not be stored
+func (s *ResumableSession) release(chunkNum int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.uploading, chunkNum)
+}
+
+// missingLocked lists chunk numbers that have not arrived, up to the declared
+// total or the highest chunk received so far
+func (s *ResumableSession) missingLocked(totalChunks int) []int {
+	if totalChunks == 0 {
+		totalChunks = s.inferredTotalLocked()
+	}
+
+	missing := []int{}
+	for i := 0; i < totalChunks; i++ {
+		if _, ok := s.chunks[i]; !ok {
+			missing = append(missing, i)
+		}
+	}
+	return missing
+}
+
+// inferredTotalLocked assumes the highest chunk received so far is the last one
+func (s *ResumableSession) inferredTotalLocked() int {
+	total := 0
+	for number := range s.chunks {
+		if number+1 > total {
+			total = number + 1
+		}
+	}
+	return total
+}
+
+func (s *ResumableSession) receivedBytesLocked() int64 {
+	var total int64
+	for _, chunk := range s.chunks {
+		total += chunk.Size
+	}
+	return total
+}
+
+// Status returns a snapshot of the session
+func (s *ResumableSession) Status() ResumableSessionStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	received := make([]ChunkInfo, 0, len(s.chunks))
+	for _, chunk := range s.chunks {
+		received = append(received, chunk)
+	}
+	sort.Slice(received, func(i, j int) bool {
+		return received[i].Number < received[j].Number
+	})
+
+	return ResumableSessionStatus{
+		ID:             s.ID,
+		State:          s.state,
+		ChannelID:      s.req.channelID,
+		FileName:       s.req.fileName,
+		Key:            s.req.basePath,
+		TotalChunks:    s.totalChunks,
+		ReceivedChunks: received,
+		MissingChunks:  s.missingLocked(s.totalChunks),
+		ReceivedBytes:  s.receivedBytesLocked(),
+		JobID:          s.jobID,
+		LastError:      s.lastError,
+		Result:         s.result,
+		CreatedAt:      s.createdAt,
+		UpdatedAt:      s.updatedAt,
+	}
+}
+
+// finish records the outcome of processing. A failed attempt reopens the
+// session so the client can fix chunks and complete again.
+func (s *ResumableSession) finish(response *UploadResponse, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.updatedAt = time.Now()
+	if err != nil {
+		s.state = SessionStateOpen
+		s.lastError = err.Error()
+		return
+	}
+	s.state = SessionStateCompleted
+	s.lastError = ""
+	s.result = response
+}
+
+// chunkKeysLocked returns chunk keys and checksums in upload order
+func (s *ResumableSession) chunkKeysLocked(totalChunks int) ([]string, []string) {
+	keys := make([]string, 0, totalChunks)
+	checksums := make([]string, 0, totalChunks)
+	for i := 0; i < totalChunks; i++ {
+		keys = append(keys, chunkKey(s.ID, i))
+		checksums = append(checksums, s.chunks[i].SHA256)
+	}
+	return keys, checksums
+}
+
+// chunkKeys returns the keys of every chunk received so far
+func (s *ResumableSession) chunkKeys() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := make([]string, 0, len(s.chunks))
+	for number := range s.chunks {
+		keys = append(keys, chunkKey(s.ID, number))
+	}
+	return keys
+}
+
+// SessionStore keeps resumable upload sessions in memory. Chunks live in the
+// storage backend until the session completes or is swept.
+type SessionStore struct {
+	s3Client *S3Client
+
+	mu       sync.Mutex
+	sessions map[string]*ResumableSession
+}
+
+func NewSessionStore(s3Client *S3Client) *SessionStore {
+	return &SessionStore{s3Client: s3Client, sessions: make(map[string]*ResumableSession)}
+}
+
+// Create registers a new session whose chunks are sealed with chunkCipher
+func (s *SessionStore) Create(req uploadRequest, totalChunks int, chunkCipher *segmentCipher) *ResumableSession {
+	now := time.Now()
+	session := &ResumableSession{
+		ID:          "rs_" + newRequestID(),
+		cipher:      chunkCipher,
+		req:         req,
+		state:       SessionStateOpen,
+		totalChunks: totalChunks,
+		chunks:      make(map[int]ChunkInfo),
+		uploading:   make(map[int]int64),
+		createdAt:   now,
+		updatedAt:   now,
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions[session.ID] = session
+	return session
+}
+
+func (s *SessionStore) Get(id string) (*ResumableSession, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.sessions[id]
+	return session, ok
+}
+
+// StartSweeper periodically discards idle sessions and chunks left behind by
+// sessions this process no longer knows, until ctx is done
+func (s *SessionStore) StartSweeper(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(sessionSweepInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.sweep(ctx, time.Now())
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+func (s *SessionStore) sweep(ctx context.Context, now time.Time) {
+	ctx, span := startSpan(ctx, "session sweep")
+	defer span.End()
+	logger := loggerFromContext(ctx)
+
+	for _, session := range s.evictIdle(now) {
+		keys := session.chunkKeys()
+		logger.Info("Discarding idle upload session", "session_id", session.ID, "chunks", len(keys))
+		// The upload path claimed when the session started is released with its chunks
+		s.discardChunks(ctx, session.ID, append(keys, reservationKey(session.req.basePath)))
+	}
+
+	// Sessions are lost on restart; their chunks are found by age instead
+	objects, err := s.s3Client.ListObjects(ctx, sessionChunkPrefix)
+	if err != nil {
+		logger.Error("Failed to list upload session chunks", "error", err)
+		return
+	}
+	var orphaned []string
+	for _, object := range objects {
+		sessionID, _, _ := strings.Cut(strings.TrimPrefix(object.Key, sessionChunkPrefix), "/")
+		if _, known := s.Get(sessionID); !known && now.Sub(object.LastModified) > sessionRetention {
+			orphaned = append(orphaned, object.Key)
+		}
+	}
+	if len(orphaned) > 0 {
+		logger.Info("Deleting chunks of unknown upload sessions", "chunks", len(orphaned))
+		s.discardChunks(ctx, "", orphaned)
+	}
+}
+
+// evictIdle removes sessions idle for longer than sessionRetention. Sessions
+// that are completing or storing a chunk are never idle.
+func (s *SessionStore) evictIdle(now time.Time) []*ResumableSession {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var expired []*ResumableSession
+	for id, session := range s.sessions {
+		session.mu.Lock()
+		idle := now.Sub(session.updatedAt) > sessionRetention && session.state != SessionStateCompleting && len(session.uploading) == 0
+		if idle {
+			session.state = SessionStateExpired
+			expired = append(expired, session)
+			delete(s.sessions, id)
+		}
+		session.mu.Unlock()
+	}
+	return expired
+}
+
+// discardChunks removes a session's chunk objects (and, for an idle session,
+// its reservation) once they are no longer needed
+func (s *SessionStore) discardChunks(ctx context.Context, sessionID string, keys []string) {
+	if err := s.s3Client.DeleteObjects(ctx, keys); err != nil {
+		loggerFromContext(ctx).Warn("Failed to delete chunks of session", "session_id", sessionID, "error", err)
+	}
+}
+
+// HandleResumableInit starts a resumable upload session
+func (h *UploadHandler) HandleResumableInit(w http.ResponseWriter, r *http.Request) {
+	if h.uploads.Draining() {
+		writeShuttingDown(w, r)
+		return
+	}
+	config, err := h.parseUploadConfig(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, ErrCodeInvalidParameter, err.Error())
+		return
+	}
+	// Chunks are sealed with a data key of their own that is never stored:
+	// sessions do not survive a restart, so no other process reads their chunks
+	chunkCipher, _, err := h.envelope.newUploadCipher()
+	if err != nil {
+		loggerFromContext(r.Context()).Error("Failed to create chunk cipher", "error", err)
+		writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, "Failed to set up chunk encryption")
+		return
+	}
+	req, ok := h.prepareUpload(w, r, config)
+	if !ok {
+		return
+	}
+
+	totalChunks, err := parseTotalChunks(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, ErrCodeInvalidParameter, err.Error())
+		return
+	}
+
+	session := h.sessions.Create(req, totalChunks, chunkCipher)
+	req.logger.Info("Started resumable upload session", "session_id", session.ID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", resumableSessionPrefix+session.ID)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(session.Status())
+}
+
+// HandleResumableStatus reports which chunks have arrived and which are missing
+func (h *UploadHandler) HandleResumableStatus(w http.ResponseWriter, r *http.Request) {
+	session, ok := h.lookupSession(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(session.Status())
+}
+
+// HandleResumableChunk stores one numbered chunk. Re-sending a chunk replaces it.
+func (h *UploadHandler) HandleResumableChunk(w http.ResponseWriter, r *http.Request) {
+	session, ok := h.lookupSession(w, r)
+	if !ok {
+		return
+	}
+
+	chunkNum, err := strconv.Atoi(r.PathValue("chunkNumber"))
+	if err != nil || chunkNum < 0 {
+		writeError(w, r, http.StatusBadRequest, ErrCodeInvalidParameter, "Chunk number must be a non-negative integer")
+		return
+	}
+
+	// Reject early before reading the body; reserve checks the state again
+	session.mu.Lock()
+	state, totalChunks := session.state, session.totalChunks
+	session.mu.Unlock()
+	if state != SessionStateOpen {
+		writeError(w, r, http.StatusConflict, ErrCodeSessionClosed, fmt.Sprintf("Upload session is %s", state))
+		return
+	}
+	if totalChunks > 0 && chunkNum >= totalChunks {
+		writeErrorDetails(w, r, http.StatusBadRequest, ErrCodeInvalidParameter, "Chunk number exceeds declared total", map[string]interface{}{"totalChunks": totalChunks})
+		return
+	}
+
+	data, err := io.ReadAll(io.LimitReader(r.Body, MAX_CHUNK_SIZE+1))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, ErrCodeInvalidParameter, fmt.Sprintf("Failed to read chunk: %v", err))
+		return
+	}
+	if len(data) == 0 {
+		writeError(w, r, http.StatusBadRequest, ErrCodeInvalidParameter, "Chunk is empty")
+		return
+	}
+	if len(data) > MAX_CHUNK_SIZE {
+		writeErrorDetails(w, r, http.StatusRequestEntityTooLarge, ErrCodeFileTooLarge, "Chunk too large", map[string]interface{}{"maxBytes": MAX_CHUNK_SIZE})
+		return
+	}
+
+	maxFileSize := h.config.uploadFor(session.req.channelID).MaxFileSize
+	switch err := session.reserve(chunkNum, int64(len(data)), maxFileSize); {
+	case errors.Is(err, errSessionClosed):
+		writeError(w, r, http.StatusConflict, ErrCodeSessionClosed, fmt.Sprintf("Upload session is %s", session.Status().State))
+		return
+	case errors.Is(err, errChunkInProgress):
+		writeError(w, r, http.StatusConflict, ErrCodeConflict, fmt.Sprintf("Chunk %d is already being uploaded", chunkNum))
+		return
+	case errors.Is(err, errSessionTooLarge):
+		writeErrorDetails(w, r, http.StatusRequestEntityTooLarge, ErrCodeFileTooLarge, "File too large", map[string]interface{}{"maxBytes": maxFileSize})
+		return
+	}
+
+	key := chunkKey(session.ID, chunkNum)
+	sealed, err := session.cipher.Seal(key, data)
+	if err != nil {
+		session.release(chunkNum)
+		writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, fmt.Sprintf("Failed to encrypt chunk %d", chunkNum))
+		return
+	}
+	checksum, err := h.s3Client.UploadSegment(r.Context(), key, sealed)
+	if err != nil {
+		session.release(chunkNum)
+		writeStorageError(w, r, fmt.Sprintf("Failed to store chunk %d", chunkNum), err)
+		return
+	}
+	session.record(ChunkInfo{
+		Number:     chunkNum,
+		Size:       int64(len(data)),
+		SHA256:     checksum,
+		ReceivedAt: time.Now(),
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(session.Status())
+}
+
+// HandleResumableComplete reassembles the chunks in order and feeds them through
+// the regular segmenting pipeline. Rows split across chunk boundaries are handled
+// because the CSV reader sees the chunks as one continuous stream.
+func (h *UploadHandler) HandleResumableComplete(w http.ResponseWriter, r *http.Request) {
+	session, ok := h.lookupSession(w, r)
+	if !ok {
+		return
+	}
+	// The storage key is fixed when the session starts
+	auditEventFromContext(r.Context()).describe(AuditActionUpload, session.req.channelID, session.req.basePath)
+
+	totalChunks, err := parseTotalChunks(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, ErrCodeInvalidParameter, err.Error())
+		return
+	}
+	async, err := parseAsync(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, ErrCodeInvalidParameter, err.Error())
+		return
+	}
+
+	release, ok := h.uploads.Begin()
+	if !ok {
+		writeShuttingDown(w, r)
+		return
+	}
+	// Async completions release the tracker when their job finishes
+	background := false
+	defer func() {
+		if !background {
+			release()
+		}
+	}()
+
+	session.mu.Lock()
+	switch session.state {
+	case SessionStateCompleted:
+		// Completing twice is harmless: hand back the original result
+		result := session.result
+		session.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(result)
+		return
+	case SessionStateCompleting:
+		session.mu.Unlock()
+		writeError(w, r, http.StatusConflict, ErrCodeSessionClosed, "Upload session is already being completed")
+		return
+	}
+
+	if len(session.uploading) > 0 {
+		uploading := make([]int, 0, len(session.uploading))
+		for number := range session.uploading {
+			uploading = append(uploading, number)
+		}
+		sort.Ints(uploading)
+		session.mu.Unlock()
+		writeErrorDetails(w, r, http.StatusConflict, ErrCodeUploadIncomplete, "Chunks are still being uploaded", map[string]interface{}{"uploadingChunks": uploading})
+		return
+	}
+	if totalChunks == 0 {
+		totalChunks = session.totalChunks
+	}
+	if totalChunks == 0 {
+		totalChunks = session.inferredTotalLocked()
+	}
+	if missing := session.missingLocked(totalChunks); len(missing) > 0 || totalChunks == 0 {
+		session.mu.Unlock()
+		writeErrorDetails(w, r, http.StatusConflict, ErrCodeUploadIncomplete, "Upload is missing chunks", map[string]interface{}{"missingChunks": missing})
+		return
+	}
+	if len(session.chunks) > totalChunks {
+		session.mu.Unlock()
+		writeErrorDetails(w, r, http.StatusConflict, ErrCodeUploadIncomplete, "More chunks were received than declared", map[string]interface{}{"receivedChunks": len(session.chunks)})
+		return
+	}
+
+	keys, checksums := session.chunkKeysLocked(totalChunks)
+	retried := session.lastError != ""
+	req := session.req
+	req.size = session.receivedBytesLocked()
+	req.logger = loggerFromContext(r.Context()).With("channel", req.channelID, "key", req.basePath, "session_id", session.ID)
+	req.ctx = r.Context()
+	session.state = SessionStateCompleting
+	session.totalChunks = totalChunks
+	session.updatedAt = time.Now()
+	session.mu.Unlock()
+
+	// Async completions read the chunks after the response is sent
+	chunks := &chunkSequenceReader{ctx: context.WithoutCancel(r.Context()), s3Client: h.s3Client, cipher: session.cipher, keys: keys, checksums: checksums}
+	req.body = chunks
+	done := func(response *UploadResponse, err error) {
+		chunks.Close()
+		session.finish(response, err)
+		if err == nil {
+			h.sessions.discardChunks(context.WithoutCancel(r.Context()), session.ID, keys)
+		}
+	}
+
+	// A failed attempt deleted the upload's reservation along with its segments
+	if retried {
+		if err := h.s3Client.ReserveUploadKey(r.Context(), req.basePath); err != nil && !errors.Is(err, ErrConflict) {
+			done(nil, err)
+			writeStorageError(w, r, "Failed to reserve upload path", err)
+			return
+		}
+	}
+
+	if async {
+		background = true
+		h.runUploadJob(w, req, func(response *UploadResponse, err error) {
+			done(response, err)
+			release()
+		})
+		session.mu.Lock()
+		session.jobID = req.job.ID
+		session.mu.Unlock()
+		return
+	}
+
+	response, err := h.processUpload(req)
+	done(response, err)
+	if err != nil {
+		writeUploadError(w, r, err)
+		return
+	}
+	auditEventFromContext(r.Context()).setRows(0, response.Rows)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(response)
+}
+
+func (h *UploadHandler) lookupSession(w http.ResponseWriter, r *http.Request) (*ResumableSession, bool) {
+	sessionID := r.PathValue("sessionId")
+	if sessionID == "" {
+		writeError(w, r, http.StatusBadRequest, ErrCodeMissingParameter, "Session ID is required")
+		return nil, false
+	}
+
+	session, ok := h.sessions.Get(sessionID)
+	if !ok {
+		writeError(w, r, http.StatusNotFound, ErrCodeNotFound, "Upload session not found")
+		return nil, false
+	}
+	return session, true
+}
+
+// parseTotalChunks reads the optional totalChunks query parameter
+func parseTotalChunks(r *http.Request) (int, error) {
+	totalStr := r.URL.Query().Get("totalChunks")
+	if totalStr == "" {
+		return 0, nil
+	}
+	total, err := strconv.Atoi(totalStr)
+	if err != nil || total <= 0 {
+		return 0, fmt.Errorf("Invalid totalChunks parameter. Must be a positive integer")
+	}
+	return total, nil
+}
+
+// chunkSequenceReader reads stored chunks one after another as a single stream,
+// verifying each chunk's checksum (and decrypting it) as it is opened
+type chunkSequenceReader struct {
+	ctx       context.Context
+	s3Client  *S3Client
+	cipher    *segmentCipher
+	keys      []string
+	checksums []string
+	current   io.ReadCloser
+}
+
+func (c *chunkSequenceReader) Read(p []byte) (int, error) {
+	for {
+		if c.current == nil {
+			if len(c.keys) == 0 {
+				return 0, io.EOF
+			}
+			content, err := c.openChunk(c.keys[0], c.checksums[0])
+			if err != nil {
+				return 0, err
+			}
+			c.current = content
+			c.keys, c.checksums = c.keys[1:], c.checksums[1:]
+		}
+
+		n, err := c.current.Read(p)
+		if err == io.EOF {
+			c.current.Close()
+			c.current = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+// openChunk returns the bytes of a chunk as they were received
+func (c *chunkSequenceReader) openChunk(key, checksum string) (io.ReadCloser, error) {
+	content, err := c.s3Client.GetVerifiedCSVContent(c.ctx, key, checksum)
+	if err != nil || c.cipher == nil {
+		return content, err
+	}
+	defer content.Close()
+
+	sealed, err := io.ReadAll(content)
+	if err != nil {
+		return nil, newStorageError("GetObject", key, err)
+	}
+	data, err := c.cipher.Open(key, sealed)
+	if err != nil {
+		return nil, &StorageError{Op: "Decrypt", Key: key, Kind: ErrChecksumMismatch, Err: err}
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (c *chunkSequenceReader) Close() error {
+	if c.current == nil {
+		return nil
+	}
+	err := c.current.Close()
+	c.current = nil
+	return err
+}
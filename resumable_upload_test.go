@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startSession starts a resumable upload on the test server and returns its ID
+func startSession(t *testing.T, server *testServer, query string) string {
+	t.Helper()
+	w := server.do(http.MethodPost, "/cht/v1/file/csv-resumable/1/data.csv"+query, nil)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("start session: %d: %s", w.Code, w.Body)
+	}
+	var status ResumableSessionStatus
+	decodeJSON(t, w, &status)
+	return status.ID
+}
+
+func putChunk(server *testServer, sessionID string, n int, data string) int {
+	return server.do(http.MethodPut, fmt.Sprintf("%s%s/chunks/%d", resumableSessionPrefix, sessionID, n), strings.NewReader(data)).Code
+}
+
+func TestResumableUpload(t *testing.T) {
+	server := newTestServer(t, nil)
+	csv := testCSV(100)
+	sessionID := startSession(t, server, "")
+
+	// Chunks split rows and arrive out of order
+	chunks := []string{csv[:1000], csv[1000:2001], csv[2001:]}
+	for _, n := range []int{2, 0, 1} {
+		if code := putChunk(server, sessionID, n, chunks[n]); code != http.StatusOK {
+			t.Fatalf("chunk %d: status %d", n, code)
+		}
+	}
+	if keys := server.store.keys(sessionChunkPrefix + sessionID); len(keys) != 3 {
+		t.Fatalf("stored chunks = %v, want 3", keys)
+	}
+
+	w := server.do(http.MethodPost, resumableSessionPrefix+sessionID+"/complete", nil)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("complete: %d: %s", w.Code, w.Body)
+	}
+	var response UploadResponse
+	decodeJSON(t, w, &response)
+	if response.Rows != 100 || response.Size != int64(len(csv)) {
+		t.Errorf("rows = %d, size = %d, want 100 rows of %d bytes", response.Rows, response.Size, len(csv))
+	}
+	if keys := server.store.keys(sessionChunkPrefix + sessionID); len(keys) != 0 {
+		t.Errorf("chunks left after completion: %v", keys)
+	}
+
+	// Completing again hands back the same result; chunks are no longer accepted
+	w = server.do(http.MethodPost, resumableSessionPrefix+sessionID+"/complete", nil)
+	var again UploadResponse
+	decodeJSON(t, w, &again)
+	if w.Code != http.StatusCreated || again.Key != response.Key {
+		t.Errorf("second complete: %d %s, want 201 %s", w.Code, again.Key, response.Key)
+	}
+	if code := putChunk(server, sessionID, 0, "x"); code != http.StatusConflict {
+		t.Errorf("chunk after completion: status %d, want 409", code)
+	}
+}
+
+func TestResumableSessionReserve(t *testing.T) {
+	const maxFileSize = 100
+	tests := []struct {
+		name     string
+		state    string
+		chunks   map[int]int64 // received chunk sizes
+		pending  map[int]int64 // reserved chunk sizes
+		chunk    int
+		size     int64
+		wantErr  error
+		wantSize int64 // bytes counted after a successful reservation
+	}{
+		{"first chunk", SessionStateOpen, nil, nil, 0, 40, nil, 40},
+		{"fills the limit", SessionStateOpen, map[int]int64{0: 60}, nil, 1, 40, nil, 100},
+		{"over the limit", SessionStateOpen, map[int]int64{0: 70}, nil, 1, 40, errSessionTooLarge, 0},
+		{"reserved bytes count", SessionStateOpen, nil, map[int]int64{0: 70}, 1, 40, errSessionTooLarge, 0},
+		{"replacing a chunk", SessionStateOpen, map[int]int64{0: 70}, nil, 0, 90, nil, 90},
+		{"chunk in progress", SessionStateOpen, nil, map[int]int64{0: 10}, 0, 10, errChunkInProgress, 0},
+		{"completing", SessionStateCompleting, nil, nil, 0, 10, errSessionClosed, 0},
+		{"expired", SessionStateExpired, nil, nil, 0, 10, errSessionClosed, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session := NewSessionStore(nil).Create(uploadRequest{}, 0, nil)
+			session.state = tt.state
+			for n, size := range tt.chunks {
+				session.chunks[n] = ChunkInfo{Number: n, Size: size}
+			}
+			for n, size := range tt.pending {
+				session.uploading[n] = size
+			}
+
+			err := session.reserve(tt.chunk, tt.size, maxFileSize)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("reserve() = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			session.record(ChunkInfo{Number: tt.chunk, Size: tt.size})
+			if got := session.Status().ReceivedBytes; got != tt.wantSize || len(session.uploading) != 0 {
+				t.Errorf("received = %d with %d reserved, want %d and none", got, len(session.uploading), tt.wantSize)
+			}
+		})
+	}
+}
+
+func TestResumableConcurrentChunksRespectMaxFileSize(t *testing.T) {
+	server := newTestServer(t, func(c *Config) { c.Upload.MaxFileSize = 100 })
+	sessionID := startSession(t, server, "")
+
+	var wg sync.WaitGroup
+	for n := 0; n < 10; n++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			putChunk(server, sessionID, n, strings.Repeat("x", 30))
+		}(n)
+	}
+	wg.Wait()
+
+	session, _ := server.uploads.sessions.Get(sessionID)
+	status := session.Status()
+	if status.ReceivedBytes > 100 || len(status.ReceivedChunks) != 3 {
+		t.Errorf("received %d bytes in %d chunks, want 90 in 3", status.ReceivedBytes, len(status.ReceivedChunks))
+	}
+}
+
+func TestResumableCompleteWaitsForReservedChunks(t *testing.T) {
+	server := newTestServer(t, nil)
+	sessionID := startSession(t, server, "")
+	if code := putChunk(server, sessionID, 0, testCSV(5)); code != http.StatusOK {
+		t.Fatalf("chunk 0: status %d", code)
+	}
+	session, _ := server.uploads.sessions.Get(sessionID)
+	if err := session.reserve(1, 10, 1<<20); err != nil {
+		t.Fatal(err)
+	}
+
+	w := server.do(http.MethodPost, resumableSessionPrefix+sessionID+"/complete", nil)
+	var response ErrorResponse
+	decodeJSON(t, w, &response)
+	if w.Code != http.StatusConflict || response.Code != ErrCodeUploadIncomplete {
+		t.Fatalf("complete: %d %s, want 409 %s", w.Code, response.Code, ErrCodeUploadIncomplete)
+	}
+	if code := putChunk(server, sessionID, 1, "x"); code != http.StatusConflict {
+		t.Errorf("chunk 1 while reserved: status %d, want 409", code)
+	}
+	if session.Status().State != SessionStateOpen {
+		t.Errorf("state = %s, want open", session.Status().State)
+	}
+}
+
+func TestSessionStoreSweep(t *testing.T) {
+	s3Client, store := newTestS3Client(t)
+	sessions := NewSessionStore(s3Client)
+	now := time.Now()
+
+	create := func(name string) *ResumableSession {
+		session := sessions.Create(uploadRequest{basePath: "csv_upload/1/" + name}, 0, nil)
+		store.put(reservationKey(session.req.basePath), nil)
+		return session
+	}
+
+	idle := create("idle")
+	idle.chunks[0] = ChunkInfo{Number: 0}
+	idle.updatedAt = now.Add(-2 * sessionRetention)
+	store.put(chunkKey(idle.ID, 0), []byte("idle"))
+
+	busy := create("busy")
+	busy.uploading[0] = 4
+	busy.updatedAt = now.Add(-2 * sessionRetention)
+
+	active := create("active")
+	active.chunks[0] = ChunkInfo{Number: 0}
+	store.put(chunkKey(active.ID, 0), []byte("active"))
+
+	// Chunks of sessions lost in a restart
+	store.put(chunkKey("rs_lost", 0), []byte("old"))
+	store.modified[chunkKey("rs_lost", 0)] = now.Add(-2 * sessionRetention)
+	store.put(chunkKey("rs_recent", 0), []byte("new"))
+
+	sessions.sweep(context.Background(), now)
+
+	for _, tt := range []struct {
+		session *ResumableSession
+		kept    bool
+	}{{idle, false}, {busy, true}, {active, true}} {
+		if _, ok := sessions.Get(tt.session.ID); ok != tt.kept {
+			t.Errorf("session %s kept = %t, want %t", tt.session.ID, ok, tt.kept)
+		}
+		if _, ok := store.object(reservationKey(tt.session.req.basePath)); ok != tt.kept {
+			t.Errorf("reservation of %s kept = %t, want %t", tt.session.req.basePath, ok, tt.kept)
+		}
+	}
+	if idle.Status().State != SessionStateExpired {
+		t.Errorf("idle session state = %s, want expired", idle.Status().State)
+	}
+	want := []string{chunkKey(active.ID, 0), chunkKey("rs_recent", 0)}
+	if got := store.keys(sessionChunkPrefix); strings.Join(got, ",") != strings.Join(sortedCopy(want), ",") {
+		t.Errorf("chunks after sweep = %v, want %v", got, want)
+	}
+}
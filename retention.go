@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// RetentionConfig controls how long uploads are kept. It is built from the
+// retention and channels sections of Config.
+type RetentionConfig struct {
+	DefaultTTL    time.Duration            // 0 keeps uploads forever
+	ChannelTTLs   map[string]time.Duration // channelId -> TTL, overrides DefaultTTL
+	SweepInterval time.Duration            // how often expired uploads are deleted; 0 disables sweeping
+}
+
+func (c RetentionConfig) ttlFor(channelID string) time.Duration {
+	if ttl, ok := c.ChannelTTLs[channelID]; ok {
+		return ttl
+	}
+	return c.DefaultTTL
+}
+
+// RetentionManager decides when uploads expire and deletes them
+type RetentionManager struct {
+	s3Client *S3Client
+	config   RetentionConfig
+}
+
+func NewRetentionManager(s3Client *S3Client, config RetentionConfig) *RetentionManager {
+	return &RetentionManager{s3Client: s3Client, config: config}
+}
+
+// newExpiry returns the expiry to record for an upload created now, or nil if
+// the channel keeps uploads forever
+func (m *RetentionManager) newExpiry(channelID string, createdAt time.Time) *time.Time {
+	ttl := m.config.ttlFor(channelID)
+	if ttl <= 0 {
+		return nil
+	}
+	expiresAt := createdAt.Add(ttl)
+	return &expiresAt
+}
+
+// expiresAt returns when the upload at key expires. The expiry recorded in
+// metadata wins; uploads without one (older uploads, or ones whose metadata is
+// already gone) fall back to their creation time plus the channel's TTL.
+func (m *RetentionManager) expiresAt(key string, metadata *UploadMetadata) (time.Time, bool) {
+	if metadata != nil && metadata.ExpiresAt != nil {
+		return *metadata.ExpiresAt, true
+	}
+
+	channelID, uploadID, ok := parseUploadKey(key)
+	if !ok {
+		return time.Time{}, false
+	}
+	ttl := m.config.ttlFor(channelID)
+	if ttl <= 0 {
+		return time.Time{}, false
+	}
+
+	createdAt, ok := uploadIDTime(uploadID)
+	if metadata != nil {
+		createdAt, ok = metadata.CreatedAt, true
+	}
+	if !ok {
+		return time.Time{}, false
+	}
+	return createdAt.Add(ttl), true
+}
+
+// Expired reports whether the upload at key is past its expiry
+func (m *RetentionManager) Expired(key string, metadata *UploadMetadata) bool {
+	expiresAt, ok := m.expiresAt(key, metadata)
+	return ok && time.Now().After(expiresAt)
+}
+
+// extend pushes an upload's expiry out to until, so deduplicated uploads that
+// point at it are not left dangling when the original expires
+func (m *RetentionManager) extend(ctx context.Context, metadata *UploadMetadata, until *time.Time) error {
+	current, ok := m.expiresAt(metadata.Key, metadata)
+	if !ok {
+		return nil // never expires
+	}
+	if until != nil && !until.After(current) {
+		return nil
+	}
+
+	metadata.ExpiresAt = until
+	if err := m.s3Client.PutJSON(ctx, metadataKey(metadata.Key), metadata); err != nil {
+		return fmt.Errorf("failed to extend retention of %s: %w", metadata.Key, err)
+	}
+	return nil
+}
+
+// Delete removes every object stored under an upload key and returns how many
+// were deleted. metadata.json goes last, so a partial failure leaves the upload
+// visible to the next sweep.
+func (m *RetentionManager) Delete(ctx context.Context, key string) (int, error) {
+	logger := loggerFromContext(ctx)
+
+	objects, err := m.s3Client.ListObjects(ctx, key+"/")
+	if err != nil {
+		return 0, err
+	}
+	if len(objects) == 0 {
+		return 0, &StorageError{Op: "DeleteUpload", Key: key, Kind: ErrNotFound, Err: errors.New("no objects under key")}
+	}
+
+	var metadata *UploadMetadata
+	loaded := &UploadMetadata{}
+	if err := m.s3Client.GetJSON(ctx, metadataKey(key), loaded); err == nil {
+		metadata = loaded
+	} else if !errors.Is(err, ErrNotFound) {
+		return 0, err
+	}
+
+	var data, markers []string
+	for _, object := range objects {
+		if object.Key == metadataKey(key) || object.Key == reservationKey(key) {
+			markers = append(markers, object.Key)
+		} else {
+			data = append(data, object.Key)
+		}
+	}
+	if err := m.s3Client.DeleteObjects(ctx, data); err != nil {
+		return 0, err
+	}
+	if err := m.s3Client.DeleteObjects(ctx, markers); err != nil {
+		return len(data), err
+	}
+
+	// Drop the content index entry so deduplication does not have to discover
+	// the deletion itself
+	if metadata != nil && metadata.ContentSHA256 != "" && metadata.AliasOf == "" {
+		indexKey := contentIndexKey(metadata.ChannelID, metadata.ContentSHA256)
+		var entry ContentIndexEntry
+		if err := m.s3Client.GetJSON(ctx, indexKey, &entry); err == nil && entry.Key == key {
+			if err := m.s3Client.DeleteObjects(ctx, []string{indexKey}); err != nil {
+				logger.Warn("Failed to delete content index entry", "key", key, "error", err)
+			}
+		}
+	}
+
+	logger.Info("Deleted upload", "key", key, "objects", len(objects))
+	return len(objects), nil
+}
+
+// StartSweeper periodically deletes expired uploads until ctx is done
+func (m *RetentionManager) StartSweeper(ctx context.Context) {
+	if m.config.SweepInterval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(m.config.SweepInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				m.sweep(ctx)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+func (m *RetentionManager) sweep(ctx context.Context) {
+	ctx, span := startSpan(ctx, "retention sweep")
+	defer span.End()
+	logger := loggerFromContext(ctx)
+
+	channels, err := m.s3Client.ListPrefixes(ctx, "csv_upload/")
+	if err != nil {
+		logger.Error("Failed to list channels for retention sweep", "error", err)
+		return
+	}
+
+	deleted := 0
+	for _, channel := range channels {
+		uploads, err := m.s3Client.ListPrefixes(ctx, channel)
+		if err != nil {
+			logger.Error("Failed to list uploads", "prefix", channel, "error", err)
+			continue
+		}
+		for _, upload := range uploads {
+			key := strings.TrimSuffix(upload, "/")
+
+			var metadata *UploadMetadata
+			loaded := &UploadMetadata{}
+			if err := m.s3Client.GetJSON(ctx, metadataKey(key), loaded); err == nil {
+				metadata = loaded
+			} else if !errors.Is(err, ErrNotFound) {
+				logger.Error("Failed to read metadata", "key", key, "error", err)
+				continue
+			}
+
+			if !m.Expired(key, metadata) {
+				continue
+			}
+			if _, err := m.Delete(ctx, key); err != nil {
+				logger.Error("Failed to delete expired upload", "key", key, "error", err)
+				continue
+			}
+			deleted++
+		}
+	}
+	if deleted > 0 {
+		logger.Info("Retention sweep deleted expired uploads", "uploads", deleted)
+	}
+}
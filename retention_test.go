@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRetentionExpiry(t *testing.T) {
+	s3Client, _ := newTestS3Client(t)
+	manager := NewRetentionManager(s3Client, RetentionConfig{
+		DefaultTTL:  24 * time.Hour,
+		ChannelTTLs: map[string]time.Duration{"short": time.Hour},
+	})
+	now := time.Now()
+	idAt := func(at time.Time) string { return (&uploadIDGenerator{}).next(at) }
+	recorded := now.Add(time.Minute)
+
+	tests := []struct {
+		name        string
+		key         string
+		metadata    *UploadMetadata
+		wantExpired bool
+		wantNever   bool
+	}{
+		{"fresh upload", "csv_upload/ch/" + idAt(now.Add(-time.Hour)), nil, false, false},
+		{"past the default ttl", "csv_upload/ch/" + idAt(now.Add(-25*time.Hour)), nil, true, false},
+		{"past the channel ttl", "csv_upload/short/" + idAt(now.Add(-2*time.Hour)), nil, true, false},
+		{"legacy key", "csv_upload/ch/" + now.Add(-48*time.Hour).Format(legacyUploadIDLayout), nil, true, false},
+		{"recorded expiry wins", "csv_upload/short/" + idAt(now.Add(-2*time.Hour)), &UploadMetadata{ExpiresAt: &recorded}, false, false},
+		{"metadata creation time", "csv_upload/ch/" + idAt(now), &UploadMetadata{CreatedAt: now.Add(-25 * time.Hour)}, true, false},
+		{"unknown key format", "csv_upload/ch/upload", nil, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := manager.Expired(tt.key, tt.metadata); got != tt.wantExpired {
+				t.Errorf("Expired = %v, want %v", got, tt.wantExpired)
+			}
+			if _, ok := manager.expiresAt(tt.key, tt.metadata); ok == tt.wantNever {
+				t.Errorf("expiresAt known = %v, want %v", ok, !tt.wantNever)
+			}
+		})
+	}
+}
+
+func TestRetentionNewExpiry(t *testing.T) {
+	s3Client, _ := newTestS3Client(t)
+	config := DefaultConfig
+	config.Retention.TTL = 0
+	config.Channels = map[string]ChannelOverrides{"short": {TTL: Duration(time.Hour)}}
+	manager := NewRetentionManager(s3Client, config.retentionConfig())
+
+	createdAt := time.Date(2024, 3, 21, 10, 0, 0, 0, time.UTC)
+	if expiry := manager.newExpiry("kept", createdAt); expiry != nil {
+		t.Errorf("newExpiry with ttl 0 = %v, want nil", expiry)
+	}
+	if expiry := manager.newExpiry("short", createdAt); expiry == nil || !expiry.Equal(createdAt.Add(time.Hour)) {
+		t.Errorf("newExpiry = %v, want %v", expiry, createdAt.Add(time.Hour))
+	}
+}
+
+func TestRetentionSweepUsesChannelTTLs(t *testing.T) {
+	ts := newTestServer(t, func(c *Config) {
+		c.Retention.TTL = Duration(24 * time.Hour)
+		c.Channels["short"] = ChannelOverrides{TTL: Duration(time.Hour)}
+	})
+	twoHoursAgo := time.Now().Add(-2 * time.Hour)
+	keys := seedUploads(ts, "short", []time.Time{twoHoursAgo}, time.Time{})
+	kept := seedUploads(ts, "long", []time.Time{twoHoursAgo}, time.Time{})
+
+	NewRetentionManager(ts.s3, ts.config.retentionConfig()).sweep(context.Background())
+
+	if _, ok := ts.store.object(reservationKey(keys[0])); ok {
+		t.Errorf("%s outlived its channel ttl", keys[0])
+	}
+	if _, ok := ts.store.object(reservationKey(kept[0])); !ok {
+		t.Errorf("%s was deleted before the default ttl", kept[0])
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// RetryPolicy controls how storage operations are retried on transient errors
+type RetryPolicy struct {
+	MaxAttempts int           // total attempts including the first one
+	BaseDelay   time.Duration // delay before the first retry
+	MaxDelay    time.Duration // upper bound for a single backoff delay
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 4,
+	BaseDelay:   200 * time.Millisecond,
+	MaxDelay:    5 * time.Second,
+}
+
+// backoff returns a jittered delay for the given retry attempt (1-based).
+// Full jitter: a random duration between 0 and min(MaxDelay, BaseDelay*2^(attempt-1)).
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	delay := p.BaseDelay << (attempt - 1)
+	if delay <= 0 || delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(delay) + 1))
+}
+
+// Do runs fn until it succeeds, returns a non-retryable error or runs out of
+// attempts. Backoff stops as soon as ctx is done, returning the last error
+// together with the context's cause.
+func (p RetryPolicy) Do(ctx context.Context, operation string, fn func() error) error {
+	attempts := p.MaxAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		err = fn()
+		if err == nil || !isRetryableStorageError(err) || attempt == attempts {
+			return err
+		}
+
+		delay := p.backoff(attempt)
+		loggerFromContext(ctx).Warn("Storage request failed, retrying", "operation", operation, "attempt", attempt, "attempts", attempts, "delay_ms", delay.Milliseconds(), "error", err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("%w (retry abandoned: %w)", err, context.Cause(ctx))
+		}
+	}
+	return err
+}
+
+// isRetryableStorageError reports whether an SDK error is worth retrying
+// (throttling, timeouts, 5xx responses and connection failures)
+func isRetryableStorageError(err error) bool {
+	if request.IsErrorRetryable(err) || request.IsErrorThrottle(err) {
+		return true
+	}
+	if reqErr, ok := err.(awserr.RequestFailure); ok {
+		return reqErr.StatusCode() >= 500 || reqErr.StatusCode() == 429
+	}
+	return false
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := RetryPolicy{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+	tests := []struct {
+		attempt int
+		max     time.Duration
+	}{
+		{1, 100 * time.Millisecond},
+		{2, 200 * time.Millisecond},
+		{4, 800 * time.Millisecond},
+		{5, time.Second},
+		{40, time.Second}, // shift overflow falls back to MaxDelay
+	}
+	for _, tt := range tests {
+		for i := 0; i < 100; i++ {
+			if delay := policy.backoff(tt.attempt); delay < 0 || delay > tt.max {
+				t.Fatalf("backoff(%d) = %v, want within [0, %v]", tt.attempt, delay, tt.max)
+			}
+		}
+	}
+}
+
+func TestRetryPolicyDo(t *testing.T) {
+	retryable := awserr.NewRequestFailure(awserr.New("InternalError", "boom", nil), http.StatusInternalServerError, "")
+	permanent := awserr.NewRequestFailure(awserr.New("AccessDenied", "no", nil), http.StatusForbidden, "")
+	throttled := awserr.NewRequestFailure(awserr.New("SlowDown", "slow", nil), http.StatusServiceUnavailable, "")
+
+	tests := []struct {
+		name      string
+		errs      []error // returned by successive attempts; nil succeeds
+		wantCalls int
+		wantErr   error
+	}{
+		{"success", []error{nil}, 1, nil},
+		{"retry then success", []error{retryable, nil}, 2, nil},
+		{"throttled then success", []error{throttled, throttled, nil}, 3, nil},
+		{"permanent error", []error{permanent, nil}, 1, permanent},
+		{"attempts exhausted", []error{retryable, retryable, retryable, nil}, 3, retryable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			err := RetryPolicy{MaxAttempts: 3}.Do(context.Background(), "test", func() error {
+				calls++
+				return tt.errs[calls-1]
+			})
+			if calls != tt.wantCalls {
+				t.Errorf("calls = %d, want %d", calls, tt.wantCalls)
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("err = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyDoStopsOnCancel(t *testing.T) {
+	retryable := awserr.NewRequestFailure(awserr.New("InternalError", "boom", nil), http.StatusInternalServerError, "")
+	ctx, cancel := context.WithCancel(context.Background())
+	policy := RetryPolicy{MaxAttempts: 5, BaseDelay: time.Hour, MaxDelay: time.Hour}
+
+	calls := 0
+	done := make(chan error, 1)
+	go func() {
+		done <- policy.Do(ctx, "test", func() error {
+			calls++
+			return retryable
+		})
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) || !errors.Is(err, retryable) {
+			t.Errorf("err = %v, want the last error and context.Canceled", err)
+		}
+		if calls != 1 {
+			t.Errorf("calls = %d, want 1", calls)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Do kept backing off after the context was canceled")
+	}
+}
+
+func TestBatchUploadRetriesPerObject(t *testing.T) {
+	client, store := newTestS3Client(t)
+	failed := false
+	store.fail = func(op, key string) (int, string) {
+		if op == "PutObject" && key == "batch/b" && !failed {
+			failed = true
+			return http.StatusInternalServerError, "InternalError"
+		}
+		return 0, ""
+	}
+
+	targets := []S3UploadDTO{
+		{Key: "batch/a", Content: []byte("a"), Checksum: checksumSHA256([]byte("a"))},
+		{Key: "batch/b", Content: []byte("b"), Checksum: checksumSHA256([]byte("b"))},
+		{Key: "batch/c", Content: []byte("c"), Checksum: checksumSHA256([]byte("c"))},
+	}
+	if err := client.BatchUpload(context.Background(), targets); err != nil {
+		t.Fatal(err)
+	}
+	// a and c once, b twice: the failure did not upload a again
+	if got := store.count("PutObject"); got != 4 {
+		t.Errorf("PutObject requests = %d, want 4", got)
+	}
+	for _, target := range targets {
+		if data, _ := store.object(target.Key); string(data) != string(target.Content) {
+			t.Errorf("%s = %q, want %q", target.Key, data, target.Content)
+		}
+	}
+}
+
+func TestGetVerifiedCSVContent(t *testing.T) {
+	client, store := newTestS3Client(t)
+	store.put("segment", []byte("a,b\n1,2\n"))
+
+	tests := []struct {
+		name     string
+		checksum string
+		wantKind error
+	}{
+		{"matching checksum", checksumSHA256([]byte("a,b\n1,2\n")), nil},
+		{"no checksum", "", nil},
+		{"mismatch", checksumSHA256([]byte("other")), ErrChecksumMismatch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content, err := client.GetVerifiedCSVContent(context.Background(), "segment", tt.checksum)
+			if !errors.Is(err, tt.wantKind) {
+				t.Fatalf("err = %v, want %v", err, tt.wantKind)
+			}
+			if err == nil {
+				content.Close()
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Router is a ServeMux whose own 404 and 405 responses use the JSON error body
+// of every other endpoint
+type Router struct {
+	*http.ServeMux
+}
+
+// newRouter registers every endpoint. Path parameters are read by the
+// handlers with r.PathValue; a path that matches a route with a different
+// method gets 405 with an Allow header.
+func newRouter(cfg *Config, uploads *UploadHandler, queries *QueryHandler, audit *AuditHandler, health *HealthHandler) *Router {
+	mux := http.NewServeMux()
+
+	// Uploads: mode, segmentSize and workers are query parameters
+	mux.HandleFunc("POST /cht/v1/file/csv/{channelId}/{fileName}", uploads.HandleUpload)
+	mux.HandleFunc("GET "+jobStatusPrefix+"{jobId}", uploads.HandleJobStatus)
+
+	// Resumable uploads: initiate, PUT numbered chunks, complete
+	mux.HandleFunc("POST "+resumableInitPrefix+"{channelId}/{fileName}", uploads.HandleResumableInit)
+	mux.HandleFunc("GET "+resumableSessionPrefix+"{sessionId}", uploads.HandleResumableStatus)
+	mux.HandleFunc("PUT "+resumableSessionPrefix+"{sessionId}/chunks/{chunkNumber}", uploads.HandleResumableChunk)
+	mux.HandleFunc("POST "+resumableSessionPrefix+"{sessionId}/complete", uploads.HandleResumableComplete)
+
+	// Admin: query, delete and list uploads, audit log, effective configuration
+	mux.HandleFunc("GET /admin/cht/v1/file/csv-upload/{key...}", queries.HandleQuery)
+	mux.HandleFunc("DELETE /admin/cht/v1/file/csv-upload/{key...}", queries.HandleDelete)
+	mux.HandleFunc("GET "+originalPrefix+"{key...}", queries.HandleOriginal)
+	mux.HandleFunc("GET "+listPrefix+"{channelId}", queries.HandleList)
+	mux.HandleFunc("GET "+auditEventsPath, audit.HandleAuditQuery)
+	mux.HandleFunc("GET "+configPath, cfg.HandleConfig)
+
+	// Operations
+	mux.Handle("GET "+metricsPath, promhttp.Handler())
+	mux.HandleFunc("GET "+healthzPath, health.HandleHealthz)
+	mux.HandleFunc("GET "+readyzPath, health.HandleReadyz)
+
+	return &Router{ServeMux: mux}
+}
+
+func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	handler, pattern := rt.Handler(r)
+	if pattern != "" {
+		rt.ServeMux.ServeHTTP(w, r)
+		return
+	}
+
+	// No route matched: let the mux decide between 404 and 405, then answer in JSON
+	recorder := &routeErrorRecorder{header: http.Header{}}
+	handler.ServeHTTP(recorder, r)
+	if recorder.status == http.StatusMethodNotAllowed {
+		allow := recorder.header.Get("Allow")
+		w.Header().Set("Allow", allow)
+		writeErrorDetails(w, r, http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed,
+			fmt.Sprintf("Method %s is not allowed on %s", r.Method, r.URL.Path),
+			map[string]interface{}{"allow": strings.Split(allow, ", ")})
+		return
+	}
+	writeError(w, r, http.StatusNotFound, ErrCodeNotFound, fmt.Sprintf("No route for %s %s", r.Method, r.URL.Path))
+}
+
+// routeErrorRecorder captures the status and headers of the mux's built-in
+// error handlers and discards their plain text body
+type routeErrorRecorder struct {
+	header http.Header
+	status int
+}
+
+func (r *routeErrorRecorder) Header() http.Header         { return r.header }
+func (r *routeErrorRecorder) Write(b []byte) (int, error) { return len(b), nil }
+func (r *routeErrorRecorder) WriteHeader(status int)      { r.status = status }
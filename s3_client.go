@@ -2,41 +2,62 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
-	"log"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 )
 
-const (
-	bucketName = "bin.exp.channel.io"
-	awsProfile = "ch-dev"
-	awsRegion  = "ap-northeast-2"
-)
-
 type S3Client struct {
 	client   *s3.S3
 	uploader *s3manager.Uploader
+
+	// Bucket holds every object the service stores
+	Bucket string
+
+	// RetryPolicy is applied to every S3 request; SDK-level retries are disabled
+	RetryPolicy RetryPolicy
+	// Encryption is sent with every PUT
+	Encryption ServerSideEncryption
+
+	// Objects larger than PartSize are stored as multipart uploads with up to
+	// PartConcurrency parts in flight
+	PartSize        int64
+	PartConcurrency int
+}
+
+// S3Object is a listing entry
+type S3Object struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
 }
 
 type S3UploadDTO struct {
-	Key     string
-	Content []byte
+	Key      string
+	Content  []byte
+	Checksum string // hex encoded SHA-256 of Content
 }
 
-func NewS3Client() (*S3Client, error) {
+func NewS3Client(config StorageConfig) (*S3Client, error) {
 	// Load shared config and credentials
 	cfg := aws.NewConfig().
-		WithRegion(awsRegion).
-		WithCredentialsChainVerboseErrors(true)
+		WithRegion(config.Region).
+		WithCredentialsChainVerboseErrors(true).
+		WithMaxRetries(0) // retries are handled by RetryPolicy
 
 	// Create session with shared config enabled
 	sess, err := session.NewSessionWithOptions(session.Options{
-		Profile:           awsProfile,
+		Profile:           config.Profile,
 		Config:            *cfg,
 		SharedConfigState: session.SharedConfigEnable,
 	})
@@ -45,70 +66,463 @@ func NewS3Client() (*S3Client, error) {
 	}
 
 	client := s3.New(sess)
+	client.Handlers.Complete.PushBack(observeS3Request)
 	uploader := s3manager.NewUploaderWithClient(client)
 
 	return &S3Client{
-		client:   client,
-		uploader: uploader,
+		client:      client,
+		uploader:    uploader,
+		Bucket:      config.Bucket,
+		RetryPolicy: config.Retry.policy(),
+		Encryption:  DefaultServerSideEncryption,
+
+		PartSize:        config.PartSize,
+		PartConcurrency: config.PartConcurrency,
 	}, nil
 }
 
-func (c *S3Client) GetCSVContent(key string) (io.ReadCloser, error) {
-	output, err := c.client.GetObject(&s3.GetObjectInput{
-		Bucket: aws.String(bucketName),
-		Key:    aws.String(key),
+func (c *S3Client) GetCSVContent(ctx context.Context, key string) (_ io.ReadCloser, err error) {
+	ctx, span := startSpan(ctx, "S3 GetObject", attrKey.String(key))
+	defer endSpan(span, &err)
+
+	var output *s3.GetObjectOutput
+	err = c.RetryPolicy.Do(ctx, "GetObject "+key, func() error {
+		var err error
+		output, err = c.client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(c.Bucket),
+			Key:    aws.String(key),
+		})
+		return err
 	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to get object: %v", err)
+		return nil, newStorageError("GetObject", key, err)
 	}
+	span.SetAttributes(attrBytes.Int64(aws.Int64Value(output.ContentLength)))
 
 	return output.Body, nil
 }
 
-// UploadSegment uploads a segment of CSV data to S3
-func (c *S3Client) UploadSegment(key string, data []byte) error {
-	_, err := c.client.PutObject(&s3.PutObjectInput{
-		Bucket: aws.String(bucketName),
-		Key:    aws.String(key),
-		Body:   bytes.NewReader(data),
+// GetVerifiedCSVContent downloads the whole object and checks it against the
+// expected hex SHA-256 before handing it out. An empty checksum skips the check.
+func (c *S3Client) GetVerifiedCSVContent(ctx context.Context, key, checksum string) (io.ReadCloser, error) {
+	content, err := c.GetCSVContent(ctx, key)
+	if err != nil || checksum == "" {
+		return content, err
+	}
+	defer content.Close()
+
+	data, err := io.ReadAll(content)
+	if err != nil {
+		return nil, newStorageError("GetObject", key, err)
+	}
+	if actual := checksumSHA256(data); actual != checksum {
+		return nil, &StorageError{
+			Op:   "VerifyChecksum",
+			Key:  key,
+			Kind: ErrChecksumMismatch,
+			Err:  fmt.Errorf("expected sha256 %s, got %s", checksum, actual),
+		}
+	}
+
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+// UploadSegment uploads a segment of CSV data to S3 with a SHA-256 checksum
+// that S3 verifies on receipt: with one PutObject up to PartSize, as a
+// multipart upload above it. It returns the hex encoded checksum.
+func (c *S3Client) UploadSegment(ctx context.Context, key string, data []byte) (string, error) {
+	if int64(len(data)) <= c.PartSize {
+		// Small enough for one request
+		return c.putObject(ctx, key, data)
+	}
+	// Parts are cut straight from data, so no part buffers are borrowed
+	writer := c.newObjectWriter(ctx, key, nil)
+	writer.writeParts(data)
+	return writer.Commit()
+}
+
+// putObject stores data with a single PutObject
+func (c *S3Client) putObject(ctx context.Context, key string, data []byte) (_ string, err error) {
+	ctx, span := startSpan(ctx, "S3 PutObject", attrKey.String(key), attrBytes.Int(len(data)))
+	defer endSpan(span, &err)
+
+	checksum := checksumSHA256(data)
+	encoded, err := base64Checksum(checksum)
+	if err != nil {
+		return "", err
+	}
+
+	err = c.RetryPolicy.Do(ctx, "PutObject "+key, func() error {
+		input := &s3.PutObjectInput{
+			Bucket:         aws.String(c.Bucket),
+			Key:            aws.String(key),
+			Body:           bytes.NewReader(data),
+			ChecksumSHA256: aws.String(encoded),
+		}
+		input.ServerSideEncryption, input.SSEKMSKeyId = c.Encryption.parameters()
+		_, err := c.client.PutObjectWithContext(ctx, input)
+		return err
+	})
+	if err != nil {
+		return "", newStorageError("PutObject", key, err)
+	}
+	return checksum, nil
+}
+
+// createMultipartUpload starts a multipart upload whose parts carry SHA-256 checksums
+func (c *S3Client) createMultipartUpload(ctx context.Context, key string) (_ string, err error) {
+	ctx, span := startSpan(ctx, "S3 CreateMultipartUpload", attrKey.String(key))
+	defer endSpan(span, &err)
+
+	var output *s3.CreateMultipartUploadOutput
+	err = c.RetryPolicy.Do(ctx, "CreateMultipartUpload "+key, func() error {
+		input := &s3.CreateMultipartUploadInput{
+			Bucket:            aws.String(c.Bucket),
+			Key:               aws.String(key),
+			ChecksumAlgorithm: aws.String(s3.ChecksumAlgorithmSha256),
+		}
+		input.ServerSideEncryption, input.SSEKMSKeyId = c.Encryption.parameters()
+		var err error
+		output, err = c.client.CreateMultipartUploadWithContext(ctx, input)
+		return err
 	})
 	if err != nil {
-		return fmt.Errorf("failed to upload segment: %v", err)
+		return "", newStorageError("CreateMultipartUpload", key, err)
+	}
+	return aws.StringValue(output.UploadId), nil
+}
+
+// uploadPart stores one part, retried on its own, and returns what
+// CompleteMultipartUpload needs to know about it
+func (c *S3Client) uploadPart(ctx context.Context, key, uploadID string, number int64, data []byte) (_ *s3.CompletedPart, err error) {
+	ctx, span := startSpan(ctx, "S3 UploadPart", attrKey.String(key), attrPart.Int64(number), attrBytes.Int(len(data)))
+	defer endSpan(span, &err)
+
+	encoded, err := base64Checksum(checksumSHA256(data))
+	if err != nil {
+		return nil, err
+	}
+
+	var output *s3.UploadPartOutput
+	err = c.RetryPolicy.Do(ctx, fmt.Sprintf("UploadPart %s #%d", key, number), func() error {
+		var err error
+		output, err = c.client.UploadPartWithContext(ctx, &s3.UploadPartInput{
+			Bucket:         aws.String(c.Bucket),
+			Key:            aws.String(key),
+			UploadId:       aws.String(uploadID),
+			PartNumber:     aws.Int64(number),
+			Body:           bytes.NewReader(data),
+			ChecksumSHA256: aws.String(encoded),
+		})
+		return err
+	})
+	if err != nil {
+		return nil, newStorageError("UploadPart", key, err)
+	}
+	return &s3.CompletedPart{
+		ETag:           output.ETag,
+		PartNumber:     aws.Int64(number),
+		ChecksumSHA256: aws.String(encoded),
+	}, nil
+}
+
+// completeMultipartUpload assembles the uploaded parts, in part number order, into the object
+func (c *S3Client) completeMultipartUpload(ctx context.Context, key, uploadID string, parts []*s3.CompletedPart) (err error) {
+	ctx, span := startSpan(ctx, "S3 CompleteMultipartUpload", attrKey.String(key), attrParts.Int(len(parts)))
+	defer endSpan(span, &err)
+
+	err = c.RetryPolicy.Do(ctx, "CompleteMultipartUpload "+key, func() error {
+		_, err := c.client.CompleteMultipartUploadWithContext(ctx, &s3.CompleteMultipartUploadInput{
+			Bucket:          aws.String(c.Bucket),
+			Key:             aws.String(key),
+			UploadId:        aws.String(uploadID),
+			MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+		})
+		return err
+	})
+	if err != nil {
+		return newStorageError("CompleteMultipartUpload", key, err)
 	}
 	return nil
 }
 
-func (c *S3Client) BatchUpload(targets []S3UploadDTO) error {
-	log.Printf("Initializing batch upload for %d files...", len(targets))
-	objects := make([]s3manager.BatchUploadObject, len(targets))
+// abortMultipartUpload discards the parts of an unfinished multipart upload
+func (c *S3Client) abortMultipartUpload(ctx context.Context, key, uploadID string) (err error) {
+	ctx, span := startSpan(ctx, "S3 AbortMultipartUpload", attrKey.String(key))
+	defer endSpan(span, &err)
 
+	err = c.RetryPolicy.Do(ctx, "AbortMultipartUpload "+key, func() error {
+		_, err := c.client.AbortMultipartUploadWithContext(ctx, &s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(c.Bucket),
+			Key:      aws.String(key),
+			UploadId: aws.String(uploadID),
+		})
+		return err
+	})
+	if err != nil {
+		return newStorageError("AbortMultipartUpload", key, err)
+	}
+	return nil
+}
+
+// BatchUpload stores the targets one after another through the uploader,
+// which switches to a multipart upload for large objects. Every object is
+// retried on its own, so a failure never uploads the stored ones again.
+func (c *S3Client) BatchUpload(ctx context.Context, targets []S3UploadDTO) (err error) {
 	totalSize := int64(0)
-	for i, target := range targets {
+	for _, target := range targets {
 		totalSize += int64(len(target.Content))
+	}
+	ctx, span := startSpan(ctx, "S3 BatchUpload", attrSegments.Int(len(targets)), attrBytes.Int64(totalSize))
+	defer endSpan(span, &err)
+	logger := loggerFromContext(ctx)
+
+	logger.Debug("Starting batch upload", "objects", len(targets), "bytes", totalSize)
+	for i, target := range targets {
 		input := &s3manager.UploadInput{
-			Bucket: aws.String(bucketName),
+			Bucket: aws.String(c.Bucket),
 			Key:    aws.String(target.Key),
-			Body:   bytes.NewReader(target.Content),
 		}
-		objects[i] = s3manager.BatchUploadObject{
-			Object: input,
-			After: func() error {
-				log.Printf("Successfully uploaded segment %d/%d", i+1, len(targets))
-				return nil
-			},
+		if target.Checksum != "" {
+			encoded, err := base64Checksum(target.Checksum)
+			if err != nil {
+				return err
+			}
+			input.ChecksumSHA256 = aws.String(encoded)
+		}
+		input.ServerSideEncryption, input.SSEKMSKeyId = c.Encryption.parameters()
+
+		err = c.RetryPolicy.Do(ctx, "Upload "+target.Key, func() error {
+			input.Body = bytes.NewReader(target.Content)
+			_, err := c.uploader.UploadWithContext(ctx, input)
+			return err
+		})
+		if err != nil {
+			return newStorageError("BatchUpload", target.Key, err)
 		}
+		logger.Debug("Uploaded batch object", "key", target.Key, "index", i+1, "objects", len(targets))
 	}
+	return nil
+}
+
+// PutJSON stores v as a JSON object under key
+func (c *S3Client) PutJSON(ctx context.Context, key string, v interface{}) (err error) {
+	ctx, span := startSpan(ctx, "S3 PutObject", attrKey.String(key))
+	defer endSpan(span, &err)
 
-	log.Printf("Starting batch upload (total size: %.2f MB)...", float64(totalSize)/1024/1024)
-	iter := &s3manager.UploadObjectsIterator{Objects: objects}
-	if err := c.uploader.UploadWithIterator(aws.BackgroundContext(), iter); err != nil {
-		return fmt.Errorf("batch upload failed: %v", err)
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s: %v", key, err)
+	}
+	span.SetAttributes(attrBytes.Int(len(data)))
+
+	err = c.RetryPolicy.Do(ctx, "PutObject "+key, func() error {
+		input := &s3.PutObjectInput{
+			Bucket:      aws.String(c.Bucket),
+			Key:         aws.String(key),
+			Body:        bytes.NewReader(data),
+			ContentType: aws.String("application/json"),
+		}
+		input.ServerSideEncryption, input.SSEKMSKeyId = c.Encryption.parameters()
+		_, err := c.client.PutObjectWithContext(ctx, input)
+		return err
+	})
+	if err != nil {
+		return newStorageError("PutObject", key, err)
+	}
+	return nil
+}
+
+// GetJSON reads the JSON object under key into v
+func (c *S3Client) GetJSON(ctx context.Context, key string, v interface{}) error {
+	content, err := c.GetCSVContent(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	if err := json.NewDecoder(content).Decode(v); err != nil {
+		return fmt.Errorf("failed to decode %s: %w", key, err)
+	}
+	return nil
+}
+
+// HeadBucket checks that the bucket is reachable with the configured
+// credentials. It is not retried: readiness probes call it repeatedly anyway.
+func (c *S3Client) HeadBucket(ctx context.Context) (err error) {
+	ctx, span := startSpan(ctx, "S3 HeadBucket")
+	defer endSpan(span, &err)
+
+	_, err = c.client.HeadBucketWithContext(ctx, &s3.HeadBucketInput{Bucket: aws.String(c.Bucket)})
+	return newStorageError("HeadBucket", c.Bucket, err)
+}
+
+// DeleteObjects removes the given keys, 1000 keys per request
+func (c *S3Client) DeleteObjects(ctx context.Context, keys []string) (err error) {
+	if len(keys) == 0 {
+		return nil
+	}
+	ctx, span := startSpan(ctx, "S3 DeleteObjects", attrKey.String(keys[0]), attrObjects.Int(len(keys)))
+	defer endSpan(span, &err)
+
+	for start := 0; start < len(keys); start += 1000 {
+		end := start + 1000
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		objects := make([]*s3.ObjectIdentifier, 0, end-start)
+		for _, key := range keys[start:end] {
+			objects = append(objects, &s3.ObjectIdentifier{Key: aws.String(key)})
+		}
+
+		var output *s3.DeleteObjectsOutput
+		err = c.RetryPolicy.Do(ctx, "DeleteObjects", func() error {
+			var err error
+			output, err = c.client.DeleteObjectsWithContext(ctx, &s3.DeleteObjectsInput{
+				Bucket: aws.String(c.Bucket),
+				Delete: &s3.Delete{Objects: objects, Quiet: aws.Bool(true)},
+			})
+			return err
+		})
+		if err != nil {
+			return newStorageError("DeleteObjects", keys[start], err)
+		}
+		if len(output.Errors) > 0 {
+			failed := output.Errors[0]
+			return newStorageError("DeleteObjects", aws.StringValue(failed.Key),
+				awserr.New(aws.StringValue(failed.Code), aws.StringValue(failed.Message), nil))
+		}
 	}
+	return nil
+}
 
-	log.Printf("Batch upload completed successfully")
+// ReserveUploadKey claims basePath for a new upload. The reservation object is
+// written with If-None-Match: *, so S3 rejects it if another upload already
+// claimed the same path; that case is reported as ErrConflict.
+//
+// A retried PUT that S3 rejects this way found the reservation written by an
+// earlier attempt whose response was lost, so it counts as claimed: upload IDs
+// are unique, and nothing else writes to a fresh path in the meantime.
+func (c *S3Client) ReserveUploadKey(ctx context.Context, basePath string) (err error) {
+	key := reservationKey(basePath)
+	ctx, span := startSpan(ctx, "S3 PutObject", attrKey.String(key))
+	defer endSpan(span, &err)
+	body := []byte(time.Now().UTC().Format(time.RFC3339Nano))
+
+	attempt := 0
+	err = c.RetryPolicy.Do(ctx, "PutObject "+key, func() error {
+		attempt++
+		input := &s3.PutObjectInput{
+			Bucket: aws.String(c.Bucket),
+			Key:    aws.String(key),
+			Body:   bytes.NewReader(body),
+		}
+		input.ServerSideEncryption, input.SSEKMSKeyId = c.Encryption.parameters()
+		req, _ := c.client.PutObjectRequest(input)
+		req.SetContext(ctx)
+		req.HTTPRequest.Header.Set("If-None-Match", "*")
+		err := req.Send()
+		if err != nil && attempt > 1 && classifyStorageError(err) == ErrConflict {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return newStorageError("PutObject", key, err)
+	}
 	return nil
 }
 
+// ListObjects returns every object under prefix
+func (c *S3Client) ListObjects(ctx context.Context, prefix string) (_ []S3Object, err error) {
+	ctx, span := startSpan(ctx, "S3 ListObjectsV2", attrKey.String(prefix))
+	defer endSpan(span, &err)
+
+	var objects []S3Object
+	var token *string
+	for {
+		var output *s3.ListObjectsV2Output
+		err = c.RetryPolicy.Do(ctx, "ListObjectsV2 "+prefix, func() error {
+			var err error
+			output, err = c.client.ListObjectsV2WithContext(ctx, &s3.ListObjectsV2Input{
+				Bucket:            aws.String(c.Bucket),
+				Prefix:            aws.String(prefix),
+				ContinuationToken: token,
+			})
+			return err
+		})
+		if err != nil {
+			return nil, newStorageError("ListObjectsV2", prefix, err)
+		}
+
+		for _, object := range output.Contents {
+			objects = append(objects, S3Object{
+				Key:          aws.StringValue(object.Key),
+				Size:         aws.Int64Value(object.Size),
+				LastModified: aws.TimeValue(object.LastModified),
+			})
+		}
+		if !aws.BoolValue(output.IsTruncated) {
+			span.SetAttributes(attrObjects.Int(len(objects)))
+			return objects, nil
+		}
+		token = output.NextContinuationToken
+	}
+}
+
+// ListPrefixes returns the "directories" directly under prefix, i.e. the
+// common prefixes of a delimiter listing, each ending in "/"
+func (c *S3Client) ListPrefixes(ctx context.Context, prefix string) ([]string, error) {
+	var prefixes []string
+	err := c.ListPrefixesAfter(ctx, prefix, "", func(common string) bool {
+		prefixes = append(prefixes, common)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return prefixes, nil
+}
+
+// ListPrefixesAfter calls visit with the "directories" directly under prefix
+// that sort after startAfter, in key order, until visit returns false or the
+// listing ends. Pages are only fetched while visit asks for more.
+func (c *S3Client) ListPrefixesAfter(ctx context.Context, prefix, startAfter string, visit func(common string) bool) (err error) {
+	ctx, span := startSpan(ctx, "S3 ListObjectsV2", attrKey.String(prefix))
+	defer endSpan(span, &err)
+
+	input := &s3.ListObjectsV2Input{
+		Bucket:    aws.String(c.Bucket),
+		Prefix:    aws.String(prefix),
+		Delimiter: aws.String("/"),
+	}
+	if startAfter != "" {
+		input.StartAfter = aws.String(startAfter)
+	}
+	for {
+		var output *s3.ListObjectsV2Output
+		err = c.RetryPolicy.Do(ctx, "ListObjectsV2 "+prefix, func() error {
+			var err error
+			output, err = c.client.ListObjectsV2WithContext(ctx, input)
+			return err
+		})
+		if err != nil {
+			return newStorageError("ListObjectsV2", prefix, err)
+		}
+
+		for _, common := range output.CommonPrefixes {
+			if !visit(aws.StringValue(common.Prefix)) {
+				return nil
+			}
+		}
+		if !aws.BoolValue(output.IsTruncated) {
+			return nil
+		}
+		input.ContinuationToken = output.NextContinuationToken
+	}
+}
+
 // ValidateUploadKey checks if the upload path is valid
 func (c *S3Client) ValidateUploadKey(key string) error {
 	if key == "" {
@@ -116,3 +530,12 @@ func (c *S3Client) ValidateUploadKey(key string) error {
 	}
 	return nil
 }
+
+// base64Checksum converts a hex checksum into the base64 form S3 expects
+func base64Checksum(checksum string) (string, error) {
+	raw, err := hex.DecodeString(checksum)
+	if err != nil {
+		return "", fmt.Errorf("invalid checksum %q: %v", checksum, err)
+	}
+	return base64.StdEncoding.EncodeToString(raw), nil
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// memoryS3 is an in-process S3 endpoint for tests. It keeps objects in memory,
+// understands the requests S3Client sends (including conditional PUTs,
+// multipart uploads, batch deletes and ListObjectsV2 paging) and can be told
+// to fail chosen operations.
+type memoryS3 struct {
+	mu        sync.Mutex
+	objects   map[string][]byte
+	modified  map[string]time.Time
+	multipart map[string]map[int][]byte // upload ID -> part number -> data
+	nextID    int
+	calls     map[string]int    // operation -> requests received
+	sse       map[string]string // key -> server-side encryption requested when it was written
+	maxKeys   int               // page size of listings, 1000 if zero
+
+	// fail, if set, is asked before every request and returns a status and S3
+	// error code to answer with instead, or 0 to serve the request
+	fail func(op, key string) (int, string)
+}
+
+func newMemoryS3() *memoryS3 {
+	return &memoryS3{
+		objects:   map[string][]byte{},
+		modified:  map[string]time.Time{},
+		multipart: map[string]map[int][]byte{},
+		calls:     map[string]int{},
+		sse:       map[string]string{},
+	}
+}
+
+// newTestS3Client returns an S3Client talking to a fresh memoryS3. Retries
+// happen without delay.
+func newTestS3Client(t testing.TB) (*S3Client, *memoryS3) {
+	t.Helper()
+	store := newMemoryS3()
+	server := httptest.NewServer(store)
+	t.Cleanup(server.Close)
+
+	sess, err := session.NewSession(aws.NewConfig().
+		WithRegion("ap-northeast-2").
+		WithEndpoint(server.URL).
+		WithS3ForcePathStyle(true).
+		WithCredentials(credentials.NewStaticCredentials("test", "test", "")).
+		WithMaxRetries(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := s3.New(sess)
+	client.Handlers.Complete.PushBack(observeS3Request)
+	return &S3Client{
+		client:          client,
+		uploader:        s3manager.NewUploaderWithClient(client),
+		Bucket:          "test",
+		RetryPolicy:     RetryPolicy{MaxAttempts: 3},
+		Encryption:      DefaultServerSideEncryption,
+		PartSize:        minPartSize,
+		PartConcurrency: 2,
+	}, store
+}
+
+func (m *memoryS3) object(key string) ([]byte, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.objects[key]
+	return data, ok
+}
+
+func (m *memoryS3) put(key string, data []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.objects[key] = data
+	m.modified[key] = time.Now()
+}
+
+func (m *memoryS3) keys(prefix string) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var keys []string
+	for key := range m.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// encryption returns the server-side encryption the object at key was written with
+func (m *memoryS3) encryption(key string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.sse[key]
+}
+
+func (m *memoryS3) count(op string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.calls[op]
+}
+
+func (m *memoryS3) openUploads() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.multipart)
+}
+
+func (m *memoryS3) setFail(fail func(op, key string) (int, string)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.fail = fail
+}
+
+func (m *memoryS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	query := r.URL.Query()
+	// Path style: /{bucket}/{key}
+	key := ""
+	if parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2); len(parts) == 2 {
+		key = parts[1]
+	}
+
+	var op string
+	switch {
+	case r.Method == http.MethodHead && key == "":
+		op = "HeadBucket"
+	case r.Method == http.MethodGet && key == "":
+		op = "ListObjectsV2"
+	case r.Method == http.MethodGet:
+		op = "GetObject"
+	case r.Method == http.MethodPut && query.Has("partNumber"):
+		op = "UploadPart"
+	case r.Method == http.MethodPut:
+		op = "PutObject"
+	case r.Method == http.MethodPost && query.Has("delete"):
+		op = "DeleteObjects"
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		op = "CreateMultipartUpload"
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		op = "CompleteMultipartUpload"
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		op = "AbortMultipartUpload"
+	case r.Method == http.MethodDelete:
+		op = "DeleteObject"
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.calls[op]++
+	if m.fail != nil {
+		if status, code := m.fail(op, key); status != 0 {
+			writeS3Error(w, status, code)
+			return
+		}
+	}
+
+	// Verify payload checksums the way S3 does
+	if sum := r.Header.Get("X-Amz-Checksum-Sha256"); sum != "" {
+		actual := sha256.Sum256(body)
+		if base64.StdEncoding.EncodeToString(actual[:]) != sum {
+			writeS3Error(w, http.StatusBadRequest, "BadDigest")
+			return
+		}
+	}
+
+	switch op {
+	case "HeadBucket":
+	case "GetObject":
+		data, ok := m.objects[key]
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Write(data)
+	case "PutObject":
+		if _, exists := m.objects[key]; exists && r.Header.Get("If-None-Match") == "*" {
+			writeS3Error(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+		m.objects[key] = body
+		m.modified[key] = time.Now()
+		m.sse[key] = r.Header.Get("X-Amz-Server-Side-Encryption")
+		w.Header().Set("ETag", `"etag"`)
+	case "DeleteObject":
+		delete(m.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	case "DeleteObjects":
+		var request struct {
+			Objects []struct {
+				Key string `xml:"Key"`
+			} `xml:"Object"`
+		}
+		xml.Unmarshal(body, &request)
+		for _, object := range request.Objects {
+			delete(m.objects, object.Key)
+		}
+		fmt.Fprint(w, `<DeleteResult></DeleteResult>`)
+	case "CreateMultipartUpload":
+		m.nextID++
+		uploadID := fmt.Sprintf("upload-%d", m.nextID)
+		m.multipart[uploadID] = map[int][]byte{}
+		m.sse[key] = r.Header.Get("X-Amz-Server-Side-Encryption")
+		fmt.Fprintf(w, `<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>`, uploadID)
+	case "UploadPart":
+		parts, ok := m.multipart[query.Get("uploadId")]
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		number, _ := strconv.Atoi(query.Get("partNumber"))
+		parts[number] = body
+		w.Header().Set("ETag", fmt.Sprintf(`"part-%d"`, number))
+	case "CompleteMultipartUpload":
+		parts, ok := m.multipart[query.Get("uploadId")]
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		var request struct {
+			Parts []struct {
+				PartNumber int `xml:"PartNumber"`
+			} `xml:"Part"`
+		}
+		xml.Unmarshal(body, &request)
+		var data []byte
+		for i, part := range request.Parts {
+			if part.PartNumber != i+1 {
+				writeS3Error(w, http.StatusBadRequest, "InvalidPartOrder")
+				return
+			}
+			data = append(data, parts[part.PartNumber]...)
+		}
+		delete(m.multipart, query.Get("uploadId"))
+		m.objects[key] = data
+		m.modified[key] = time.Now()
+		fmt.Fprint(w, `<CompleteMultipartUploadResult><ETag>"etag"</ETag></CompleteMultipartUploadResult>`)
+	case "AbortMultipartUpload":
+		delete(m.multipart, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case "ListObjectsV2":
+		m.list(w, query.Get("prefix"), query.Get("delimiter"), query.Get("start-after"), query.Get("continuation-token"), query.Get("max-keys"))
+	default:
+		writeS3Error(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+// list answers ListObjectsV2. Continuation tokens are the last key or common
+// prefix of the previous page.
+func (m *memoryS3) list(w http.ResponseWriter, prefix, delimiter, startAfter, token, maxKeysParam string) {
+	maxKeys := m.maxKeys
+	if maxKeys == 0 {
+		maxKeys = 1000
+	}
+	if n, err := strconv.Atoi(maxKeysParam); err == nil && n < maxKeys {
+		maxKeys = n
+	}
+	after := startAfter
+	if token != "" {
+		after = token
+	}
+
+	var keys []string
+	for key := range m.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	type entry struct {
+		key    string
+		common bool
+	}
+	var entries []entry
+	for _, key := range keys {
+		if delimiter != "" {
+			if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+				common := key[:len(prefix)+i+len(delimiter)]
+				if len(entries) == 0 || entries[len(entries)-1].key != common {
+					entries = append(entries, entry{key: common, common: true})
+				}
+				continue
+			}
+		}
+		entries = append(entries, entry{key: key})
+	}
+
+	var out strings.Builder
+	count, truncated, last := 0, false, ""
+	for _, e := range entries {
+		if e.key <= after {
+			continue
+		}
+		if count == maxKeys {
+			truncated = true
+			break
+		}
+		count++
+		last = e.key
+		if e.common {
+			fmt.Fprintf(&out, `<CommonPrefixes><Prefix>%s</Prefix></CommonPrefixes>`, e.key)
+			continue
+		}
+		fmt.Fprintf(&out, `<Contents><Key>%s</Key><Size>%d</Size><LastModified>%s</LastModified></Contents>`,
+			e.key, len(m.objects[e.key]), m.modified[e.key].UTC().Format("2006-01-02T15:04:05.000Z"))
+	}
+	next := ""
+	if truncated {
+		next = `<NextContinuationToken>` + last + `</NextContinuationToken>`
+	}
+	fmt.Fprintf(w, `<ListBucketResult><Name>test</Name><Prefix>%s</Prefix><KeyCount>%d</KeyCount><IsTruncated>%t</IsTruncated>%s%s</ListBucketResult>`,
+		prefix, count, truncated, next, out.String())
+}
+
+func writeS3Error(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `<Error><Code>%s</Code><Message>injected</Message></Error>`, code)
+}
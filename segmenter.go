@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// maxPooledSegmentBuffer keeps buffers grown by unusually large segments out
+// of the pool, so one big upload does not pin its memory afterwards
+const maxPooledSegmentBuffer = 32 * 1024 * 1024
+
+// segmentBuffers recycles the buffers segments are encoded and compressed into
+var segmentBuffers = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+func getSegmentBuffer() *bytes.Buffer {
+	buf := segmentBuffers.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+func putSegmentBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledSegmentBuffer {
+		return
+	}
+	segmentBuffers.Put(buf)
+}
+
+// memoryBudget bounds the bytes of buffers one upload holds at once. A holder
+// reserves what its buffers may grow to before allocating them and returns
+// the reservation once they are released. A reservation that does not fit is
+// still granted while nothing else is held, so an upload always progresses.
+type memoryBudget struct {
+	limit int64
+
+	mu      sync.Mutex
+	used    int64
+	peak    int64         // most bytes reserved at once
+	changed chan struct{} // closed and replaced whenever bytes are released
+}
+
+func newMemoryBudget(limit int64) *memoryBudget {
+	return &memoryBudget{limit: limit, changed: make(chan struct{})}
+}
+
+// acquire waits until n more bytes fit
+func (b *memoryBudget) acquire(ctx context.Context, n int64) error {
+	for {
+		b.mu.Lock()
+		if b.fitsLocked(n) {
+			b.takeLocked(n)
+			b.mu.Unlock()
+			return nil
+		}
+		changed := b.changed
+		b.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return context.Cause(ctx)
+		}
+	}
+}
+
+// tryAcquire takes n bytes if they fit
+func (b *memoryBudget) tryAcquire(n int64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.fitsLocked(n) {
+		return false
+	}
+	b.takeLocked(n)
+	return true
+}
+
+// charge takes n bytes without waiting, for a holder that cannot wait
+func (b *memoryBudget) charge(n int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.takeLocked(n)
+}
+
+func (b *memoryBudget) release(n int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.used -= n
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+func (b *memoryBudget) fitsLocked(n int64) bool {
+	return b.used == 0 || b.used+n <= b.limit
+}
+
+func (b *memoryBudget) takeLocked(n int64) {
+	b.used += n
+	b.peak = max(b.peak, b.used)
+}
+
+// maxUsed returns the most bytes that were reserved at once
+func (b *memoryBudget) maxUsed() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.peak
+}
+
+// holds returns how many reservations of n bytes fit in the budget, at least one
+func (b *memoryBudget) holds(n int64) int64 {
+	return max(b.limit/n, 1)
+}
+
+// getBoundedBuffer returns a pooled buffer whose capacity does not exceed
+// limit, so a buffer grown by an earlier upload holds no more than reserved
+func getBoundedBuffer(limit int64) *bytes.Buffer {
+	buf := getSegmentBuffer()
+	if int64(buf.Cap()) > limit {
+		// Left to the garbage collector
+		return new(bytes.Buffer)
+	}
+	return buf
+}
+
+// growBuffer makes room for n more bytes in buf. Unlike bytes.Buffer's own
+// growth, which may double past what was reserved, capacity stays within
+// limit unless the n bytes alone need more.
+func growBuffer(buf *bytes.Buffer, n int, limit int64) {
+	if buf.Available() >= n {
+		return
+	}
+	size := max(2*buf.Cap(), buf.Len()+n, 64*1024)
+	size = min(size, max(int(limit), buf.Len()+n))
+	grown := make([]byte, buf.Len(), size)
+	copy(grown, buf.Bytes())
+	*buf = *bytes.NewBuffer(grown)
+}
+
+// gzipBound is the most bytes compressSegment writes for n bytes of input;
+// incompressible data is stored with a few bytes of framing per block
+func gzipBound(n int64) int64 {
+	return n + n/1024 + 64
+}
+
+// gzipWriterState is about what one gzip.Writer allocates for its window and
+// hash chains at the default level
+const gzipWriterState = 1100 * 1024
+
+// segmentCharge is what the buffers of one segment of up to maxBytes encoded
+// bytes may hold: the CSV, its compressed copy with the gzip state that wrote
+// it, and its sealed copy
+func segmentCharge(maxBytes int64, compression string, cipher *segmentCipher) int64 {
+	charge, stored := maxBytes, maxBytes
+	if compression == CompressionGzip {
+		stored = gzipBound(maxBytes)
+		charge += stored + gzipWriterState
+	}
+	return charge + cipher.copySize(stored)
+}
+
+// encodedSegment is a segment's CSV, header included, waiting to be stored.
+// Its buffers and its share of the memory budget are held until release.
+type encodedSegment struct {
+	number   int
+	firstRow int // index of the segment's first data row in the upload
+	rows     int
+	buf      *bytes.Buffer
+
+	extra    []*bytes.Buffer // compression output, see sealSegment
+	budget   *memoryBudget
+	capacity int64 // encoded bytes the reservation covers
+	charged  int64 // bytes reserved in budget
+}
+
+// release returns the segment's buffers to the pool and its share of the budget
+func (s *encodedSegment) release() {
+	if s.buf == nil {
+		return
+	}
+	putSegmentBuffer(s.buf)
+	for _, buf := range s.extra {
+		putSegmentBuffer(buf)
+	}
+	s.buf, s.extra = nil, nil
+	s.budget.release(s.charged)
+}
+
+// segmenter encodes rows straight into pooled segment buffers, so no mode
+// keeps parsed rows around. A segment is cut before a row would take its
+// encoded CSV past maxBytes, or once it holds maxRows rows, so wide rows do
+// not make huge objects and narrow rows do not make thousands of tiny ones.
+// Only a row wider than maxBytes on its own makes a larger segment.
+type segmenter struct {
+	maxRows  int
+	maxBytes int64
+	header   []string
+	budget   *memoryBudget
+	charge   int64 // reserved per segment, see segmentCharge
+	charger  func(encodedBytes int64) int64
+
+	// beforeWait runs when the budget is full and a new segment has to wait for
+	// room. Batch mode uses it to store what it has collected so far.
+	beforeWait func() error
+
+	current  *encodedSegment
+	writer   *csv.Writer
+	bytes    int64 // encoded size of current, including what writer buffers
+	next     int   // number of the next segment
+	firstRow int   // first data row of the next segment
+}
+
+func newSegmenter(req *uploadRequest, header []string) *segmenter {
+	config := req.config
+	// Without a byte target segments are still cut at the memory budget
+	maxBytes := config.SegmentBytes
+	if maxBytes == 0 {
+		maxBytes = config.MemoryBudget
+	}
+	charger := func(encodedBytes int64) int64 {
+		return segmentCharge(encodedBytes, config.Compression, req.cipher)
+	}
+	return &segmenter{
+		maxRows:  config.SegmentSize,
+		maxBytes: maxBytes,
+		header:   header,
+		budget:   req.budget,
+		charge:   charger(maxBytes),
+		charger:  charger,
+	}
+}
+
+// segments is the number of segments that fit in the budget
+func (s *segmenter) segments() int64 {
+	return s.budget.holds(s.charge)
+}
+
+// fits reports whether row can join the current segment. When it cannot, the
+// caller cuts the segment before adding the row.
+func (s *segmenter) fits(row []string) bool {
+	return s.current == nil || s.bytes+csvRowSize(row) <= s.maxBytes
+}
+
+// add encodes row into the current segment and reports whether the segment is
+// full. Starting a new segment waits for room in the memory budget.
+func (s *segmenter) add(ctx context.Context, row []string) (bool, error) {
+	if s.current == nil {
+		if err := s.start(ctx); err != nil {
+			return false, err
+		}
+	}
+	size := csvRowSize(row)
+	if s.bytes+size > s.maxBytes {
+		// A row wider than maxBytes: the memory already holds the parsed row,
+		// so its segment is charged for the excess instead of waiting
+		s.current.capacity = s.bytes + size
+		if extra := s.charger(s.current.capacity) - s.current.charged; extra > 0 {
+			s.budget.charge(extra)
+			s.current.charged += extra
+		}
+	}
+	growBuffer(s.current.buf, int(s.bytes+size)-s.current.buf.Len(), s.maxBytes)
+	if err := s.writer.Write(row); err != nil {
+		return false, fmt.Errorf("failed to write row: %v", err)
+	}
+	s.current.rows++
+	s.bytes += size
+	return s.current.rows >= s.maxRows || s.bytes >= s.maxBytes, nil
+}
+
+func (s *segmenter) start(ctx context.Context) error {
+	if !s.budget.tryAcquire(s.charge) {
+		if s.beforeWait != nil {
+			if err := s.beforeWait(); err != nil {
+				return err
+			}
+		}
+		if err := s.budget.acquire(ctx, s.charge); err != nil {
+			return err
+		}
+	}
+
+	s.current = &encodedSegment{number: s.next, firstRow: s.firstRow, buf: getBoundedBuffer(s.maxBytes), budget: s.budget, capacity: s.maxBytes, charged: s.charge}
+	s.writer = csv.NewWriter(s.current.buf)
+	s.bytes = csvRowSize(s.header)
+	growBuffer(s.current.buf, int(s.bytes), s.maxBytes)
+	if err := s.writer.Write(s.header); err != nil {
+		return fmt.Errorf("failed to write header: %v", err)
+	}
+	return nil
+}
+
+// pending reports whether a segment has rows waiting to be cut
+func (s *segmenter) pending() bool {
+	return s.current != nil
+}
+
+// cut finishes the current segment and hands it over; the caller releases it
+// once it is stored
+func (s *segmenter) cut() *encodedSegment {
+	// Writing to a buffer never fails
+	s.writer.Flush()
+	segment := s.current
+	s.current, s.writer = nil, nil
+	s.next++
+	s.firstRow += segment.rows
+	return segment
+}
+
+// csvRowSize estimates the bytes csv.Writer writes for row, including quoting
+// and the line ending
+func csvRowSize(row []string) int64 {
+	var size int64
+	for _, field := range row {
+		size += int64(len(field)) + 1 // field and its comma, or the newline after the last one
+		if field == "" {
+			continue
+		}
+		if strings.ContainsAny(field, "\",\r\n") || field[0] == ' ' || field[0] == '\t' {
+			size += 2 + int64(strings.Count(field, `"`))
+		}
+	}
+	return size
+}
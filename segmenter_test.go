@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// segmentRows feeds rows to s and returns the rows of every cut segment
+func segmentRows(t *testing.T, s *segmenter, rows [][]string) []int {
+	t.Helper()
+	var cuts []int
+	for _, row := range rows {
+		if !s.fits(row) {
+			segment := s.cut()
+			cuts = append(cuts, segment.rows)
+			segment.release()
+		}
+		full, err := s.add(context.Background(), row)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if full {
+			segment := s.cut()
+			cuts = append(cuts, segment.rows)
+			segment.release()
+		}
+	}
+	if s.pending() {
+		segment := s.cut()
+		cuts = append(cuts, segment.rows)
+		segment.release()
+	}
+	return cuts
+}
+
+func rowsOfWidth(n, width int) [][]string {
+	rows := make([][]string, n)
+	for i := range rows {
+		rows[i] = []string{strings.Repeat("x", width)}
+	}
+	return rows
+}
+
+func TestSegmenterCuts(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxRows  int
+		maxBytes int64
+		rows     [][]string
+		want     []int
+	}{
+		{"row cap", 4, 1 << 20, rowsOfWidth(10, 9), []int{4, 4, 2}},
+		// Header "h\n" is 2 bytes, each row 10
+		{"byte target", 100, 42, rowsOfWidth(10, 9), []int{4, 4, 2}},
+		{"row cap first", 3, 42, rowsOfWidth(7, 9), []int{3, 3, 1}},
+		{"cut before the row that does not fit", 100, 45, rowsOfWidth(10, 9), []int{4, 4, 2}},
+		{"row wider than the target", 100, 42, rowsOfWidth(3, 99), []int{1, 1, 1}},
+		{"exact fit", 5, 1 << 20, rowsOfWidth(10, 9), []int{5, 5}},
+		{"no rows", 5, 1 << 20, nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &uploadRequest{config: UploadConfig{SegmentSize: tt.maxRows, SegmentBytes: tt.maxBytes}, budget: newMemoryBudget(1 << 30)}
+			got := segmentRows(t, newSegmenter(req, []string{"h"}), tt.rows)
+			if len(got) != len(tt.want) {
+				t.Fatalf("segments of %v rows, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("segments of %v rows, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestSegmenterNumbersSegments(t *testing.T) {
+	req := &uploadRequest{config: UploadConfig{SegmentSize: 3, SegmentBytes: 1 << 20}, budget: newMemoryBudget(1 << 30)}
+	s := newSegmenter(req, []string{"id", "name"})
+
+	wantFirstRows := []int{0, 3, 6}
+	for i, wantFirstRow := range wantFirstRows {
+		for j := 0; j < 3; j++ {
+			if _, err := s.add(context.Background(), []string{"1", "a,b"}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		segment := s.cut()
+		if segment.number != i || segment.firstRow != wantFirstRow || segment.rows != 3 {
+			t.Errorf("segment %d: number %d, first row %d, %d rows", i, segment.number, segment.firstRow, segment.rows)
+		}
+		records, err := csv.NewReader(bytes.NewReader(segment.buf.Bytes())).ReadAll()
+		if err != nil || len(records) != 4 || records[0][1] != "name" || records[1][1] != "a,b" {
+			t.Errorf("segment %d holds %q (%v), want the header and 3 rows", i, records, err)
+		}
+		segment.release()
+	}
+}
+
+func TestSegmenterWaitsForBudget(t *testing.T) {
+	// Room for two segments of 64 bytes
+	req := &uploadRequest{config: UploadConfig{SegmentSize: 1, SegmentBytes: 64}, budget: newMemoryBudget(128)}
+	s := newSegmenter(req, []string{"h"})
+	waits := 0
+	s.beforeWait = func() error { waits++; return nil }
+
+	var held []*encodedSegment
+	for i := 0; i < 2; i++ {
+		s.add(context.Background(), []string{"row"})
+		held = append(held, s.cut())
+	}
+	if waits != 0 {
+		t.Fatalf("beforeWait ran %d times while the budget had room", waits)
+	}
+
+	// A third segment waits until one is released
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := s.add(ctx, []string{"row"}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("add over budget = %v, want to wait until the deadline", err)
+	}
+	if waits != 1 {
+		t.Errorf("beforeWait ran %d times, want once", waits)
+	}
+
+	held[0].release()
+	if _, err := s.add(context.Background(), []string{"row"}); err != nil {
+		t.Fatalf("add after release: %v", err)
+	}
+	s.cut().release()
+	held[1].release()
+}
+
+func TestSegmenterBeforeWaitError(t *testing.T) {
+	req := &uploadRequest{config: UploadConfig{SegmentSize: 1, SegmentBytes: 64}, budget: newMemoryBudget(64)}
+	s := newSegmenter(req, []string{"h"})
+	failed := errors.New("store failed")
+	s.beforeWait = func() error { return failed }
+
+	s.add(context.Background(), []string{"row"})
+	held := s.cut()
+	defer held.release()
+	if _, err := s.add(context.Background(), []string{"row"}); !errors.Is(err, failed) {
+		t.Errorf("add = %v, want the beforeWait error", err)
+	}
+}
+
+func TestCSVRowSize(t *testing.T) {
+	tests := []struct {
+		name string
+		row  []string
+	}{
+		{"plain", []string{"1", "alice", "alice@example.com"}},
+		{"empty fields", []string{"", "", ""}},
+		{"comma", []string{"a,b", "c"}},
+		{"quotes", []string{`say "hi"`, `""`}},
+		{"newline", []string{"line\nbreak", "cr\rhere"}},
+		{"leading space", []string{" padded", "\ttab"}},
+		{"unicode", []string{"한글", "ünïcødé"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			writer := csv.NewWriter(&buf)
+			writer.Write(tt.row)
+			writer.Flush()
+			if got := csvRowSize(tt.row); got != int64(buf.Len()) {
+				t.Errorf("csvRowSize = %d, csv.Writer wrote %d bytes", got, buf.Len())
+			}
+		})
+	}
+}
+
+func TestMemoryBudget(t *testing.T) {
+	ctx := context.Background()
+	budget := newMemoryBudget(100)
+
+	// A reservation larger than the budget is granted while nothing is held
+	if !budget.tryAcquire(150) {
+		t.Fatal("oversized reservation refused on an empty budget")
+	}
+	if budget.tryAcquire(1) {
+		t.Error("reservation granted beyond the budget")
+	}
+	budget.release(150)
+
+	steps := []struct {
+		name string
+		do   func() bool
+		want bool
+	}{
+		{"first half", func() bool { return budget.tryAcquire(50) }, true},
+		{"second half", func() bool { return budget.tryAcquire(50) }, true},
+		{"full", func() bool { return budget.tryAcquire(1) }, false},
+		{"release", func() bool { budget.release(30); return true }, true},
+		{"fits again", func() bool { return budget.tryAcquire(30) }, true},
+		{"charge beyond the limit", func() bool { budget.charge(20); return true }, true},
+		{"nothing fits while overdrawn", func() bool { return budget.tryAcquire(1) }, false},
+	}
+	for _, step := range steps {
+		if got := step.do(); got != step.want {
+			t.Fatalf("%s = %v, want %v", step.name, got, step.want)
+		}
+	}
+	if peak := budget.maxUsed(); peak != 150 {
+		t.Errorf("maxUsed = %d, want 150", peak)
+	}
+
+	// acquire wakes up once enough is released
+	acquired := make(chan error)
+	go func() { acquired <- budget.acquire(ctx, 40) }()
+	budget.release(20)
+	select {
+	case err := <-acquired:
+		t.Fatalf("acquire returned %v before there was room", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	budget.release(60)
+	if err := <-acquired; err != nil {
+		t.Fatal(err)
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := budget.acquire(canceled, 100); !errors.Is(err, context.Canceled) {
+		t.Errorf("acquire on a canceled context = %v", err)
+	}
+}
+
+func TestSegmentBuffersStayWithinCharge(t *testing.T) {
+	provider, err := NewLocalKeyProvider(filepath.Join(t.TempDir(), "master.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	segCipher, _, err := (&EnvelopeEncryption{Provider: provider, Encrypt: true}).newUploadCipher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	random := make([]string, 200)
+	for i := range random {
+		field := make([]byte, 900)
+		rand.Read(field)
+		random[i] = hex.EncodeToString(field)
+	}
+
+	const maxBytes = 64 * 1024
+	tests := []struct {
+		name        string
+		compression string
+		cipher      *segmentCipher
+		rows        [][]string
+	}{
+		{"plain", CompressionNone, nil, rowsOfWidth(2000, 300)},
+		{"gzip", CompressionGzip, nil, rowsOfWidth(2000, 300)},
+		{"gzip, incompressible", CompressionGzip, nil, [][]string{random}},
+		{"encrypted", CompressionNone, segCipher, rowsOfWidth(2000, 300)},
+		{"gzip and encrypted", CompressionGzip, segCipher, rowsOfWidth(2000, 300)},
+		{"row wider than the target", CompressionGzip, segCipher, append(rowsOfWidth(10, 300), rowsOfWidth(2, 3*maxBytes)...)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// A buffer grown by an earlier upload must not be handed out as is
+			putSegmentBuffer(bytes.NewBuffer(make([]byte, 0, 4*maxBytes)))
+
+			budget := newMemoryBudget(1 << 30)
+			req := &uploadRequest{
+				basePath: "csv_upload/ch/id",
+				config:   UploadConfig{SegmentSize: 100000, SegmentBytes: maxBytes, Compression: tt.compression},
+				cipher:   tt.cipher,
+				budget:   budget,
+				ctx:      context.Background(),
+			}
+			s := newSegmenter(req, []string{"h"})
+			check := func(segment *encodedSegment) {
+				data, err := sealSegment(req, segment)
+				if err != nil {
+					t.Fatal(err)
+				}
+				held := int64(segment.buf.Cap())
+				for _, buf := range segment.extra {
+					held += int64(buf.Cap())
+				}
+				if tt.cipher != nil {
+					held += int64(len(data))
+				}
+				if held > segment.charged {
+					t.Errorf("segment %d holds %d bytes, charged %d", segment.number, held, segment.charged)
+				}
+				segment.release()
+			}
+			for _, row := range tt.rows {
+				if !s.fits(row) {
+					check(s.cut())
+				}
+				full, err := s.add(context.Background(), row)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if full {
+					check(s.cut())
+				}
+			}
+			if s.pending() {
+				check(s.cut())
+			}
+			if budget.used != 0 {
+				t.Errorf("%d bytes still reserved after every segment was released", budget.used)
+			}
+		})
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// TestMain keeps the log lines of handlers under test out of the test output
+func TestMain(m *testing.M) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	os.Exit(m.Run())
+}
+
+// testServer wires every handler the way main does, against a memoryS3
+type testServer struct {
+	handler http.Handler
+	router  *Router
+	store   *memoryS3
+	s3      *S3Client
+	config  *Config
+	uploads *UploadHandler
+	queries *QueryHandler
+	audit   *FileAuditSink
+	health  *HealthHandler
+}
+
+// newTestServer builds a server from DefaultConfig; configure, if not nil,
+// may change the configuration first
+func newTestServer(t testing.TB, configure func(*Config)) *testServer {
+	t.Helper()
+	s3Client, store := newTestS3Client(t)
+	config := DefaultConfig
+	config.Channels = map[string]ChannelOverrides{}
+	if configure != nil {
+		configure(&config)
+	}
+
+	// Encryption is set up from the config the way main does it
+	if kmsKeyID := config.Storage.SSEKMSKeyID; kmsKeyID != "" {
+		s3Client.Encryption = ServerSideEncryption{Algorithm: s3.ServerSideEncryptionAwsKms, KMSKeyID: kmsKeyID}
+	}
+	var envelope *EnvelopeEncryption
+	if keyFile := config.Storage.EnvelopeKeyFile; keyFile != "" {
+		provider, err := NewLocalKeyProvider(keyFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		envelope = &EnvelopeEncryption{Provider: provider, Encrypt: true}
+	}
+
+	audit := NewFileAuditSink(filepath.Join(t.TempDir(), "audit.jsonl"))
+	tracker := NewUploadTracker()
+	health := NewHealthHandler(tracker, ReadinessCheck{Name: "storage", Check: s3Client.HeadBucket})
+	retention := NewRetentionManager(s3Client, config.retentionConfig())
+	uploads := NewUploadHandler(s3Client, NewJobStore(), NewSessionStore(s3Client), NewIdempotencyStore(s3Client, config.idempotencyConfig()), retention, envelope, &config, tracker)
+	queries := NewQueryHandler(s3Client, retention, envelope, config.maskingConfig(), audit, &config)
+	router := newRouter(&config, uploads, queries, NewAuditHandler(audit), health)
+
+	return &testServer{
+		handler: withRequestID(promhttp.InstrumentHandlerInFlight(inFlightRequests, withRequestLog(audit, router))),
+		router:  router,
+		store:   store,
+		s3:      s3Client,
+		config:  &config,
+		uploads: uploads,
+		queries: queries,
+		audit:   audit,
+		health:  health,
+	}
+}
+
+// do sends a request through the full middleware chain
+func (s *testServer) do(method, target string, body io.Reader, header ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, body)
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	return s.serve(r)
+}
+
+// upload stores csv for channelID through the upload endpoint and returns the response
+func (s *testServer) upload(t testing.TB, channelID, csv string, query string, header ...string) UploadResponse {
+	t.Helper()
+	target := "/cht/v1/file/csv/" + channelID + "/data.csv"
+	if query != "" {
+		target += "?" + query
+	}
+	w := s.do(http.MethodPost, target, strings.NewReader(csv), header...)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("upload: status %d: %s", w.Code, w.Body)
+	}
+	var response UploadResponse
+	decodeJSON(t, w, &response)
+	return response
+}
+
+func decodeJSON(t testing.TB, w *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+	if err := json.NewDecoder(w.Body).Decode(v); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+}
+
+// testCSV returns a CSV file with a header and rows data rows
+func testCSV(rows int) string {
+	var b strings.Builder
+	b.WriteString("id,name,email\n")
+	for i := 0; i < rows; i++ {
+		fmt.Fprintf(&b, "%d,user %d,user%d@example.com\n", i, i, i)
+	}
+	return b.String()
+}
+
+func sortedCopy(values []string) []string {
+	sorted := append([]string(nil), values...)
+	sort.Strings(sorted)
+	return sorted
+}
+
+// serve sends r through the full middleware chain
+func (s *testServer) serve(r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	s.handler.ServeHTTP(w, r)
+	return w
+}
+
+// newChunkedRequest returns a request whose body length is unknown, as with
+// chunked transfer encoding
+func newChunkedRequest(method, target, body string) *http.Request {
+	r := httptest.NewRequest(method, target, io.NopCloser(strings.NewReader(body)))
+	r.ContentLength = -1
+	return r
+}
+
+func countSuffix(keys []string, suffix string) int {
+	n := 0
+	for _, key := range keys {
+		if strings.HasSuffix(key, suffix) {
+			n++
+		}
+	}
+	return n
+}
+
+// query reads rows of the upload at key through the query endpoint
+func (s *testServer) query(t testing.TB, key, params string, header ...string) QueryResponse {
+	t.Helper()
+	target := "/admin/cht/v1/file/csv-upload/" + key
+	if params != "" {
+		target += "?" + params
+	}
+	w := s.do(http.MethodGet, target, nil, header...)
+	if w.Code != http.StatusOK {
+		t.Fatalf("query %s: status %d: %s", key, w.Code, w.Body)
+	}
+	var response QueryResponse
+	decodeJSON(t, w, &response)
+	return response
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	readHeaderTimeout = 10 * time.Second
+	// abortCleanupTimeout bounds the deletion of a failed or aborted upload's objects
+	abortCleanupTimeout = 10 * time.Second
+)
+
+var errShuttingDown = errors.New("server is shutting down")
+
+// UploadTracker counts running uploads, synchronous and background, so that
+// shutdown can stop new ones, wait for the rest and abort whatever is still
+// running when the deadline passes
+type UploadTracker struct {
+	mu       sync.Mutex
+	draining bool
+	running  sync.WaitGroup
+
+	aborted context.Context // canceled with errShuttingDown by Abort
+	abort   context.CancelCauseFunc
+}
+
+func NewUploadTracker() *UploadTracker {
+	aborted, abort := context.WithCancelCause(context.Background())
+	return &UploadTracker{aborted: aborted, abort: abort}
+}
+
+// Begin registers a new upload. It returns false once draining has started.
+// release must be called exactly once when the upload has finished.
+func (t *UploadTracker) Begin() (release func(), ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.draining {
+		return nil, false
+	}
+	t.running.Add(1)
+	var once sync.Once
+	return func() { once.Do(t.running.Done) }, true
+}
+
+// Draining reports whether shutdown has started
+func (t *UploadTracker) Draining() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.draining
+}
+
+// StopAccepting makes Begin refuse new uploads
+func (t *UploadTracker) StopAccepting() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.draining = true
+}
+
+// Drain stops new uploads and waits for running ones until ctx is done
+func (t *UploadTracker) Drain(ctx context.Context) error {
+	t.StopAccepting()
+
+	done := make(chan struct{})
+	go func() {
+		t.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Abort cancels every running upload and waits up to timeout for them to
+// record their failure and clean up
+func (t *UploadTracker) Abort(timeout time.Duration) error {
+	t.abort(errShuttingDown)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return t.Drain(ctx)
+}
+
+// abortable derives a context that is canceled with errShuttingDown when
+// running uploads are aborted
+func (t *UploadTracker) abortable(ctx context.Context) (context.Context, func()) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	stop := context.AfterFunc(t.aborted, func() { cancel(errShuttingDown) })
+	return ctx, func() {
+		stop()
+		cancel(nil)
+	}
+}
+
+// writeShuttingDown rejects a request that would start a new upload
+func writeShuttingDown(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Retry-After", "5")
+	writeError(w, r, http.StatusServiceUnavailable, ErrCodeShuttingDown, "Server is shutting down, retry on another instance")
+}
+
+// shutdown stops the server in order: readiness fails while traffic is still
+// served for config.ShutdownDelay, then new uploads are refused, in-flight
+// requests and background uploads get config.ShutdownTimeout to finish, and
+// uploads still running after that are aborted and cleaned up
+func shutdown(server *http.Server, health *HealthHandler, uploads *UploadTracker, config ServerConfig) {
+	delay, timeout := time.Duration(config.ShutdownDelay), time.Duration(config.ShutdownTimeout)
+	slog.Info("Shutting down", "delay", delay.String(), "timeout", timeout.String())
+
+	health.MarkShuttingDown()
+	time.Sleep(delay)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// Refuse uploads before the listener closes, so requests already on open
+	// connections are refused as well
+	uploads.StopAccepting()
+	drained := make(chan error, 1)
+	go func() { drained <- uploads.Drain(ctx) }()
+
+	if err := server.Shutdown(ctx); err != nil {
+		slog.Warn("In-flight requests did not finish before the shutdown deadline", "error", err)
+	}
+	if err := <-drained; err != nil {
+		slog.Warn("Aborting uploads still running at the shutdown deadline")
+		if err := uploads.Abort(2 * abortCleanupTimeout); err != nil {
+			slog.Error("Uploads did not stop after being aborted", "error", err)
+		}
+	}
+	// Close whatever connections are left
+	server.Close()
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// Storage error kinds. Errors returned by S3Client wrap one of these, so callers
+// can use errors.Is instead of matching on messages.
+var (
+	ErrNotFound         = errors.New("not found")
+	ErrAccessDenied     = errors.New("access denied")
+	ErrThrottled        = errors.New("throttled")
+	ErrTimeout          = errors.New("timeout")
+	ErrCanceled         = errors.New("canceled") // the caller went away; not a storage failure
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+	ErrConflict         = errors.New("conflict")
+)
+
+// StorageError describes a failed storage operation
+type StorageError struct {
+	Op   string // storage operation, e.g. "GetObject"
+	Key  string // object key the operation was applied to
+	Kind error  // one of the Err* kinds above, nil if unclassified
+	Err  error  // underlying SDK error
+}
+
+func (e *StorageError) Error() string {
+	return fmt.Sprintf("%s %s: %v", e.Op, e.Key, e.Err)
+}
+
+func (e *StorageError) Unwrap() []error {
+	if e.Kind == nil {
+		return []error{e.Err}
+	}
+	return []error{e.Kind, e.Err}
+}
+
+// newStorageError wraps an SDK error into a StorageError with its kind resolved
+func newStorageError(op, key string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &StorageError{Op: op, Key: key, Kind: classifyStorageError(err), Err: err}
+}
+
+// classifyStorageError maps SDK error codes and HTTP statuses to an error kind
+func classifyStorageError(err error) error {
+	// The SDK reports a canceled context as RequestCanceled; a canceled backoff
+	// wraps context.Canceled
+	if errors.Is(err, context.Canceled) {
+		return ErrCanceled
+	}
+	var aerr awserr.Error
+	if errors.As(err, &aerr) {
+		switch aerr.Code() {
+		case "NoSuchKey", "NoSuchBucket", "NotFound":
+			return ErrNotFound
+		case "AccessDenied", "Forbidden", "InvalidAccessKeyId", "SignatureDoesNotMatch":
+			return ErrAccessDenied
+		case "BadDigest", "InvalidDigest", "XAmzContentSHA256Mismatch":
+			return ErrChecksumMismatch
+		case "RequestTimeout":
+			return ErrTimeout
+		case request.CanceledErrorCode:
+			// A deadline also cancels the request; only an expired one is a timeout
+			if errors.Is(aerr.OrigErr(), context.DeadlineExceeded) {
+				return ErrTimeout
+			}
+			return ErrCanceled
+		case "PreconditionFailed", "ConditionalRequestConflict":
+			return ErrConflict
+		}
+	}
+	if request.IsErrorThrottle(err) {
+		return ErrThrottled
+	}
+
+	var reqErr awserr.RequestFailure
+	if errors.As(err, &reqErr) {
+		switch reqErr.StatusCode() {
+		case http.StatusNotFound:
+			return ErrNotFound
+		case http.StatusForbidden:
+			return ErrAccessDenied
+		case http.StatusPreconditionFailed, http.StatusConflict:
+			return ErrConflict
+		case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+			return ErrThrottled
+		}
+	}
+
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return ErrTimeout
+	}
+	return nil
+}
+
+// statusClientClosedRequest is the nginx convention for a request the client
+// abandoned. The client never sees it, but logs and audit events do.
+const statusClientClosedRequest = 499
+
+// storageErrorStatus picks the HTTP status and error code for a storage error
+func storageErrorStatus(err error) (int, string) {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return http.StatusNotFound, ErrCodeNotFound
+	case errors.Is(err, ErrAccessDenied):
+		return http.StatusForbidden, ErrCodeStorageDenied
+	case errors.Is(err, ErrThrottled):
+		return http.StatusServiceUnavailable, ErrCodeStorageThrottled
+	case errors.Is(err, ErrCanceled):
+		return statusClientClosedRequest, ErrCodeClientClosedRequest
+	case errors.Is(err, ErrTimeout):
+		return http.StatusGatewayTimeout, ErrCodeStorageTimeout
+	case errors.Is(err, ErrChecksumMismatch):
+		return http.StatusInternalServerError, ErrCodeChecksumMismatch
+	case errors.Is(err, ErrConflict):
+		return http.StatusConflict, ErrCodeConflict
+	default:
+		return http.StatusInternalServerError, ErrCodeStorageError
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+func TestClassifyStorageError(t *testing.T) {
+	failure := func(code string, status int) error {
+		return awserr.NewRequestFailure(awserr.New(code, "message", nil), status, "request-id")
+	}
+	tests := []struct {
+		name string
+		err  error
+		want error
+	}{
+		{"no such key", failure("NoSuchKey", http.StatusNotFound), ErrNotFound},
+		{"404 without code", failure("", http.StatusNotFound), ErrNotFound},
+		{"access denied", failure("AccessDenied", http.StatusForbidden), ErrAccessDenied},
+		{"bad digest", failure("BadDigest", http.StatusBadRequest), ErrChecksumMismatch},
+		{"request timeout", failure("RequestTimeout", http.StatusBadRequest), ErrTimeout},
+		{"slow down", failure("SlowDown", http.StatusServiceUnavailable), ErrThrottled},
+		{"429", failure("", http.StatusTooManyRequests), ErrThrottled},
+		{"precondition failed", failure("PreconditionFailed", http.StatusPreconditionFailed), ErrConflict},
+		{"client canceled", awserr.New(request.CanceledErrorCode, "canceled", context.Canceled), ErrCanceled},
+		{"deadline exceeded", awserr.New(request.CanceledErrorCode, "canceled", context.DeadlineExceeded), ErrTimeout},
+		{"backoff canceled", fmt.Errorf("%w (retry abandoned: %w)", failure("InternalError", 500), context.Canceled), ErrCanceled},
+		{"context deadline", context.DeadlineExceeded, ErrTimeout},
+		{"server error", failure("InternalError", http.StatusInternalServerError), nil},
+		{"unknown", errors.New("boom"), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := classifyStorageError(tt.err); got != tt.want {
+				t.Errorf("classifyStorageError() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStorageErrorStatus(t *testing.T) {
+	tests := []struct {
+		kind       error
+		wantStatus int
+		wantCode   string
+	}{
+		{ErrNotFound, http.StatusNotFound, ErrCodeNotFound},
+		{ErrAccessDenied, http.StatusForbidden, ErrCodeStorageDenied},
+		{ErrThrottled, http.StatusServiceUnavailable, ErrCodeStorageThrottled},
+		{ErrTimeout, http.StatusGatewayTimeout, ErrCodeStorageTimeout},
+		{ErrCanceled, statusClientClosedRequest, ErrCodeClientClosedRequest},
+		{ErrChecksumMismatch, http.StatusInternalServerError, ErrCodeChecksumMismatch},
+		{ErrConflict, http.StatusConflict, ErrCodeConflict},
+		{nil, http.StatusInternalServerError, ErrCodeStorageError},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.kind), func(t *testing.T) {
+			err := &StorageError{Op: "GetObject", Key: "key", Kind: tt.kind, Err: errors.New("cause")}
+			status, code := storageErrorStatus(fmt.Errorf("wrapped: %w", err))
+			if status != tt.wantStatus || code != tt.wantCode {
+				t.Errorf("storageErrorStatus() = %d %s, want %d %s", status, code, tt.wantStatus, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestStorageErrorKindLabel(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{awserr.New(request.CanceledErrorCode, "canceled", context.Canceled), "canceled"},
+		{awserr.New("RequestTimeout", "slow", nil), "timeout"},
+		{awserr.New("NoSuchKey", "missing", nil), "not_found"},
+		{errors.New("boom"), "other"},
+	}
+	for _, tt := range tests {
+		if got := storageErrorKind(tt.err); got != tt.want {
+			t.Errorf("storageErrorKind(%v) = %q, want %q", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestStorageClientErrors(t *testing.T) {
+	client, store := newTestS3Client(t)
+	store.put("present", []byte("data"))
+
+	tests := []struct {
+		name string
+		key  string
+		fail func(op, key string) (int, string)
+		want error
+	}{
+		{"missing key", "absent", nil, ErrNotFound},
+		{"denied", "present", func(string, string) (int, string) { return http.StatusForbidden, "AccessDenied" }, ErrAccessDenied},
+		{"throttled", "present", func(string, string) (int, string) { return http.StatusServiceUnavailable, "SlowDown" }, ErrThrottled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store.setFail(tt.fail)
+			_, err := client.GetCSVContent(context.Background(), tt.key)
+			var storageErr *StorageError
+			if !errors.As(err, &storageErr) || !errors.Is(err, tt.want) {
+				t.Fatalf("err = %v, want a StorageError of kind %v", err, tt.want)
+			}
+			if storageErr.Op != "GetObject" || storageErr.Key != tt.key {
+				t.Errorf("StorageError = %s %s, want GetObject %s", storageErr.Op, storageErr.Key, tt.key)
+			}
+		})
+	}
+
+	t.Run("canceled", func(t *testing.T) {
+		store.setFail(nil)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err := client.GetCSVContent(ctx, "present")
+		if !errors.Is(err, ErrCanceled) || errors.Is(err, ErrTimeout) {
+			t.Fatalf("err = %v, want ErrCanceled", err)
+		}
+	})
+}
+
+func TestUploadOutcome(t *testing.T) {
+	tests := []struct {
+		name     string
+		response *UploadResponse
+		err      error
+		want     string
+	}{
+		{"success", &UploadResponse{}, nil, uploadOutcomeSuccess},
+		{"deduplicated", &UploadResponse{Deduplicated: true}, nil, uploadOutcomeDeduplicated},
+		{"shutdown", nil, fmt.Errorf("upload aborted: %w", errShuttingDown), uploadOutcomeAborted},
+		{"client gone", nil, &StorageError{Op: "PutObject", Kind: ErrCanceled, Err: context.Canceled}, uploadOutcomeCanceled},
+		{"malformed", nil, fmt.Errorf("%w: bad quote", errMalformedCSV), uploadOutcomeInvalid},
+		{"storage", nil, &StorageError{Op: "PutObject", Kind: ErrTimeout, Err: errors.New("slow")}, uploadOutcomeStorageError},
+		{"other", nil, errors.New("boom"), uploadOutcomeError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := uploadOutcome(tt.response, tt.err); got != tt.want {
+				t.Errorf("uploadOutcome() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
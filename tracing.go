@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Trace exporters, selected with CSV_TRACE_EXPORTER
+const (
+	TraceExporterNone   = ""       // spans are still created for propagation, but not exported
+	TraceExporterOTLP   = "otlp"   // OTLP over HTTP; endpoint from OTEL_EXPORTER_OTLP_ENDPOINT
+	TraceExporterStdout = "stdout" // pretty printed JSON on stdout, for local runs
+)
+
+const serviceName = "csv_query"
+
+// Span attributes
+const (
+	attrChannel  = attribute.Key("csv.channel")
+	attrKey      = attribute.Key("csv.key")
+	attrMode     = attribute.Key("csv.upload_mode")
+	attrSegment  = attribute.Key("csv.segment")
+	attrSegments = attribute.Key("csv.segments")
+	attrRows     = attribute.Key("csv.rows")
+	attrBytes    = attribute.Key("csv.bytes")
+	attrObjects  = attribute.Key("csv.objects")
+	attrPart     = attribute.Key("csv.part")
+	attrParts    = attribute.Key("csv.parts")
+)
+
+var tracer = otel.Tracer(serviceName)
+
+// initTracing installs the global tracer provider and the W3C trace context
+// propagator. The returned function flushes pending spans.
+func initTracing(exporter string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var spanExporter sdktrace.SpanExporter
+	var err error
+	switch exporter {
+	case TraceExporterNone:
+		return func(context.Context) error { return nil }, nil
+	case TraceExporterOTLP:
+		spanExporter, err = otlptracehttp.New(context.Background())
+	case TraceExporterStdout:
+		spanExporter, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q, expected %q or %q", exporter, TraceExporterOTLP, TraceExporterStdout)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s trace exporter: %w", exporter, err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(attribute.String("service.name", serviceName)))
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(spanExporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// withTracing starts a server span per request, continuing the caller's trace
+// if the request carries one. Spans are named after the matched route pattern,
+// which includes the method.
+func withTracing(mux *Router, next http.Handler) http.Handler {
+	return otelhttp.NewHandler(next, "http.server",
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			if _, route := mux.Handler(r); route != "" {
+				return route
+			}
+			return r.Method + " unmatched"
+		}),
+		otelhttp.WithFilter(func(r *http.Request) bool {
+			return !isProbePath(r.URL.Path)
+		}),
+	)
+}
+
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan ends span, marking it failed if *err is set. It is meant to be
+// deferred with a pointer to a named error result.
+func endSpan(span trace.Span, err *error) {
+	if *err != nil {
+		span.RecordError(*err)
+		span.SetStatus(codes.Error, (*err).Error())
+	}
+	span.End()
+}
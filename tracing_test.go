@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	spanRecorderOnce sync.Once
+	spanRecorder     *tracetest.SpanRecorder
+)
+
+// recordSpans installs a global tracer provider that keeps every ended span.
+// The global tracer delegates to the first provider installed, so all tests
+// share one recorder and tell their spans apart by trace ID.
+func recordSpans() *tracetest.SpanRecorder {
+	spanRecorderOnce.Do(func() {
+		spanRecorder = tracetest.NewSpanRecorder()
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spanRecorder)))
+		otel.SetTextMapPropagator(propagation.TraceContext{})
+	})
+	return spanRecorder
+}
+
+// spansOf returns the ended spans of a trace by name
+func spansOf(recorder *tracetest.SpanRecorder, traceID trace.TraceID) map[string][]sdktrace.ReadOnlySpan {
+	spans := make(map[string][]sdktrace.ReadOnlySpan)
+	for _, span := range recorder.Ended() {
+		if span.SpanContext().TraceID() == traceID {
+			spans[span.Name()] = append(spans[span.Name()], span)
+		}
+	}
+	return spans
+}
+
+func TestInitTracing(t *testing.T) {
+	tests := []struct {
+		exporter string
+		wantErr  bool
+	}{
+		{TraceExporterNone, false},
+		{"zipkin", true},
+	}
+	for _, tt := range tests {
+		shutdown, err := initTracing(tt.exporter)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("initTracing(%q) error = %v, want error %v", tt.exporter, err, tt.wantErr)
+		}
+		if err == nil {
+			if err := shutdown(context.Background()); err != nil {
+				t.Errorf("shutdown: %v", err)
+			}
+		}
+	}
+}
+
+func TestEndSpan(t *testing.T) {
+	recorder := recordSpans()
+	tests := []struct {
+		name       string
+		err        error
+		wantStatus codes.Code
+		wantEvents int
+	}{
+		{"success", nil, codes.Unset, 0},
+		{"failure", errors.New("boom"), codes.Error, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, span := startSpan(context.Background(), "end span "+tt.name, attrRows.Int(3))
+			err := tt.err
+			endSpan(span, &err)
+
+			ended := spansOf(recorder, span.SpanContext().TraceID())["end span "+tt.name]
+			if len(ended) != 1 {
+				t.Fatalf("recorded %d spans, want 1", len(ended))
+			}
+			if got := ended[0].Status().Code; got != tt.wantStatus {
+				t.Errorf("status %v, want %v", got, tt.wantStatus)
+			}
+			if got := len(ended[0].Events()); got != tt.wantEvents {
+				t.Errorf("%d events, want %d", got, tt.wantEvents)
+			}
+		})
+	}
+}
+
+func TestRequestSpans(t *testing.T) {
+	recorder := recordSpans()
+	const traceParent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	traceID, _ := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+
+	tests := []struct {
+		name      string
+		mode      string
+		wantSpans []string
+	}{
+		{"fine", UploadModeFineGrained, []string{"upload fine", "segment", "S3 PutObject"}},
+		{"batch", UploadModeBatch, []string{"upload batch", "S3 BatchUpload"}},
+		{"stream", UploadModeStream, []string{"upload stream", "csv read", "segment", "segment encode"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t, nil)
+			handler := withTracing(ts.router, ts.handler)
+			before := len(spansOf(recorder, traceID)["POST /cht/v1/file/csv/{channelId}/{fileName}"])
+
+			r := httptest.NewRequest(http.MethodPost, "/cht/v1/file/csv/ch/data.csv?mode="+tt.mode, strings.NewReader(testCSV(30)))
+			r.Header.Set("traceparent", traceParent)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != http.StatusCreated {
+				t.Fatalf("upload: status %d: %s", w.Code, w.Body)
+			}
+
+			spans := spansOf(recorder, traceID)
+			servers := spans["POST /cht/v1/file/csv/{channelId}/{fileName}"]
+			if len(servers) != before+1 {
+				t.Fatalf("recorded %d server spans in the caller's trace, want %d", len(servers), before+1)
+			}
+			if server := servers[len(servers)-1]; !server.Parent().IsRemote() || server.SpanKind() != trace.SpanKindServer {
+				t.Errorf("server span parent %v kind %v, want the caller's span", server.Parent(), server.SpanKind())
+			}
+			for _, name := range tt.wantSpans {
+				if len(spans[name]) == 0 {
+					t.Errorf("no %q span in the request's trace", name)
+				}
+			}
+		})
+	}
+
+	t.Run("probes are not traced", func(t *testing.T) {
+		ts := newTestServer(t, nil)
+		r := httptest.NewRequest(http.MethodGet, healthzPath, nil)
+		r.Header.Set("traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+		withTracing(ts.router, ts.handler).ServeHTTP(httptest.NewRecorder(), r)
+
+		probeTrace, _ := trace.TraceIDFromHex("0af7651916cd43dd8448eb211c80319c")
+		if spans := spansOf(recorder, probeTrace); len(spans) != 0 {
+			t.Errorf("probe recorded spans %v", spans)
+		}
+	})
+}
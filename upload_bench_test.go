@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"runtime/metrics"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// benchmarkCSV is a 32MB file of wide rows, about 4KB each
+var benchmarkCSV = sync.OnceValue(func() []byte { return wideRowsCSV(32 * 1024 * 1024) })
+
+// wideRowsCSV returns a file of about size bytes in rows of about 4KB
+func wideRowsCSV(size int) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("id,name,email,notes\n")
+	notes := strings.Repeat("lorem ipsum dolor sit amet ", 150)
+	for i := 0; buf.Len() < size; i++ {
+		fmt.Fprintf(&buf, "%d,user %d,user%d@example.com,%q\n", i, i, i, notes)
+	}
+	return buf.Bytes()
+}
+
+// BenchmarkUploadModes reports the peak heap of processUpload for each mode,
+// above the heap live before the upload starts, against an in-process S3
+// endpoint that discards what it receives. Garbage not yet collected counts
+// too, so the numbers move with GOGC.
+//
+//	go test -run '^$' -bench BenchmarkUploadModes -benchtime 3x
+func BenchmarkUploadModes(b *testing.B) {
+	for _, mode := range []string{UploadModeFineGrained, UploadModeCoarseGrained, UploadModeBatch, UploadModeStream} {
+		for _, compression := range []string{CompressionNone, CompressionGzip} {
+			b.Run(mode+"/"+compression, func(b *testing.B) {
+				handler := newBenchmarkUploadHandler(b)
+				config := UploadConfig{
+					UploadMode:   mode,
+					SegmentSize:  DefaultConfig.Upload.SegmentSize,
+					SegmentBytes: DefaultConfig.Upload.SegmentBytes,
+					Compression:  compression,
+					MemoryBudget: DefaultConfig.Upload.MemoryBudget,
+				}
+				if mode == UploadModeStream {
+					config.Workers = DefaultConfig.Upload.Workers
+				}
+
+				data := benchmarkCSV()
+				b.SetBytes(int64(len(data)))
+				b.ReportAllocs()
+				var peak uint64
+				for i := 0; i < b.N; i++ {
+					req := uploadRequest{
+						channelID: "bench",
+						fileName:  "bench.csv",
+						ext:       ".csv",
+						uploadID:  newUploadID(),
+						size:      int64(len(data)),
+						body:      bytes.NewReader(data),
+						config:    config,
+						logger:    slog.New(slog.NewTextHandler(io.Discard, nil)),
+						ctx:       context.Background(),
+					}
+					req.basePath = "csv_upload/bench/" + req.uploadID
+
+					runtime.GC()
+					baseline := heapObjectBytes()
+					var iterationPeak uint64
+					stop := sampleHeap(&iterationPeak)
+					_, err := handler.processUpload(req)
+					stop()
+					if err != nil {
+						b.Fatal(err)
+					}
+					if iterationPeak > baseline && iterationPeak-baseline > peak {
+						peak = iterationPeak - baseline
+					}
+				}
+				b.ReportMetric(float64(peak)/1024/1024, "peak-heap-MB")
+			})
+		}
+	}
+}
+
+func heapObjectBytes() uint64 {
+	samples := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+	metrics.Read(samples)
+	return samples[0].Value.Uint64()
+}
+
+// sampleHeap records the largest heap seen until the returned function is called
+func sampleHeap(peak *uint64) (stop func()) {
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		ticker := time.NewTicker(time.Millisecond)
+		defer ticker.Stop()
+		for {
+			if heap := heapObjectBytes(); heap > atomic.LoadUint64(peak) {
+				atomic.StoreUint64(peak, heap)
+			}
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-finished
+	}
+}
+
+func newBenchmarkUploadHandler(b testing.TB) *UploadHandler {
+	server := httptest.NewServer(http.HandlerFunc(fakeS3))
+	b.Cleanup(server.Close)
+
+	sess, err := session.NewSession(aws.NewConfig().
+		WithRegion("ap-northeast-2").
+		WithEndpoint(server.URL).
+		WithS3ForcePathStyle(true).
+		WithCredentials(credentials.NewStaticCredentials("bench", "bench", "")).
+		WithMaxRetries(0))
+	if err != nil {
+		b.Fatal(err)
+	}
+	client := s3.New(sess)
+	s3Client := &S3Client{
+		client:      client,
+		uploader:    s3manager.NewUploaderWithClient(client),
+		Bucket:      "bench",
+		RetryPolicy: DefaultRetryPolicy,
+		Encryption:  DefaultServerSideEncryption,
+
+		PartSize:        DefaultConfig.Storage.PartSize,
+		PartConcurrency: DefaultConfig.Storage.PartConcurrency,
+	}
+
+	config := DefaultConfig
+	return NewUploadHandler(s3Client, NewJobStore(), nil, nil, NewRetentionManager(s3Client, RetentionConfig{}), nil, &config, NewUploadTracker())
+}
+
+// fakeS3 accepts and discards every write, including multipart uploads
+func fakeS3(w http.ResponseWriter, r *http.Request) {
+	io.Copy(io.Discard, r.Body)
+	query := r.URL.Query()
+	switch {
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		fmt.Fprint(w, `<InitiateMultipartUploadResult><UploadId>bench</UploadId></InitiateMultipartUploadResult>`)
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		fmt.Fprint(w, `<CompleteMultipartUploadResult><ETag>"bench"</ETag></CompleteMultipartUploadResult>`)
+	case r.Method == http.MethodPut:
+		w.Header().Set("ETag", `"bench"`)
+	case r.Method == http.MethodDelete:
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `<Error><Code>NoSuchKey</Code></Error>`)
+	}
+}
+
+// liveHeap collects garbage and returns the heap it found live
+func liveHeap() uint64 {
+	runtime.GC()
+	samples := []metrics.Sample{{Name: "/gc/heap/live:bytes"}}
+	metrics.Read(samples)
+	return samples[0].Value.Uint64()
+}
+
+// heapSampledReader samples the live heap every interval bytes read. Sampling
+// from the goroutine that parses the file keeps its garbage from piling up
+// while a collection runs, which would otherwise count as live.
+type heapSampledReader struct {
+	io.Reader
+	interval int
+	unread   int
+	peak     uint64
+}
+
+func (r *heapSampledReader) Read(p []byte) (int, error) {
+	if r.unread <= 0 {
+		r.peak = max(r.peak, liveHeap())
+		r.unread = r.interval
+	}
+	n, err := r.Reader.Read(p[:min(len(p), r.unread)])
+	r.unread -= n
+	return n, err
+}
+
+// TestUploadMemoryStaysWithinBudget checks the live heap of an upload, sampled
+// right after garbage collections, against its memory budget. Unlike the
+// benchmark's numbers these leave out garbage not yet collected.
+func TestUploadMemoryStaysWithinBudget(t *testing.T) {
+	if testing.Short() {
+		t.Skip("collects garbage throughout the upload")
+	}
+	// Room for one part of the original and the segments
+	const budget = 12 * 1024 * 1024
+	// Reader, HTTP and SDK state that is not charged to the budget
+	const overhead = 1024 * 1024
+	handler := newBenchmarkUploadHandler(t)
+	handler.s3Client.PartSize = minPartSize
+	data := wideRowsCSV(16 * 1024 * 1024)
+
+	tests := []struct {
+		mode         string
+		compression  string
+		keepOriginal bool
+	}{
+		{UploadModeFineGrained, CompressionNone, false},
+		{UploadModeCoarseGrained, CompressionGzip, false},
+		{UploadModeBatch, CompressionNone, false},
+		{UploadModeBatch, CompressionGzip, false},
+		{UploadModeStream, CompressionNone, false},
+		{UploadModeStream, CompressionGzip, false},
+		{UploadModeFineGrained, CompressionNone, true},
+		{UploadModeBatch, CompressionNone, true},
+		{UploadModeStream, CompressionGzip, true},
+	}
+	for _, tt := range tests {
+		name := tt.mode + "/" + tt.compression
+		if tt.keepOriginal {
+			name += "/original"
+		}
+		t.Run(name, func(t *testing.T) {
+			var logs bytes.Buffer
+			body := &heapSampledReader{Reader: bytes.NewReader(data), interval: 128 * 1024}
+			req := uploadRequest{
+				channelID: "memory",
+				fileName:  "memory.csv",
+				ext:       ".csv",
+				uploadID:  newUploadID(),
+				size:      int64(len(data)),
+				body:      body,
+				config: UploadConfig{
+					UploadMode:   tt.mode,
+					SegmentSize:  DefaultConfig.Upload.MaxSegmentSize,
+					SegmentBytes: 512 * 1024,
+					Compression:  tt.compression,
+					MemoryBudget: budget,
+					KeepOriginal: tt.keepOriginal,
+				},
+				logger: slog.New(slog.NewJSONHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug})),
+				ctx:    context.Background(),
+			}
+			req.basePath = "csv_upload/memory/" + req.uploadID
+			if tt.mode == UploadModeStream {
+				req.config.Workers = 8
+			}
+
+			// Pooled buffers of earlier uploads are dropped by two collections
+			liveHeap()
+			baseline := liveHeap()
+			response, err := handler.processUpload(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if response.Chunks < 10 {
+				t.Fatalf("%d segments, want enough to fill the budget", response.Chunks)
+			}
+
+			var reserved float64
+			for _, line := range logLines(t, &logs) {
+				if line["msg"] == "Segments stored" {
+					reserved = line["peak_memory_bytes"].(float64)
+				}
+			}
+			if reserved == 0 || reserved > budget {
+				t.Errorf("reserved up to %.0f bytes of a %d byte budget", reserved, budget)
+			}
+			grown := int64(body.peak) - int64(baseline)
+			if grown > budget+overhead {
+				t.Errorf("live heap grew by %d bytes, budget %d", grown, budget)
+			}
+			t.Logf("reserved %.0f, live heap grew by %d", reserved, grown)
+		})
+	}
+}
@@ -1,29 +1,43 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
+	"net/url"
+	"os"
 	"path/filepath"
+	"strconv"
+	"sync"
 	"time"
 )
 
 const (
-	SEGMENT_SIZE  = 50000             // rows per segment (increased from 10,000)
-	MAX_FILE_SIZE = 100 * 1024 * 1024 // 100MB in bytes
-
 	UploadModeFineGrained   = "fine"
 	UploadModeCoarseGrained = "coarse"
 	UploadModeBatch         = "batch"
 	UploadModeStream        = "stream"
+
+	maxReserveAttempts = 3 // attempts to claim a unique upload path
 )
 
+// errMalformedCSV marks read failures caused by the uploaded content itself
+var errMalformedCSV = errors.New("malformed CSV")
+
 type UploadHandler struct {
-	s3Client *S3Client
+	s3Client    *S3Client
+	jobs        *JobStore
+	sessions    *SessionStore
+	idempotency *IdempotencyStore
+	retention   *RetentionManager
+	envelope    *EnvelopeEncryption
+	config      *Config
+	uploads     *UploadTracker
 }
 
 type UploadResponse struct {
@@ -36,12 +50,32 @@ type UploadResponse struct {
 	Size        int64  `json:"size"`
 	ContentType string `json:"contentType"`
 	Chunks      int    `json:"chunks"`
+	Rows        int    `json:"rows"` // data rows, excluding the header
+
+	// Settings the upload was processed with, after defaults were applied
+	Mode         string `json:"mode"`
+	SegmentSize  int    `json:"segmentSize"`
+	SegmentBytes int64  `json:"segmentBytes,omitempty"` // absent when segments are cut at the memory budget
+	Workers      int    `json:"workers,omitempty"`      // stream mode only
+	Compression  string `json:"compression"`
+
+	OriginalSHA256 string `json:"originalSha256,omitempty"` // checksum of the stored original, when it was kept
+
+	Deduplicated bool   `json:"deduplicated,omitempty"` // identical content was already uploaded to the channel
+	AliasOf      string `json:"aliasOf,omitempty"`      // key holding the data when Key is an alias
+
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"` // when the upload is deleted by retention
 }
 
 type UploadConfig struct {
-	SegmentSize int
-	UploadMode  string
-	Workers     int // Number of concurrent workers for streaming mode
+	SegmentSize  int   // most rows per segment
+	SegmentBytes int64 // encoded bytes a segment is cut at; 0 cuts at MemoryBudget
+	UploadMode   string
+	Workers      int    // Number of concurrent workers for streaming mode, 0 for other modes
+	Compression  string // CompressionNone or CompressionGzip
+	KeepOriginal bool   // tee the request body into the original object
+
+	MemoryBudget int64 // bytes of encoded segments held at once, from the configuration
 }
 
 type SegmentStats struct {
@@ -50,340 +84,960 @@ type SegmentStats struct {
 	DataSize       int           // 세그먼트 데이터 크기 (bytes)
 }
 
-func NewUploadHandler(s3Client *S3Client) *UploadHandler {
-	return &UploadHandler{s3Client: s3Client}
+// uploadRequest carries a validated upload from the HTTP layer to processUpload
+type uploadRequest struct {
+	channelID string
+	fileName  string
+	ext       string
+	uploadID  string
+	basePath  string
+	size      int64
+	body      io.Reader
+	config    UploadConfig
+	job       *UploadJob      // progress sink for async uploads, nil otherwise
+	cipher    *segmentCipher  // envelope encryption of segments, nil when disabled
+	budget    *memoryBudget   // bounds the buffers the upload holds at once
+	logger    *slog.Logger    // tagged with the request ID, channel and key
+	ctx       context.Context // carries the trace; detached from cancellation for async uploads
 }
 
+func NewUploadHandler(s3Client *S3Client, jobs *JobStore, sessions *SessionStore, idempotency *IdempotencyStore, retention *RetentionManager, envelope *EnvelopeEncryption, config *Config, uploads *UploadTracker) *UploadHandler {
+	return &UploadHandler{
+		s3Client:    s3Client,
+		jobs:        jobs,
+		sessions:    sessions,
+		idempotency: idempotency,
+		retention:   retention,
+		envelope:    envelope,
+		config:      config,
+		uploads:     uploads,
+	}
+}
+
+// HandleUpload stores a CSV/TSV upload. The upload mode, segment size, number
+// of stream workers and compression come from query parameters.
 func (h *UploadHandler) HandleUpload(w http.ResponseWriter, r *http.Request) {
-	// 기본 설정으로 HandleUploadWithConfig 호출
-	h.HandleUploadWithConfig(w, r, UploadConfig{
-		SegmentSize: SEGMENT_SIZE,
-		UploadMode:  UploadModeFineGrained,
-	})
+	config, err := h.parseUploadConfig(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, ErrCodeInvalidParameter, err.Error())
+		return
+	}
+	h.HandleUploadWithConfig(w, r, config)
 }
 
 func (h *UploadHandler) HandleUploadWithConfig(w http.ResponseWriter, r *http.Request, config UploadConfig) {
-	timer := NewTimeCheck()
-	defer timer.End()
+	channelID := r.PathValue("channelId")
+	limits := h.config.uploadFor(channelID)
 
 	// Check content length
-	if r.ContentLength > MAX_FILE_SIZE {
-		http.Error(w, "File too large", http.StatusRequestEntityTooLarge)
+	if r.ContentLength > limits.MaxFileSize {
+		writeErrorDetails(w, r, http.StatusRequestEntityTooLarge, ErrCodeFileTooLarge, "File too large", map[string]interface{}{"maxBytes": limits.MaxFileSize})
 		return
 	}
 
-	// Get filename from URL
-	fileName, ok := r.Context().Value(fileNameKey).(string)
-	if !ok || fileName == "" {
-		http.Error(w, "Filename is required", http.StatusBadRequest)
+	async, err := parseAsync(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, ErrCodeInvalidParameter, err.Error())
+		return
+	}
+
+	release, ok := h.uploads.Begin()
+	if !ok {
+		writeShuttingDown(w, r)
 		return
 	}
+	// Async uploads release the tracker when their job finishes
+	background := false
+	defer func() {
+		if !background {
+			release()
+		}
+	}()
+
+	// Idempotency-Key: replay or reject before a new upload path is allocated
+	idempotencyKey := r.Header.Get(idempotencyKeyHeader)
+	event := auditEventFromContext(r.Context())
+	event.describe(AuditActionUpload, channelID, "")
+	var body *hashingBody
+	if idempotencyKey != "" {
+		if !h.beginIdempotent(w, r, channelID, idempotencyKey) {
+			return
+		}
+		body = newHashingBody(r.Body)
+		r.Body = body
+	}
+	// finishIdempotent records successful uploads and releases the key.
+	// Failed uploads are not recorded so the client can retry with the same key.
+	finishIdempotent := func(response *UploadResponse, err error) {
+		if body == nil {
+			return
+		}
+		defer h.idempotency.End(channelID, idempotencyKey)
+		if err == nil {
+			// The upload itself succeeded, so a failed record is only logged
+			if err := h.idempotency.Save(context.WithoutCancel(r.Context()), channelID, idempotencyKey, body.Sum(), response); err != nil {
+				loggerFromContext(r.Context()).Error("Failed to save idempotency record", "channel", channelID, "error", err)
+			}
+		}
+	}
+
+	req, ok := h.prepareUpload(w, r, config)
+	if !ok {
+		finishIdempotent(nil, errors.New("invalid upload request"))
+		return
+	}
+	event.setKey(req.basePath)
+
+	// 비동기 모드: 바디만 받아두고 202 응답 후 백그라운드에서 처리
+	if async {
+		background = true
+		h.startUploadJob(w, r, req, func(response *UploadResponse, err error) {
+			finishIdempotent(response, err)
+			release()
+		})
+		return
+	}
+
+	response, err := h.processUpload(req)
+	if err == nil && body != nil {
+		if err = body.Drain(limits.MaxFileSize); err != nil {
+			h.discardUpload(req, err)
+		}
+	}
+	finishIdempotent(response, err)
+	if err != nil {
+		writeUploadError(w, r, err)
+		return
+	}
+	event.setKey(response.Key)
+	event.setRows(0, response.Rows)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(response)
+}
+
+// prepareUpload validates the upload target from the request path and
+// allocates its storage path. It writes the error response itself on failure.
+func (h *UploadHandler) prepareUpload(w http.ResponseWriter, r *http.Request, config UploadConfig) (uploadRequest, bool) {
+	// Get filename from URL
+	fileName := r.PathValue("fileName")
+	if fileName == "" {
+		writeError(w, r, http.StatusBadRequest, ErrCodeMissingParameter, "Filename is required")
+		return uploadRequest{}, false
+	}
 
 	// Validate file type
 	ext := filepath.Ext(fileName)
 	if ext != ".csv" && ext != ".tsv" {
-		http.Error(w, "Invalid file type", http.StatusBadRequest)
-		return
+		writeErrorDetails(w, r, http.StatusBadRequest, ErrCodeInvalidFileType, "Invalid file type", map[string]interface{}{"allowed": []string{".csv", ".tsv"}})
+		return uploadRequest{}, false
 	}
 
 	// Generate storage path
-	channelID, ok := r.Context().Value(channelIDKey).(string)
-	if !ok || channelID == "" {
-		http.Error(w, "Channel ID is required", http.StatusBadRequest)
-		return
+	channelID := r.PathValue("channelId")
+	if channelID == "" {
+		writeError(w, r, http.StatusBadRequest, ErrCodeMissingParameter, "Channel ID is required")
+		return uploadRequest{}, false
+	}
+
+	// Allocate a unique, time-sortable storage path and claim it in storage.
+	// A conflict is practically impossible with ULIDs, but retry with a fresh ID if it happens.
+	var uploadID, basePath string
+	for attempt := 1; ; attempt++ {
+		uploadID = newUploadID()
+		basePath = fmt.Sprintf("csv_upload/%s/%s", channelID, uploadID)
+
+		// Validate upload path
+		if err := h.s3Client.ValidateUploadKey(basePath); err != nil {
+			writeError(w, r, http.StatusBadRequest, ErrCodeInvalidPath, "Invalid upload path")
+			return uploadRequest{}, false
+		}
+
+		err := h.s3Client.ReserveUploadKey(r.Context(), basePath)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, ErrConflict) || attempt == maxReserveAttempts {
+			writeStorageError(w, r, "Failed to reserve upload path", err)
+			return uploadRequest{}, false
+		}
+		loggerFromContext(r.Context()).Warn("Upload path already taken, retrying with a new ID", "key", basePath)
 	}
 
-	timestamp := time.Now().Format("2006-01-02-15-04-05")
-	basePath := fmt.Sprintf("csv_upload/%s/%s", channelID, timestamp)
+	return uploadRequest{
+		channelID: channelID,
+		fileName:  fileName,
+		ext:       ext,
+		uploadID:  uploadID,
+		basePath:  basePath,
+		size:      r.ContentLength,
+		body:      r.Body,
+		config:    config,
+		logger:    loggerFromContext(r.Context()).With("channel", channelID, "key", basePath),
+		ctx:       r.Context(),
+	}, true
+}
+
+// parseUploadConfig reads the optional mode, segmentSize, segmentBytes, workers,
+// compression and keepOriginal query parameters, checks them against the
+// configured limits and fills in the channel's defaults for the ones that are absent
+func (h *UploadHandler) parseUploadConfig(r *http.Request) (UploadConfig, error) {
+	query := r.URL.Query()
+	limits := h.config.uploadFor(r.PathValue("channelId"))
+	config := UploadConfig{
+		UploadMode:   UploadModeFineGrained,
+		SegmentBytes: limits.SegmentBytes,
+		Compression:  limits.Compression,
+		KeepOriginal: limits.KeepOriginal,
+		MemoryBudget: limits.MemoryBudget,
+	}
+	if mode := query.Get("mode"); mode != "" {
+		switch mode {
+		case UploadModeFineGrained, UploadModeCoarseGrained, UploadModeBatch, UploadModeStream:
+			config.UploadMode = mode
+		default:
+			return UploadConfig{}, fmt.Errorf("Invalid mode parameter. Must be fine, coarse, batch or stream")
+		}
+	}
 
-	// Validate upload path
-	if err := h.s3Client.ValidateUploadKey(basePath); err != nil {
-		http.Error(w, "Invalid upload path", http.StatusBadRequest)
+	var err error
+	if config.SegmentSize, err = positiveIntParam(query, "segmentSize"); err != nil {
+		return UploadConfig{}, err
+	}
+	segmentBytes, err := positiveIntParam(query, "segmentBytes")
+	if err != nil {
+		return UploadConfig{}, err
+	}
+	if segmentBytes > 0 {
+		if int64(segmentBytes) < limits.MinSegmentBytes || int64(segmentBytes) > limits.MaxSegmentBytes {
+			return UploadConfig{}, fmt.Errorf("Invalid segmentBytes parameter. Must be between %d and %d", limits.MinSegmentBytes, limits.MaxSegmentBytes)
+		}
+		config.SegmentBytes = int64(segmentBytes)
+	}
+	if config.Workers, err = positiveIntParam(query, "workers"); err != nil {
+		return UploadConfig{}, err
+	}
+	if config.Workers > 0 && config.UploadMode != UploadModeStream {
+		return UploadConfig{}, fmt.Errorf("Invalid workers parameter. Only stream mode uses workers")
+	}
+	if compression := query.Get("compression"); compression != "" {
+		if !validCompression(compression) {
+			return UploadConfig{}, fmt.Errorf("Invalid compression parameter. Must be none or gzip")
+		}
+		config.Compression = compression
+	}
+	if keepStr := query.Get("keepOriginal"); keepStr != "" {
+		keep, err := strconv.ParseBool(keepStr)
+		if err != nil {
+			return UploadConfig{}, fmt.Errorf("Invalid keepOriginal parameter. Must be true or false")
+		}
+		// The original is stored as received, which would bypass envelope encryption
+		if keep && h.envelope.enabled() {
+			return UploadConfig{}, fmt.Errorf("Invalid keepOriginal parameter. Not available while envelope encryption is enabled")
+		}
+		config.KeepOriginal = keep
+	}
+
+	switch {
+	case config.SegmentSize == 0:
+		config.SegmentSize = limits.segmentSizeFor(config.UploadMode)
+	case config.SegmentSize < limits.MinSegmentSize || config.SegmentSize > limits.MaxSegmentSize:
+		return UploadConfig{}, fmt.Errorf("Invalid segmentSize parameter. Must be between %d and %d", limits.MinSegmentSize, limits.MaxSegmentSize)
+	}
+	if config.UploadMode == UploadModeStream {
+		switch {
+		case config.Workers == 0:
+			config.Workers = limits.Workers
+		case config.Workers > limits.MaxWorkers:
+			return UploadConfig{}, fmt.Errorf("Invalid workers parameter. Must be between 1 and %d", limits.MaxWorkers)
+		}
+	}
+	return config, nil
+}
+
+// positiveIntParam reads an optional positive integer query parameter, 0 if absent
+func positiveIntParam(query url.Values, name string) (int, error) {
+	value := query.Get(name)
+	if value == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("Invalid %s parameter. Must be a positive integer", name)
+	}
+	return n, nil
+}
+
+// parseAsync reads the optional async query parameter
+func parseAsync(r *http.Request) (bool, error) {
+	asyncStr := r.URL.Query().Get("async")
+	if asyncStr == "" {
+		return false, nil
+	}
+	async, err := strconv.ParseBool(asyncStr)
+	if err != nil {
+		return false, fmt.Errorf("Invalid async parameter. Must be true or false")
+	}
+	return async, nil
+}
+
+// startUploadJob spools the request body to a temp file, registers a job and
+// processes the upload in the background. done, if set, runs once the request
+// has been answered or the job has finished.
+func (h *UploadHandler) startUploadJob(w http.ResponseWriter, r *http.Request, req uploadRequest, done func(*UploadResponse, error)) {
+	spool, err := os.CreateTemp("", "csv-upload-*")
+	if err != nil {
+		h.discardUpload(req, err)
+		if done != nil {
+			done(nil, err)
+		}
+		writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, fmt.Sprintf("Failed to buffer upload: %v", err))
+		return
+	}
+	cleanup := func() {
+		spool.Close()
+		os.Remove(spool.Name())
+	}
+	fail := func(err error) {
+		cleanup()
+		h.discardUpload(req, err)
+		if done != nil {
+			done(nil, err)
+		}
+	}
+
+	maxFileSize := h.config.uploadFor(req.channelID).MaxFileSize
+	size, err := io.Copy(spool, io.LimitReader(r.Body, maxFileSize+1))
+	if err != nil {
+		fail(err)
+		writeError(w, r, http.StatusBadRequest, ErrCodeInvalidParameter, fmt.Sprintf("Failed to read request body: %v", err))
+		return
+	}
+	if size > maxFileSize {
+		fail(errors.New("file too large"))
+		writeErrorDetails(w, r, http.StatusRequestEntityTooLarge, ErrCodeFileTooLarge, "File too large", map[string]interface{}{"maxBytes": maxFileSize})
+		return
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		fail(err)
+		writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, fmt.Sprintf("Failed to buffer upload: %v", err))
 		return
 	}
 
+	req.body = spool
+	req.size = size
+	h.runUploadJob(w, req, func(response *UploadResponse, err error) {
+		cleanup()
+		if done != nil {
+			done(response, err)
+		}
+	})
+}
+
+// runUploadJob processes req in the background and answers 202 with the job status.
+// done, if set, runs after processing finishes.
+func (h *UploadHandler) runUploadJob(w http.ResponseWriter, req uploadRequest, done func(*UploadResponse, error)) {
+	req.job = h.jobs.Create(req.channelID, req.fileName, req.size)
+	req.logger = req.logger.With("job_id", req.job.ID)
+	req.ctx = context.WithoutCancel(req.ctx)
+
+	go func() {
+		req.job.start()
+		response, err := h.processUpload(req)
+		if err != nil {
+			req.logger.Error("Upload job failed", "error", err)
+		}
+		req.job.finish(response, err)
+		if done != nil {
+			done(response, err)
+		}
+	}()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", jobStatusPath(req.job.ID))
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(req.job.Status())
+}
+
+// processUpload segments the body and stores it, reporting progress to req.job if set
+func (h *UploadHandler) processUpload(req uploadRequest) (response *UploadResponse, err error) {
+	start := time.Now()
+	// Shutdown aborts uploads that are still running at its deadline
+	abortable, stop := h.uploads.abortable(req.ctx)
+	defer stop()
+	ctx, span := startSpan(abortable, "upload "+req.config.UploadMode,
+		attrChannel.String(req.channelID), attrKey.String(req.basePath), attrMode.String(req.config.UploadMode))
+	req.ctx = ctx
+	defer func() {
+		if err != nil {
+			if errors.Is(context.Cause(abortable), errShuttingDown) {
+				response, err = nil, fmt.Errorf("upload aborted: %w", errShuttingDown)
+			}
+			h.discardUpload(req, err)
+		}
+		if response != nil {
+			span.SetAttributes(attrRows.Int(response.Rows), attrSegments.Int(response.Chunks))
+		}
+		endSpan(span, &err)
+		observeUpload(req.config.UploadMode, start, response, err)
+	}()
+
+	basePath := req.basePath
+	config := req.config
+	job := req.job
+	logger := req.logger
+
+	// 원본 보관이 켜져 있으면 요청 본문을 읽는 그대로 original 객체에 기록
+	body := req.body
+	segmentBudget := config.MemoryBudget
+	var original *originalWriter
+	if config.KeepOriginal {
+		partBudget := originalPartBudget(config.MemoryBudget, h.s3Client.PartSize, h.s3Client.PartConcurrency)
+		segmentBudget = max(segmentBudget-partBudget, 0)
+		original = newOriginalWriter(req.ctx, h.s3Client, basePath, newMemoryBudget(partBudget))
+		// No-op once committed; discards the original of a failed upload
+		defer original.Abort()
+		body = io.TeeReader(body, original)
+	}
+
 	// Process file in segments
-	reader := csv.NewReader(r.Body)
+	reader := csv.NewReader(&progressReader{r: body, job: job})
 	csvHeader, err := reader.Read()
 	if err != nil {
-		http.Error(w, "Failed to read header", http.StatusUnprocessableEntity)
-		return
+		return nil, readError("failed to read header", err)
+	}
+	content := newContentHasher()
+	content.Write(csvHeader)
+	pii := newPIIDetector(csvHeader)
+	observeRow := func(row []string) {
+		content.Write(row)
+		pii.Write(row)
 	}
 
+	// 봉투 암호화가 켜져 있으면 업로드마다 새 데이터 키로 세그먼트를 암호화
+	segCipher, encryption, err := h.envelope.newUploadCipher()
+	if err != nil {
+		return nil, err
+	}
+	req.cipher = segCipher
+	req.budget = newMemoryBudget(segmentBudget)
+
 	// Set the number of expected fields per record -> 테스트 필요
 	// reader.FieldsPerRecord = -1
 
+	// Rows are encoded into segment buffers as soon as they are read and never
+	// kept, so the reader can reuse its record slice. Set after the header is
+	// read, so csvHeader keeps its own slice.
+	reader.ReuseRecord = true
+
 	var segmentCount int
+	var segmentStats []SegmentMetadata
 	if config.UploadMode == UploadModeStream {
-		err = h.handleStreamUpload(basePath, csvHeader, reader, config)
+		segmentStats, err = h.handleStreamUpload(&req, csvHeader, reader, observeRow)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Failed to stream upload: %v", err), http.StatusInternalServerError)
-			return
+			return nil, fmt.Errorf("failed to stream upload: %w", err)
 		}
+		segmentCount = len(segmentStats)
 	} else {
-		var segments [][][]string
-		var currentSegment [][]string
-		segmentCount = 0
+		segmenter := newSegmenter(&req, csvHeader)
+
+		// 배치 모드: 메모리 예산이 허락하는 만큼 세그먼트를 모아 한 번에 업로드
+		var batch []*encodedSegment
+		var uploadTargets []S3UploadDTO
+		uploadBatch := func() error {
+			if len(batch) == 0 {
+				return nil
+			}
+			logger.Info("Starting batch upload", "segments", len(batch))
+			start := time.Now()
+			err := h.s3Client.BatchUpload(req.ctx, uploadTargets)
+			for _, segment := range batch {
+				segment.release()
+			}
+			if err != nil {
+				return fmt.Errorf("failed to batch upload segments: %w", err)
+			}
+			duration := time.Since(start)
+			logger.Info("Batch upload completed", "segments", len(batch), "duration_ms", duration.Milliseconds())
+
+			// 배치는 한 번에 올라가므로 소요 시간을 세그먼트 수로 나눠 기록
+			for _, segment := range segmentStats[len(segmentStats)-len(batch):] {
+				job.recordSegment(SegmentStats{
+					SegmentSize:    segment.Rows,
+					UploadDuration: duration / time.Duration(len(batch)),
+					DataSize:       segment.Size,
+				})
+				observeSegment(config.UploadMode, segment.Rows, segment.Size, duration/time.Duration(len(batch)))
+			}
+			batch, uploadTargets = batch[:0], uploadTargets[:0]
+			return nil
+		}
+		if config.UploadMode == UploadModeBatch {
+			segmenter.beforeWait = uploadBatch
+		}
+
+		// fine/coarse-grained 모드에서는 세그먼트가 차는 즉시 업로드
+		flush := func() error {
+			segment := segmenter.cut()
+			if config.UploadMode != UploadModeBatch {
+				stats, err := h.storeSegment(&req, segment)
+				segment.release()
+				if err != nil {
+					return fmt.Errorf("failed to upload segment %d: %w", segment.number, err)
+				}
+				segmentStats = append(segmentStats, stats)
+				return nil
+			}
+
+			logger.Debug("Preparing segment", "segment", segment.number, "rows", segment.rows)
+			data, err := sealSegment(&req, segment)
+			if err != nil {
+				segment.release()
+				return fmt.Errorf("failed to encode segment %d: %w", segment.number, err)
+			}
+			key := segmentKey(basePath, segment.number)
+			checksum := checksumSHA256(data)
+			uploadTargets = append(uploadTargets, S3UploadDTO{
+				Key:      key,
+				Content:  data,
+				Checksum: checksum,
+			})
+			segmentStats = append(segmentStats, SegmentMetadata{
+				Number:   segment.number,
+				Key:      key,
+				FirstRow: segment.firstRow,
+				Rows:     segment.rows,
+				Size:     len(data),
+				SHA256:   checksum,
+			})
+			batch = append(batch, segment)
+			return nil
+		}
 
 		// 데이터 읽기 및 세그먼트 구성
 		for {
 			row, err := reader.Read()
 			if err == io.EOF {
-				if len(currentSegment) > 0 {
-					segments = append(segments, currentSegment)
-					if config.UploadMode != UploadModeBatch {
-						if err := h.storeSegment(basePath, segmentCount, csvHeader, currentSegment); err != nil {
-							http.Error(w, fmt.Sprintf("Failed to upload segment %d: %v", segmentCount, err), http.StatusInternalServerError)
-							return
-						}
-					}
-					segmentCount++
-				}
 				break
 			}
 			if err != nil {
-				http.Error(w, "Failed to read file", http.StatusUnprocessableEntity)
-				return
+				return nil, readError("failed to read file", err)
 			}
 
-			currentSegment = append(currentSegment, row)
-			if len(currentSegment) == config.SegmentSize {
-				segments = append(segments, currentSegment)
-
-				// fine/coarse-grained 모드에서는 즉시 업로드
-				if config.UploadMode != UploadModeBatch {
-					if err := h.storeSegment(basePath, segmentCount, csvHeader, currentSegment); err != nil {
-						http.Error(w, fmt.Sprintf("Failed to upload segment %d: %v", segmentCount, err), http.StatusInternalServerError)
-						return
-					}
+			observeRow(row)
+			job.addRows(1)
+			if !segmenter.fits(row) {
+				if err := flush(); err != nil {
+					return nil, err
 				}
-
-				segmentCount++
-				currentSegment = make([][]string, 0, config.SegmentSize)
 			}
+			full, err := segmenter.add(req.ctx, row)
+			if err != nil {
+				return nil, err
+			}
+			if full {
+				if err := flush(); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if segmenter.pending() {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+		}
+		if err := uploadBatch(); err != nil {
+			return nil, err
 		}
+		segmentCount = len(segmentStats)
+	}
 
-		// 배치 업로드 처리
-		if config.UploadMode == UploadModeBatch && len(segments) > 0 {
-			log.Printf("Starting batch upload preparation for %d segments...", len(segments))
-			var uploadTargets []S3UploadDTO
+	peakMemory := req.budget.maxUsed()
+	if original != nil {
+		peakMemory += original.budget.maxUsed()
+	}
+	logger.Debug("Segments stored", "segments", segmentCount, "peak_memory_bytes", peakMemory)
 
-			for i, segment := range segments {
-				log.Printf("Preparing segment %d of %d (size: %d rows)...", i+1, len(segments), len(segment))
-				var buf bytes.Buffer
-				writer := csv.NewWriter(&buf)
+	// The reader has consumed the whole body, so the original is complete
+	var originalMetadata *OriginalMetadata
+	if original != nil {
+		if originalMetadata, err = original.Commit(); err != nil {
+			return nil, fmt.Errorf("failed to store original file: %w", err)
+		}
+	}
 
-				if err := writer.Write(csvHeader); err != nil {
-					http.Error(w, fmt.Sprintf("Failed to write header for segment %d: %v", i, err), http.StatusInternalServerError)
-					return
-				}
+	// Record segment checksums so queries can verify what they read
+	sortSegments(segmentStats)
+	createdAt := time.Now()
+	metadata := UploadMetadata{
+		ID:           fmt.Sprintf("csv_%s", req.uploadID),
+		ChannelID:    req.channelID,
+		FileName:     req.fileName,
+		Key:          basePath,
+		UploadMode:   config.UploadMode,
+		SegmentSize:  config.SegmentSize,
+		SegmentBytes: config.SegmentBytes,
+		Workers:      config.Workers,
+		Compression:  config.Compression,
+		Header:       csvHeader,
+		CreatedAt:    createdAt,
+		Segments:     segmentStats,
 
-				for _, row := range segment {
-					if err := writer.Write(row); err != nil {
-						http.Error(w, fmt.Sprintf("Failed to write row in segment %d: %v", i, err), http.StatusInternalServerError)
-						return
-					}
-				}
-				writer.Flush()
+		ContentSHA256: content.Sum(),
+		ExpiresAt:     h.retention.newExpiry(req.channelID, createdAt),
+		Encryption:    encryption,
+		PIIColumns:    pii.Columns(),
+		Original:      originalMetadata,
+	}
+	for _, segment := range segmentStats {
+		metadata.Rows += segment.Rows
+	}
 
-				key := fmt.Sprintf("%s/segment-%d.csv", basePath, i)
-				uploadTargets = append(uploadTargets, S3UploadDTO{
-					Key:     key,
-					Content: buf.Bytes(),
-				})
-			}
+	// 같은 채널에 동일한 내용이 이미 있으면 정책에 따라 기존 키 반환 또는 alias 저장
+	if response, err := h.deduplicate(req, &metadata); err != nil || response != nil {
+		return response, err
+	}
 
-			log.Printf("Starting batch upload of %d segments to S3...", len(segments))
-			start := time.Now()
-			if err := h.s3Client.BatchUpload(uploadTargets); err != nil {
-				http.Error(w, fmt.Sprintf("Failed to batch upload segments: %v", err), http.StatusInternalServerError)
-				return
-			}
-			duration := time.Since(start)
-			log.Printf("Batch upload completed successfully. Total time: %v", duration)
-		}
+	if err := h.s3Client.PutJSON(req.ctx, metadataKey(basePath), metadata); err != nil {
+		return nil, fmt.Errorf("failed to store upload metadata: %w", err)
 	}
+	h.indexContent(req, &metadata)
 
-	// Create response
-	response := UploadResponse{
-		Bucket:      bucketName,
-		Key:         basePath,
-		ID:          fmt.Sprintf("csv_%s", timestamp),
-		Type:        "text/" + ext[1:],
-		Name:        fileName,
-		Ext:         ext[1:],
-		Size:        r.ContentLength,
-		ContentType: ext[1:],
-		Chunks:      segmentCount,
+	return h.newUploadResponse(req, &metadata, segmentCount), nil
+}
+
+// discardUpload deletes whatever a failed upload had stored, including its
+// reservation. Objects left behind by a failed delete expire with the channel's TTL.
+func (h *UploadHandler) discardUpload(req uploadRequest, cause error) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(req.ctx), abortCleanupTimeout)
+	defer cancel()
+	deleted, err := h.retention.Delete(ctx, req.basePath)
+	if err != nil {
+		req.logger.Error("Failed to clean up failed upload", "error", err)
+		return
 	}
+	if errors.Is(cause, errShuttingDown) {
+		req.logger.Warn("Aborted upload during shutdown", "objects", deleted)
+		return
+	}
+	req.logger.Info("Deleted objects of failed upload", "objects", deleted, "error", cause)
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(response)
+// newUploadResponse describes the stored upload identified by metadata
+func (h *UploadHandler) newUploadResponse(req uploadRequest, metadata *UploadMetadata, chunks int) *UploadResponse {
+	response := &UploadResponse{
+		Bucket:       h.s3Client.Bucket,
+		Key:          metadata.Key,
+		ID:           metadata.ID,
+		Type:         "text/" + req.ext[1:],
+		Name:         req.fileName,
+		Ext:          req.ext[1:],
+		Size:         req.size,
+		ContentType:  req.ext[1:],
+		Chunks:       chunks,
+		Rows:         metadata.Rows,
+		Mode:         req.config.UploadMode,
+		SegmentSize:  req.config.SegmentSize,
+		SegmentBytes: req.config.SegmentBytes,
+		Workers:      req.config.Workers,
+		Compression:  req.config.Compression,
+		ExpiresAt:    metadata.ExpiresAt,
+	}
+	if metadata.Original != nil {
+		response.OriginalSHA256 = metadata.Original.SHA256
+	}
+	return response
 }
 
-func (h *UploadHandler) storeSegment(basePath string, segmentNum int, header []string, rows [][]string) error {
-	start := time.Now()
-	var buf bytes.Buffer
-	writer := csv.NewWriter(&buf)
+// readError classifies a failure while reading the upload body. Storage errors
+// (e.g. from reassembled resumable chunks) pass through; anything else is the
+// content's fault.
+func readError(message string, err error) error {
+	var storageErr *StorageError
+	if errors.As(err, &storageErr) {
+		return fmt.Errorf("%s: %w", message, err)
+	}
+	return fmt.Errorf("%w: %s: %v", errMalformedCSV, message, err)
+}
 
-	// Write header
-	if err := writer.Write(header); err != nil {
-		return fmt.Errorf("failed to write header: %v", err)
+// writeUploadError maps an error returned by processUpload to an HTTP response
+func writeUploadError(w http.ResponseWriter, r *http.Request, err error) {
+	var storageErr *StorageError
+	switch {
+	case errors.Is(err, errShuttingDown):
+		writeShuttingDown(w, r)
+	case errors.Is(err, errMalformedCSV):
+		writeError(w, r, http.StatusUnprocessableEntity, ErrCodeInvalidCSV, err.Error())
+	case errors.Is(err, errBodyTooLarge):
+		writeError(w, r, http.StatusRequestEntityTooLarge, ErrCodeFileTooLarge, err.Error())
+	case errors.As(err, &storageErr):
+		writeStorageError(w, r, "Upload failed", err)
+	default:
+		writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, err.Error())
 	}
+}
 
-	// Write rows
-	for _, row := range rows {
-		if err := writer.Write(row); err != nil {
-			return fmt.Errorf("failed to write row: %v", err)
-		}
+func (h *UploadHandler) storeSegment(req *uploadRequest, segment *encodedSegment) (_ SegmentMetadata, err error) {
+	segmentNum, rows := segment.number, segment.rows
+	ctx, span := startSpan(req.ctx, "segment", attrSegment.Int(segmentNum), attrRows.Int(rows))
+	defer endSpan(span, &err)
+
+	start := time.Now()
+	data, err := sealSegment(req, segment)
+	if err != nil {
+		return SegmentMetadata{}, err
 	}
-	writer.Flush()
+	span.SetAttributes(attrBytes.Int(len(data)))
 
 	// Upload to S3
-	key := fmt.Sprintf("%s/segment-%d.csv", basePath, segmentNum)
-	err := h.s3Client.UploadSegment(key, buf.Bytes())
+	key := segmentKey(req.basePath, segmentNum)
+	checksum, err := h.s3Client.UploadSegment(ctx, key, data)
 
 	// Log performance metrics
 	duration := time.Since(start)
-	dataSize := buf.Len()
+	dataSize := len(data)
 	uploadSpeed := float64(dataSize) / duration.Seconds() / 1024 / 1024 // MB/s
 
-	log.Printf("Segment %d stats: Size=%d rows, Data=%d bytes, Duration=%v, Speed=%.2f MB/s",
-		segmentNum, len(rows), dataSize, duration, uploadSpeed)
+	req.logger.Info("Segment uploaded", "segment", segmentNum, "rows", rows, "bytes", dataSize,
+		"duration_ms", duration.Milliseconds(), "speed_mbps", uploadSpeed)
 
-	return err
+	if err == nil {
+		req.job.recordSegment(SegmentStats{
+			SegmentSize:    rows,
+			UploadDuration: duration,
+			DataSize:       dataSize,
+		})
+		observeSegment(req.config.UploadMode, rows, dataSize, duration)
+	}
+
+	return SegmentMetadata{
+		Number:   segmentNum,
+		Key:      key,
+		FirstRow: segment.firstRow,
+		Rows:     rows,
+		Size:     dataSize,
+		SHA256:   checksum,
+	}, err
 }
 
-// handleStreamUpload processes and uploads segments concurrently using goroutines
-func (h *UploadHandler) handleStreamUpload(basePath string, header []string, reader *csv.Reader, config UploadConfig) error {
-	type SegmentJob struct {
-		number int
-		rows   [][]string
+// sealSegment compresses an encoded segment if the upload asked for it and
+// seals it with the upload's cipher. Without either, the segment's own buffer
+// is returned, so it must not be released before the data is stored.
+func sealSegment(req *uploadRequest, segment *encodedSegment) (_ []byte, err error) {
+	_, span := startSpan(req.ctx, "segment encode", attrSegment.Int(segment.number), attrRows.Int(segment.rows))
+	defer endSpan(span, &err)
+
+	// 암호문은 압축되지 않으므로 암호화 전에 압축
+	data := segment.buf.Bytes()
+	if req.config.Compression == CompressionGzip {
+		// Sized up front, so the buffer stays within the segment's reservation
+		compressed := getBoundedBuffer(gzipBound(segment.capacity))
+		growBuffer(compressed, int(gzipBound(int64(len(data)))), gzipBound(segment.capacity))
+		segment.extra = append(segment.extra, compressed)
+		if err := compressSegment(compressed, data); err != nil {
+			return nil, err
+		}
+		data = compressed.Bytes()
+	}
+
+	data, err = req.cipher.Seal(segmentKey(req.basePath, segment.number), data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt segment: %w", err)
 	}
+	span.SetAttributes(attrBytes.Int(len(data)))
+	return data, nil
+}
+
+// handleStreamUpload processes and uploads segments concurrently using goroutines
+func (h *UploadHandler) handleStreamUpload(req *uploadRequest, header []string, reader *csv.Reader, observeRow func([]string)) ([]SegmentMetadata, error) {
+	config := req.config
+	job := req.job
+	logger := req.logger
 
-	numWorkers := 4 // default value
-	if config.Workers > 0 {
-		numWorkers = config.Workers
+	type SegmentResult struct {
+		stats SegmentMetadata
+		err   error
 	}
 
+	numWorkers := config.Workers
+	segmenter := newSegmenter(req, header)
+
+	// 세그먼트가 실패하면 메모리 예산을 기다리던 읽기도 멈추도록 취소
+	readCtx, cancelRead := context.WithCancel(req.ctx)
+	defer cancelRead()
+
 	// 작업 채널 생성
-	jobs := make(chan SegmentJob, numWorkers)        // 작업 큐
-	results := make(chan error, numWorkers)          // 결과 채널
-	done := make(chan bool)                          // 작업 완료 신호
+	jobs := make(chan *encodedSegment, numWorkers)   // 작업 큐
+	results := make(chan SegmentResult, numWorkers)  // 결과 채널
+	done := make(chan struct{})                      // 결과 수집 완료 신호
+	failed := make(chan struct{})                    // 첫 세그먼트 실패 시 닫힘
 	activeWorkers := make(chan struct{}, numWorkers) // 활성 워커 수 추적
-	expectedSegments := 0                            // 예상되는 총 세그먼트 수
+	var workers sync.WaitGroup
 
-	log.Printf("Starting streaming upload with %d workers", numWorkers)
+	logger.Info("Starting streaming upload", "workers", numWorkers, "segments_in_memory", segmenter.segments())
 
 	// 워커 풀 생성
 	for i := 0; i < numWorkers; i++ {
+		workers.Add(1)
 		go func(workerId int) {
 			activeWorkers <- struct{}{} // 워커 활성화
+			activeStreamWorkers.Inc()
 			defer func() {
 				<-activeWorkers // 워커 비활성화
+				activeStreamWorkers.Dec()
+				workers.Done()
 			}()
 
-			for job := range jobs {
-				log.Printf("Worker %d/%d processing segment %d (%d rows)",
-					workerId+1, numWorkers, job.number, len(job.rows))
+			for segment := range jobs {
+				logger.Debug("Worker processing segment", "worker", workerId+1, "segment", segment.number, "rows", segment.rows)
 
-				err := h.streamSegment(basePath, job.number, header, job.rows)
-				results <- err
+				stats, err := h.streamSegment(req, segment)
+				segment.release()
+				results <- SegmentResult{stats: stats, err: err}
 			}
 		}(i)
 	}
 
-	// 결과 모니터링 goroutine
 	go func() {
-		segmentCount := 0
-		for err := range results {
-			if err != nil {
-				log.Printf("Error uploading segment: %v", err)
-				done <- false
-				return
-			}
-			segmentCount++
-			if segmentCount%10 == 0 {
-				log.Printf("Successfully uploaded %d/%d segments", segmentCount, expectedSegments)
+		workers.Wait()
+		close(results)
+	}()
+
+	// 결과 모니터링 goroutine. 실패 후에도 결과를 끝까지 받아야 워커가 막히지 않음
+	var uploaded []SegmentMetadata
+	var uploadErr error
+	go func() {
+		defer close(done)
+		for result := range results {
+			if result.err != nil {
+				logger.Error("Segment upload failed", "error", result.err)
+				if uploadErr == nil {
+					uploadErr = result.err
+					close(failed)
+					cancelRead()
+				}
+				continue
 			}
-			if segmentCount == expectedSegments {
-				log.Printf("All %d segments uploaded successfully", expectedSegments)
-				done <- true
-				return
+			uploaded = append(uploaded, result.stats)
+			if len(uploaded)%10 == 0 {
+				logger.Info("Streaming upload progress", "uploaded", len(uploaded))
 			}
 		}
 	}()
 
-	// CSV 파일 읽기 및 작업 할당
-	var currentSegment [][]string
+	// 세그먼트가 실패하면 더 읽지 않고 중단
+	enqueue := func(segment *encodedSegment) bool {
+		select {
+		case jobs <- segment:
+			return true
+		case <-failed:
+			segment.release()
+			return false
+		}
+	}
+
+	// CSV 파일 읽기 및 작업 할당. 워커가 밀려 있으면 jobs 전송에서 대기하는 시간도 포함됨
+	// 메모리 예산이 가득 차면 새 세그먼트 시작에서 대기하는 시간도 포함됨
+	_, readSpan := startSpan(req.ctx, "csv read")
 	segmentNum := 0
+	rowCount := 0
+	var readErr error
 
 	for {
 		row, err := reader.Read()
 		if err == io.EOF {
-			if len(currentSegment) > 0 {
-				jobs <- SegmentJob{number: segmentNum, rows: currentSegment}
-				expectedSegments = segmentNum + 1
-			} else {
-				expectedSegments = segmentNum
+			if segmenter.pending() && enqueue(segmenter.cut()) {
+				segmentNum++
 			}
 			break
 		}
 		if err != nil {
-			close(jobs)
-			return fmt.Errorf("failed to read file: %v", err)
+			readErr = readError("failed to read file", err)
+			break
 		}
 
-		currentSegment = append(currentSegment, row)
-		if len(currentSegment) == config.SegmentSize {
-			jobs <- SegmentJob{number: segmentNum, rows: currentSegment}
+		observeRow(row)
+		job.addRows(1)
+		rowCount++
+		if !segmenter.fits(row) {
+			if !enqueue(segmenter.cut()) {
+				break
+			}
+			segmentNum++
+		}
+		full, err := segmenter.add(readCtx, row)
+		if err != nil {
+			// Canceled by a failed segment, reported below as uploadErr
+			readErr = err
+			break
+		}
+		if full {
+			if !enqueue(segmenter.cut()) {
+				break
+			}
 			segmentNum++
-			currentSegment = make([][]string, 0, config.SegmentSize)
 		}
 	}
 
 	// 모든 작업이 큐에 들어갔음을 표시
 	close(jobs)
+	readSpan.SetAttributes(attrRows.Int(rowCount), attrSegments.Int(segmentNum))
+	endSpan(readSpan, &readErr)
 
 	// 작업 완료 대기
-	if success := <-done; !success {
-		return fmt.Errorf("one or more segments failed to upload")
+	<-done
+	if uploadErr != nil {
+		return nil, fmt.Errorf("one or more segments failed to upload: %w", uploadErr)
 	}
+	if readErr != nil {
+		return nil, readErr
+	}
+	logger.Info("All segments uploaded", "segments", len(uploaded))
 
-	return nil
+	return uploaded, nil
 }
 
 // streamSegment uploads a single segment to S3
-func (h *UploadHandler) streamSegment(basePath string, segmentNum int, header []string, rows [][]string) error {
-	start := time.Now()
-	var buf bytes.Buffer
-	writer := csv.NewWriter(&buf)
+func (h *UploadHandler) streamSegment(req *uploadRequest, segment *encodedSegment) (_ SegmentMetadata, err error) {
+	segmentNum, rows := segment.number, segment.rows
+	ctx, span := startSpan(req.ctx, "segment", attrSegment.Int(segmentNum), attrRows.Int(rows))
+	defer endSpan(span, &err)
 
-	// Write header
-	if err := writer.Write(header); err != nil {
-		return fmt.Errorf("failed to write header: %v", err)
-	}
-
-	// Write rows
-	for _, row := range rows {
-		if err := writer.Write(row); err != nil {
-			return fmt.Errorf("failed to write row: %v", err)
-		}
+	start := time.Now()
+	data, err := sealSegment(req, segment)
+	if err != nil {
+		return SegmentMetadata{}, err
 	}
-	writer.Flush()
+	span.SetAttributes(attrBytes.Int(len(data)))
 
 	// Upload to S3
-	key := fmt.Sprintf("%s/segment-%d.csv", basePath, segmentNum)
-	err := h.s3Client.UploadSegment(key, buf.Bytes())
+	key := segmentKey(req.basePath, segmentNum)
+	checksum, err := h.s3Client.UploadSegment(ctx, key, data)
 
 	// Log performance metrics
 	duration := time.Since(start)
-	dataSize := buf.Len()
+	dataSize := len(data)
 	uploadSpeed := float64(dataSize) / duration.Seconds() / 1024 / 1024 // MB/s
 
-	log.Printf("Segment %d streaming stats: Size=%d rows, Data=%d bytes, Duration=%v, Speed=%.2f MB/s",
-		segmentNum, len(rows), dataSize, duration, uploadSpeed)
+	req.logger.Info("Segment streamed", "segment", segmentNum, "rows", rows, "bytes", dataSize,
+		"duration_ms", duration.Milliseconds(), "speed_mbps", uploadSpeed)
+
+	if err == nil {
+		req.job.recordSegment(SegmentStats{
+			SegmentSize:    rows,
+			UploadDuration: duration,
+			DataSize:       dataSize,
+		})
+		observeSegment(req.config.UploadMode, rows, dataSize, duration)
+	}
 
-	return err
+	return SegmentMetadata{
+		Number:   segmentNum,
+		Key:      key,
+		FirstRow: segment.firstRow,
+		Rows:     rows,
+		Size:     dataSize,
+		SHA256:   checksum,
+	}, err
 }
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// failPut makes storing keys ending in suffix fail with AccessDenied
+func failPut(suffix string) func(op, key string) (int, string) {
+	return func(op, key string) (int, string) {
+		if op == "PutObject" && strings.HasSuffix(key, suffix) {
+			return http.StatusForbidden, "AccessDenied"
+		}
+		return 0, ""
+	}
+}
+
+func TestFailedUploadLeavesNothingBehind(t *testing.T) {
+	malformed := testCSV(250) + "250,\"unterminated,user250@example.com\n"
+
+	tests := []struct {
+		name  string
+		query string
+		csv   string
+		fail  func(op, key string) (int, string)
+	}{
+		{"fine, storage error", "mode=fine", testCSV(250), failPut("/segment-2.csv")},
+		{"coarse, storage error", "mode=coarse", testCSV(250), failPut("/segment-2.csv")},
+		{"batch, storage error", "mode=batch", testCSV(250), failPut("/segment-2.csv")},
+		{"stream, storage error", "mode=stream", testCSV(250), failPut("/segment-2.csv")},
+		{"fine, malformed csv", "mode=fine", malformed, nil},
+		{"batch, malformed csv", "mode=batch", malformed, nil},
+		{"stream, malformed csv", "mode=stream", malformed, nil},
+		{"metadata not stored", "mode=fine", testCSV(250), failPut("/metadata.json")},
+		{"original kept, storage error", "mode=fine&keepOriginal=true", testCSV(250), failPut("/segment-2.csv")},
+		{"original kept, malformed csv", "mode=stream&keepOriginal=true", malformed, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t, nil)
+			ts.store.setFail(tt.fail)
+
+			w := ts.do(http.MethodPost, "/cht/v1/file/csv/ch/data.csv?segmentSize=100&"+tt.query, strings.NewReader(tt.csv))
+			if w.Code == http.StatusCreated {
+				t.Fatalf("upload succeeded: %s", w.Body)
+			}
+			if keys := ts.store.keys("csv_upload/"); len(keys) != 0 {
+				t.Errorf("failed upload left %v", keys)
+			}
+		})
+	}
+}
+
+func TestFailedAsyncUploadLeavesNothingBehind(t *testing.T) {
+	ts := newTestServer(t, nil)
+	ts.store.setFail(failPut("/segment-2.csv"))
+
+	w := ts.do(http.MethodPost, "/cht/v1/file/csv/ch/data.csv?async=true&segmentSize=100", strings.NewReader(testCSV(250)))
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("status = %d, want 202: %s", w.Code, w.Body)
+	}
+	var accepted UploadJobStatus
+	decodeJSON(t, w, &accepted)
+	if status := waitForJob(t, ts, accepted.ID); status.State != JobStateFailed {
+		t.Fatalf("state = %s, want %s", status.State, JobStateFailed)
+	}
+	if keys := ts.store.keys("csv_upload/"); len(keys) != 0 {
+		t.Errorf("failed upload left %v", keys)
+	}
+}
+
+func TestResumableCompleteAfterFailedAttempt(t *testing.T) {
+	ts := newTestServer(t, nil)
+	sessionID := startSession(t, ts, "?segmentSize=100")
+	if code := putChunk(ts, sessionID, 0, testCSV(250)); code != http.StatusOK {
+		t.Fatalf("chunk: status %d", code)
+	}
+
+	ts.store.setFail(failPut("/segment-2.csv"))
+	if w := ts.do(http.MethodPost, resumableSessionPrefix+sessionID+"/complete", nil); w.Code == http.StatusCreated {
+		t.Fatalf("complete succeeded while storage fails: %s", w.Body)
+	}
+	if keys := ts.store.keys("csv_upload/"); len(keys) != 0 {
+		t.Fatalf("failed completion left %v", keys)
+	}
+
+	ts.store.setFail(nil)
+	w := ts.do(http.MethodPost, resumableSessionPrefix+sessionID+"/complete", nil)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("retried complete: %d: %s", w.Code, w.Body)
+	}
+	var response UploadResponse
+	decodeJSON(t, w, &response)
+	if _, ok := ts.store.object(reservationKey(response.Key)); !ok {
+		t.Error("retried upload has no reservation")
+	}
+	if got := ts.query(t, response.Key, "offset=200&limit=100"); len(got.Data) != 50 {
+		t.Errorf("query returned %d rows, want 50", len(got.Data))
+	}
+}
+
+func TestParseUploadConfigSegmentSize(t *testing.T) {
+	config := DefaultConfig
+	config.Channels = map[string]ChannelOverrides{"big": {SegmentSize: 5000, CoarseSegmentSize: 50000}}
+	handler := NewUploadHandler(nil, nil, nil, nil, nil, nil, &config, NewUploadTracker())
+
+	tests := []struct {
+		name            string
+		channelID       string
+		query           string
+		wantSegmentSize int
+		wantErr         string
+	}{
+		{"default mode", "ch", "", 1000, ""},
+		{"fine", "ch", "mode=fine", 1000, ""},
+		{"coarse", "ch", "mode=coarse", 10000, ""},
+		{"batch", "ch", "mode=batch", 1000, ""},
+		{"stream", "ch", "mode=stream", 1000, ""},
+		{"channel fine", "big", "mode=fine", 5000, ""},
+		{"channel coarse", "big", "mode=coarse", 50000, ""},
+		{"explicit size wins over the mode", "ch", "mode=coarse&segmentSize=300", 300, ""},
+		{"size out of range", "ch", "mode=coarse&segmentSize=10", 0, "Invalid segmentSize parameter"},
+		{"unknown mode", "ch", "mode=medium", 0, "Invalid mode parameter"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/cht/v1/file/csv/"+tt.channelID+"/data.csv?"+tt.query, nil)
+			r.SetPathValue("channelId", tt.channelID)
+			got, err := handler.parseUploadConfig(r)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.SegmentSize != tt.wantSegmentSize {
+				t.Errorf("segmentSize = %d, want %d", got.SegmentSize, tt.wantSegmentSize)
+			}
+		})
+	}
+}
+
+func TestCoarseUploadsCutLargerSegments(t *testing.T) {
+	ts := newTestServer(t, func(c *Config) {
+		c.Upload.SegmentSize = 100
+		c.Upload.CoarseSegmentSize = 200
+	})
+	tests := []struct {
+		mode            string
+		wantSegmentSize int
+		wantChunks      int
+	}{
+		{UploadModeFineGrained, 100, 5},
+		{UploadModeCoarseGrained, 200, 3},
+	}
+	for _, tt := range tests {
+		response := ts.upload(t, "ch", testCSV(450), "mode="+tt.mode)
+		if response.SegmentSize != tt.wantSegmentSize || response.Chunks != tt.wantChunks {
+			t.Errorf("%s: segmentSize %d in %d chunks, want %d in %d", tt.mode, response.SegmentSize, response.Chunks, tt.wantSegmentSize, tt.wantChunks)
+		}
+	}
+}
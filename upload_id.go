@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// crockfordAlphabet is the ULID base32 alphabet (no I, L, O, U)
+	crockfordAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+	// legacyUploadIDLayout is the timestamp format used before ULIDs
+	legacyUploadIDLayout = "2006-01-02-15-04-05"
+)
+
+// uploadIDGenerator produces ULIDs: 48 bits of millisecond timestamp followed by
+// 80 random bits, encoded as 26 Crockford base32 characters. IDs sort by creation
+// time, and IDs generated within the same millisecond are kept monotonic by
+// incrementing the random part. Should the random part run out within one
+// millisecond, the generator waits for the next one rather than wrap around.
+type uploadIDGenerator struct {
+	mu       sync.Mutex
+	lastMs   uint64
+	lastRand [10]byte
+}
+
+var uploadIDs = &uploadIDGenerator{}
+
+// newUploadID returns a new time-sortable, collision-resistant upload ID
+func newUploadID() string {
+	return uploadIDs.next(time.Now())
+}
+
+func (g *uploadIDGenerator) next(now time.Time) string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	ms := uint64(now.UnixMilli())
+	if ms <= g.lastMs {
+		// Same (or earlier) millisecond: bump the random part to stay monotonic
+		ms = g.lastMs
+		overflow := true
+		for i := len(g.lastRand) - 1; i >= 0; i-- {
+			g.lastRand[i]++
+			if g.lastRand[i] != 0 {
+				overflow = false
+				break
+			}
+		}
+		if overflow {
+			// Wrapping to zero would sort before the previous ID. Holding the
+			// lock keeps other callers waiting too.
+			ms++
+			time.Sleep(time.Until(time.UnixMilli(int64(ms))))
+			g.randomize(now)
+		}
+	} else {
+		g.randomize(now)
+	}
+	g.lastMs = ms
+
+	var raw [16]byte
+	raw[0] = byte(ms >> 40)
+	raw[1] = byte(ms >> 32)
+	raw[2] = byte(ms >> 24)
+	raw[3] = byte(ms >> 16)
+	raw[4] = byte(ms >> 8)
+	raw[5] = byte(ms)
+	copy(raw[6:], g.lastRand[:])
+
+	return encodeULID(raw)
+}
+
+// randomize draws a fresh random part
+func (g *uploadIDGenerator) randomize(now time.Time) {
+	if _, err := rand.Read(g.lastRand[:]); err != nil {
+		// crypto/rand does not fail on supported platforms; fall back to the clock
+		binary.BigEndian.PutUint64(g.lastRand[2:], uint64(now.UnixNano()))
+	}
+}
+
+// encodeULID encodes 128 bits as 26 base32 characters, most significant first
+func encodeULID(raw [16]byte) string {
+	hi := binary.BigEndian.Uint64(raw[:8])
+	lo := binary.BigEndian.Uint64(raw[8:])
+
+	var out [26]byte
+	for i := 25; i >= 0; i-- {
+		out[i] = crockfordAlphabet[lo&0x1f]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out[:])
+}
+
+// uploadIDTimePrefix encodes t as the 10-character timestamp that starts every
+// ULID created in that millisecond. Every such ID sorts after the prefix, and
+// every ID created earlier sorts before it.
+func uploadIDTimePrefix(t time.Time) string {
+	ms := t.UnixMilli()
+	if ms < 0 {
+		ms = 0
+	}
+	var raw [16]byte
+	binary.BigEndian.PutUint64(raw[:8], uint64(ms)<<16)
+	return encodeULID(raw)[:10]
+}
+
+// uploadIDTime recovers the creation time from the last element of an upload
+// key. It understands ULIDs and the older YYYY-MM-DD-HH-mm-ss timestamps.
+func uploadIDTime(id string) (time.Time, bool) {
+	if len(id) == 26 {
+		var ms uint64
+		for _, c := range id[:10] {
+			index := strings.IndexRune(crockfordAlphabet, c)
+			if index < 0 {
+				return time.Time{}, false
+			}
+			ms = ms<<5 | uint64(index)
+		}
+		return time.UnixMilli(int64(ms)), true
+	}
+
+	// Legacy keys were formatted with time.Now(), i.e. in server local time
+	if t, err := time.ParseInLocation(legacyUploadIDLayout, id, time.Local); err == nil {
+		return t, true
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUploadIDGenerator(t *testing.T) {
+	var g uploadIDGenerator
+	base := time.UnixMilli(1711015200000)
+
+	tests := []struct {
+		name string
+		now  time.Time
+	}{
+		{"first", base},
+		{"same millisecond", base},
+		{"same millisecond again", base},
+		{"clock went back", base.Add(-time.Second)},
+		{"later", base.Add(time.Millisecond)},
+		{"much later", base.Add(time.Hour)},
+	}
+	previous := ""
+	for _, tt := range tests {
+		id := g.next(tt.now)
+		if len(id) != 26 || strings.Trim(id, crockfordAlphabet) != "" {
+			t.Fatalf("%s: %q is not a 26 character Crockford base32 ULID", tt.name, id)
+		}
+		if id <= previous {
+			t.Errorf("%s: %q does not sort after %q", tt.name, id, previous)
+		}
+		previous = id
+	}
+}
+
+func TestUploadIDGeneratorRandomOverflow(t *testing.T) {
+	base := time.UnixMilli(1711015200000)
+	tests := []struct {
+		name     string
+		lastRand [10]byte
+		wantTime time.Time
+	}{
+		{"room left", [10]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xfe}, base},
+		{"last byte carries", [10]byte{0x00, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, base},
+		{"exhausted", [10]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, base.Add(time.Millisecond)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := uploadIDGenerator{lastMs: uint64(base.UnixMilli()), lastRand: tt.lastRand}
+			var raw [16]byte
+			binary.BigEndian.PutUint64(raw[:8], uint64(base.UnixMilli())<<16)
+			copy(raw[6:], tt.lastRand[:])
+			previous := encodeULID(raw)
+
+			id := g.next(base)
+			if id <= previous {
+				t.Errorf("%q does not sort after %q", id, previous)
+			}
+			if got, _ := uploadIDTime(id); !got.Equal(tt.wantTime) {
+				t.Errorf("id time = %v, want %v", got, tt.wantTime)
+			}
+		})
+	}
+}
+
+func TestUploadIDTime(t *testing.T) {
+	created := time.UnixMilli(1711015200123)
+	tests := []struct {
+		name   string
+		id     string
+		want   time.Time
+		wantOK bool
+	}{
+		{"ulid", (&uploadIDGenerator{}).next(created), created, true},
+		{"legacy timestamp", "2025-03-19-10-45-09", time.Date(2025, 3, 19, 10, 45, 9, 0, time.Local), true},
+		{"ulid with invalid character", "01JQ2Z8X4U5N6P7Q8R9S0T1V2W", time.Time{}, false},
+		{"unknown format", "upload-1", time.Time{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := uploadIDTime(tt.id)
+			if ok != tt.wantOK || !got.Equal(tt.want) {
+				t.Errorf("uploadIDTime(%q) = %v, %t, want %v, %t", tt.id, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestReserveUploadKey(t *testing.T) {
+	client, store := newTestS3Client(t)
+	if err := client.ReserveUploadKey(context.Background(), "csv_upload/1/a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store.object(reservationKey("csv_upload/1/a")); !ok {
+		t.Fatal("reservation object was not written")
+	}
+	if err := client.ReserveUploadKey(context.Background(), "csv_upload/1/a"); !errors.Is(err, ErrConflict) {
+		t.Errorf("second reservation: err = %v, want ErrConflict", err)
+	}
+}
+
+func TestReserveUploadKeyRetries(t *testing.T) {
+	const basePath = "csv_upload/1/a"
+	tests := []struct {
+		name      string
+		taken     bool // claimed by another upload before the first attempt
+		failFirst bool // the first attempt fails with a retryable error
+		lands     bool // ... after the reservation was stored
+		wantErr   error
+		wantCalls int
+	}{
+		{"first attempt succeeds", false, false, false, nil, 1},
+		{"transient failure", false, true, false, nil, 2},
+		{"response of a stored attempt lost", false, true, true, nil, 2},
+		{"taken by another upload", true, false, false, ErrConflict, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, store := newTestS3Client(t)
+			if tt.taken {
+				store.put(reservationKey(basePath), []byte("other"))
+			}
+			attempts := 0
+			store.setFail(func(op, key string) (int, string) {
+				if op != "PutObject" || key != reservationKey(basePath) {
+					return 0, ""
+				}
+				if attempts++; attempts == 1 && tt.failFirst {
+					if tt.lands {
+						// The fail hook runs under the store's lock
+						store.objects[key] = []byte("stored")
+					}
+					return http.StatusInternalServerError, "InternalError"
+				}
+				return 0, ""
+			})
+
+			err := client.ReserveUploadKey(context.Background(), basePath)
+			if (tt.wantErr == nil && err != nil) || !errors.Is(err, tt.wantErr) {
+				t.Errorf("err = %v, want %v", err, tt.wantErr)
+			}
+			if calls := store.count("PutObject"); calls != tt.wantCalls {
+				t.Errorf("PutObject calls = %d, want %d", calls, tt.wantCalls)
+			}
+			if _, ok := store.object(reservationKey(basePath)); !ok {
+				t.Error("no reservation object")
+			}
+		})
+	}
+}
+
+func TestUploadRetriesTakenPath(t *testing.T) {
+	server := newTestServer(t, nil)
+	taken := 0
+	server.store.setFail(func(op, key string) (int, string) {
+		if op == "PutObject" && strings.HasSuffix(key, reservationKey("")) && taken == 0 {
+			taken++
+			return http.StatusPreconditionFailed, "PreconditionFailed"
+		}
+		return 0, ""
+	})
+
+	response := server.upload(t, "1", testCSV(3), "")
+	if taken != 1 {
+		t.Fatalf("conflicts = %d, want 1", taken)
+	}
+	if _, ok := server.store.object(reservationKey(response.Key)); !ok {
+		t.Errorf("upload %s has no reservation", response.Key)
+	}
+}
+
+func TestUploadIDTimePrefix(t *testing.T) {
+	for _, at := range []time.Time{
+		time.UnixMilli(0),
+		time.Date(2024, 3, 21, 10, 0, 0, 0, time.UTC),
+		time.Date(2024, 3, 21, 10, 0, 0, 999999, time.UTC),
+	} {
+		prefix := uploadIDTimePrefix(at)
+		id := (&uploadIDGenerator{}).next(at)
+		if id[:10] != prefix {
+			t.Errorf("%v: prefix %s, ID %s", at, prefix, id)
+		}
+		if earlier := (&uploadIDGenerator{}).next(at.Add(-time.Millisecond)); at.UnixMilli() > 0 && earlier >= prefix {
+			t.Errorf("%v: earlier ID %s sorts after prefix %s", at, earlier, prefix)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	JobStateQueued    = "queued"
+	JobStateRunning   = "running"
+	JobStateSucceeded = "succeeded"
+	JobStateFailed    = "failed"
+
+	jobStatusPrefix = "/cht/v1/file/csv-jobs/"
+	jobRetention    = time.Hour // finished jobs are forgotten after this long
+)
+
+// UploadJobStatus is the JSON view of an asynchronous upload
+type UploadJobStatus struct {
+	ID              string          `json:"id"`
+	State           string          `json:"state"`
+	ChannelID       string          `json:"channelId"`
+	FileName        string          `json:"fileName"`
+	TotalBytes      int64           `json:"totalBytes"`
+	BytesRead       int64           `json:"bytesRead"`
+	RowsProcessed   int64           `json:"rowsProcessed"`
+	SegmentsWritten int             `json:"segmentsWritten"`
+	BytesUploaded   int64           `json:"bytesUploaded"`
+	UploadTimeMs    int64           `json:"uploadTimeMs"`    // sum of per-segment upload durations
+	UploadSpeedMBps float64         `json:"uploadSpeedMBps"` // average per-segment upload speed
+	Errors          []string        `json:"errors,omitempty"`
+	Result          *UploadResponse `json:"result,omitempty"`
+	CreatedAt       time.Time       `json:"createdAt"`
+	UpdatedAt       time.Time       `json:"updatedAt"`
+}
+
+// UploadJob tracks the progress of one asynchronous upload. All progress
+// methods are safe to call on a nil job, which is what synchronous uploads pass.
+type UploadJob struct {
+	ID string
+
+	mu             sync.Mutex
+	status         UploadJobStatus
+	uploadDuration time.Duration
+}
+
+func (j *UploadJob) start() {
+	j.update(func(s *UploadJobStatus) {
+		s.State = JobStateRunning
+	})
+}
+
+func (j *UploadJob) addRows(n int) {
+	j.update(func(s *UploadJobStatus) {
+		s.RowsProcessed += int64(n)
+	})
+}
+
+func (j *UploadJob) addBytesRead(n int) {
+	j.update(func(s *UploadJobStatus) {
+		s.BytesRead += int64(n)
+	})
+}
+
+// recordSegment feeds the timing gathered by storeSegment/streamSegment into the status
+func (j *UploadJob) recordSegment(stats SegmentStats) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.uploadDuration += stats.UploadDuration
+	j.status.SegmentsWritten++
+	j.status.BytesUploaded += int64(stats.DataSize)
+	j.status.UploadTimeMs = j.uploadDuration.Milliseconds()
+	if seconds := j.uploadDuration.Seconds(); seconds > 0 {
+		j.status.UploadSpeedMBps = float64(j.status.BytesUploaded) / seconds / 1024 / 1024
+	}
+	j.status.UpdatedAt = time.Now()
+}
+
+func (j *UploadJob) finish(response *UploadResponse, err error) {
+	j.update(func(s *UploadJobStatus) {
+		if err != nil {
+			s.State = JobStateFailed
+			s.Errors = append(s.Errors, err.Error())
+			return
+		}
+		s.State = JobStateSucceeded
+		s.Result = response
+	})
+}
+
+func (j *UploadJob) update(fn func(s *UploadJobStatus)) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	fn(&j.status)
+	j.status.UpdatedAt = time.Now()
+}
+
+// Status returns a snapshot of the job's progress
+func (j *UploadJob) Status() UploadJobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	status := j.status
+	status.Errors = append([]string(nil), j.status.Errors...)
+	return status
+}
+
+func (j *UploadJob) finished() bool {
+	state := j.Status().State
+	return state == JobStateSucceeded || state == JobStateFailed
+}
+
+// JobStore keeps upload jobs in memory
+type JobStore struct {
+	mu   sync.Mutex
+	jobs map[string]*UploadJob
+}
+
+func NewJobStore() *JobStore {
+	return &JobStore{jobs: make(map[string]*UploadJob)}
+}
+
+// Create registers a new queued job
+func (s *JobStore) Create(channelID, fileName string, totalBytes int64) *UploadJob {
+	now := time.Now()
+	job := &UploadJob{
+		ID: "job_" + newRequestID(),
+		status: UploadJobStatus{
+			State:      JobStateQueued,
+			ChannelID:  channelID,
+			FileName:   fileName,
+			TotalBytes: totalBytes,
+			CreatedAt:  now,
+			UpdatedAt:  now,
+		},
+	}
+	job.status.ID = job.ID
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pruneLocked(now)
+	s.jobs[job.ID] = job
+	return job
+}
+
+func (s *JobStore) Get(id string) (*UploadJob, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[id]
+	return job, ok
+}
+
+// pruneLocked drops finished jobs older than jobRetention
+func (s *JobStore) pruneLocked(now time.Time) {
+	for id, job := range s.jobs {
+		if job.finished() && now.Sub(job.Status().UpdatedAt) > jobRetention {
+			delete(s.jobs, id)
+		}
+	}
+}
+
+func jobStatusPath(jobID string) string {
+	return jobStatusPrefix + jobID
+}
+
+// HandleJobStatus reports the progress of an asynchronous upload
+func (h *UploadHandler) HandleJobStatus(w http.ResponseWriter, r *http.Request) {
+	jobID := r.PathValue("jobId")
+	if jobID == "" {
+		writeError(w, r, http.StatusBadRequest, ErrCodeMissingParameter, "Job ID is required")
+		return
+	}
+
+	job, ok := h.jobs.Get(jobID)
+	if !ok {
+		writeError(w, r, http.StatusNotFound, ErrCodeNotFound, "Upload job not found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(job.Status())
+}
+
+// progressReader counts bytes read from the upload body into the job
+type progressReader struct {
+	r   io.Reader
+	job *UploadJob
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.job.addBytesRead(n)
+	return n, err
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAsyncUpload(t *testing.T) {
+	tests := []struct {
+		name      string
+		fail      func(op, key string) (int, string)
+		wantState string
+	}{
+		{"succeeds", nil, JobStateSucceeded},
+		{"storage fails", func(op, key string) (int, string) {
+			if op == "PutObject" && strings.HasSuffix(key, ".csv") {
+				return http.StatusForbidden, "AccessDenied"
+			}
+			return 0, ""
+		}, JobStateFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newTestServer(t, nil)
+			server.store.setFail(tt.fail)
+			csv := testCSV(250)
+
+			w := server.do(http.MethodPost, "/cht/v1/file/csv/1/data.csv?async=true&segmentSize=100", strings.NewReader(csv))
+			if w.Code != http.StatusAccepted {
+				t.Fatalf("status = %d, want 202: %s", w.Code, w.Body)
+			}
+			var accepted UploadJobStatus
+			decodeJSON(t, w, &accepted)
+			if accepted.ID == "" || w.Header().Get("Location") != jobStatusPath(accepted.ID) {
+				t.Fatalf("job ID = %q, Location = %q", accepted.ID, w.Header().Get("Location"))
+			}
+
+			status := waitForJob(t, server, accepted.ID)
+			if status.State != tt.wantState {
+				t.Fatalf("state = %s, want %s (errors %v)", status.State, tt.wantState, status.Errors)
+			}
+			if tt.wantState == JobStateFailed {
+				if len(status.Errors) == 0 || status.Result != nil {
+					t.Errorf("errors = %v, result = %v, want an error and no result", status.Errors, status.Result)
+				}
+				return
+			}
+			if status.RowsProcessed != 250 || status.SegmentsWritten != 3 || status.Result == nil || status.Result.Rows != 250 {
+				t.Errorf("rows = %d, segments = %d, result = %+v, want 250 rows in 3 segments", status.RowsProcessed, status.SegmentsWritten, status.Result)
+			}
+			if status.BytesRead != int64(len(csv)) {
+				t.Errorf("bytesRead = %d, want %d", status.BytesRead, len(csv))
+			}
+			if status.BytesUploaded == 0 {
+				t.Error("bytesUploaded = 0")
+			}
+		})
+	}
+}
+
+// waitForJob polls the job status endpoint until the job finishes
+func waitForJob(t *testing.T, server *testServer, jobID string) UploadJobStatus {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		w := server.do(http.MethodGet, jobStatusPath(jobID), nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("job status: %d: %s", w.Code, w.Body)
+		}
+		var status UploadJobStatus
+		decodeJSON(t, w, &status)
+		if status.State == JobStateSucceeded || status.State == JobStateFailed {
+			return status
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job %s still %s", jobID, status.State)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestUploadJobProgressOnNilJob(t *testing.T) {
+	var job *UploadJob
+	job.start()
+	job.addRows(1)
+	job.addBytesRead(1)
+	job.recordSegment(SegmentStats{DataSize: 1})
+	job.finish(nil, nil)
+}
+
+func TestUploadJobRecordSegment(t *testing.T) {
+	job := NewJobStore().Create("1", "data.csv", 0)
+	job.recordSegment(SegmentStats{DataSize: 1024 * 1024, UploadDuration: time.Second})
+	job.recordSegment(SegmentStats{DataSize: 1024 * 1024, UploadDuration: time.Second})
+
+	status := job.Status()
+	if status.SegmentsWritten != 2 || status.BytesUploaded != 2*1024*1024 || status.UploadTimeMs != 2000 || status.UploadSpeedMBps != 1 {
+		t.Errorf("status = %+v, want 2 segments, 2MB in 2s at 1MB/s", status)
+	}
+}
+
+func TestJobStorePrunesFinishedJobs(t *testing.T) {
+	store := NewJobStore()
+	old := store.Create("1", "old.csv", 0)
+	old.finish(&UploadResponse{}, nil)
+	old.status.UpdatedAt = time.Now().Add(-2 * jobRetention)
+	running := store.Create("1", "running.csv", 0)
+	running.start()
+	running.status.UpdatedAt = time.Now().Add(-2 * jobRetention)
+
+	store.Create("1", "new.csv", 0)
+	if _, ok := store.Get(old.ID); ok {
+		t.Error("finished job past retention was kept")
+	}
+	if _, ok := store.Get(running.ID); !ok {
+		t.Error("running job was pruned")
+	}
+}